@@ -27,7 +27,12 @@ func main() {
 		&cli.StringFlag{
 			Name:  "data-dir",
 			Value: "-data-tmp-",
-			Usage: "Set the db dirname",
+			Usage: "Set the db dirname, a comma separated list spreads the shards over several dirs",
+		},
+		&cli.StringFlag{
+			Name:  "data-dir-weights",
+			Value: "",
+			Usage: "Set the comma separated relative capacities of the data dirs, by default the dirs are equal",
 		},
 		&cli.StringFlag{
 			Name:  "restore",
@@ -55,6 +60,84 @@ func main() {
 			Value: "60s",
 			Usage: "Set the expiration interval for the keys",
 		},
+		&cli.StringFlag{
+			Name:  "db-compact-interval",
+			Value: "10m",
+			Usage: "Set how often the shards with mostly free space are compacted, 0 - never",
+		},
+		&cli.StringFlag{
+			Name:  "db-scrub-interval",
+			Value: "0s",
+			Usage: "Set how often the records on disk are verified, 0 - never",
+		},
+		&cli.Int64Flag{
+			Name:  "db-max-value-size",
+			Value: 1 << 30,
+			Usage: "Set the max value size in bytes, 0 - no limit",
+		},
+		&cli.StringFlag{
+			Name:  "db-cold-dir",
+			Value: "",
+			Usage: "Set the capacity tier dir for the rarely accessed records, empty - tiering is off",
+		},
+		&cli.StringFlag{
+			Name:  "db-tier-after",
+			Value: "24h",
+			Usage: "Set how long a record must stay idle to be moved to the cold tier",
+		},
+		&cli.StringFlag{
+			Name:  "db-tier-interval",
+			Value: "10m",
+			Usage: "Set how often the idle records are moved to the cold tier",
+		},
+		&cli.IntFlag{
+			Name:  "db-dedup-threshold",
+			Value: 0,
+			Usage: "Set the min value size in bytes stored once for all the keys with the same value, 0 - no dedup",
+		},
+		&cli.IntFlag{
+			Name:  "db-inline-max",
+			Value: 0,
+			Usage: "Set the max value size in bytes kept in memory to serve the reads without disk access, 0 - off",
+		},
+		&cli.Float64Flag{
+			Name:  "db-slot-growth",
+			Value: 1.25,
+			Usage: "Set the ratio of the neighbour record slot sizes from 1.1 to 2, lower wastes less space on padding",
+		},
+		&cli.IntFlag{
+			Name:  "db-shards",
+			Value: 256,
+			Usage: "Set the number of the shard files, it must not be changed for the existing data dir",
+		},
+		&cli.IntFlag{
+			Name:  "db-max-open-files",
+			Value: 0,
+			Usage: "Set the max number of the shard files kept open, 0 - all the files are open",
+		},
+		&cli.IntFlag{
+			Name:  "db-load-workers",
+			Value: 4,
+			Usage: "Set the number of the shards loaded in parallel on start",
+		},
+		&cli.BoolFlag{
+			Name:  "db-load-fail-fast",
+			Usage: "Fail the requests for the shards which aren't loaded yet instead of waiting",
+		},
+		&cli.BoolFlag{
+			Name:  "db-migrate-legacy-buckets",
+			Usage: "Move the keys of the buckets of the old data dirs to the buckets, the plain keys starting with a bucket name are moved too",
+		},
+		&cli.IntFlag{
+			Name:  "db-keep-versions",
+			Value: 0,
+			Usage: "Keep the last n versions of every key, 0 - no limit of the number",
+		},
+		&cli.StringFlag{
+			Name:  "db-keep-versions-for",
+			Value: "0s",
+			Usage: "Keep the versions of the keys for the duration, the versioning is off while both limits are 0",
+		},
 	}
 	a.Usage = "Nyx kvs"
 	a.Description = "High-speed, key-value storage"
@@ -2,6 +2,7 @@ package common
 
 import (
 	"errors"
+	"io"
 )
 
 type FilePath string
@@ -30,6 +31,25 @@ type DBHandler interface {
 	Noop(req NoopRequest) error
 	Quit(req QuitRequest) error
 	Version(req VersionRequest) error
+	Batch(req BatchRequest) error
+	Stats(req StatsRequest) error
+	BucketSet(req BucketSetRequest) error
+	BucketGet(req BucketGetRequest) error
+	BucketDelete(req BucketDeleteRequest) error
+	BucketRange(req BucketRangeRequest) error
+	BucketList(req BucketListRequest) error
+	BucketDrop(req BucketDropRequest) error
+	BucketRename(req BucketRenameRequest) error
+	BucketConfig(req BucketConfigRequest) error
+	Scan(req ScanRequest) error
+	Purge(req PurgeRequest) error
+	PurgeStatus(req PurgeStatusRequest) error
+	PurgeCancel(req PurgeCancelRequest) error
+	TTL(req TTLRequest) error
+	Persist(req PersistRequest) error
+	ExpireAt(req ExpireAtRequest) error
+	History(req HistoryRequest) error
+	GetVersion(req GetVersionRequest) error
 	Unknown(req Request) error
 	Error(req Request, reqType RequestType, err error)
 }
@@ -55,6 +75,7 @@ var (
 	ErrInternal       = errors.New("ERROR Internal error")
 	ErrBusy           = errors.New("ERROR Busy")
 	ErrTempFailure    = errors.New("ERROR Temporary error")
+	ErrNoTTL          = errors.New("ERROR Key has no ttl")
 
 	ErrCollision = errors.New("ERROR Hash collision")
 )
@@ -77,6 +98,7 @@ func IsAppError(err error) bool {
 		errors.Is(err, ErrInternal) ||
 		errors.Is(err, ErrBusy) ||
 		errors.Is(err, ErrTempFailure) ||
+		errors.Is(err, ErrNoTTL) ||
 		errors.Is(err, ErrCollision)
 }
 
@@ -135,6 +157,63 @@ const (
 
 	// RequestVersion replies with a string designating the current software version
 	RequestVersion
+
+	// RequestBatch applies a group of sets and deletes atomically
+	RequestBatch
+
+	// RequestStats replies with the server statistics of the given group
+	RequestStats
+
+	// RequestBucketSet stores the key in the bucket and adds it to the bucket index
+	RequestBucketSet
+
+	// RequestBucketGet gets the keys of the bucket
+	RequestBucketGet
+
+	// RequestBucketDelete deletes the key of the bucket and drops it from the bucket index
+	RequestBucketDelete
+
+	// RequestBucketRange replies with a page of the ordered keys of the bucket in a range or with a prefix
+	RequestBucketRange
+
+	// RequestBucketList replies with all the buckets, the number of their keys and the size of the values
+	RequestBucketList
+
+	// RequestBucketDrop deletes the bucket with all its keys
+	RequestBucketDrop
+
+	// RequestBucketRename moves the bucket with all its keys to the new name atomically
+	RequestBucketRename
+
+	// RequestBucketConfig sets the default TTL and the limits of the bucket
+	RequestBucketConfig
+
+	// RequestScan replies with a page of the keys of the store matching the pattern
+	RequestScan
+
+	// RequestPurge starts the background delete of all the keys matching the prefix or the pattern
+	RequestPurge
+
+	// RequestPurgeStatus replies with the progress of the background deletes
+	RequestPurgeStatus
+
+	// RequestPurgeCancel stops the background delete
+	RequestPurgeCancel
+
+	// RequestTTL replies with the remaining TTL of the item
+	RequestTTL
+
+	// RequestPersist removes the TTL of the item
+	RequestPersist
+
+	// RequestExpireAt sets the absolute expire time of the item
+	RequestExpireAt
+
+	// RequestHistory replies with the versions of the item kept by the MVCC mode
+	RequestHistory
+
+	// RequestGetVersion replies with the value of the version of the item
+	RequestGetVersion
 )
 
 type Request interface {
@@ -151,6 +230,9 @@ type SetRequest struct {
 	Exptime uint32
 	Opaque  uint32
 	Quiet   bool
+	// Stream ... the big data block of Length bytes which is read by the handler instead of Data
+	Stream io.Reader
+	Length int64
 }
 
 func (r SetRequest) GetOpaque() uint32 {
@@ -216,6 +298,90 @@ func (r TouchRequest) IsQuiet() bool {
 	return r.Quiet
 }
 
+// TTLRequest corresponds to common.RequestTTL.
+type TTLRequest struct {
+	Key    []byte
+	Opaque uint32
+}
+
+func (r TTLRequest) GetOpaque() uint32 {
+	return r.Opaque
+}
+
+func (r TTLRequest) IsQuiet() bool {
+	return false
+}
+
+// PersistRequest corresponds to common.RequestPersist.
+type PersistRequest struct {
+	Key    []byte
+	Opaque uint32
+	Quiet  bool
+}
+
+func (r PersistRequest) GetOpaque() uint32 {
+	return r.Opaque
+}
+
+func (r PersistRequest) IsQuiet() bool {
+	return r.Quiet
+}
+
+// ExpireAtRequest corresponds to common.RequestExpireAt. Exptime is the unix time in seconds.
+type ExpireAtRequest struct {
+	Key     []byte
+	Exptime uint32
+	Opaque  uint32
+	Quiet   bool
+}
+
+func (r ExpireAtRequest) GetOpaque() uint32 {
+	return r.Opaque
+}
+
+func (r ExpireAtRequest) IsQuiet() bool {
+	return r.Quiet
+}
+
+// HistoryRequest corresponds to common.RequestHistory.
+type HistoryRequest struct {
+	Key    []byte
+	Opaque uint32
+}
+
+func (r HistoryRequest) GetOpaque() uint32 {
+	return r.Opaque
+}
+
+func (r HistoryRequest) IsQuiet() bool {
+	return false
+}
+
+// GetVersionRequest corresponds to common.RequestGetVersion.
+type GetVersionRequest struct {
+	Key     []byte
+	Version uint64
+	Opaque  uint32
+}
+
+func (r GetVersionRequest) GetOpaque() uint32 {
+	return r.Opaque
+}
+
+func (r GetVersionRequest) IsQuiet() bool {
+	return false
+}
+
+// VersionInfo is a single version of the item, Written is the unix time of the write.
+// The deleting version has no value
+type VersionInfo struct {
+	Version uint64
+	Written int64
+	Deleted bool
+	Flags   uint32
+	Size    int64
+}
+
 // GATRequest corresponds to common.RequestGat. It contains all the information required to fulfill
 // a get-and-touch request.
 type GATRequest struct {
@@ -276,6 +442,287 @@ func (r VersionRequest) IsQuiet() bool {
 	return false
 }
 
+// BatchRequest corresponds to common.RequestBatch. It contains all the set and delete operations that
+// have to be applied atomically.
+type BatchRequest struct {
+	Ops    []BatchOp
+	Opaque uint32
+	Quiet  bool
+}
+
+func (r BatchRequest) GetOpaque() uint32 {
+	return r.Opaque
+}
+
+func (r BatchRequest) IsQuiet() bool {
+	return r.Quiet
+}
+
+// StatsRequest corresponds to common.RequestStats. Group selects the statistics,
+// empty group means the general ones.
+type StatsRequest struct {
+	Group  string
+	Opaque uint32
+}
+
+func (r StatsRequest) GetOpaque() uint32 {
+	return r.Opaque
+}
+
+func (r StatsRequest) IsQuiet() bool {
+	return false
+}
+
+// BucketSetRequest corresponds to common.RequestBucketSet. It contains all the information required
+// to fulfill a bucket set request.
+type BucketSetRequest struct {
+	Bucket  string
+	Key     []byte
+	Data    []byte
+	Exptime uint32
+	Opaque  uint32
+	Quiet   bool
+}
+
+func (r BucketSetRequest) GetOpaque() uint32 {
+	return r.Opaque
+}
+
+func (r BucketSetRequest) IsQuiet() bool {
+	return r.Quiet
+}
+
+// BucketGetRequest corresponds to common.RequestBucketGet. It contains all the information required
+// to fulfill a bucket get request.
+type BucketGetRequest struct {
+	Bucket string
+	Keys   [][]byte
+	Opaque uint32
+}
+
+func (r BucketGetRequest) GetOpaque() uint32 {
+	return r.Opaque
+}
+
+func (r BucketGetRequest) IsQuiet() bool {
+	return false
+}
+
+// BucketDeleteRequest corresponds to common.RequestBucketDelete. It contains all the information
+// required to fulfill a bucket delete request.
+type BucketDeleteRequest struct {
+	Bucket string
+	Key    []byte
+	Opaque uint32
+	Quiet  bool
+}
+
+func (r BucketDeleteRequest) GetOpaque() uint32 {
+	return r.Opaque
+}
+
+func (r BucketDeleteRequest) IsQuiet() bool {
+	return r.Quiet
+}
+
+// BucketRangeRequest corresponds to common.RequestBucketRange. The keys are either the ones from Start
+// to End, End excluded, a nil bound is open, or the ones with the Prefix if it's set. Limit is the max
+// number of the keys in the reply, 0 for no limit, Cursor is the last key of the previous page.
+type BucketRangeRequest struct {
+	Bucket  string
+	Start   []byte
+	End     []byte
+	Prefix  []byte
+	Reverse bool
+	Limit   int
+	Cursor  []byte
+	Opaque  uint32
+}
+
+func (r BucketRangeRequest) GetOpaque() uint32 {
+	return r.Opaque
+}
+
+func (r BucketRangeRequest) IsQuiet() bool {
+	return false
+}
+
+// RangeResponse is a page of the bucket keys in order. Cursor is passed to the next request to get
+// the next page, it's nil on the last page.
+type RangeResponse struct {
+	Items  []GetResponse
+	Cursor []byte
+	Opaque uint32
+}
+
+// BucketListRequest corresponds to common.RequestBucketList.
+type BucketListRequest struct {
+	Opaque uint32
+}
+
+func (r BucketListRequest) GetOpaque() uint32 {
+	return r.Opaque
+}
+
+func (r BucketListRequest) IsQuiet() bool {
+	return false
+}
+
+// BucketDropRequest corresponds to common.RequestBucketDrop. It contains all the information required
+// to fulfill a bucket drop request.
+type BucketDropRequest struct {
+	Bucket string
+	Opaque uint32
+	Quiet  bool
+}
+
+func (r BucketDropRequest) GetOpaque() uint32 {
+	return r.Opaque
+}
+
+func (r BucketDropRequest) IsQuiet() bool {
+	return r.Quiet
+}
+
+// BucketRenameRequest corresponds to common.RequestBucketRename. It contains all the information
+// required to fulfill a bucket rename request.
+type BucketRenameRequest struct {
+	Bucket  string
+	NewName string
+	Opaque  uint32
+	Quiet   bool
+}
+
+func (r BucketRenameRequest) GetOpaque() uint32 {
+	return r.Opaque
+}
+
+func (r BucketRenameRequest) IsQuiet() bool {
+	return r.Quiet
+}
+
+// BucketConfigRequest corresponds to common.RequestBucketConfig. TTL is the default ttl of the keys
+// in seconds, MaxKeys and MaxBytes are the limits of the bucket, 0 means no ttl or no limit.
+// Overflow is either "reject" or "evict", empty means "reject".
+type BucketConfigRequest struct {
+	Bucket   string
+	TTL      uint32
+	MaxKeys  int
+	MaxBytes int64
+	Overflow string
+	Opaque   uint32
+	Quiet    bool
+}
+
+func (r BucketConfigRequest) GetOpaque() uint32 {
+	return r.Opaque
+}
+
+func (r BucketConfigRequest) IsQuiet() bool {
+	return r.Quiet
+}
+
+// BucketInfo is a single bucket of the bucket list with the number of its keys and the size of the values
+type BucketInfo struct {
+	Name  string
+	Keys  int
+	Bytes int64
+}
+
+// ScanRequest corresponds to common.RequestScan. Cursor 0 starts the iteration, the next ones come
+// from the previous responses. Match is the glob pattern of the keys, empty matches every key.
+// Count is the number of the keys to examine, 0 for the default.
+type ScanRequest struct {
+	Cursor uint64
+	Match  string
+	Count  int
+	Opaque uint32
+}
+
+func (r ScanRequest) GetOpaque() uint32 {
+	return r.Opaque
+}
+
+func (r ScanRequest) IsQuiet() bool {
+	return false
+}
+
+// ScanResponse is a page of the keys, Cursor 0 means the iteration is over.
+type ScanResponse struct {
+	Keys   [][]byte
+	Cursor uint64
+	Opaque uint32
+}
+
+// PurgeRequest corresponds to common.RequestPurge. Pattern is the key prefix if Prefix is set,
+// the glob pattern of the keys otherwise.
+type PurgeRequest struct {
+	Pattern string
+	Prefix  bool
+	Opaque  uint32
+}
+
+func (r PurgeRequest) GetOpaque() uint32 {
+	return r.Opaque
+}
+
+func (r PurgeRequest) IsQuiet() bool {
+	return false
+}
+
+// PurgeStatusRequest corresponds to common.RequestPurgeStatus.
+type PurgeStatusRequest struct {
+	Opaque uint32
+}
+
+func (r PurgeStatusRequest) GetOpaque() uint32 {
+	return r.Opaque
+}
+
+func (r PurgeStatusRequest) IsQuiet() bool {
+	return false
+}
+
+// PurgeCancelRequest corresponds to common.RequestPurgeCancel.
+type PurgeCancelRequest struct {
+	ID     uint64
+	Opaque uint32
+	Quiet  bool
+}
+
+func (r PurgeCancelRequest) GetOpaque() uint32 {
+	return r.Opaque
+}
+
+func (r PurgeCancelRequest) IsQuiet() bool {
+	return r.Quiet
+}
+
+// PurgeInfo is the progress of a single background delete
+type PurgeInfo struct {
+	ID      uint64
+	Match   string
+	State   string
+	Scanned uint64
+	Deleted uint64
+}
+
+// Stat is a single named statistics value
+type Stat struct {
+	Name  string
+	Value string
+}
+
+// BatchOp is a single operation of the batch. Type is either RequestSet or RequestDelete, Data, Flags
+// and Exptime are used by the set only.
+type BatchOp struct {
+	Type    RequestType
+	Key     []byte
+	Data    []byte
+	Flags   uint32
+	Exptime uint32
+}
+
 // GetResponse is used in both RequestGet and RequestGat handling. Both respond in the same manner
 // but with different opcodes. It is binary-protocol specific, but is still a part of the interface
 // of responder to make the handling code more protocol-agnostic.
@@ -286,6 +733,10 @@ type GetResponse struct {
 	Flags  uint32
 	Miss   bool
 	Quiet  bool
+	// Stream ... the big value of Size bytes which is written out instead of Data,
+	// the handler closes it once the response is written
+	Stream io.ReadCloser
+	Size   int64
 }
 
 // GetEResponse is used in the GetE protocol extension
@@ -2,6 +2,8 @@ package config
 
 import (
 	"net"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/DenzelPenzel/nyx/internal/common"
@@ -10,9 +12,26 @@ import (
 )
 
 type DBConfig struct {
-	DataDir        string
-	Backup         string
-	ExpireInterval time.Duration
+	DataDirs        []string
+	DataDirWeights  []int
+	Backup          string
+	ExpireInterval  time.Duration
+	CompactInterval time.Duration
+	ScrubInterval   time.Duration
+	MaxValueSize    int64
+	ColdDir         string
+	TierAfter       time.Duration
+	TierInterval    time.Duration
+	Shards          int
+	MaxOpenFiles    int
+	DedupThreshold  int
+	InlineMax       int
+	SlotGrowth      float64
+	LoadWorkers     int
+	LoadFailFast    bool
+	MigrateLegacy   bool
+	KeepVersions    int
+	KeepVersionsFor time.Duration
 }
 
 // ServerConfig ... Server configuration options
@@ -33,18 +52,51 @@ type Config struct {
 // NewConfig ... Initializer
 func NewConfig(c *cli.Context) *Config {
 	env := c.String("env")
-	dataDir := c.String("data-dir")
+	var dataDirs []string
+	for _, dir := range strings.Split(c.String("data-dir"), ",") {
+		dataDirs = append(dataDirs, strings.TrimSpace(dir))
+	}
+	var dataDirWeights []int
+	if weights := c.String("data-dir-weights"); weights != "" {
+		for _, w := range strings.Split(weights, ",") {
+			// the invalid weight is left zero and rejected by the store
+			weight, _ := strconv.Atoi(strings.TrimSpace(w))
+			dataDirWeights = append(dataDirWeights, weight)
+		}
+	}
 	backup := c.String("backup")
 	httpAddr, _ := utils.GetTCPAddr(c.String("hostname"))
 	dbExpireInterval, _ := time.ParseDuration(c.String("db-expire-interval"))
+	dbCompactInterval, _ := time.ParseDuration(c.String("db-compact-interval"))
+	dbScrubInterval, _ := time.ParseDuration(c.String("db-scrub-interval"))
+	dbTierAfter, _ := time.ParseDuration(c.String("db-tier-after"))
+	dbTierInterval, _ := time.ParseDuration(c.String("db-tier-interval"))
+	dbKeepVersionsFor, _ := time.ParseDuration(c.String("db-keep-versions-for"))
 
 	config := &Config{
 		Environment: common.Env(env),
 
 		DBConfig: &DBConfig{
-			DataDir:        dataDir,
-			Backup:         backup,
-			ExpireInterval: dbExpireInterval,
+			DataDirs:        dataDirs,
+			DataDirWeights:  dataDirWeights,
+			Backup:          backup,
+			ExpireInterval:  dbExpireInterval,
+			CompactInterval: dbCompactInterval,
+			ScrubInterval:   dbScrubInterval,
+			MaxValueSize:    c.Int64("db-max-value-size"),
+			ColdDir:         c.String("db-cold-dir"),
+			TierAfter:       dbTierAfter,
+			TierInterval:    dbTierInterval,
+			Shards:          c.Int("db-shards"),
+			MaxOpenFiles:    c.Int("db-max-open-files"),
+			DedupThreshold:  c.Int("db-dedup-threshold"),
+			InlineMax:       c.Int("db-inline-max"),
+			SlotGrowth:      c.Float64("db-slot-growth"),
+			LoadWorkers:     c.Int("db-load-workers"),
+			LoadFailFast:    c.Bool("db-load-fail-fast"),
+			MigrateLegacy:   c.Bool("db-migrate-legacy-buckets"),
+			KeepVersions:    c.Int("db-keep-versions"),
+			KeepVersionsFor: dbKeepVersionsFor,
 		},
 
 		ServerConfig: &ServerConfig{
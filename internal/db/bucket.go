@@ -0,0 +1,129 @@
+package db
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/DenzelPenzel/nyx/internal/common"
+	"github.com/DenzelPenzel/nyx/internal/db/store"
+)
+
+func (c *db) BucketSet(cmd common.BucketSetRequest) error {
+	atomic.StoreInt64(&c.updateAt, time.Now().Unix())
+	b, err := c.store.Bucket(cmd.Bucket)
+	if err != nil {
+		return err
+	}
+	expire := cmd.Exptime
+	if cmd.Exptime > 0 {
+		expire += uint32(time.Now().Unix())
+	}
+	return c.store.PutWithExpire(b, cmd.Key, cmd.Data, expire)
+}
+
+// BucketGet ... the keys of the missing bucket are misses
+func (c *db) BucketGet(cmd common.BucketGetRequest) ([]common.GetResponse, error) {
+	b, err := c.store.FindBucket(cmd.Bucket)
+	if err != nil && !errors.Is(err, common.ErrKeyNotFound) {
+		return nil, err
+	}
+
+	res := make([]common.GetResponse, 0, len(cmd.Keys))
+	for _, key := range cmd.Keys {
+		r := common.GetResponse{Key: key, Opaque: cmd.Opaque, Miss: true}
+		if b != nil {
+			data, err := c.store.BucketGet(b, key)
+			if errors.Is(err, common.ErrTempFailure) {
+				return nil, err
+			}
+			if err == nil {
+				r.Data, r.Miss = data, false
+			}
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+func (c *db) BucketDelete(cmd common.BucketDeleteRequest) error {
+	atomic.StoreInt64(&c.updateAt, time.Now().Unix())
+	b, err := c.store.FindBucket(cmd.Bucket)
+	if err != nil {
+		return err
+	}
+	deleted, err := c.store.BucketDelete(b, cmd.Key)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return common.ErrKeyNotFound
+	}
+	return nil
+}
+
+func (c *db) BucketList(_ common.BucketListRequest) ([]common.BucketInfo, error) {
+	buckets, err := c.store.Buckets()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]common.BucketInfo, 0, len(buckets))
+	for _, b := range buckets {
+		res = append(res, common.BucketInfo{Name: b.Name, Keys: b.Keys, Bytes: b.Bytes})
+	}
+	return res, nil
+}
+
+func (c *db) BucketDrop(cmd common.BucketDropRequest) error {
+	atomic.StoreInt64(&c.updateAt, time.Now().Unix())
+	return c.store.DropBucket(cmd.Bucket)
+}
+
+func (c *db) BucketRename(cmd common.BucketRenameRequest) error {
+	atomic.StoreInt64(&c.updateAt, time.Now().Unix())
+	_, err := c.store.RenameBucket(cmd.Bucket, cmd.NewName)
+	return err
+}
+
+func (c *db) BucketConfig(cmd common.BucketConfigRequest) error {
+	b, err := c.store.Bucket(cmd.Bucket)
+	if err != nil {
+		return err
+	}
+	err = c.store.SetBucketOptions(b, store.BucketOptions{
+		TTL:      time.Duration(cmd.TTL) * time.Second,
+		MaxKeys:  cmd.MaxKeys,
+		MaxBytes: cmd.MaxBytes,
+		Overflow: store.OverflowPolicy(cmd.Overflow),
+	})
+	if err != nil && !errors.Is(err, common.ErrKeyNotFound) {
+		return errors.Join(common.ErrInvalidArgs, err)
+	}
+	return err
+}
+
+func (c *db) BucketRange(cmd common.BucketRangeRequest) (common.RangeResponse, error) {
+	res := common.RangeResponse{Opaque: cmd.Opaque}
+	b, err := c.store.FindBucket(cmd.Bucket)
+	if errors.Is(err, common.ErrKeyNotFound) {
+		return res, nil
+	}
+	if err != nil {
+		return res, err
+	}
+
+	opts := store.RangeOpts{Reverse: cmd.Reverse, Limit: cmd.Limit, Cursor: cmd.Cursor}
+	var items []store.BucketItem
+	if cmd.Prefix != nil {
+		items, res.Cursor, err = c.store.BucketPrefix(b, cmd.Prefix, opts)
+	} else {
+		items, res.Cursor, err = c.store.BucketRange(b, cmd.Start, cmd.End, opts)
+	}
+	if err != nil {
+		return res, err
+	}
+	for _, item := range items {
+		res.Items = append(res.Items, common.GetResponse{Key: item.Key, Data: item.Value, Opaque: cmd.Opaque})
+	}
+	return res, nil
+}
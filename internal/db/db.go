@@ -2,7 +2,9 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"runtime/debug"
@@ -29,9 +31,27 @@ type DB interface {
 	GAT(cmd common.GATRequest) (common.GetResponse, error)
 	Delete(cmd common.DeleteRequest) error
 	Touch(cmd common.TouchRequest) error
+	TTL(cmd common.TTLRequest) (int64, error)
+	Persist(cmd common.PersistRequest) error
+	ExpireAt(cmd common.ExpireAtRequest) error
+	History(cmd common.HistoryRequest) ([]common.VersionInfo, error)
+	GetVersion(cmd common.GetVersionRequest) (common.GetResponse, error)
+	Batch(cmd common.BatchRequest) error
 	Close() error
 	Count() uint64
-	Stats() (response []byte, err error)
+	Stats(cmd common.StatsRequest) ([]common.Stat, error)
+	BucketSet(cmd common.BucketSetRequest) error
+	BucketGet(cmd common.BucketGetRequest) ([]common.GetResponse, error)
+	BucketDelete(cmd common.BucketDeleteRequest) error
+	BucketRange(cmd common.BucketRangeRequest) (common.RangeResponse, error)
+	BucketList(cmd common.BucketListRequest) ([]common.BucketInfo, error)
+	BucketDrop(cmd common.BucketDropRequest) error
+	BucketRename(cmd common.BucketRenameRequest) error
+	BucketConfig(cmd common.BucketConfigRequest) error
+	Scan(cmd common.ScanRequest) (common.ScanResponse, error)
+	Purge(cmd common.PurgeRequest) (uint64, error)
+	PurgeStatus(cmd common.PurgeStatusRequest) ([]common.PurgeInfo, error)
+	PurgeCancel(cmd common.PurgeCancelRequest) error
 	Backup(name string) error
 	Restore(name string) error
 }
@@ -56,7 +76,41 @@ func NewDB(ctx context.Context, cfg *config.DBConfig) (DB, error) {
 		slaveAddr: cfg.Backup,
 	}
 
-	s, err := store.Open(store.Dir(cfg.DataDir), store.ExpireInterval(cfg.ExpireInterval))
+	opts := []store.OptStore{store.Dirs(cfg.DataDirs...),
+		store.DirWeights(cfg.DataDirWeights...),
+		store.ExpireInterval(cfg.ExpireInterval),
+		store.CompactInterval(cfg.CompactInterval),
+		store.ScrubInterval(cfg.ScrubInterval),
+		store.MaxValueSize(cfg.MaxValueSize),
+		store.MaxOpenFiles(cfg.MaxOpenFiles),
+		store.DedupThreshold(cfg.DedupThreshold),
+		store.InlineMax(cfg.InlineMax),
+		store.ColdDir(cfg.ColdDir),
+		store.TierInterval(cfg.TierInterval),
+		// the server accepts connections while the shards are loading
+		store.LoadInBackground(true),
+		store.LoadFailFast(cfg.LoadFailFast),
+		store.MigrateLegacyBuckets(cfg.MigrateLegacy),
+	}
+	if cfg.TierAfter > 0 {
+		opts = append(opts, store.TierAfter(cfg.TierAfter))
+	}
+	if cfg.KeepVersions > 0 {
+		opts = append(opts, store.KeepVersions(cfg.KeepVersions))
+	}
+	if cfg.KeepVersionsFor > 0 {
+		opts = append(opts, store.KeepVersionsFor(cfg.KeepVersionsFor))
+	}
+	if cfg.Shards > 0 {
+		opts = append(opts, store.ShardsTotal(cfg.Shards))
+	}
+	if cfg.SlotGrowth > 0 {
+		opts = append(opts, store.SlotGrowth(cfg.SlotGrowth))
+	}
+	if cfg.LoadWorkers > 0 {
+		opts = append(opts, store.LoadWorkers(cfg.LoadWorkers))
+	}
+	s, err := store.Open(opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -71,73 +125,108 @@ func NewDB(ctx context.Context, cfg *config.DBConfig) (DB, error) {
 	return d, nil
 }
 
+// checkKeys ... the internal keys of the store, the bucket keys and the versions,
+// are reached with their own commands only
+func checkKeys(keys ...[]byte) error {
+	for _, key := range keys {
+		if store.IsInternalKey(key) {
+			return common.ErrBadRequest
+		}
+	}
+	return nil
+}
+
 func (c *db) Set(cmd common.SetRequest) error {
+	err := checkKeys(cmd.Key)
+	if err != nil {
+		if cmd.Stream != nil {
+			// the data block must be consumed to keep the connection in sync
+			_, _ = io.Copy(io.Discard, cmd.Stream)
+		}
+		return err
+	}
 	expire := cmd.Exptime
 	if cmd.Exptime > 0 {
 		expire += uint32(time.Now().Unix())
 	}
 	// TODO: replication
-	return c.store.Set(cmd.Key, cmd.Data, expire)
+	if cmd.Stream != nil {
+		err := c.store.SetStream(cmd.Key, cmd.Stream, cmd.Length, expire, cmd.Flags)
+		// the rest of the data block must be consumed to keep the connection in sync
+		_, drainErr := io.Copy(io.Discard, cmd.Stream)
+		if err == nil {
+			err = drainErr
+		}
+		return err
+	}
+	return c.store.SetWithFlags(cmd.Key, cmd.Data, expire, cmd.Flags)
 }
 
 func (c *db) Add(cmd common.SetRequest) error {
-	_, err := c.store.Get(cmd.Key)
-	if err == nil {
-		c.store.Delete(cmd.Key)
-		return common.ErrKeyExists
+	err := checkKeys(cmd.Key)
+	if err != nil {
+		return err
 	}
-
 	expire := cmd.Exptime
 	if cmd.Exptime > 0 {
 		expire += uint32(time.Now().Unix())
 	}
-
-	return c.store.Set(cmd.Key, cmd.Data, expire)
+	return c.store.Add(cmd.Key, cmd.Data, expire, cmd.Flags)
 }
 
 func (c *db) Replace(cmd common.SetRequest) error {
-	_, err := c.store.Get(cmd.Key)
+	err := checkKeys(cmd.Key)
 	if err != nil {
-		c.store.Delete(cmd.Key)
-		return common.ErrKeyNotFound
+		return err
 	}
-
 	expire := cmd.Exptime
 	if cmd.Exptime > 0 {
 		expire += uint32(time.Now().Unix())
 	}
-
-	return c.store.Set(cmd.Key, cmd.Data, expire)
+	return c.store.Replace(cmd.Key, cmd.Data, expire, cmd.Flags)
 }
 
 func (c *db) Append(cmd common.SetRequest) error {
-	data, err := c.store.Get(cmd.Key)
+	err := checkKeys(cmd.Key)
 	if err != nil {
-		c.store.Delete(cmd.Key)
-		return common.ErrKeyNotFound
+		return err
 	}
-	data = append(data, cmd.Data...)
-	return c.store.Set(cmd.Key, data, cmd.Exptime)
+	return c.store.Append(cmd.Key, cmd.Data)
 }
 
 func (c *db) Prepend(cmd common.SetRequest) error {
-	data, err := c.store.Get(cmd.Key)
+	err := checkKeys(cmd.Key)
 	if err != nil {
-		c.store.Delete(cmd.Key)
-		return common.ErrKeyNotFound
+		return err
 	}
-	data = append(cmd.Data, data...)
-	return c.store.Set(cmd.Key, data, cmd.Exptime)
+	return c.store.Prepend(cmd.Key, cmd.Data)
 }
 
 func (c *db) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
 	dataOut := make(chan common.GetResponse, len(cmd.Keys))
-	errOut := make(chan error)
+	errOut := make(chan error, 1)
+
+	err := checkKeys(cmd.Keys...)
+	if err != nil {
+		errOut <- err
+		close(dataOut)
+		close(errOut)
+		return dataOut, errOut
+	}
+	if len(cmd.Keys) > 1 {
+		c.getMany(cmd, dataOut, errOut)
+		close(dataOut)
+		close(errOut)
+		return dataOut, errOut
+	}
 
 	for idx, key := range cmd.Keys {
-		data, err := c.store.Get(key)
+		r, err := c.store.GetReader(key)
+		if errors.Is(err, common.ErrTempFailure) {
+			errOut <- err
+			break
+		}
 		if err != nil {
-			c.store.Delete(key)
 			dataOut <- common.GetResponse{
 				Miss:   true,
 				Quiet:  cmd.Quiet[idx],
@@ -147,13 +236,20 @@ func (c *db) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error
 			continue
 		}
 
-		dataOut <- common.GetResponse{
+		res := common.GetResponse{
 			Miss:   false,
 			Quiet:  cmd.Quiet[idx],
 			Opaque: cmd.Opaques[idx],
+			Flags:  r.Header().Flags(),
 			Key:    key,
-			Data:   data,
 		}
+		// the large value is streamed out chunk by chunk
+		if r.Chunked() {
+			res.Stream, res.Size = r, r.Size()
+		} else {
+			res.Data, _ = r.Bytes()
+		}
+		dataOut <- res
 	}
 
 	close(dataOut)
@@ -162,15 +258,62 @@ func (c *db) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error
 	return dataOut, errOut
 }
 
+// getMany ... the multi-key get reads all the keys at the same moment,
+// so a concurrent update is seen either for all of them or for none. The large values are streamed
+// from the chunks pinned by GetReaders, a later overwrite doesn't change the streamed value
+func (c *db) getMany(cmd common.GetRequest, dataOut chan<- common.GetResponse, errOut chan<- error) {
+	readers, err := c.store.GetReaders(cmd.Keys...)
+	if err != nil {
+		errOut <- err
+		return
+	}
+
+	for idx, key := range cmd.Keys {
+		r := readers[idx]
+		if r == nil {
+			dataOut <- common.GetResponse{
+				Miss:   true,
+				Quiet:  cmd.Quiet[idx],
+				Opaque: cmd.Opaques[idx],
+				Key:    key,
+			}
+			continue
+		}
+
+		res := common.GetResponse{
+			Miss:   false,
+			Quiet:  cmd.Quiet[idx],
+			Opaque: cmd.Opaques[idx],
+			Flags:  r.Header().Flags(),
+			Key:    key,
+		}
+		if r.Chunked() {
+			res.Stream, res.Size = r, r.Size()
+		} else {
+			res.Data, _ = r.Bytes()
+		}
+		dataOut <- res
+	}
+}
+
 func (c *db) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
 	dataOut := make(chan common.GetEResponse, len(cmd.Keys))
-	errorOut := make(chan error)
+	errorOut := make(chan error, 1)
 
+	err := checkKeys(cmd.Keys...)
+	if err != nil {
+		errorOut <- err
+		close(dataOut)
+		close(errorOut)
+		return dataOut, errorOut
+	}
 	for idx, key := range cmd.Keys {
-		data, err := c.store.Get(key)
-
+		data, header, err := c.store.GetWithHeader(key)
+		if errors.Is(err, common.ErrTempFailure) {
+			errorOut <- err
+			break
+		}
 		if err != nil {
-			c.store.Delete(key)
 			dataOut <- common.GetEResponse{
 				Miss:   true,
 				Quiet:  cmd.Quiet[idx],
@@ -181,12 +324,13 @@ func (c *db) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan err
 		}
 
 		dataOut <- common.GetEResponse{
-			Miss:   false,
-			Quiet:  cmd.Quiet[idx],
-			Opaque: cmd.Opaques[idx],
-			// TODO add expire and flags
-			Key:  key,
-			Data: data,
+			Miss:    false,
+			Quiet:   cmd.Quiet[idx],
+			Opaque:  cmd.Opaques[idx],
+			Flags:   header.Flags(),
+			Exptime: header.Expire(),
+			Key:     key,
+			Data:    data,
 		}
 	}
 
@@ -202,6 +346,10 @@ func (c *db) GAT(_ common.GATRequest) (common.GetResponse, error) {
 }
 
 func (c *db) Delete(cmd common.DeleteRequest) error {
+	err := checkKeys(cmd.Key)
+	if err != nil {
+		return err
+	}
 	logger := logging.WithContext(c.ctx)
 	atomic.StoreInt64(&c.updateAt, time.Now().Unix())
 	deleted, err := c.store.Delete(cmd.Key)
@@ -229,6 +377,10 @@ func (c *db) Delete(cmd common.DeleteRequest) error {
 }
 
 func (c *db) Touch(cmd common.TouchRequest) error {
+	err := checkKeys(cmd.Key)
+	if err != nil {
+		return err
+	}
 	atomic.StoreInt64(&c.updateAt, time.Now().Unix())
 	expire := cmd.Exptime
 	if expire > 0 {
@@ -237,6 +389,141 @@ func (c *db) Touch(cmd common.TouchRequest) error {
 	return c.store.Touch(cmd.Key, expire)
 }
 
+// TTL ... remaining ttl of the key in seconds
+func (c *db) TTL(cmd common.TTLRequest) (int64, error) {
+	err := checkKeys(cmd.Key)
+	if err != nil {
+		return 0, err
+	}
+	ttl, err := c.store.TTL(cmd.Key)
+	if err != nil {
+		return 0, err
+	}
+	return int64(ttl / time.Second), nil
+}
+
+func (c *db) Persist(cmd common.PersistRequest) error {
+	err := checkKeys(cmd.Key)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&c.updateAt, time.Now().Unix())
+	return c.store.Persist(cmd.Key)
+}
+
+func (c *db) ExpireAt(cmd common.ExpireAtRequest) error {
+	err := checkKeys(cmd.Key)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&c.updateAt, time.Now().Unix())
+	if cmd.Exptime == 0 {
+		return common.ErrInvalidArgs
+	}
+	return c.store.ExpireAt(cmd.Key, time.Unix(int64(cmd.Exptime), 0))
+}
+
+func (c *db) History(cmd common.HistoryRequest) ([]common.VersionInfo, error) {
+	versions, err := c.store.History(cmd.Key)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]common.VersionInfo, 0, len(versions))
+	for _, v := range versions {
+		res = append(res, common.VersionInfo{
+			Version: v.Version,
+			Written: v.Written.Unix(),
+			Deleted: v.Deleted,
+			Flags:   v.Flags,
+			Size:    v.Size,
+		})
+	}
+	return res, nil
+}
+
+// GetVersion ... the deleting version is a miss
+func (c *db) GetVersion(cmd common.GetVersionRequest) (common.GetResponse, error) {
+	val, v, err := c.store.GetVersion(cmd.Key, cmd.Version)
+	if err != nil {
+		return common.GetResponse{}, err
+	}
+	return common.GetResponse{
+		Key:    cmd.Key,
+		Data:   val,
+		Flags:  v.Flags,
+		Opaque: cmd.Opaque,
+		Miss:   v.Deleted,
+	}, nil
+}
+
+func (c *db) Batch(cmd common.BatchRequest) error {
+	atomic.StoreInt64(&c.updateAt, time.Now().Unix())
+	b := c.store.NewWriteBatch()
+	for _, op := range cmd.Ops {
+		err := checkKeys(op.Key)
+		if err != nil {
+			return err
+		}
+		switch op.Type {
+		case common.RequestSet:
+			expire := op.Exptime
+			if op.Exptime > 0 {
+				expire += uint32(time.Now().Unix())
+			}
+			b.SetWithFlags(op.Key, op.Data, expire, op.Flags)
+		case common.RequestDelete:
+			b.Delete(op.Key)
+		default:
+			return common.ErrInvalidArgs
+		}
+	}
+	return b.Commit()
+}
+
+// Scan ... the keys of the buckets and the versions of the keys are reached with their own commands, they aren't listed
+func (c *db) Scan(cmd common.ScanRequest) (common.ScanResponse, error) {
+	keys, next, err := c.store.Scan(cmd.Cursor, cmd.Match, cmd.Count)
+	if err != nil {
+		return common.ScanResponse{}, errors.Join(common.ErrInvalidArgs, err)
+	}
+	res := common.ScanResponse{Cursor: next, Opaque: cmd.Opaque}
+	for _, key := range keys {
+		if !store.IsInternalKey(key) {
+			res.Keys = append(res.Keys, key)
+		}
+	}
+	return res, nil
+}
+
+// Purge ... start the background delete, returns its id
+func (c *db) Purge(cmd common.PurgeRequest) (uint64, error) {
+	atomic.StoreInt64(&c.updateAt, time.Now().Unix())
+	var id uint64
+	var err error
+	if cmd.Prefix {
+		id, err = c.store.DeletePrefix([]byte(cmd.Pattern))
+	} else {
+		id, err = c.store.DeleteMatch(cmd.Pattern)
+	}
+	if err != nil {
+		return 0, errors.Join(common.ErrInvalidArgs, err)
+	}
+	return id, nil
+}
+
+func (c *db) PurgeStatus(_ common.PurgeStatusRequest) ([]common.PurgeInfo, error) {
+	purges := c.store.Purges()
+	res := make([]common.PurgeInfo, 0, len(purges))
+	for _, p := range purges {
+		res = append(res, common.PurgeInfo{ID: p.ID, Match: p.Match, State: p.State, Scanned: p.Scanned, Deleted: p.Deleted})
+	}
+	return res, nil
+}
+
+func (c *db) PurgeCancel(cmd common.PurgeCancelRequest) error {
+	return c.store.CancelPurge(cmd.ID)
+}
+
 func (c *db) Close() error {
 	return c.store.Close()
 }
@@ -245,11 +532,6 @@ func (c *db) Count() uint64 {
 	return uint64(c.store.Count())
 }
 
-func (c *db) Stats() ([]byte, error) {
-	// TODO implement me
-	panic("implement me")
-}
-
 func (c *db) Backup(name string) error {
 	if c.store != nil {
 		file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_EXCL, os.FileMode(0644))
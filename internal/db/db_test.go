@@ -6,6 +6,7 @@ import (
 	"encoding/binary"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/DenzelPenzel/nyx/internal/common"
 	"github.com/DenzelPenzel/nyx/internal/config"
@@ -21,8 +22,8 @@ func openDB() (db.DB, func(), error) {
 	cfg := &config.Config{
 		Environment: common.Local,
 		DBConfig: &config.DBConfig{
-			DataDir: dirName,
-			Backup:  "",
+			DataDirs: []string{dirName},
+			Backup:   "",
 		},
 	}
 	dbNode, err := db.NewDB(ctx, cfg.DBConfig)
@@ -124,15 +125,15 @@ func Test_Add(t *testing.T) {
 		require.True(t, bytes.Equal(res.Data, []byte("123qwe")))
 	})
 
-	t.Run("test key miss, if call add operation for existing key", func(t *testing.T) {
-		// add operation for existing key remove this key
+	t.Run("test failed add operation for existing key", func(t *testing.T) {
+		// add operation for existing key keeps the old value
 		err = d.Add(common.SetRequest{
 			Key:     key,
-			Data:    []byte("123qwe"),
+			Data:    []byte("456asd"),
 			Exptime: 0,
 		})
-		require.Error(t, err)
-		// should be key miss here
+		require.ErrorIs(t, err, common.ErrKeyExists)
+
 		resChan, errChan := d.Get(common.GetRequest{
 			Keys:    [][]byte{key},
 			Opaques: []uint32{0},
@@ -141,7 +142,8 @@ func Test_Add(t *testing.T) {
 		err := <-errChan
 		res := <-resChan
 		require.NoError(t, err)
-		require.True(t, res.Miss)
+		require.False(t, res.Miss)
+		require.True(t, bytes.Equal(res.Data, []byte("123qwe")))
 	})
 }
 
@@ -229,6 +231,44 @@ func Test_Append(t *testing.T) {
 	})
 }
 
+func Test_AppendKeepsTTLAndFlags(t *testing.T) {
+	// open db conn
+	d, shutdown, err := openDB()
+	defer shutdown()
+	require.NoError(t, err)
+	key := []byte("abc")
+
+	err = d.Set(common.SetRequest{
+		Key:     key,
+		Data:    []byte("123"),
+		Flags:   42,
+		Exptime: 100,
+	})
+	require.NoError(t, err)
+
+	// exptime and flags of the append request are ignored
+	err = d.Append(common.SetRequest{
+		Key:     key,
+		Data:    []byte("456"),
+		Flags:   1,
+		Exptime: 10,
+	})
+	require.NoError(t, err)
+
+	resChan, errChan := d.GetE(common.GetRequest{
+		Keys:    [][]byte{key},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	})
+	err = <-errChan
+	res := <-resChan
+	require.NoError(t, err)
+	require.False(t, res.Miss)
+	require.Equal(t, "123456", string(res.Data))
+	require.Equal(t, uint32(42), res.Flags)
+	require.Greater(t, int64(res.Exptime), time.Now().Unix()+90)
+}
+
 func Test_Prepend(t *testing.T) {
 	// open db conn
 	d, shutdown, err := openDB()
@@ -270,3 +310,384 @@ func Test_Prepend(t *testing.T) {
 		require.True(t, bytes.Equal(res.Data, []byte("123456")))
 	})
 }
+
+func Test_Batch(t *testing.T) {
+	// open db conn
+	d, shutdown, err := openDB()
+	defer shutdown()
+	require.NoError(t, err)
+
+	err = d.Set(common.SetRequest{
+		Key:  []byte("c"),
+		Data: []byte("old"),
+	})
+	require.NoError(t, err)
+
+	err = d.Batch(common.BatchRequest{
+		Ops: []common.BatchOp{
+			{Type: common.RequestSet, Key: []byte("a"), Data: []byte("1")},
+			{Type: common.RequestSet, Key: []byte("b"), Data: []byte("2")},
+			{Type: common.RequestDelete, Key: []byte("c")},
+		},
+	})
+	require.NoError(t, err)
+
+	resChan, _ := d.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte("a"), []byte("b"), []byte("c")},
+		Opaques: []uint32{0, 0, 0},
+		Quiet:   []bool{false, false, false},
+	})
+	res := <-resChan
+	require.Equal(t, "1", string(res.Data))
+	res = <-resChan
+	require.Equal(t, "2", string(res.Data))
+	res = <-resChan
+	require.True(t, res.Miss)
+
+	t.Run("test unknown batch op", func(t *testing.T) {
+		err = d.Batch(common.BatchRequest{
+			Ops: []common.BatchOp{{Type: common.RequestTouch, Key: []byte("a")}},
+		})
+		require.ErrorIs(t, err, common.ErrInvalidArgs)
+	})
+}
+
+func Test_StreamSet(t *testing.T) {
+	// open db conn
+	d, shutdown, err := openDB()
+	defer shutdown()
+	require.NoError(t, err)
+
+	val := bytes.Repeat([]byte("0123456789abcdef"), 256<<10)
+	err = d.Set(common.SetRequest{
+		Key:    []byte("big"),
+		Flags:  5,
+		Stream: bytes.NewReader(val),
+		Length: int64(len(val)),
+	})
+	require.NoError(t, err)
+
+	resChan, _ := d.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte("big")},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	})
+	res := <-resChan
+	require.False(t, res.Miss)
+	require.Equal(t, uint32(5), res.Flags)
+	require.NotNil(t, res.Stream)
+	require.Equal(t, int64(len(val)), res.Size)
+
+	var buf bytes.Buffer
+	_, err = buf.ReadFrom(res.Stream)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(val, buf.Bytes()))
+}
+
+func Test_Stats(t *testing.T) {
+	// open db conn
+	d, shutdown, err := openDB()
+	defer shutdown()
+	require.NoError(t, err)
+
+	require.NoError(t, d.Set(common.SetRequest{Key: []byte("a"), Data: []byte("1")}))
+
+	stats, err := d.Stats(common.StatsRequest{})
+	require.NoError(t, err)
+	require.Contains(t, stats, common.Stat{Name: "curr_items", Value: "1"})
+	require.Contains(t, stats, common.Stat{Name: "shards_total", Value: "256"})
+
+	stats, err = d.Stats(common.StatsRequest{Group: db.StatsMaintenance})
+	require.NoError(t, err)
+	require.Contains(t, stats, common.Stat{Name: "compact_runs", Value: "0"})
+	require.Contains(t, stats, common.Stat{Name: "expire_last_error", Value: `""`})
+
+	stats, err = d.Stats(common.StatsRequest{Group: db.StatsScrub})
+	require.NoError(t, err)
+	require.Contains(t, stats, common.Stat{Name: "findings", Value: "0"})
+
+	_, err = d.Stats(common.StatsRequest{Group: "unknown"})
+	require.ErrorIs(t, err, common.ErrInvalidArgs)
+}
+
+func Test_Bucket(t *testing.T) {
+	// open db conn
+	d, shutdown, err := openDB()
+	defer shutdown()
+	require.NoError(t, err)
+
+	for _, k := range []string{"b", "d", "a", "c"} {
+		err = d.BucketSet(common.BucketSetRequest{Bucket: "users", Key: []byte(k), Data: []byte("v" + k)})
+		require.NoError(t, err)
+	}
+
+	res, err := d.BucketGet(common.BucketGetRequest{Bucket: "users", Keys: [][]byte{[]byte("a"), []byte("x")}})
+	require.NoError(t, err)
+	require.Len(t, res, 2)
+	require.Equal(t, "va", string(res[0].Data))
+	require.True(t, res[1].Miss)
+
+	page, err := d.BucketRange(common.BucketRangeRequest{Bucket: "users", Start: []byte("b"), Limit: 2})
+	require.NoError(t, err)
+	require.Len(t, page.Items, 2)
+	require.Equal(t, "b", string(page.Items[0].Key))
+	require.Equal(t, "vc", string(page.Items[1].Data))
+	require.Equal(t, "c", string(page.Cursor))
+
+	page, err = d.BucketRange(common.BucketRangeRequest{Bucket: "users", Start: []byte("b"), Limit: 2, Cursor: page.Cursor})
+	require.NoError(t, err)
+	require.Len(t, page.Items, 1)
+	require.Equal(t, "d", string(page.Items[0].Key))
+	require.Nil(t, page.Cursor)
+
+	err = d.BucketDelete(common.BucketDeleteRequest{Bucket: "users", Key: []byte("d")})
+	require.NoError(t, err)
+	err = d.BucketDelete(common.BucketDeleteRequest{Bucket: "users", Key: []byte("d")})
+	require.ErrorIs(t, err, common.ErrKeyNotFound)
+
+	page, err = d.BucketRange(common.BucketRangeRequest{Bucket: "users", Prefix: []byte(""), Reverse: true})
+	require.NoError(t, err)
+	require.Len(t, page.Items, 3)
+	require.Equal(t, "c", string(page.Items[0].Key))
+
+	t.Run("test missing bucket", func(t *testing.T) {
+		page, err := d.BucketRange(common.BucketRangeRequest{Bucket: "none"})
+		require.NoError(t, err)
+		require.Empty(t, page.Items)
+		res, err := d.BucketGet(common.BucketGetRequest{Bucket: "none", Keys: [][]byte{[]byte("a")}})
+		require.NoError(t, err)
+		require.True(t, res[0].Miss)
+	})
+
+	t.Run("test rename and drop", func(t *testing.T) {
+		err := d.BucketRename(common.BucketRenameRequest{Bucket: "users", NewName: "customers"})
+		require.NoError(t, err)
+		buckets, err := d.BucketList(common.BucketListRequest{})
+		require.NoError(t, err)
+		require.Equal(t, []common.BucketInfo{{Name: "customers", Keys: 3, Bytes: 6}}, buckets)
+
+		require.NoError(t, d.BucketDrop(common.BucketDropRequest{Bucket: "customers"}))
+		err = d.BucketDrop(common.BucketDropRequest{Bucket: "customers"})
+		require.ErrorIs(t, err, common.ErrKeyNotFound)
+		buckets, err = d.BucketList(common.BucketListRequest{})
+		require.NoError(t, err)
+		require.Empty(t, buckets)
+	})
+	t.Run("test config", func(t *testing.T) {
+		err := d.BucketConfig(common.BucketConfigRequest{Bucket: "cache", MaxKeys: 2, Overflow: "evict"})
+		require.NoError(t, err)
+		for _, k := range []string{"a", "b", "c"} {
+			err = d.BucketSet(common.BucketSetRequest{Bucket: "cache", Key: []byte(k), Data: []byte("v"), Exptime: 60})
+			require.NoError(t, err)
+		}
+		page, err := d.BucketRange(common.BucketRangeRequest{Bucket: "cache"})
+		require.NoError(t, err)
+		require.Len(t, page.Items, 2)
+		require.Equal(t, "b", string(page.Items[0].Key))
+
+		err = d.BucketConfig(common.BucketConfigRequest{Bucket: "cache", MaxKeys: 2})
+		require.NoError(t, err)
+		err = d.BucketSet(common.BucketSetRequest{Bucket: "cache", Key: []byte("d"), Data: []byte("v")})
+		require.ErrorIs(t, err, common.ErrNoMem)
+	})
+}
+
+func Test_InternalKeys(t *testing.T) {
+	// open db conn
+	d, shutdown, err := openDB()
+	defer shutdown()
+	require.NoError(t, err)
+
+	err = d.BucketSet(common.BucketSetRequest{Bucket: "b", Key: []byte("k"), Data: []byte("v")})
+	require.NoError(t, err)
+
+	// the bucket metadata and the versions aren't reached by the plain key commands
+	for _, k := range []string{"[bucket_meta]b", "[version_seq]", "[version_pending]x", "[version]x"} {
+		key := []byte(k)
+		require.ErrorIs(t, d.Set(common.SetRequest{Key: key, Data: []byte("v")}), common.ErrBadRequest)
+		require.ErrorIs(t, d.Add(common.SetRequest{Key: key, Data: []byte("v")}), common.ErrBadRequest)
+		require.ErrorIs(t, d.Append(common.SetRequest{Key: key, Data: []byte("v")}), common.ErrBadRequest)
+		require.ErrorIs(t, d.Delete(common.DeleteRequest{Key: key}), common.ErrBadRequest)
+		require.ErrorIs(t, d.Touch(common.TouchRequest{Key: key}), common.ErrBadRequest)
+		_, err = d.TTL(common.TTLRequest{Key: key})
+		require.ErrorIs(t, err, common.ErrBadRequest)
+		err = d.Batch(common.BatchRequest{Ops: []common.BatchOp{{Type: common.RequestDelete, Key: key}}})
+		require.ErrorIs(t, err, common.ErrBadRequest)
+
+		dataOut, errOut := d.Get(common.GetRequest{
+			Keys:    [][]byte{[]byte("a"), key},
+			Opaques: []uint32{0, 0},
+			Quiet:   []bool{false, false},
+		})
+		require.Empty(t, dataOut)
+		require.ErrorIs(t, <-errOut, common.ErrBadRequest)
+	}
+
+	res, err := d.BucketGet(common.BucketGetRequest{Bucket: "b", Keys: [][]byte{[]byte("k")}})
+	require.NoError(t, err)
+	require.Equal(t, "v", string(res[0].Data))
+}
+
+func Test_Scan(t *testing.T) {
+	// open db conn
+	d, shutdown, err := openDB()
+	defer shutdown()
+	require.NoError(t, err)
+
+	for _, k := range []string{"user:1", "user:2", "order:1"} {
+		err = d.Set(common.SetRequest{Key: []byte(k), Data: []byte("v")})
+		require.NoError(t, err)
+	}
+	// bucket keys aren't listed
+	err = d.BucketSet(common.BucketSetRequest{Bucket: "users", Key: []byte("user:3"), Data: []byte("v")})
+	require.NoError(t, err)
+
+	var keys []string
+	cursor := uint64(0)
+	for {
+		res, err := d.Scan(common.ScanRequest{Cursor: cursor, Match: "user:*", Count: 2})
+		require.NoError(t, err)
+		for _, k := range res.Keys {
+			keys = append(keys, string(k))
+		}
+		if res.Cursor == 0 {
+			break
+		}
+		cursor = res.Cursor
+	}
+	require.ElementsMatch(t, []string{"user:1", "user:2"}, keys)
+
+	_, err = d.Scan(common.ScanRequest{Cursor: 1 << 60})
+	require.ErrorIs(t, err, common.ErrInvalidArgs)
+}
+
+func Test_Purge(t *testing.T) {
+	// open db conn
+	d, shutdown, err := openDB()
+	defer shutdown()
+	require.NoError(t, err)
+
+	for _, k := range []string{"tenant:a:1", "tenant:a:2", "tenant:b:1"} {
+		err = d.Set(common.SetRequest{Key: []byte(k), Data: []byte("v")})
+		require.NoError(t, err)
+	}
+
+	id, err := d.Purge(common.PurgeRequest{Pattern: "tenant:a:", Prefix: true})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		purges, err := d.PurgeStatus(common.PurgeStatusRequest{})
+		require.NoError(t, err)
+		require.Len(t, purges, 1)
+		require.Equal(t, id, purges[0].ID)
+		return purges[0].State == "done" && purges[0].Deleted == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	res, err := d.Scan(common.ScanRequest{Match: "tenant:*", Count: 100})
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("tenant:b:1")}, res.Keys)
+
+	require.NoError(t, d.PurgeCancel(common.PurgeCancelRequest{ID: id}))
+	err = d.PurgeCancel(common.PurgeCancelRequest{ID: id + 1})
+	require.ErrorIs(t, err, common.ErrKeyNotFound)
+	_, err = d.Purge(common.PurgeRequest{})
+	require.ErrorIs(t, err, common.ErrInvalidArgs)
+}
+
+func Test_TTL(t *testing.T) {
+	// open db conn
+	d, shutdown, err := openDB()
+	defer shutdown()
+	require.NoError(t, err)
+
+	require.NoError(t, d.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("v"), Exptime: 100}))
+	require.NoError(t, d.Set(common.SetRequest{Key: []byte("bar"), Data: []byte("v")}))
+
+	ttl, err := d.TTL(common.TTLRequest{Key: []byte("foo")})
+	require.NoError(t, err)
+	require.InDelta(t, 100, ttl, 2)
+	_, err = d.TTL(common.TTLRequest{Key: []byte("bar")})
+	require.ErrorIs(t, err, common.ErrNoTTL)
+	_, err = d.TTL(common.TTLRequest{Key: []byte("baz")})
+	require.ErrorIs(t, err, common.ErrKeyNotFound)
+
+	require.NoError(t, d.Persist(common.PersistRequest{Key: []byte("foo")}))
+	require.ErrorIs(t, d.Persist(common.PersistRequest{Key: []byte("foo")}), common.ErrNoTTL)
+	require.ErrorIs(t, d.Persist(common.PersistRequest{Key: []byte("baz")}), common.ErrKeyNotFound)
+
+	at := uint32(time.Now().Unix() + 500)
+	require.NoError(t, d.ExpireAt(common.ExpireAtRequest{Key: []byte("bar"), Exptime: at}))
+	ttl, err = d.TTL(common.TTLRequest{Key: []byte("bar")})
+	require.NoError(t, err)
+	require.InDelta(t, 500, ttl, 2)
+	err = d.ExpireAt(common.ExpireAtRequest{Key: []byte("baz"), Exptime: at})
+	require.ErrorIs(t, err, common.ErrKeyNotFound)
+	err = d.ExpireAt(common.ExpireAtRequest{Key: []byte("bar")})
+	require.ErrorIs(t, err, common.ErrInvalidArgs)
+}
+
+func Test_History(t *testing.T) {
+	dirName := utils.TempDir("db-interation-test-")
+	os.RemoveAll(dirName)
+	defer os.RemoveAll(dirName)
+	d, err := db.NewDB(context.Background(), &config.DBConfig{
+		DataDirs:     []string{dirName},
+		KeepVersions: 2,
+	})
+	require.NoError(t, err)
+	defer d.Close()
+
+	for _, v := range []string{"a", "bb", "ccc"} {
+		require.NoError(t, d.Set(common.SetRequest{Key: []byte("foo"), Data: []byte(v), Flags: 7}))
+	}
+	require.NoError(t, d.Delete(common.DeleteRequest{Key: []byte("foo")}))
+
+	versions, err := d.History(common.HistoryRequest{Key: []byte("foo")})
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	require.False(t, versions[0].Deleted)
+	require.Equal(t, int64(3), versions[0].Size)
+	require.Equal(t, uint32(7), versions[0].Flags)
+	require.True(t, versions[1].Deleted)
+
+	res, err := d.GetVersion(common.GetVersionRequest{Key: []byte("foo"), Version: versions[0].Version})
+	require.NoError(t, err)
+	require.False(t, res.Miss)
+	require.Equal(t, []byte("ccc"), res.Data)
+	require.Equal(t, uint32(7), res.Flags)
+
+	res, err = d.GetVersion(common.GetVersionRequest{Key: []byte("foo"), Version: versions[1].Version})
+	require.NoError(t, err)
+	require.True(t, res.Miss)
+
+	_, err = d.GetVersion(common.GetVersionRequest{Key: []byte("foo"), Version: versions[0].Version - 1})
+	require.ErrorIs(t, err, common.ErrKeyNotFound)
+	_, err = d.History(common.HistoryRequest{Key: []byte("bar")})
+	require.ErrorIs(t, err, common.ErrKeyNotFound)
+}
+
+func Test_MultiGet(t *testing.T) {
+	// open db conn
+	d, shutdown, err := openDB()
+	defer shutdown()
+	require.NoError(t, err)
+
+	require.NoError(t, d.Set(common.SetRequest{Key: []byte("a"), Data: []byte("1"), Flags: 5}))
+	require.NoError(t, d.Set(common.SetRequest{Key: []byte("c"), Data: []byte("3")}))
+
+	resChan, errChan := d.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte("a"), []byte("b"), []byte("c")},
+		Opaques: []uint32{1, 2, 3},
+		Quiet:   []bool{false, false, false},
+	})
+	require.NoError(t, <-errChan)
+	var res []common.GetResponse
+	for r := range resChan {
+		res = append(res, r)
+	}
+	require.Len(t, res, 3)
+	require.Equal(t, []byte("1"), res[0].Data)
+	require.Equal(t, uint32(5), res[0].Flags)
+	require.True(t, res[1].Miss)
+	require.Equal(t, uint32(2), res[1].Opaque)
+	require.Equal(t, []byte("3"), res[2].Data)
+}
@@ -0,0 +1,95 @@
+package db
+
+import (
+	"os"
+	"strconv"
+
+	"github.com/DenzelPenzel/nyx/internal/common"
+)
+
+// Groups of the statistics
+const (
+	StatsGeneral     = ""
+	StatsMaintenance = "maintenance"
+	StatsScrub       = "scrub"
+)
+
+func (c *db) Stats(cmd common.StatsRequest) ([]common.Stat, error) {
+	switch cmd.Group {
+	case StatsGeneral:
+		load := c.store.LoadStatus()
+		fds := c.store.FdStats()
+		tiers := c.store.Tiers()
+		dedup := c.store.Dedup()
+		// logical bytes per stored byte of the shared values
+		dedupRatio := 1.0
+		if dedup.StoredBytes > 0 {
+			dedupRatio = float64(dedup.LogicalBytes) / float64(dedup.StoredBytes)
+		}
+		return []common.Stat{
+			{Name: "pid", Value: strconv.Itoa(os.Getpid())},
+			{Name: "version", Value: common.VersionString},
+			{Name: "curr_items", Value: strconv.Itoa(c.store.Count())},
+			{Name: "shards_total", Value: strconv.Itoa(load.Total)},
+			{Name: "shards_loaded", Value: strconv.Itoa(load.Loaded)},
+			{Name: "shards_loading", Value: strconv.FormatBool(!load.Done)},
+			{Name: "shards_load_ms", Value: strconv.FormatInt(load.Duration.Milliseconds(), 10)},
+			{Name: "open_files", Value: strconv.Itoa(fds.Open)},
+			{Name: "open_files_limit", Value: strconv.Itoa(fds.Limit)},
+			{Name: "open_files_evictions", Value: strconv.FormatUint(fds.Evictions, 10)},
+			{Name: "hot_items", Value: strconv.Itoa(tiers.Hot)},
+			{Name: "cold_items", Value: strconv.Itoa(tiers.Cold)},
+			{Name: "tier_demoted", Value: strconv.FormatUint(tiers.Demoted, 10)},
+			{Name: "tier_promoted", Value: strconv.FormatUint(tiers.Promoted, 10)},
+			{Name: "inline_items", Value: strconv.Itoa(c.store.Inlined())},
+			{Name: "dedup_blobs", Value: strconv.Itoa(dedup.Blobs)},
+			{Name: "dedup_refs", Value: strconv.Itoa(dedup.Refs)},
+			{Name: "dedup_ratio", Value: strconv.FormatFloat(dedupRatio, 'f', 2, 64)},
+			{Name: "dedup_saved_bytes", Value: strconv.FormatInt(dedup.LogicalBytes-dedup.StoredBytes, 10)},
+		}, nil
+
+	case StatsMaintenance:
+		var res []common.Stat
+		for _, job := range c.store.Maintenance() {
+			var lastRun int64
+			if !job.LastRun.IsZero() {
+				lastRun = job.LastRun.Unix()
+			}
+			res = append(res,
+				common.Stat{Name: job.Name + "_interval_sec", Value: strconv.FormatFloat(job.Interval.Seconds(), 'f', -1, 64)},
+				common.Stat{Name: job.Name + "_running", Value: strconv.FormatBool(job.Running)},
+				common.Stat{Name: job.Name + "_runs", Value: strconv.FormatUint(job.Runs, 10)},
+				common.Stat{Name: job.Name + "_errors", Value: strconv.FormatUint(job.Errors, 10)},
+				common.Stat{Name: job.Name + "_last_run", Value: strconv.FormatInt(lastRun, 10)},
+				common.Stat{Name: job.Name + "_last_duration_ms", Value: strconv.FormatInt(job.Duration.Milliseconds(), 10)},
+				// the error text may contain spaces
+				common.Stat{Name: job.Name + "_last_error", Value: strconv.Quote(job.LastError)},
+			)
+		}
+		return res, nil
+
+	case StatsScrub:
+		st := c.store.ScrubStatus()
+		var lastPass int64
+		if !st.LastPass.IsZero() {
+			lastPass = st.LastPass.Unix()
+		}
+		res := []common.Stat{
+			{Name: "shard", Value: strconv.Itoa(st.Shard)},
+			{Name: "offset", Value: strconv.FormatInt(st.Offset, 10)},
+			{Name: "passes", Value: strconv.FormatUint(st.Passes, 10)},
+			{Name: "last_pass", Value: strconv.FormatInt(lastPass, 10)},
+			{Name: "bytes", Value: strconv.FormatUint(st.Bytes, 10)},
+			{Name: "records", Value: strconv.FormatUint(st.Records, 10)},
+			{Name: "findings", Value: strconv.FormatUint(st.Findings, 10)},
+			{Name: "quarantined", Value: strconv.FormatUint(st.Quarantined, 10)},
+		}
+		for i, finding := range st.Recent {
+			res = append(res, common.Stat{Name: "finding_" + strconv.Itoa(i), Value: strconv.Quote(finding)})
+		}
+		return res, nil
+
+	default:
+		return nil, common.ErrInvalidArgs
+	}
+}
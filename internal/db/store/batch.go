@@ -0,0 +1,349 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/DenzelPenzel/nyx/internal/db/store/shard"
+	"github.com/DenzelPenzel/nyx/internal/logging"
+	"github.com/spaolacci/murmur3"
+	"go.uber.org/zap"
+)
+
+const (
+	batchLogName = "batch.log"
+	batchLogVer  = 2
+
+	batchOpSet    = 1
+	batchOpDelete = 2
+
+	// op + expire + flags + key length + val length
+	batchOpHead = 1 + 4 + 4 + 2 + 4
+)
+
+var batchLogMagic = []byte("NYXB")
+
+// ErrBatchRollback ... the failed batch couldn't be rolled back, its log is kept
+// and the batch is fully applied before the next one or on the next Open
+var ErrBatchRollback = errors.New("batch rollback failed")
+
+type batchOp struct {
+	kind   byte
+	key    []byte
+	val    []byte
+	expire uint32
+	flags  uint32
+}
+
+// WriteBatch ... collects sets and deletes across shards and applies them all-or-nothing.
+// Before touching the shards the batch is written and fsynced to the batch log,
+// so a crash in the middle of Commit is repaired by replaying the log on the next Open.
+// All the affected shards are locked for the whole apply phase,
+// so the concurrent readers observe either none or all of the batch writes
+type WriteBatch struct {
+	s   *Store
+	ops []batchOp
+}
+
+// NewWriteBatch ... create an empty batch bound to the store
+func (s *Store) NewWriteBatch() *WriteBatch {
+	return &WriteBatch{s: s}
+}
+
+// Set ... queue the key write, expire is an absolute unix time or 0
+func (b *WriteBatch) Set(key, val []byte, expire uint32) {
+	b.SetWithFlags(key, val, expire, 0)
+}
+
+// SetWithFlags ... same as Set, the opaque client flags are stored with the value
+func (b *WriteBatch) SetWithFlags(key, val []byte, expire, flags uint32) {
+	b.ops = append(b.ops, batchOp{kind: batchOpSet, key: key, val: val, expire: expire, flags: flags})
+}
+
+// Delete ... queue the key removal
+func (b *WriteBatch) Delete(key []byte) {
+	b.ops = append(b.ops, batchOp{kind: batchOpDelete, key: key})
+}
+
+// Len ... number of queued operations
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+// Reset ... drop all the queued operations
+func (b *WriteBatch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// Commit ... apply all the queued operations atomically.
+// On error none of the operations are visible, except ErrBatchRollback:
+// then some of them may be visible until all of them are applied by the next batch or the next Open
+func (b *WriteBatch) Commit() error {
+	if len(b.ops) == 0 {
+		return nil
+	}
+	keys := make([][]byte, len(b.ops))
+	for i, op := range b.ops {
+		keys[i] = op.key
+	}
+	return b.s.versioned(b.commit, keys...)
+}
+
+func (b *WriteBatch) commit() error {
+	s := b.s
+
+	hashes := make([]uint32, len(b.ops))
+	for i, op := range b.ops {
+		hashes[i] = murmur3.Sum32WithSeed(op.key, 0)
+	}
+	err := s.waitKey(hashes...)
+	if err != nil {
+		return err
+	}
+
+	s.batchMu.Lock()
+	defer s.batchMu.Unlock()
+	err = s.replayKept()
+	if err != nil {
+		return err
+	}
+
+	err = s.writeBatchLog(encodeBatch(b.ops))
+	if err != nil {
+		return err
+	}
+
+	ls := s.lockShards(hashes...)
+	return s.applyLogged(ls, b.ops, hashes)
+}
+
+// applyLogged ... apply the operations already written to the batch log, release the log and the shard locks.
+// The caller holds batchMu and the locks of the shards of the operations
+func (s *Store) applyLogged(ls *shardLocks, ops []batchOp, hashes []uint32) error {
+	defer ls.unlock()
+	undo, err := s.applyBatch(ls, ops, hashes)
+	if err != nil {
+		rbErr := s.rollbackBatch(ls, undo)
+		if rbErr != nil {
+			// keep the log, the batch will be fully applied before the next one or on the next Open
+			s.keptBatch = make([]batchOp, len(ops))
+			for i, op := range ops {
+				op.key, op.val = bytes.Clone(op.key), bytes.Clone(op.val)
+				s.keptBatch[i] = op
+			}
+			return fmt.Errorf("%w: %w, cause: %w", ErrBatchRollback, rbErr, err)
+		}
+		return errors.Join(err, s.releaseBatchLog(ls))
+	}
+	return s.releaseBatchLog(ls)
+}
+
+// releaseBatchLog ... fsync the shards written by the batch and remove its log.
+// The shard locks are still held, so the replay of the log can't overwrite the later writes of the keys
+func (s *Store) releaseBatchLog(ls *shardLocks) error {
+	for _, i := range ls.shardsHeld() {
+		err := s.shards[i].FsyncLocked()
+		if err != nil {
+			return err
+		}
+	}
+	err := s.removeBatchLog()
+	if err != nil {
+		return err
+	}
+	return shard.SyncDir(s.filePath(batchLogName))
+}
+
+// replayKept ... apply the batch kept by the failed rollback before its log is overwritten by the next batch.
+// The caller holds batchMu
+func (s *Store) replayKept() error {
+	if s.keptBatch == nil {
+		return nil
+	}
+	err := s.replayBatch(s.keptBatch)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrBatchRollback, err)
+	}
+	s.keptBatch = nil
+	return nil
+}
+
+// undoOp ... state of the key before the batch operation was applied
+type undoOp struct {
+	key     []byte
+	h       uint32
+	val     []byte
+	expire  uint32
+	flags   uint32
+	existed bool
+}
+
+func (s *Store) applyBatch(ls *shardLocks, ops []batchOp, hashes []uint32) ([]undoOp, error) {
+	undo := make([]undoOp, 0, len(ops))
+	for i, op := range ops {
+		h := hashes[i]
+		old, header, err := s.getLocked(ls, op.key, h)
+		u := undoOp{key: op.key, h: h}
+		if err == nil {
+			u.val, u.expire, u.flags, u.existed = old, header.Expire(), header.Flags(), true
+		}
+		undo = append(undo, u)
+
+		switch op.kind {
+		case batchOpSet:
+			err = s.setLocked(ls, op.key, op.val, h, op.expire, op.flags)
+		case batchOpDelete:
+			_, err = s.deleteLocked(ls, op.key, h)
+		default:
+			err = fmt.Errorf("unknown batch op: %d", op.kind)
+		}
+		if err != nil {
+			return undo, err
+		}
+	}
+	return undo, nil
+}
+
+func (s *Store) rollbackBatch(ls *shardLocks, undo []undoOp) error {
+	for i := len(undo) - 1; i >= 0; i-- {
+		u := undo[i]
+		var err error
+		if u.existed {
+			err = s.setLocked(ls, u.key, u.val, u.h, u.expire, u.flags)
+		} else {
+			_, err = s.deleteLocked(ls, u.key, u.h)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) writeBatchLog(data []byte) error {
+	f, err := os.OpenFile(s.filePath(batchLogName), os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.FileMode(0644))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	return errors.Join(err, f.Close())
+}
+
+func (s *Store) removeBatchLog() error {
+	err := os.Remove(s.filePath(batchLogName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// recoverBatch ... replay the batch log left by an interrupted Commit.
+// An incomplete log means the crash happened before any shard was touched, so it's dropped
+func (s *Store) recoverBatch() error {
+	logger := logging.NoContext()
+	data, err := os.ReadFile(s.filePath(batchLogName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	ops, err := decodeBatch(data)
+	if err != nil {
+		logger.Warn("Drop incomplete batch log", zap.String("dir", s.dir), zap.Error(err))
+		return s.removeBatchLog()
+	}
+
+	logger.Warn("Replay interrupted batch", zap.String("dir", s.dir), zap.Int("ops", len(ops)))
+	return s.replayBatch(ops)
+}
+
+// replayBatch ... apply all the operations of the logged batch, the log is released once they are durable
+func (s *Store) replayBatch(ops []batchOp) error {
+	hashes := make([]uint32, len(ops))
+	for i, op := range ops {
+		hashes[i] = murmur3.Sum32WithSeed(op.key, 0)
+	}
+	ls := s.lockShards(hashes...)
+	_, err := s.applyBatch(ls, ops, hashes)
+	if err == nil {
+		err = s.releaseBatchLog(ls)
+	}
+	ls.unlock()
+	if err != nil {
+		return err
+	}
+	s.indexBucketOps(ops)
+	return nil
+}
+
+// encodeBatch ... magic | ver | count | [op | expire | flags | key len | val len | key | val]* | crc32
+func encodeBatch(ops []batchOp) []byte {
+	var buf bytes.Buffer
+	buf.Write(batchLogMagic)
+	buf.WriteByte(batchLogVer)
+	_ = binary.Write(&buf, binary.BigEndian, uint32(len(ops)))
+	head := make([]byte, batchOpHead)
+	for _, op := range ops {
+		head[0] = op.kind
+		binary.BigEndian.PutUint32(head[1:5], op.expire)
+		binary.BigEndian.PutUint32(head[5:9], op.flags)
+		binary.BigEndian.PutUint16(head[9:11], uint16(len(op.key)))
+		binary.BigEndian.PutUint32(head[11:15], uint32(len(op.val)))
+		buf.Write(head)
+		buf.Write(op.key)
+		buf.Write(op.val)
+	}
+	_ = binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(buf.Bytes()))
+	return buf.Bytes()
+}
+
+func decodeBatch(data []byte) ([]batchOp, error) {
+	start := len(batchLogMagic) + 1 + 4
+	if len(data) < start+4 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	body, sum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if !bytes.Equal(body[:len(batchLogMagic)], batchLogMagic) {
+		return nil, errors.New("wrong batch log magic")
+	}
+	if body[len(batchLogMagic)] != batchLogVer {
+		return nil, fmt.Errorf("wrong batch log version %d", body[len(batchLogMagic)])
+	}
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, errors.New("batch log checksum mismatch")
+	}
+
+	cnt := binary.BigEndian.Uint32(body[start-4 : start])
+	ops := make([]batchOp, 0, cnt)
+	r := body[start:]
+	for i := uint32(0); i < cnt; i++ {
+		if len(r) < batchOpHead {
+			return nil, io.ErrUnexpectedEOF
+		}
+		op := batchOp{
+			kind:   r[0],
+			expire: binary.BigEndian.Uint32(r[1:5]),
+			flags:  binary.BigEndian.Uint32(r[5:9]),
+		}
+		kl := int(binary.BigEndian.Uint16(r[9:11]))
+		vl := int(binary.BigEndian.Uint32(r[11:15]))
+		r = r[batchOpHead:]
+		if len(r) < kl+vl {
+			return nil, io.ErrUnexpectedEOF
+		}
+		op.key, op.val = r[:kl], r[kl:kl+vl]
+		r = r[kl+vl:]
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
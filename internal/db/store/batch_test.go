@@ -0,0 +1,141 @@
+package store
+
+import (
+	"os"
+	"testing"
+
+	"github.com/DenzelPenzel/nyx/internal/common"
+	"github.com/spaolacci/murmur3"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_WriteBatch(t *testing.T) {
+	s, shutdown, err := mockDB()
+	require.NoError(t, err)
+	defer shutdown()
+
+	err = s.Set([]byte("c"), []byte("old"), 0)
+	require.NoError(t, err)
+
+	b := s.NewWriteBatch()
+	b.Set([]byte("a"), []byte("1"), 0)
+	b.Set([]byte("b"), []byte("2"), 0)
+	b.Delete([]byte("c"))
+	require.Equal(t, 3, b.Len())
+
+	err = b.Commit()
+	require.NoError(t, err)
+
+	v, err := s.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, "1", string(v))
+
+	v, err = s.Get([]byte("b"))
+	require.NoError(t, err)
+	require.Equal(t, "2", string(v))
+
+	_, err = s.Get([]byte("c"))
+	require.ErrorIs(t, err, common.ErrKeyNotFound)
+
+	// log is removed after the successful commit
+	_, err = os.Stat(s.filePath(batchLogName))
+	require.True(t, os.IsNotExist(err))
+}
+
+func Test_WriteBatchRollback(t *testing.T) {
+	s, shutdown, err := mockDB()
+	require.NoError(t, err)
+	defer shutdown()
+
+	err = s.Set([]byte("a"), []byte("old"), 0)
+	require.NoError(t, err)
+
+	hashes := []uint32{0, 0}
+	ops := []batchOp{
+		{kind: batchOpSet, key: []byte("a"), val: []byte("new")},
+		{kind: 0xff, key: []byte("b")},
+	}
+	for i, op := range ops {
+		hashes[i] = murmur3.Sum32WithSeed(op.key, 0)
+	}
+
+	ls := s.lockShards(hashes...)
+	undo, err := s.applyBatch(ls, ops, hashes)
+	require.Error(t, err)
+	require.NoError(t, s.rollbackBatch(ls, undo))
+	ls.unlock()
+
+	v, err := s.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, "old", string(v))
+}
+
+func Test_WriteBatchRecovery(t *testing.T) {
+	os.RemoveAll(dirName)
+	defer os.RemoveAll(dirName)
+
+	s, err := Open(Dir(dirName))
+	require.NoError(t, err)
+	require.NoError(t, s.Set([]byte("c"), []byte("old"), 0))
+
+	// emulate the crash right after the batch log was written
+	err = s.writeBatchLog(encodeBatch([]batchOp{
+		{kind: batchOpSet, key: []byte("a"), val: []byte("1")},
+		{kind: batchOpDelete, key: []byte("c")},
+	}))
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	s, err = Open(Dir(dirName))
+	require.NoError(t, err)
+
+	v, err := s.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, "1", string(v))
+	_, err = s.Get([]byte("c"))
+	require.ErrorIs(t, err, common.ErrKeyNotFound)
+
+	// torn log must be dropped without touching the data
+	data := encodeBatch([]batchOp{{kind: batchOpDelete, key: []byte("a")}})
+	require.NoError(t, s.writeBatchLog(data[:len(data)-2]))
+	require.NoError(t, s.Close())
+
+	s, err = Open(Dir(dirName))
+	require.NoError(t, err)
+	defer s.Close()
+
+	v, err = s.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, "1", string(v))
+	_, err = os.Stat(s.filePath(batchLogName))
+	require.True(t, os.IsNotExist(err))
+}
+
+func Test_WriteBatchKept(t *testing.T) {
+	s, shutdown, err := mockDB()
+	require.NoError(t, err)
+	defer shutdown()
+
+	// emulate the batch failed to roll back, its log is kept
+	ops := []batchOp{
+		{kind: batchOpSet, key: []byte("a"), val: []byte("1")},
+		{kind: batchOpSet, key: []byte("b"), val: []byte("2")},
+	}
+	require.NoError(t, s.writeBatchLog(encodeBatch(ops)))
+	s.batchMu.Lock()
+	s.keptBatch = ops
+	s.batchMu.Unlock()
+
+	// the next batch applies the kept one before its log is overwritten
+	b := s.NewWriteBatch()
+	b.Set([]byte("c"), []byte("3"), 0)
+	require.NoError(t, b.Commit())
+	for k, val := range map[string]string{"a": "1", "b": "2", "c": "3"} {
+		v, err := s.Get([]byte(k))
+		require.NoError(t, err)
+		require.Equal(t, val, string(v))
+	}
+	require.Nil(t, s.keptBatch)
+	_, err = os.Stat(s.filePath(batchLogName))
+	require.True(t, os.IsNotExist(err))
+}
@@ -1,9 +1,11 @@
 package store
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
-	"slices"
-	"strings"
+	"sync"
+	"time"
 
 	"github.com/DenzelPenzel/nyx/internal/common"
 	"github.com/google/btree"
@@ -18,49 +20,375 @@ func (a Str) Less(b btree.Item) bool {
 }
 
 var (
-	GlobalBucketKeysStore = []byte("[all_bucket_keys]")
+	// bucketKeyPrefix ... the store key of a bucket key is the prefix, the name length, the name and the key,
+	// so the keys of the buckets never collide
+	bucketKeyPrefix = []byte("[bucket]")
 )
 
+// bucketBtreeDegree ... degree of the bucket index trees
+const bucketBtreeDegree = 32
+
 type BucketStore struct {
 	Name  string
-	Btree *btree.BTree
+	Btree *btree.BTree // ordered keys of the bucket, without the bucket prefix
+
+	mu      sync.RWMutex
+	entries map[Str]bucketEntry
+	ages    *btree.BTree // keys ordered by the write time, the oldest first
+	seq     uint64       // order of the writes within the same second
+	bytes   int64        // total size of the values
+	meta    bucketMeta
+
+	// the writes of the keys hold the read lock, drop, rename and the options change hold the write lock
+	writeMu sync.RWMutex
+	dropped bool       // the bucket was dropped or renamed, the writes through this handle fail
+	limitMu sync.Mutex // serializes the writes of the bucket with the limits
+}
+
+// bucketEntry ... indexed key of the bucket, the write time is kept in the flags of the record,
+// so the age of the key survives the reload
+type bucketEntry struct {
+	size    int64
+	written uint32
+	expire  uint32
+	seq     uint64
+}
+
+// ageItem ... key of the bucket ordered by its write time
+type ageItem struct {
+	written uint32
+	seq     uint64
+	key     Str
+}
+
+func (a ageItem) Less(b btree.Item) bool {
+	o := b.(ageItem)
+	if a.written != o.written {
+		return a.written < o.written
+	}
+	return a.seq < o.seq
+}
+
+func newBucketStore(name string) *BucketStore {
+	return &BucketStore{
+		Name:    name,
+		Btree:   btree.New(bucketBtreeDegree),
+		entries: make(map[Str]bucketEntry),
+		ages:    btree.New(bucketBtreeDegree),
+	}
 }
 
-func (bkt *BucketStore) Put(key []byte) {
+// put ... add the key to the index
+func (bkt *BucketStore) put(key []byte, e bucketEntry) {
+	bkt.mu.Lock()
+	defer bkt.mu.Unlock()
+	if old, ok := bkt.entries[Str(key)]; ok {
+		bkt.bytes -= old.size
+		bkt.ages.Delete(ageItem{written: old.written, seq: old.seq, key: Str(key)})
+	}
+	bkt.seq++
+	e.seq = bkt.seq
+	bkt.bytes += e.size
+	bkt.entries[Str(key)] = e
+	bkt.ages.ReplaceOrInsert(ageItem{written: e.written, seq: e.seq, key: Str(key)})
 	bkt.Btree.ReplaceOrInsert(Str(key))
 }
 
-// Bucket ... Create a new bucket in the memory index
-func (s *Store) Bucket(name string) (*BucketStore, error) {
-	val, err := s.Get(GlobalBucketKeysStore)
-	if errors.Is(err, common.ErrKeyNotFound) {
-		err = nil
+// remove ... drop the key from the index
+func (bkt *BucketStore) remove(key []byte) {
+	bkt.mu.Lock()
+	defer bkt.mu.Unlock()
+	old, ok := bkt.entries[Str(key)]
+	if !ok {
+		return
 	}
+	bkt.bytes -= old.size
+	delete(bkt.entries, Str(key))
+	bkt.ages.Delete(ageItem{written: old.written, seq: old.seq, key: Str(key)})
+	bkt.Btree.Delete(Str(key))
+}
+
+// Info ... number of the indexed keys and the total size of their values,
+// the keys expired or deleted past the bucket are counted until they are removed from the index
+func (bkt *BucketStore) Info() BucketInfo {
+	bkt.mu.RLock()
+	defer bkt.mu.RUnlock()
+	return BucketInfo{Name: bkt.Name, Keys: bkt.Btree.Len(), Bytes: bkt.bytes}
+}
+
+// keys ... up to n keys of the index from start to end, end excluded, n <= 0 for all of them.
+// A nil bound is open, the walk starts right after the key after if it's set
+func (bkt *BucketStore) keys(start, end, after []byte, reverse bool, n int) []Str {
+	bkt.mu.RLock()
+	defer bkt.mu.RUnlock()
+
+	var res []Str
+	iter := func(item btree.Item) bool {
+		k := item.(Str)
+		if reverse && start != nil && k < Str(start) {
+			return false
+		}
+		if !reverse && end != nil && k >= Str(end) {
+			return false
+		}
+		if (after != nil && k == Str(after)) || (reverse && end != nil && k >= Str(end)) {
+			return true
+		}
+		res = append(res, k)
+		return n <= 0 || len(res) < n
+	}
+
+	if reverse {
+		pivot := end
+		if after != nil && (pivot == nil || bytes.Compare(after, pivot) < 0) {
+			pivot = after
+		}
+		if pivot == nil {
+			bkt.Btree.Descend(iter)
+		} else {
+			bkt.Btree.DescendLessOrEqual(Str(pivot), iter)
+		}
+		return res
+	}
+
+	pivot := start
+	if after != nil && bytes.Compare(after, pivot) > 0 {
+		pivot = after
+	}
+	bkt.Btree.AscendGreaterOrEqual(Str(pivot), iter)
+	return res
+}
+
+// Key ... store key of the bucket key
+func (bkt *BucketStore) Key(k []byte) []byte {
+	return bucketKey(bkt.Name, k)
+}
+
+func bucketKey(name string, k []byte) []byte {
+	b := make([]byte, 0, len(bucketKeyPrefix)+binary.MaxVarintLen64+len(name)+len(k))
+	b = append(b, bucketKeyPrefix...)
+	b = binary.AppendUvarint(b, uint64(len(name)))
+	b = append(b, name...)
+	return append(b, k...)
+}
+
+// parseBucketKey ... bucket name and key of the store key, false for the key of no bucket
+func parseBucketKey(key []byte) (string, []byte, bool) {
+	if !bytes.HasPrefix(key, bucketKeyPrefix) {
+		return "", nil, false
+	}
+	b := key[len(bucketKeyPrefix):]
+	n, size := binary.Uvarint(b)
+	if size <= 0 || uint64(len(b)-size) < n {
+		return "", nil, false
+	}
+	b = b[size:]
+	return string(b[:n]), b[n:], true
+}
+
+// indexBuckets ... add the bucket keys and the bucket metadata found by the shard load to the bucket indexes,
+// the versions of the keys go to the versions index
+func (s *Store) indexBuckets(i int) {
+	keys := s.indexVersions(s.shards[i].PrefixedKeys())
+	if len(keys) == 0 {
+		return
+	}
+	s.bucketMu.Lock()
+	defer s.bucketMu.Unlock()
+	for _, key := range keys {
+		if name, ok := parseBucketMetaKey(key.Key); ok {
+			s.bucketNames[name] = true
+			continue
+		}
+		name, k, ok := parseBucketKey(key.Key)
+		if !ok {
+			continue
+		}
+		s.bucketIndex(name).put(k, bucketEntry{size: key.Size, written: key.Flags, expire: key.Expire})
+	}
+}
+
+// bucketIndex ... index of the bucket, created if it's missing, the caller holds bucketMu
+func (s *Store) bucketIndex(name string) *BucketStore {
+	bkt, ok := s.buckets[name]
+	if !ok {
+		bkt = newBucketStore(name)
+		s.buckets[name] = bkt
+	}
+	return bkt
+}
+
+// FindBucket ... the existing bucket, common.ErrKeyNotFound if there is no such bucket
+func (s *Store) FindBucket(name string) (*BucketStore, error) {
+	err := s.waitAll()
 	if err != nil {
 		return nil, err
 	}
-	keys := strings.Split(string(val), ",")
-	idx := slices.Index(keys, name)
+	s.bucketMu.Lock()
+	defer s.bucketMu.Unlock()
+	err = s.openBuckets()
+	if err != nil {
+		return nil, err
+	}
+	bkt, ok := s.buckets[name]
+	if !ok {
+		return nil, common.ErrKeyNotFound
+	}
+	return bkt, nil
+}
 
-	if idx == -1 {
-		keys = append(keys, name)
-		err := s.Set(GlobalBucketKeysStore, []byte(strings.Join(keys, ",")), 0)
-		if err != nil {
-			return nil, err
-		}
+// Bucket ... Create a new bucket or open the existing one,
+// the bucket index is rebuilt from the stored keys when the store is opened
+func (s *Store) Bucket(name string) (*BucketStore, error) {
+	// the index is complete once every shard is loaded
+	err := s.waitAll()
+	if err != nil {
+		return nil, err
+	}
+
+	s.bucketMu.Lock()
+	defer s.bucketMu.Unlock()
+	err = s.openBuckets()
+	if err != nil {
+		return nil, err
+	}
+	if bkt, ok := s.buckets[name]; ok {
+		return bkt, nil
 	}
 
-	return &BucketStore{Name: name, Btree: s.btree}, nil
+	bkt := newBucketStore(name)
+	bkt.meta = bucketMeta{Name: name, Created: time.Now().Unix()}
+	err = s.setBucketMeta(bkt.meta)
+	if err != nil {
+		return nil, err
+	}
+	s.buckets[name] = bkt
+	return bkt, nil
 }
 
+// Put ... store the key of the bucket and add it to the bucket index,
+// the key expires after the default TTL of the bucket
 func (s *Store) Put(bucket *BucketStore, k, val []byte) error {
-	key := []byte(bucket.Name)
-	key = append(key, k...)
-	err := s.Set(key, val, 0)
+	return s.PutWithExpire(bucket, k, val, 0)
+}
+
+// PutWithExpire ... same as Put, expire is an absolute unix time, 0 for the default TTL of the bucket.
+// The write over the limits of the bucket fails with common.ErrNoMem or evicts the oldest keys
+func (s *Store) PutWithExpire(bucket *BucketStore, k, val []byte, expire uint32) error {
+	bucket.writeMu.RLock()
+	defer bucket.writeMu.RUnlock()
+	if bucket.dropped {
+		return common.ErrKeyNotFound
+	}
+
+	now := uint32(time.Now().Unix())
+	if expire == 0 && bucket.meta.TTL > 0 {
+		expire = now + uint32(bucket.meta.TTL)
+	}
+	e := bucketEntry{size: int64(len(val)), written: now, expire: expire}
+	if bucket.meta.limited() {
+		bucket.limitMu.Lock()
+		defer bucket.limitMu.Unlock()
+		err := s.makeRoom(bucket, k, e.size)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the write time is kept in the flags
+	err := s.SetWithFlags(bucket.Key(k), val, expire, now)
 	if err != nil {
 		return err
 	}
 	// put key in index
-	bucket.Put(key)
+	bucket.put(k, e)
+	return nil
+}
+
+// BucketItem ... key of the bucket and its value
+type BucketItem struct {
+	Key   []byte
+	Value []byte
+}
+
+// RangeOpts ... Reverse walks the keys from the end to the start, Limit is the max number of items
+// of the page, 0 for no limit, Cursor is the last key of the previous page, the page starts right after it
+type RangeOpts struct {
+	Reverse bool
+	Limit   int
+	Cursor  []byte
+}
+
+// BucketGet ... value of the key of the bucket
+func (s *Store) BucketGet(bucket *BucketStore, k []byte) ([]byte, error) {
+	return s.Get(bucket.Key(k))
+}
+
+// BucketDelete ... delete the key of the bucket and drop it from the index
+func (s *Store) BucketDelete(bucket *BucketStore, k []byte) (bool, error) {
+	bucket.writeMu.RLock()
+	defer bucket.writeMu.RUnlock()
+	if bucket.dropped {
+		return false, common.ErrKeyNotFound
+	}
+	deleted, err := s.Delete(bucket.Key(k))
+	if err == nil || errors.Is(err, common.ErrKeyNotFound) {
+		// the index may keep the key expired or deleted past the bucket
+		bucket.remove(k)
+	}
+	return deleted, err
+}
+
+// BucketRange ... items of the bucket keys from start to end in order, end excluded, a nil bound is open.
+// Returns the cursor of the next page, nil for the last page. The keys without a value,
+// expired or deleted past the bucket, are skipped
+func (s *Store) BucketRange(bucket *BucketStore, start, end []byte, opts RangeOpts) ([]BucketItem, []byte, error) {
+	var items []BucketItem
+	after := opts.Cursor
+	for {
+		n := 0
+		if opts.Limit > 0 {
+			n = opts.Limit - len(items)
+		}
+		keys := bucket.keys(start, end, after, opts.Reverse, n)
+		for _, k := range keys {
+			v, err := s.Get(bucket.Key([]byte(k)))
+			if isMissing(err) {
+				continue
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, BucketItem{Key: []byte(k), Value: v})
+		}
+		if n <= 0 || len(keys) < n {
+			return items, nil, nil
+		}
+		after = []byte(keys[len(keys)-1])
+		if len(items) == opts.Limit {
+			break
+		}
+	}
+	// no cursor if the page ends the range
+	if len(bucket.keys(start, end, after, opts.Reverse, 1)) == 0 {
+		return items, nil, nil
+	}
+	return items, after, nil
+}
+
+// BucketPrefix ... items of the bucket keys with the prefix, see BucketRange
+func (s *Store) BucketPrefix(bucket *BucketStore, p []byte, opts RangeOpts) ([]BucketItem, []byte, error) {
+	return s.BucketRange(bucket, p, prefixEnd(p), opts)
+}
+
+// prefixEnd ... the smallest key after all the keys with the prefix, nil if there is no such key
+func prefixEnd(p []byte) []byte {
+	end := bytes.Clone(p)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
 	return nil
 }
@@ -0,0 +1,453 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/DenzelPenzel/nyx/internal/common"
+	"github.com/DenzelPenzel/nyx/internal/logging"
+	"go.uber.org/zap"
+)
+
+var (
+	// GlobalBucketKeysStore ... comma-joined bucket names of the stores made before the bucket metadata,
+	// the list is converted to the metadata on the first use of the buckets
+	GlobalBucketKeysStore = []byte("[all_bucket_keys]")
+
+	// bucketMetaPrefix ... the store key of the bucket metadata is the prefix and the bucket name
+	bucketMetaPrefix = []byte("[bucket_meta]")
+)
+
+// bucketDropBatch ... keys of the dropped bucket deleted at once
+const bucketDropBatch = 1000
+
+// bucketMeta ... metadata of the bucket, stored as JSON, the bucket exists as long as its metadata does
+type bucketMeta struct {
+	Name     string         `json:"name"`
+	Created  int64          `json:"created"`             // unix time
+	TTL      int64          `json:"ttl,omitempty"`       // default ttl of the keys in seconds
+	MaxKeys  int            `json:"max_keys,omitempty"`  // 0 - no limit
+	MaxBytes int64          `json:"max_bytes,omitempty"` // 0 - no limit
+	Overflow OverflowPolicy `json:"overflow,omitempty"`
+	From     string         `json:"from,omitempty"` // bucket being renamed to this one, the rename is resumed on open
+}
+
+// BucketInfo ... name of the bucket, number of its keys and the total size of their values
+type BucketInfo struct {
+	Name  string
+	Keys  int
+	Bytes int64
+}
+
+// IsBucketKey ... the store key holds a key of a bucket or the bucket metadata
+func IsBucketKey(key []byte) bool {
+	return bytes.HasPrefix(key, bucketKeyPrefix) || bytes.HasPrefix(key, bucketMetaPrefix) ||
+		bytes.Equal(key, GlobalBucketKeysStore)
+}
+
+func bucketMetaKey(name string) []byte {
+	return append(bytes.Clone(bucketMetaPrefix), name...)
+}
+
+// parseBucketMetaKey ... bucket name of the metadata key, false for any other key
+func parseBucketMetaKey(key []byte) (string, bool) {
+	if !bytes.HasPrefix(key, bucketMetaPrefix) {
+		return "", false
+	}
+	return string(key[len(bucketMetaPrefix):]), true
+}
+
+func (s *Store) setBucketMeta(meta bucketMeta) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return s.Set(bucketMetaKey(meta.Name), b, 0)
+}
+
+// MigrateLegacyBuckets ... move the keys of the buckets of the old stores to the buckets on the first use
+// of the buckets, see migrateLegacyKeys. Default false - the keys of the old stores stay plain keys
+// read under their old names, the old bucket list is kept for the migration
+func MigrateLegacyBuckets(migrate bool) OptStore {
+	return func(s *Store) error {
+		s.migrateLegacy = migrate
+		return nil
+	}
+}
+
+// openBuckets ... read the bucket metadata on the first use of the buckets, the store is loaded by then.
+// With MigrateLegacyBuckets the bucket list of the old stores is converted to the metadata and their keys
+// are migrated, the list is deleted once the migration is complete, so an interrupted one resumes. The keys
+// of a bucket without the metadata are left by an interrupted drop, they are deleted. The caller holds bucketMu
+func (s *Store) openBuckets() error {
+	if s.bucketsOpen {
+		return nil
+	}
+
+	legacy, err := s.Get(GlobalBucketKeysStore)
+	if err != nil && !errors.Is(err, common.ErrKeyNotFound) {
+		return err
+	}
+	if err == nil && !s.migrateLegacy {
+		logging.NoContext().Warn("Keys of the old buckets are kept as plain keys, enable the migration to move them",
+			zap.String("dir", s.dir), zap.String("buckets", string(legacy)))
+	}
+	if err == nil && s.migrateLegacy {
+		var names []string
+		for _, name := range strings.Split(string(legacy), ",") {
+			if name == "" {
+				continue
+			}
+			names = append(names, name)
+			if s.bucketNames[name] {
+				continue
+			}
+			err = s.setBucketMeta(bucketMeta{Name: name, Created: time.Now().Unix()})
+			if err != nil {
+				return err
+			}
+			s.bucketNames[name] = true
+		}
+		err = s.migrateLegacyKeys(names)
+		if err != nil {
+			return err
+		}
+		_, err = s.Delete(GlobalBucketKeysStore)
+		if err != nil {
+			return err
+		}
+	}
+
+	for name := range s.bucketNames {
+		b, err := s.Get(bucketMetaKey(name))
+		if errors.Is(err, common.ErrKeyNotFound) {
+			delete(s.bucketNames, name)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var meta bucketMeta
+		err = json.Unmarshal(b, &meta)
+		if err != nil {
+			return fmt.Errorf("bucket %q metadata: %w", name, err)
+		}
+		s.bucketIndex(name).meta = meta
+	}
+
+	// the renames interrupted by a crash, both buckets have the metadata until the rename is complete
+	var renamed []*BucketStore
+	for name := range s.bucketNames {
+		if s.buckets[name].meta.From != "" {
+			renamed = append(renamed, s.buckets[name])
+		}
+	}
+	for _, dst := range renamed {
+		err = s.finishRename(s.bucketIndex(dst.meta.From), dst)
+		if err != nil {
+			return err
+		}
+		delete(s.bucketNames, dst.meta.From)
+	}
+
+	for name, bkt := range s.buckets {
+		if s.bucketNames[name] {
+			continue
+		}
+		err = s.dropKeys(bkt)
+		if err != nil {
+			return err
+		}
+		delete(s.buckets, name)
+	}
+
+	s.bucketNames = nil
+	s.bucketsOpen = true
+	return nil
+}
+
+// migrateLegacyKeys ... move the keys of the old stores kept as the bucket name followed by the key
+// to their buckets, the keys keep their expire time and flags. The old format can't tell a bucket key
+// from a plain key starting with a bucket name, so every plain key starting with exactly one
+// of the names is moved, that's why the migration runs only if it's enabled. The key starting with several names is ambiguous, it's left as a plain key
+// and reported, it's still read by Get. Every key is moved with its removal in the same batch
+func (s *Store) migrateLegacyKeys(names []string) error {
+	b := s.NewWriteBatch()
+	var moved []func()
+	commit := func() error {
+		err := b.Commit()
+		if err != nil {
+			return err
+		}
+		for _, index := range moved {
+			index()
+		}
+		b.Reset()
+		moved = moved[:0]
+		return nil
+	}
+
+	var ambiguous int
+	for cursor := uint64(0); ; {
+		keys, next, err := s.Scan(cursor, "", bucketDropBatch)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if IsInternalKey(key) {
+				continue
+			}
+			var name string
+			matched := 0
+			for _, n := range names {
+				if len(key) > len(n) && bytes.HasPrefix(key, []byte(n)) {
+					name = n
+					matched++
+				}
+			}
+			if matched > 1 {
+				ambiguous++
+			}
+			if matched != 1 {
+				continue
+			}
+
+			v, header, err := s.GetWithHeader(key)
+			if isMissing(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			k := key[len(name):]
+			b.SetWithFlags(bucketKey(name, k), v, header.Expire(), header.Flags())
+			b.Delete(key)
+			entry := bucketEntry{size: int64(len(v)), written: header.Flags(), expire: header.Expire()}
+			moved = append(moved, func() {
+				s.bucketIndex(name).put(k, entry)
+			})
+			if b.Len() >= bucketDropBatch {
+				err = commit()
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	err := commit()
+	if err != nil {
+		return err
+	}
+	if ambiguous > 0 {
+		logging.NoContext().Warn("Legacy bucket keys left as plain keys, they start with several bucket names",
+			zap.String("dir", s.dir), zap.Int("keys", ambiguous))
+	}
+	return nil
+}
+
+// Buckets ... all the buckets ordered by name with the number of their keys and the size of the values
+func (s *Store) Buckets() ([]BucketInfo, error) {
+	err := s.waitAll()
+	if err != nil {
+		return nil, err
+	}
+	s.bucketMu.Lock()
+	defer s.bucketMu.Unlock()
+	err = s.openBuckets()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]BucketInfo, 0, len(s.buckets))
+	for _, bkt := range s.buckets {
+		res = append(res, bkt.Info())
+	}
+	slices.SortFunc(res, func(a, b BucketInfo) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return res, nil
+}
+
+// DropBucket ... delete the bucket with all its keys, common.ErrKeyNotFound if there is no such bucket.
+// The bucket is gone once its metadata is deleted, the keys left by an interrupted drop
+// are deleted on the next open. The writes through the handles of the bucket fail
+func (s *Store) DropBucket(name string) error {
+	err := s.waitAll()
+	if err != nil {
+		return err
+	}
+	s.bucketMu.Lock()
+	defer s.bucketMu.Unlock()
+	err = s.openBuckets()
+	if err != nil {
+		return err
+	}
+	bkt, ok := s.buckets[name]
+	if !ok {
+		return common.ErrKeyNotFound
+	}
+
+	bkt.writeMu.Lock()
+	defer bkt.writeMu.Unlock()
+	_, err = s.Delete(bucketMetaKey(name))
+	if err != nil {
+		return err
+	}
+	bkt.dropped = true
+	delete(s.buckets, name)
+	return s.dropKeys(bkt)
+}
+
+// dropKeys ... delete the indexed keys of the bucket in batches
+func (s *Store) dropKeys(bkt *BucketStore) error {
+	b := s.NewWriteBatch()
+	for _, k := range bkt.keys(nil, nil, nil, false, 0) {
+		b.Delete(bkt.Key([]byte(k)))
+		if b.Len() < bucketDropBatch {
+			continue
+		}
+		err := b.Commit()
+		if err != nil {
+			return err
+		}
+		b.Reset()
+	}
+	return b.Commit()
+}
+
+// RenameBucket ... move the bucket with all its keys to the new name, the keys keep
+// their expire time and flags. Fails with common.ErrKeyExists if the new name is taken.
+// The keys are moved in batches, each key with its removal, so the reads meanwhile find a key
+// under either name. The rename is recorded in the metadata of the new bucket first,
+// an interrupted one is completed by the next open.
+// Returns the renamed bucket, the writes through the handles of the old one fail
+func (s *Store) RenameBucket(from, to string) (*BucketStore, error) {
+	err := s.waitAll()
+	if err != nil {
+		return nil, err
+	}
+	s.bucketMu.Lock()
+	defer s.bucketMu.Unlock()
+	err = s.openBuckets()
+	if err != nil {
+		return nil, err
+	}
+	src, ok := s.buckets[from]
+	if !ok {
+		return nil, common.ErrKeyNotFound
+	}
+	if _, ok := s.buckets[to]; ok {
+		return nil, common.ErrKeyExists
+	}
+
+	src.writeMu.Lock()
+	defer src.writeMu.Unlock()
+	dst := newBucketStore(to)
+	dst.meta = src.meta
+	dst.meta.Name = to
+	dst.meta.From = from
+	err = s.setBucketMeta(dst.meta)
+	if err != nil {
+		return nil, err
+	}
+	s.buckets[to] = dst
+	err = s.finishRename(src, dst)
+	if err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
+
+// finishRename ... move the keys left in the source bucket and replace its metadata with the one
+// of the destination, the caller holds bucketMu and the source is closed for the writes
+func (s *Store) finishRename(src, dst *BucketStore) error {
+	type movedKey struct {
+		key   Str
+		entry bucketEntry
+	}
+	b := s.NewWriteBatch()
+	var moved []movedKey
+	commit := func() error {
+		err := b.Commit()
+		if err != nil {
+			return err
+		}
+		for _, m := range moved {
+			src.remove([]byte(m.key))
+			dst.put([]byte(m.key), m.entry)
+		}
+		b.Reset()
+		moved = moved[:0]
+		return nil
+	}
+
+	for _, k := range src.keys(nil, nil, nil, false, 0) {
+		v, header, err := s.GetWithHeader(src.Key([]byte(k)))
+		if isMissing(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		b.SetWithFlags(dst.Key([]byte(k)), v, header.Expire(), header.Flags())
+		b.Delete(src.Key([]byte(k)))
+		moved = append(moved, movedKey{key: k, entry: bucketEntry{size: int64(len(v)), written: header.Flags(), expire: header.Expire()}})
+		if b.Len() >= bucketDropBatch {
+			err = commit()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	meta := dst.meta
+	meta.From = ""
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	b.Set(bucketMetaKey(dst.meta.Name), data, 0)
+	b.Delete(bucketMetaKey(dst.meta.From))
+	err = commit()
+	if err != nil {
+		return err
+	}
+	src.dropped = true
+	delete(s.buckets, dst.meta.From)
+	dst.meta = meta
+	return nil
+}
+
+// indexBucketOps ... apply the bucket keys of the replayed batch to the bucket indexes
+func (s *Store) indexBucketOps(ops []batchOp) {
+	s.bucketMu.Lock()
+	defer s.bucketMu.Unlock()
+	for _, op := range ops {
+		if name, ok := parseBucketMetaKey(op.key); ok {
+			if op.kind == batchOpSet {
+				s.bucketNames[name] = true
+			} else {
+				delete(s.bucketNames, name)
+			}
+			continue
+		}
+		name, k, ok := parseBucketKey(op.key)
+		if !ok {
+			continue
+		}
+		if op.kind == batchOpSet {
+			s.bucketIndex(name).put(k, bucketEntry{size: int64(len(op.val)), written: op.flags, expire: op.expire})
+		} else {
+			s.bucketIndex(name).remove(k)
+		}
+	}
+}
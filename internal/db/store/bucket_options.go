@@ -0,0 +1,155 @@
+package store
+
+import (
+	"errors"
+	"time"
+
+	"github.com/DenzelPenzel/nyx/internal/common"
+	"github.com/google/btree"
+)
+
+// OverflowPolicy ... what happens to the write over the limits of the bucket
+type OverflowPolicy string
+
+const (
+	// OverflowReject ... the write fails with common.ErrNoMem
+	OverflowReject OverflowPolicy = "reject"
+	// OverflowEvict ... the oldest keys of the bucket are deleted to make room for the write
+	OverflowEvict OverflowPolicy = "evict"
+)
+
+// BucketOptions ... TTL is the default ttl of the keys written without the expire time, 0 - no ttl.
+// MaxKeys and MaxBytes limit the number of the keys and the total size of their values, 0 - no limit.
+// Overflow is applied to the writes over the limits, OverflowReject by default
+type BucketOptions struct {
+	TTL      time.Duration
+	MaxKeys  int
+	MaxBytes int64
+	Overflow OverflowPolicy
+}
+
+func (m bucketMeta) limited() bool {
+	return m.MaxKeys > 0 || m.MaxBytes > 0
+}
+
+// Options ... current options of the bucket
+func (bkt *BucketStore) Options() BucketOptions {
+	bkt.writeMu.RLock()
+	defer bkt.writeMu.RUnlock()
+	return BucketOptions{
+		TTL:      time.Duration(bkt.meta.TTL) * time.Second,
+		MaxKeys:  bkt.meta.MaxKeys,
+		MaxBytes: bkt.meta.MaxBytes,
+		Overflow: bkt.meta.Overflow,
+	}
+}
+
+// SetBucketOptions ... store the options in the bucket metadata, they apply to the next writes.
+// The TTL is rounded to seconds. With OverflowEvict the oldest keys over the new limits are evicted right away
+func (s *Store) SetBucketOptions(bucket *BucketStore, opts BucketOptions) error {
+	if opts.TTL < 0 || opts.MaxKeys < 0 || opts.MaxBytes < 0 {
+		return errors.New("bucket options must not be negative")
+	}
+	switch opts.Overflow {
+	case "", OverflowReject, OverflowEvict:
+	default:
+		return errors.New("unknown bucket overflow policy")
+	}
+
+	bucket.writeMu.Lock()
+	defer bucket.writeMu.Unlock()
+	if bucket.dropped {
+		return common.ErrKeyNotFound
+	}
+	meta := bucket.meta
+	meta.TTL = int64(opts.TTL.Round(time.Second) / time.Second)
+	meta.MaxKeys = opts.MaxKeys
+	meta.MaxBytes = opts.MaxBytes
+	meta.Overflow = opts.Overflow
+	err := s.setBucketMeta(meta)
+	if err != nil {
+		return err
+	}
+	bucket.meta = meta
+
+	if meta.Overflow == OverflowEvict {
+		return s.makeRoom(bucket, nil, 0)
+	}
+	return nil
+}
+
+// makeRoom ... make the write of the key with the value of size bytes fit the limits of the bucket,
+// k nil checks the keys already written. The expired keys are dropped from the index first,
+// then the oldest keys are evicted or the write is rejected with common.ErrNoMem
+func (s *Store) makeRoom(bkt *BucketStore, k []byte, size int64) error {
+	if bkt.meta.MaxBytes > 0 && size > bkt.meta.MaxBytes {
+		return common.ErrNoMem
+	}
+	if bkt.fits(k, size) {
+		return nil
+	}
+	bkt.dropExpired(uint32(time.Now().Unix()))
+	for !bkt.fits(k, size) {
+		if bkt.meta.Overflow != OverflowEvict {
+			return common.ErrNoMem
+		}
+		oldest, ok := bkt.oldest(k)
+		if !ok {
+			return common.ErrNoMem
+		}
+		_, err := s.Delete(bkt.Key(oldest))
+		if err != nil {
+			return err
+		}
+		bkt.remove(oldest)
+	}
+	return nil
+}
+
+// fits ... the keys of the bucket fit the limits after the write of the key, k nil for no write
+func (bkt *BucketStore) fits(k []byte, size int64) bool {
+	bkt.mu.RLock()
+	defer bkt.mu.RUnlock()
+	keys, bytes := len(bkt.entries), bkt.bytes
+	if k != nil {
+		if old, ok := bkt.entries[Str(k)]; ok {
+			bytes -= old.size
+		} else {
+			keys++
+		}
+		bytes += size
+	}
+	return (bkt.meta.MaxKeys == 0 || keys <= bkt.meta.MaxKeys) &&
+		(bkt.meta.MaxBytes == 0 || bytes <= bkt.meta.MaxBytes)
+}
+
+// oldest ... the key written first except the skipped one
+func (bkt *BucketStore) oldest(skip []byte) ([]byte, bool) {
+	bkt.mu.RLock()
+	defer bkt.mu.RUnlock()
+	var res []byte
+	found := false
+	bkt.ages.Ascend(func(item btree.Item) bool {
+		if skip != nil && item.(ageItem).key == Str(skip) {
+			return true
+		}
+		res, found = []byte(item.(ageItem).key), true
+		return false
+	})
+	return res, found
+}
+
+// dropExpired ... remove the expired keys from the index, the shards delete the records themselves
+func (bkt *BucketStore) dropExpired(now uint32) {
+	bkt.mu.RLock()
+	var expired []Str
+	for k, e := range bkt.entries {
+		if e.expire != 0 && e.expire < now {
+			expired = append(expired, k)
+		}
+	}
+	bkt.mu.RUnlock()
+	for _, k := range expired {
+		bkt.remove([]byte(k))
+	}
+}
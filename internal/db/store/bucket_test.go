@@ -1,9 +1,15 @@
 package store
 
 import (
+	"bytes"
 	"os"
+	"slices"
+	"strconv"
 	"testing"
+	"time"
 
+	"github.com/DenzelPenzel/nyx/internal/common"
+	"github.com/google/btree"
 	"github.com/stretchr/testify/require"
 )
 
@@ -43,17 +49,17 @@ func Test_SingleBucketStore(t *testing.T) {
 			execute: true,
 		},
 		{
-			key:      []byte(bucketName + "001"),
+			key:      []byte("001"),
 			expected: `elon`,
 			execute:  false,
 		},
 		{
-			key:      []byte(bucketName + "002"),
+			key:      []byte("002"),
 			expected: `xi`,
 			execute:  false,
 		},
 		{
-			key:      []byte(bucketName + "003"),
+			key:      []byte("003"),
 			expected: `frank`,
 			execute:  false,
 		},
@@ -64,7 +70,7 @@ func Test_SingleBucketStore(t *testing.T) {
 			err := s.Put(b, ts.key, ts.val)
 			require.NoError(t, err)
 		} else {
-			v, err := s.Get(ts.key)
+			v, err := s.Get(b.Key(ts.key))
 			require.NoError(t, err)
 			require.Equal(t, ts.expected, string(v))
 		}
@@ -93,11 +99,428 @@ func Test_MultiBucketStore(t *testing.T) {
 	err = s.Put(b2, []byte("001"), []byte("alex"))
 	require.NoError(t, err)
 
-	v, err := s.Get([]byte(bucketName1 + "001"))
+	v, err := s.Get(b1.Key([]byte("001")))
 	require.NoError(t, err)
 	require.Equal(t, "elon", string(v))
 
-	v, err = s.Get([]byte(bucketName2 + "001"))
+	v, err = s.Get(b2.Key([]byte("001")))
 	require.NoError(t, err)
 	require.Equal(t, "alex", string(v))
 }
+
+func Test_BucketIndex(t *testing.T) {
+	err := os.RemoveAll(bucketDirName)
+	defer os.RemoveAll(bucketDirName)
+	require.NoError(t, err)
+
+	opts := []OptStore{Dir(bucketDirName), ShardsCollision(1), ShardsTotal(8)}
+	s, err := Open(opts...)
+	require.NoError(t, err)
+
+	// the same concatenation of the bucket name and the key
+	a, err := s.Bucket("a")
+	require.NoError(t, err)
+	ab, err := s.Bucket("ab")
+	require.NoError(t, err)
+	require.NoError(t, s.Put(a, []byte("bc"), []byte("1")))
+	require.NoError(t, s.Put(ab, []byte("c"), []byte("2")))
+	for i := 9; i >= 0; i-- {
+		require.NoError(t, s.Put(a, []byte("k"+strconv.Itoa(i)), []byte(strconv.Itoa(i))))
+	}
+
+	check := func() {
+		a, err := s.Bucket("a")
+		require.NoError(t, err)
+		ab, err := s.Bucket("ab")
+		require.NoError(t, err)
+
+		v, err := s.Get(a.Key([]byte("bc")))
+		require.NoError(t, err)
+		require.Equal(t, "1", string(v))
+		v, err = s.Get(ab.Key([]byte("c")))
+		require.NoError(t, err)
+		require.Equal(t, "2", string(v))
+
+		var keys []string
+		a.Btree.Ascend(func(item btree.Item) bool {
+			keys = append(keys, string(item.(Str)))
+			return true
+		})
+		require.Equal(t, []string{"bc", "k0", "k1", "k2", "k3", "k4", "k5", "k6", "k7", "k8", "k9"}, keys)
+		require.Equal(t, 1, ab.Btree.Len())
+	}
+	check()
+
+	require.NoError(t, s.Close())
+	s, err = Open(opts...)
+	require.NoError(t, err)
+	defer s.Close()
+	check()
+}
+
+func Test_BucketRange(t *testing.T) {
+	err := os.RemoveAll(bucketDirName)
+	defer os.RemoveAll(bucketDirName)
+	require.NoError(t, err)
+
+	s, err := Open(Dir(bucketDirName), ShardsCollision(1), ShardsTotal(4))
+	require.NoError(t, err)
+	defer s.Close()
+
+	b, err := s.Bucket("orders")
+	require.NoError(t, err)
+	for _, k := range []string{"u1:003", "u1:001", "u2:001", "u1:002", "u1:004", "u3:001"} {
+		require.NoError(t, s.Put(b, []byte(k), []byte("v"+k)))
+	}
+	keys := func(items []BucketItem) []string {
+		var res []string
+		for _, item := range items {
+			require.Equal(t, "v"+string(item.Key), string(item.Value))
+			res = append(res, string(item.Key))
+		}
+		return res
+	}
+
+	t.Run("get and delete", func(t *testing.T) {
+		v, err := s.BucketGet(b, []byte("u1:001"))
+		require.NoError(t, err)
+		require.Equal(t, "vu1:001", string(v))
+
+		deleted, err := s.BucketDelete(b, []byte("u3:001"))
+		require.NoError(t, err)
+		require.True(t, deleted)
+		_, err = s.BucketGet(b, []byte("u3:001"))
+		require.ErrorIs(t, err, common.ErrKeyNotFound)
+		deleted, err = s.BucketDelete(b, []byte("u3:001"))
+		require.NoError(t, err)
+		require.False(t, deleted)
+		require.Equal(t, 5, b.Btree.Len())
+	})
+
+	t.Run("range", func(t *testing.T) {
+		items, cursor, err := s.BucketRange(b, []byte("u1:002"), []byte("u2:001"), RangeOpts{})
+		require.NoError(t, err)
+		require.Nil(t, cursor)
+		require.Equal(t, []string{"u1:002", "u1:003", "u1:004"}, keys(items))
+
+		items, _, err = s.BucketRange(b, nil, nil, RangeOpts{Reverse: true})
+		require.NoError(t, err)
+		require.Equal(t, []string{"u2:001", "u1:004", "u1:003", "u1:002", "u1:001"}, keys(items))
+
+		items, _, err = s.BucketRange(b, []byte("u1:002"), []byte("u2:001"), RangeOpts{Reverse: true})
+		require.NoError(t, err)
+		require.Equal(t, []string{"u1:004", "u1:003", "u1:002"}, keys(items))
+	})
+
+	t.Run("prefix", func(t *testing.T) {
+		items, _, err := s.BucketPrefix(b, []byte("u1:"), RangeOpts{})
+		require.NoError(t, err)
+		require.Equal(t, []string{"u1:001", "u1:002", "u1:003", "u1:004"}, keys(items))
+
+		items, _, err = s.BucketPrefix(b, []byte("u2"), RangeOpts{Reverse: true})
+		require.NoError(t, err)
+		require.Equal(t, []string{"u2:001"}, keys(items))
+	})
+
+	t.Run("pages", func(t *testing.T) {
+		for _, reverse := range []bool{false, true} {
+			var all []string
+			var cursor []byte
+			pages := 0
+			for {
+				var items []BucketItem
+				items, cursor, err = s.BucketPrefix(b, []byte("u1:"), RangeOpts{Reverse: reverse, Limit: 3, Cursor: cursor})
+				require.NoError(t, err)
+				all = append(all, keys(items)...)
+				pages++
+				if cursor == nil {
+					break
+				}
+			}
+			require.Equal(t, 2, pages)
+			expected := []string{"u1:001", "u1:002", "u1:003", "u1:004"}
+			if reverse {
+				slices.Reverse(expected)
+			}
+			require.Equal(t, expected, all)
+		}
+
+		// the page ending the range has no cursor
+		items, cursor, err := s.BucketPrefix(b, []byte("u1:"), RangeOpts{Limit: 4})
+		require.NoError(t, err)
+		require.Len(t, items, 4)
+		require.Nil(t, cursor)
+	})
+
+	t.Run("skip missing values", func(t *testing.T) {
+		// deleted past the bucket, the index still has the key
+		_, err := s.Delete(b.Key([]byte("u1:002")))
+		require.NoError(t, err)
+		items, cursor, err := s.BucketPrefix(b, []byte("u1:"), RangeOpts{Limit: 2})
+		require.NoError(t, err)
+		require.Equal(t, []string{"u1:001", "u1:003"}, keys(items))
+		require.Equal(t, "u1:003", string(cursor))
+
+		// expired, the index still has the key
+		require.NoError(t, s.Set(b.Key([]byte("u1:003")), []byte("vu1:003"), uint32(time.Now().Unix()-10)))
+		items, _, err = s.BucketPrefix(b, []byte("u1:"), RangeOpts{})
+		require.NoError(t, err)
+		require.Equal(t, []string{"u1:001", "u1:004"}, keys(items))
+	})
+}
+
+func Test_BucketLifecycle(t *testing.T) {
+	err := os.RemoveAll(bucketDirName)
+	defer os.RemoveAll(bucketDirName)
+	require.NoError(t, err)
+
+	opts := []OptStore{Dir(bucketDirName), ShardsCollision(1), ShardsTotal(4)}
+	s, err := Open(opts...)
+	require.NoError(t, err)
+
+	// the bucket list and the keys of the old stores, the orphan keys are left by an interrupted drop
+	require.NoError(t, s.Set(GlobalBucketKeysStore, []byte(",legacy,a,ab"), 0))
+	require.NoError(t, s.SetWithFlags([]byte("legacyk"), []byte("123"), 0, 7))
+	require.NoError(t, s.Set([]byte("abc"), []byte("1"), 0))
+	require.NoError(t, s.Set(bucketKey("orphan", []byte("k")), []byte("1"), 0))
+	require.NoError(t, s.Close())
+
+	// the keys of the old stores stay plain keys until the migration is enabled
+	s, err = Open(opts...)
+	require.NoError(t, err)
+	buckets, err := s.Buckets()
+	require.NoError(t, err)
+	require.Empty(t, buckets)
+	v, err := s.Get([]byte("legacyk"))
+	require.NoError(t, err)
+	require.Equal(t, "123", string(v))
+	_, err = s.Get(GlobalBucketKeysStore)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	s, err = Open(append(opts, MigrateLegacyBuckets(true))...)
+	require.NoError(t, err)
+
+	users, err := s.Bucket("users,admins")
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, s.Put(users, []byte("u"+strconv.Itoa(i)), []byte("value")))
+	}
+	_, err = s.Bucket("empty")
+	require.NoError(t, err)
+
+	buckets, err = s.Buckets()
+	require.NoError(t, err)
+	require.Equal(t, []BucketInfo{
+		{Name: "a"},
+		{Name: "ab"},
+		{Name: "empty"},
+		{Name: "legacy", Keys: 1, Bytes: 3},
+		{Name: "users,admins", Keys: 10, Bytes: 50},
+	}, buckets)
+	legacy, err := s.FindBucket("legacy")
+	require.NoError(t, err)
+	v, header, err := s.GetWithHeader(legacy.Key([]byte("k")))
+	require.NoError(t, err)
+	require.Equal(t, "123", string(v))
+	require.Equal(t, uint32(7), header.Flags())
+	_, err = s.Get([]byte("legacyk"))
+	require.ErrorIs(t, err, common.ErrKeyNotFound)
+	// the key of either "a" or "ab" stays where it was
+	v, err = s.Get([]byte("abc"))
+	require.NoError(t, err)
+	require.Equal(t, "1", string(v))
+	_, err = s.Get(bucketKey("orphan", []byte("k")))
+	require.ErrorIs(t, err, common.ErrKeyNotFound)
+	_, err = s.Get(GlobalBucketKeysStore)
+	require.ErrorIs(t, err, common.ErrKeyNotFound)
+
+	t.Run("rename", func(t *testing.T) {
+		_, err := s.RenameBucket("users,admins", "legacy")
+		require.ErrorIs(t, err, common.ErrKeyExists)
+		_, err = s.RenameBucket("none", "other")
+		require.ErrorIs(t, err, common.ErrKeyNotFound)
+
+		renamed, err := s.RenameBucket("users,admins", "users")
+		require.NoError(t, err)
+		require.Equal(t, BucketInfo{Name: "users", Keys: 10, Bytes: 50}, renamed.Info())
+		v, err := s.BucketGet(renamed, []byte("u3"))
+		require.NoError(t, err)
+		require.Equal(t, "value", string(v))
+		_, err = s.Get(users.Key([]byte("u3")))
+		require.ErrorIs(t, err, common.ErrKeyNotFound)
+
+		// the old handle is closed
+		require.ErrorIs(t, s.Put(users, []byte("x"), []byte("1")), common.ErrKeyNotFound)
+		_, err = s.FindBucket("users,admins")
+		require.ErrorIs(t, err, common.ErrKeyNotFound)
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		require.NoError(t, s.DropBucket("legacy"))
+		require.ErrorIs(t, s.DropBucket("legacy"), common.ErrKeyNotFound)
+		_, err := s.Get(bucketKey("legacy", []byte("k")))
+		require.ErrorIs(t, err, common.ErrKeyNotFound)
+	})
+
+	require.NoError(t, s.Close())
+	s, err = Open(opts...)
+	require.NoError(t, err)
+	defer s.Close()
+	buckets, err = s.Buckets()
+	require.NoError(t, err)
+	require.Equal(t, []BucketInfo{
+		{Name: "a"},
+		{Name: "ab"},
+		{Name: "empty"},
+		{Name: "users", Keys: 10, Bytes: 50},
+	}, buckets)
+}
+
+func Test_BucketOptions(t *testing.T) {
+	err := os.RemoveAll(bucketDirName)
+	defer os.RemoveAll(bucketDirName)
+	require.NoError(t, err)
+
+	opts := []OptStore{Dir(bucketDirName), ShardsCollision(1), ShardsTotal(4)}
+	s, err := Open(opts...)
+	require.NoError(t, err)
+
+	has := func(b *BucketStore, keys ...string) {
+		items, _, err := s.BucketRange(b, nil, nil, RangeOpts{})
+		require.NoError(t, err)
+		var res []string
+		for _, item := range items {
+			res = append(res, string(item.Key))
+		}
+		require.Equal(t, keys, res)
+	}
+
+	t.Run("default ttl", func(t *testing.T) {
+		b, err := s.Bucket("sessions")
+		require.NoError(t, err)
+		require.NoError(t, s.SetBucketOptions(b, BucketOptions{TTL: time.Hour}))
+
+		now := uint32(time.Now().Unix())
+		require.NoError(t, s.Put(b, []byte("a"), []byte("1")))
+		require.NoError(t, s.PutWithExpire(b, []byte("b"), []byte("2"), now+10))
+		_, header, err := s.GetWithHeader(b.Key([]byte("a")))
+		require.NoError(t, err)
+		require.InDelta(t, now+3600, header.Expire(), 2)
+		_, header, err = s.GetWithHeader(b.Key([]byte("b")))
+		require.NoError(t, err)
+		require.Equal(t, now+10, header.Expire())
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		b, err := s.Bucket("reject")
+		require.NoError(t, err)
+		require.NoError(t, s.SetBucketOptions(b, BucketOptions{MaxKeys: 3, MaxBytes: 10}))
+		require.Error(t, s.SetBucketOptions(b, BucketOptions{Overflow: "drop"}))
+
+		require.ErrorIs(t, s.Put(b, []byte("big"), bytes.Repeat([]byte("v"), 11)), common.ErrNoMem)
+		for _, k := range []string{"a", "b", "c"} {
+			require.NoError(t, s.Put(b, []byte(k), []byte("12")))
+		}
+		require.ErrorIs(t, s.Put(b, []byte("d"), []byte("1")), common.ErrNoMem)
+		// the overwrite keeps the number of the keys
+		require.NoError(t, s.Put(b, []byte("a"), []byte("123456")))
+		require.ErrorIs(t, s.Put(b, []byte("b"), []byte("12345")), common.ErrNoMem)
+		has(b, "a", "b", "c")
+
+		// the expired keys don't count
+		past := uint32(time.Now().Unix() - 10)
+		require.NoError(t, s.PutWithExpire(b, []byte("c"), []byte("1"), past))
+		require.NoError(t, s.Put(b, []byte("d"), []byte("1")))
+		has(b, "a", "b", "d")
+	})
+
+	t.Run("evict", func(t *testing.T) {
+		b, err := s.Bucket("evict")
+		require.NoError(t, err)
+		require.NoError(t, s.SetBucketOptions(b, BucketOptions{MaxKeys: 3, Overflow: OverflowEvict}))
+		for i := 0; i < 5; i++ {
+			require.NoError(t, s.Put(b, []byte("k"+strconv.Itoa(i)), []byte("v")))
+		}
+		has(b, "k2", "k3", "k4")
+
+		// the rewritten key is the newest one
+		require.NoError(t, s.Put(b, []byte("k2"), []byte("v")))
+		require.NoError(t, s.Put(b, []byte("k5"), []byte("v")))
+		has(b, "k2", "k4", "k5")
+		_, err = s.Get(b.Key([]byte("k3")))
+		require.ErrorIs(t, err, common.ErrKeyNotFound)
+
+		// the lower limit evicts right away
+		require.NoError(t, s.SetBucketOptions(b, BucketOptions{MaxKeys: 1, Overflow: OverflowEvict}))
+		has(b, "k5")
+	})
+
+	require.NoError(t, s.Close())
+	s, err = Open(opts...)
+	require.NoError(t, err)
+	defer s.Close()
+
+	b, err := s.FindBucket("evict")
+	require.NoError(t, err)
+	require.Equal(t, BucketOptions{MaxKeys: 1, Overflow: OverflowEvict}, b.Options())
+	require.NoError(t, s.Put(b, []byte("k6"), []byte("v")))
+	has(b, "k6")
+	b, err = s.FindBucket("sessions")
+	require.NoError(t, err)
+	require.Equal(t, time.Hour, b.Options().TTL)
+}
+
+func Test_BucketRenameResume(t *testing.T) {
+	err := os.RemoveAll(bucketDirName)
+	defer os.RemoveAll(bucketDirName)
+	require.NoError(t, err)
+
+	opts := []OptStore{Dir(bucketDirName), ShardsCollision(1), ShardsTotal(4)}
+	s, err := Open(opts...)
+	require.NoError(t, err)
+
+	n := 2*bucketDropBatch + 10
+	src, err := s.Bucket("src")
+	require.NoError(t, err)
+	for i := 0; i < n; i++ {
+		require.NoError(t, s.Put(src, []byte("k"+strconv.Itoa(i)), []byte("v")))
+	}
+
+	// the crash after the first keys were moved
+	meta := src.meta
+	meta.Name, meta.From = "dst", "src"
+	require.NoError(t, s.setBucketMeta(meta))
+	for i := 0; i < 10; i++ {
+		k := []byte("k" + strconv.Itoa(i))
+		require.NoError(t, s.Set(bucketKey("dst", k), []byte("v"), 0))
+		_, err = s.Delete(src.Key(k))
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.Close())
+
+	s, err = Open(opts...)
+	require.NoError(t, err)
+	defer s.Close()
+	buckets, err := s.Buckets()
+	require.NoError(t, err)
+	require.Equal(t, []BucketInfo{{Name: "dst", Keys: n, Bytes: int64(n)}}, buckets)
+	dst, err := s.FindBucket("dst")
+	require.NoError(t, err)
+	require.Empty(t, dst.meta.From)
+	for i := 0; i < n; i++ {
+		v, err := s.BucketGet(dst, []byte("k"+strconv.Itoa(i)))
+		require.NoError(t, err)
+		require.Equal(t, "v", string(v))
+	}
+
+	// expired, the index still has the key
+	require.NoError(t, s.Put(dst, []byte("expired"), []byte("v")))
+	require.NoError(t, s.Set(dst.Key([]byte("expired")), []byte("v"), uint32(time.Now().Unix()-10)))
+
+	renamed, err := s.RenameBucket("dst", "final")
+	require.NoError(t, err)
+	require.Equal(t, BucketInfo{Name: "final", Keys: n, Bytes: int64(n)}, renamed.Info())
+	_, err = s.Get(bucketMetaKey("dst"))
+	require.ErrorIs(t, err, common.ErrKeyNotFound)
+}
@@ -0,0 +1,259 @@
+package store
+
+import (
+	"errors"
+	"io"
+
+	"github.com/DenzelPenzel/nyx/internal/common"
+	"github.com/DenzelPenzel/nyx/internal/db/store/shard"
+	"github.com/spaolacci/murmur3"
+)
+
+// SetStream ... store the value of the given size read from r.
+// The large value is written chunk by chunk, so it's never fully buffered in memory.
+// The previous value of the key stays visible until all the chunks are written
+func (s *Store) SetStream(key []byte, r io.Reader, size int64, expire, flags uint32) error {
+	return s.versioned(func() error {
+		return s.setStream(key, r, size, expire, flags)
+	}, key)
+}
+
+func (s *Store) setStream(key []byte, r io.Reader, size int64, expire, flags uint32) error {
+	if size < 0 {
+		return common.ErrInvalidArgs
+	}
+	if s.maxValueSize > 0 && size > s.maxValueSize {
+		return common.ErrValueTooBig
+	}
+
+	h := murmur3.Sum32WithSeed(key, 0)
+	sh, err := s.ownerShard(key, h)
+	if err != nil {
+		return err
+	}
+
+	payload := int64(sh.ChunkPayload(key))
+	if payload == 0 || size <= payload {
+		val := make([]byte, size)
+		_, err = io.ReadFull(r, val)
+		if err != nil {
+			return err
+		}
+		return s.SetWithFlags(key, val, expire, flags)
+	}
+
+	m := &shard.Manifest{Size: uint64(size)}
+	buf := make([]byte, payload)
+	for left := size; left > 0; {
+		n := min(payload, left)
+		_, err = io.ReadFull(r, buf[:n])
+		if err != nil {
+			sh.ReleaseChunks(m.Chunks)
+			return err
+		}
+		ref, err := sh.WriteChunk(key, buf[:n])
+		if err != nil {
+			sh.ReleaseChunks(m.Chunks)
+			return err
+		}
+		m.Chunks = append(m.Chunks, ref)
+		left -= n
+	}
+
+	err = sh.SetChunked(key, h, m, expire, flags)
+	if err != nil {
+		sh.ReleaseChunks(m.Chunks)
+	}
+	return err
+}
+
+// ownerShard ... shard where the key is stored or would be stored by Set
+func (s *Store) ownerShard(key []byte, h uint32) (*shard.Shard, error) {
+	err := s.waitKey(h)
+	if err != nil {
+		return nil, err
+	}
+	sh := &s.shards[s.idx(h)]
+	ok, err := sh.Owns(key, h)
+	if err != nil || ok {
+		return sh, err
+	}
+	for i := 0; i < s.shardColCnt; i++ {
+		ok, err = s.shards[i].Owns(key, h)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return &s.shards[i], nil
+		}
+	}
+	return nil, common.ErrCollision
+}
+
+// GetReader ... open the value of the key for reading, the reader must be closed.
+// The chunks of the large value are read one by one while the reader is consumed,
+// they are pinned until the reader is closed, so the value replaced or removed meanwhile is still read whole
+func (s *Store) GetReader(key []byte) (*ValueReader, error) {
+	h := murmur3.Sum32WithSeed(key, 0)
+	err := s.waitKey(h)
+	if err != nil {
+		return nil, err
+	}
+	sh := &s.shards[s.idx(h)]
+	v, m, header, err := sh.GetChunked(key, h)
+	// handle collision issue
+	if errors.Is(err, common.ErrCollision) {
+		for i := 0; i < s.shardColCnt; i++ {
+			sh = &s.shards[i]
+			v, m, header, err = sh.GetChunked(key, h)
+			if errors.Is(err, common.ErrCollision) || errors.Is(err, common.ErrKeyNotFound) {
+				continue
+			}
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newValueReader(sh, key, v, m, header), nil
+}
+
+// GetReaders ... open the values of the keys for reading at the same moment: only the shards
+// of the keys are locked meanwhile, so any write of the keys, the batch too, is seen either for all of them
+// or for none. The reader of a missing key is nil, the others must be closed. The chunks of a large value
+// are pinned under the locks and streamed after the locks are released, as by GetReader
+func (s *Store) GetReaders(keys ...[]byte) ([]*ValueReader, error) {
+	hashes := make([]uint32, len(keys))
+	for i, key := range keys {
+		hashes[i] = murmur3.Sum32WithSeed(key, 0)
+	}
+	err := s.waitKey(hashes...)
+	if err != nil {
+		return nil, err
+	}
+	ls := s.lockShards(hashes...)
+	res := make([]*ValueReader, len(keys))
+	for i, key := range keys {
+		res[i], err = s.readerLocked(ls, key, hashes[i])
+		if isMissing(err) {
+			continue
+		}
+		if err != nil {
+			ls.unlock()
+			for _, r := range res {
+				if r != nil {
+					r.Close()
+				}
+			}
+			return nil, err
+		}
+	}
+	ls.unlock()
+	return res, nil
+}
+
+// readerLocked ... same as GetReader, the shard of the key is locked
+func (s *Store) readerLocked(ls *shardLocks, key []byte, h uint32) (*ValueReader, error) {
+	sh := &s.shards[s.idx(h)]
+	v, m, header, err := sh.GetChunkedLocked(key, h)
+	// handle collision issue
+	if errors.Is(err, common.ErrCollision) {
+		ls.lockCollision()
+		for i := 0; i < s.shardColCnt; i++ {
+			sh = &s.shards[i]
+			v, m, header, err = sh.GetChunkedLocked(key, h)
+			if errors.Is(err, common.ErrCollision) || errors.Is(err, common.ErrKeyNotFound) {
+				continue
+			}
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newValueReader(sh, key, v, m, header), nil
+}
+
+func newValueReader(sh *shard.Shard, key []byte, v []byte, m *shard.Manifest, header *shard.Header) *ValueReader {
+	r := &ValueReader{header: header, data: v, size: int64(len(v))}
+	if m != nil {
+		r.sh, r.key, r.pinned = sh, key, m.Chunks
+		r.chunks, r.size, r.left = m.Chunks, int64(m.Size), int64(m.Size)
+	}
+	return r
+}
+
+// ValueReader ... reader of the stored value
+type ValueReader struct {
+	header *shard.Header
+	size   int64
+	data   []byte
+
+	// chunked value
+	sh     *shard.Shard
+	key    []byte
+	pinned []shard.ChunkRef // all the chunks of the value, unpinned by Close
+	chunks []shard.ChunkRef
+	left   int64
+	closed bool
+}
+
+// Size ... full size of the value
+func (r *ValueReader) Size() int64 {
+	return r.size
+}
+
+// Header ... record header with the expire time and flags
+func (r *ValueReader) Header() *shard.Header {
+	return r.header
+}
+
+// Chunked ... the value is stored in chunks and is read lazily
+func (r *ValueReader) Chunked() bool {
+	return r.sh != nil
+}
+
+// Bytes ... the whole value, for the chunked value all the chunks are read at once
+func (r *ValueReader) Bytes() ([]byte, error) {
+	if !r.Chunked() {
+		return r.data, nil
+	}
+	return io.ReadAll(r)
+}
+
+func (r *ValueReader) Read(p []byte) (int, error) {
+	if r.closed {
+		return 0, shard.ErrChunkReleased
+	}
+	for len(r.data) == 0 {
+		if r.left <= 0 {
+			return 0, io.EOF
+		}
+		if len(r.chunks) == 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		chunk, err := r.sh.ReadChunk(r.key, r.chunks[0])
+		if err != nil {
+			return 0, err
+		}
+		r.chunks = r.chunks[1:]
+		if int64(len(chunk)) > r.left {
+			chunk = chunk[:r.left]
+		}
+		r.data = chunk
+		r.left -= int64(len(chunk))
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// Close ... unpin the chunks of the value, the chunks released by the value meanwhile can be reused from now on
+func (r *ValueReader) Close() error {
+	if r.Chunked() && !r.closed {
+		r.closed = true
+		r.data = nil
+		r.sh.UnpinChunks(r.pinned)
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+package store
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/DenzelPenzel/nyx/internal/common"
+	"github.com/DenzelPenzel/nyx/internal/db/store/shard"
+	"github.com/stretchr/testify/require"
+)
+
+func randomValue(n int) []byte {
+	v := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(v)
+	return v
+}
+
+func Test_ChunkedValue(t *testing.T) {
+	os.RemoveAll(dirName)
+	defer os.RemoveAll(dirName)
+
+	s, err := Open(Dir(dirName), ChunkSize(4<<10))
+	require.NoError(t, err)
+
+	key := []byte("big")
+	val := randomValue(50 << 10)
+
+	t.Run("set and get", func(t *testing.T) {
+		require.NoError(t, s.SetWithFlags(key, val, 0, 7))
+		res, header, err := s.GetWithHeader(key)
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(val, res))
+		require.True(t, header.Chunked())
+		require.Equal(t, uint32(7), header.Flags())
+		require.Equal(t, 1, s.Count())
+	})
+
+	t.Run("append and prepend", func(t *testing.T) {
+		require.NoError(t, s.Append(key, []byte("tail")))
+		require.NoError(t, s.Prepend(key, []byte("head")))
+		val = append(append([]byte("head"), val...), "tail"...)
+
+		res, header, err := s.GetWithHeader(key)
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(val, res))
+		require.Equal(t, uint32(7), header.Flags())
+	})
+
+	t.Run("small value reuses the chunks space", func(t *testing.T) {
+		// the first switch may take a new slot, the record is written before the old one is released
+		require.NoError(t, s.Set(key, []byte("small"), 0))
+		require.NoError(t, s.Set(key, val, 0))
+		size, err := s.FileSize()
+		require.NoError(t, err)
+
+		require.NoError(t, s.Set(key, []byte("small"), 0))
+		require.NoError(t, s.Set(key, val, 0))
+
+		after, err := s.FileSize()
+		require.NoError(t, err)
+		require.Equal(t, size, after)
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		require.NoError(t, s.Close())
+		s, err = Open(Dir(dirName), ChunkSize(4<<10))
+		require.NoError(t, err)
+
+		res, err := s.Get(key)
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(val, res))
+		require.Equal(t, 1, s.Count())
+	})
+
+	t.Run("delete releases the chunks", func(t *testing.T) {
+		size, err := s.FileSize()
+		require.NoError(t, err)
+
+		deleted, err := s.Delete(key)
+		require.NoError(t, err)
+		require.True(t, deleted)
+		_, err = s.Get(key)
+		require.ErrorIs(t, err, common.ErrKeyNotFound)
+
+		// the chunks are reused, only the manifest of the new key is appended
+		require.NoError(t, s.Set(key, val, 0))
+		after, err := s.FileSize()
+		require.NoError(t, err)
+		require.Less(t, after-size, int64(4<<10))
+	})
+
+	require.NoError(t, s.Close())
+}
+
+func Test_MaxValueSize(t *testing.T) {
+	os.RemoveAll(dirName)
+	defer os.RemoveAll(dirName)
+
+	s, err := Open(Dir(dirName), ChunkSize(4<<10), MaxValueSize(10<<10))
+	require.NoError(t, err)
+	defer s.Close()
+
+	key := []byte("key")
+	require.ErrorIs(t, s.Set(key, randomValue(10<<10+1), 0), common.ErrValueTooBig)
+	require.ErrorIs(t, s.Add(key, randomValue(10<<10+1), 0, 0), common.ErrValueTooBig)
+	require.ErrorIs(t, s.SetStream(key, bytes.NewReader(randomValue(20<<10)), 20<<10, 0, 0), common.ErrValueTooBig)
+
+	require.NoError(t, s.Set(key, randomValue(10<<10), 0))
+	require.ErrorIs(t, s.Append(key, []byte("x")), common.ErrValueTooBig)
+	require.ErrorIs(t, s.Prepend(key, []byte("x")), common.ErrValueTooBig)
+
+	res, err := s.Get(key)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(randomValue(10<<10), res))
+}
+
+func Test_StreamValue(t *testing.T) {
+	os.RemoveAll(dirName)
+	defer os.RemoveAll(dirName)
+
+	s, err := Open(Dir(dirName), ChunkSize(4<<10))
+	require.NoError(t, err)
+	defer s.Close()
+
+	key := []byte("stream")
+	val := randomValue(100 << 10)
+
+	t.Run("round trip", func(t *testing.T) {
+		require.NoError(t, s.SetStream(key, bytes.NewReader(val), int64(len(val)), 0, 3))
+
+		r, err := s.GetReader(key)
+		require.NoError(t, err)
+		require.True(t, r.Chunked())
+		require.Equal(t, int64(len(val)), r.Size())
+		require.Equal(t, uint32(3), r.Header().Flags())
+
+		res, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(val, res))
+		require.NoError(t, r.Close())
+	})
+
+	t.Run("small value", func(t *testing.T) {
+		require.NoError(t, s.SetStream([]byte("small"), bytes.NewReader([]byte("abc")), 3, 0, 0))
+
+		r, err := s.GetReader([]byte("small"))
+		require.NoError(t, err)
+		require.False(t, r.Chunked())
+		res, err := r.Bytes()
+		require.NoError(t, err)
+		require.Equal(t, []byte("abc"), res)
+	})
+
+	t.Run("short stream keeps the old value", func(t *testing.T) {
+		err := s.SetStream(key, bytes.NewReader(val[:10<<10]), int64(len(val)), 0, 0)
+		require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+		res, err := s.Get(key)
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(val, res))
+	})
+
+	t.Run("several keys", func(t *testing.T) {
+		rs, err := s.GetReaders(key, []byte("missing"), []byte("small"))
+		require.NoError(t, err)
+		require.Len(t, rs, 3)
+		require.Nil(t, rs[1])
+
+		require.True(t, rs[0].Chunked())
+		res, err := io.ReadAll(rs[0])
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(val, res))
+		require.NoError(t, rs[0].Close())
+		res, err = rs[2].Bytes()
+		require.NoError(t, err)
+		require.Equal(t, []byte("abc"), res)
+	})
+
+	t.Run("several keys replaced while read", func(t *testing.T) {
+		other := randomValue(30 << 10)
+		require.NoError(t, s.SetStream([]byte("other"), bytes.NewReader(other), int64(len(other)), 0, 0))
+		rs, err := s.GetReaders(key, []byte("other"))
+		require.NoError(t, err)
+
+		// both readers keep the values seen by the get, the overwrite of the batch isn't mixed in
+		b := s.NewWriteBatch()
+		b.Set(key, randomValue(70<<10), 0)
+		b.Set([]byte("other"), randomValue(40<<10), 0)
+		require.NoError(t, b.Commit())
+
+		res, err := io.ReadAll(rs[0])
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(val, res))
+		res, err = io.ReadAll(rs[1])
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(other, res))
+		require.NoError(t, rs[0].Close())
+		require.NoError(t, rs[1].Close())
+		require.NoError(t, s.SetStream(key, bytes.NewReader(val), int64(len(val)), 0, 0))
+	})
+
+	t.Run("value replaced while read", func(t *testing.T) {
+		r, err := s.GetReader(key)
+		require.NoError(t, err)
+		head := make([]byte, 10)
+		_, err = io.ReadFull(r, head)
+		require.NoError(t, err)
+
+		// the pinned chunks keep the old value until the reader is closed
+		require.NoError(t, s.Set(key, []byte("new"), 0))
+		require.NoError(t, s.SetStream(key, bytes.NewReader(randomValue(60<<10)), 60<<10, 0, 0))
+		rest, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(val, append(head, rest...)))
+
+		require.NoError(t, r.Close())
+		_, err = r.Read(head)
+		require.ErrorIs(t, err, shard.ErrChunkReleased)
+	})
+}
+
+func Test_ChunksReused(t *testing.T) {
+	os.RemoveAll(dirName)
+	defer os.RemoveAll(dirName)
+
+	s, err := Open(Dir(dirName), ShardsTotal(1), ShardsCollision(0), ChunkSize(4<<10))
+	require.NoError(t, err)
+	defer s.Close()
+
+	key := []byte("key")
+	require.NoError(t, s.Set(key, bytes.Repeat([]byte("a"), 20<<10), 0))
+	r, err := s.GetReader(key)
+	require.NoError(t, err)
+	_, err = r.Read(make([]byte, 10))
+	require.NoError(t, err)
+
+	// the chunks pinned by the reader aren't reused, the new value takes new slots
+	_, err = s.Delete(key)
+	require.NoError(t, err)
+	size, err := s.FileSize()
+	require.NoError(t, err)
+	require.NoError(t, s.Set(key, bytes.Repeat([]byte("b"), 20<<10), 0))
+	grown, err := s.FileSize()
+	require.NoError(t, err)
+	require.Greater(t, grown, size)
+	v, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, bytes.Repeat([]byte("a"), 20<<10-10), v)
+
+	// the new value takes the manifest and the chunk slots released by the closed reader
+	require.NoError(t, r.Close())
+	_, err = s.Delete(key)
+	require.NoError(t, err)
+	require.NoError(t, s.Set(key, bytes.Repeat([]byte("c"), 20<<10), 0))
+	size, err = s.FileSize()
+	require.NoError(t, err)
+	require.Equal(t, grown, size)
+}
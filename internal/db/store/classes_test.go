@@ -0,0 +1,116 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_SlotGrowth(t *testing.T) {
+	os.RemoveAll(dirName)
+	defer os.RemoveAll(dirName)
+
+	fileSize := func(growth float64) int64 {
+		os.RemoveAll(dirName)
+		s, err := Open(Dir(dirName), ShardsTotal(4), ShardsCollision(1), SlotGrowth(growth))
+		require.NoError(t, err)
+		defer s.Close()
+		for i := 0; i < 1000; i++ {
+			// 16 bytes header, the key and the value take just over 512 bytes
+			require.NoError(t, s.Set([]byte("key"+strconv.Itoa(i)), bytes.Repeat([]byte("v"), 497), 0))
+		}
+		size, err := s.FileSize()
+		require.NoError(t, err)
+		return size
+	}
+	require.Less(t, fileSize(1.25), fileSize(2)*2/3)
+
+	_, err := Open(Dir(dirName), SlotGrowth(2.5))
+	require.Error(t, err)
+}
+
+func Test_ConvertShardV2(t *testing.T) {
+	os.RemoveAll(dirName)
+	defer os.RemoveAll(dirName)
+	require.NoError(t, os.MkdirAll(dirName, os.FileMode(0755)))
+
+	// v2 record: size, status, key len, val len, expire, flags | val | key | padding
+	k, v := []byte("key"), []byte("value")
+	rec := make([]byte, 32)
+	rec[0] = 5
+	binary.BigEndian.PutUint16(rec[2:4], uint16(len(k)))
+	binary.BigEndian.PutUint32(rec[4:8], uint32(len(v)))
+	binary.BigEndian.PutUint32(rec[12:16], 6)
+	copy(rec[16:], v)
+	copy(rec[16+len(v):], k)
+	data := append([]byte{255, 2}, rec...)
+	require.NoError(t, os.WriteFile(dirName+"/0", data, os.FileMode(0644)))
+
+	opts := []OptStore{Dir(dirName), ShardsCollision(0), ShardsTotal(1), ChunkSize(4 << 10)}
+	s, err := Open(opts...)
+	require.NoError(t, err)
+
+	// the v2 file is served as is with the power of two slots
+	res, header, err := s.GetWithHeader(k)
+	require.NoError(t, err)
+	require.Equal(t, v, res)
+	require.Equal(t, uint32(6), header.Flags())
+
+	big := randomValue(20 << 10)
+	require.NoError(t, s.Set([]byte("big"), big, 0))
+	for i := 0; i < 100; i++ {
+		require.NoError(t, s.Set([]byte("key"+strconv.Itoa(i)), bytes.Repeat([]byte("v"), i), 0))
+	}
+	for i := 0; i < 100; i++ {
+		require.NoError(t, s.Set([]byte("key"+strconv.Itoa(i)), bytes.Repeat([]byte("v"), i+100), 0))
+	}
+	// the slots freed by the moved records are reused
+	before, err := s.FileSize()
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, s.Set([]byte("key"+strconv.Itoa(i)), bytes.Repeat([]byte("v"), i), 0))
+	}
+	after, err := s.FileSize()
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+
+	check := func() {
+		res, err := s.Get(k)
+		require.NoError(t, err)
+		require.Equal(t, v, res)
+		res, err = s.Get([]byte("big"))
+		require.NoError(t, err)
+		require.Equal(t, big, res)
+		for i := 0; i < 100; i++ {
+			res, err = s.Get([]byte("key" + strconv.Itoa(i)))
+			require.NoError(t, err)
+			require.Equal(t, bytes.Repeat([]byte("v"), i), res)
+		}
+	}
+
+	err = s.compactShard(context.Background(), 0, Budget{}, time.Now(), new(int64))
+	require.NoError(t, err)
+	head := make([]byte, 3)
+	f, err := os.Open(dirName + "/0")
+	require.NoError(t, err)
+	_, err = f.Read(head)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.Equal(t, []byte{255, 3, 125}, head)
+	check()
+
+	require.NoError(t, s.Close())
+	s, err = Open(opts...)
+	require.NoError(t, err)
+	defer s.Close()
+	check()
+	res2, err := s.shards[0].Scrub(0, 1<<30, false)
+	require.NoError(t, err)
+	require.Empty(t, res2.Findings)
+}
@@ -0,0 +1,108 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/DenzelPenzel/nyx/internal/common"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Dedup(t *testing.T) {
+	os.RemoveAll(dirName)
+	defer os.RemoveAll(dirName)
+
+	opts := []OptStore{Dir(dirName), ShardsTotal(4), ShardsCollision(1), ChunkSize(4 << 10), DedupThreshold(256)}
+	s, err := Open(opts...)
+	require.NoError(t, err)
+
+	shared := bytes.Repeat([]byte("s"), 1000)
+	n := 100
+	for i := 0; i < n; i++ {
+		require.NoError(t, s.SetWithFlags([]byte("key"+strconv.Itoa(i)), shared, 0, 3))
+	}
+	// below the threshold and chunked values are stored as is
+	require.NoError(t, s.Set([]byte("small"), []byte("small"), 0))
+	big := randomValue(20 << 10)
+	require.NoError(t, s.Set([]byte("big"), big, 0))
+
+	st := s.Dedup()
+	require.Equal(t, n, st.Refs)
+	require.LessOrEqual(t, st.Blobs, 4)
+	require.Equal(t, int64(n*len(shared)), st.LogicalBytes)
+
+	t.Run("overwrite and delete", func(t *testing.T) {
+		v, header, err := s.GetWithHeader([]byte("key1"))
+		require.NoError(t, err)
+		require.Equal(t, shared, v)
+		require.Equal(t, uint32(3), header.Flags())
+
+		require.NoError(t, s.Set([]byte("key2"), []byte("own"), 0))
+		ok, err := s.Delete([]byte("key3"))
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.NoError(t, s.Append([]byte("key4"), []byte("+")))
+		require.NoError(t, s.Set([]byte("key5"), shared, 0))
+		require.Equal(t, n-2, s.Dedup().Refs)
+	})
+
+	check := func() {
+		for i := 0; i < n; i++ {
+			v, err := s.Get([]byte("key" + strconv.Itoa(i)))
+			switch i {
+			case 2:
+				require.Equal(t, []byte("own"), v)
+			case 3:
+				require.ErrorIs(t, err, common.ErrKeyNotFound)
+			case 4:
+				require.Equal(t, append(bytes.Clone(shared), '+'), v)
+			default:
+				require.NoError(t, err)
+				require.Equal(t, shared, v)
+			}
+		}
+		v, err := s.Get([]byte("big"))
+		require.NoError(t, err)
+		require.Equal(t, big, v)
+		require.Equal(t, n-2, s.Dedup().Refs)
+	}
+	check()
+
+	t.Run("reopen", func(t *testing.T) {
+		require.NoError(t, s.Close())
+		s, err = Open(opts...)
+		require.NoError(t, err)
+		check()
+	})
+
+	t.Run("compact", func(t *testing.T) {
+		for i := range s.shards {
+			err := s.compactShard(context.Background(), i, Budget{}, time.Now(), new(int64))
+			require.NoError(t, err)
+			res, err := s.shards[i].Scrub(0, 1<<30, false)
+			require.NoError(t, err)
+			require.Empty(t, res.Findings)
+		}
+		check()
+		require.NoError(t, s.Close())
+		s, err = Open(opts...)
+		require.NoError(t, err)
+		check()
+	})
+
+	t.Run("last reference", func(t *testing.T) {
+		for i := 0; i < n; i++ {
+			_, err := s.Delete([]byte("key" + strconv.Itoa(i)))
+			require.NoError(t, err)
+		}
+		st := s.Dedup()
+		require.Zero(t, st.Blobs)
+		require.Zero(t, st.Refs)
+	})
+
+	require.NoError(t, s.Close())
+}
@@ -0,0 +1,78 @@
+package store
+
+import (
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/DenzelPenzel/nyx/internal/common"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_InlineValues(t *testing.T) {
+	os.RemoveAll(dirName)
+	defer os.RemoveAll(dirName)
+
+	// a single open file, so any read of the file reopens a descriptor
+	opts := []OptStore{Dir(dirName), ShardsTotal(8), ShardsCollision(1), MaxOpenFiles(1), InlineMax(8)}
+	s, err := Open(opts...)
+	require.NoError(t, err)
+
+	n := 100
+	for i := 0; i < n; i++ {
+		_, err := s.Incr([]byte("counter"+strconv.Itoa(i)), uint64(i))
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.Set([]byte("large"), []byte("not inlined value"), 0))
+	require.NoError(t, s.Set([]byte("flag"), []byte("1"), 0))
+	require.NoError(t, s.Append([]byte("flag"), []byte("0")))
+	require.Equal(t, n+1, s.Inlined())
+
+	check := func() {
+		opens := s.FdStats().Opens
+		for i := 0; i < n; i++ {
+			v, err := s.Incr([]byte("counter"+strconv.Itoa(i)), 1)
+			require.NoError(t, err)
+			require.Equal(t, uint64(i+1), v)
+			_, err = s.Decr([]byte("counter"+strconv.Itoa(i)), 1)
+			require.NoError(t, err)
+		}
+		v, err := s.Get([]byte("flag"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("10"), v)
+		// the writes reopen the files, the reads are served from memory
+		require.Greater(t, s.FdStats().Opens, opens)
+
+		opens = s.FdStats().Opens
+		for i := 0; i < n; i++ {
+			_, err := s.Get([]byte("counter" + strconv.Itoa(i)))
+			require.NoError(t, err)
+		}
+		require.Equal(t, opens, s.FdStats().Opens)
+	}
+	check()
+
+	t.Run("reopen", func(t *testing.T) {
+		require.NoError(t, s.Close())
+		s, err = Open(opts...)
+		require.NoError(t, err)
+		require.Equal(t, n+1, s.Inlined())
+		check()
+	})
+
+	t.Run("outgrow and delete", func(t *testing.T) {
+		require.NoError(t, s.Append([]byte("flag"), []byte("0123456789")))
+		ok, err := s.Delete([]byte("counter0"))
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, n-1, s.Inlined())
+
+		v, err := s.Get([]byte("flag"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("100123456789"), v)
+		_, err = s.Get([]byte("counter0"))
+		require.ErrorIs(t, err, common.ErrKeyNotFound)
+	})
+
+	require.NoError(t, s.Close())
+}
@@ -0,0 +1,275 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/DenzelPenzel/nyx/internal/common"
+	"github.com/DenzelPenzel/nyx/internal/db/store/shard"
+	"github.com/DenzelPenzel/nyx/internal/logging"
+	"go.uber.org/zap"
+)
+
+// ErrStoreClosed ... the store was closed before the shard was loaded
+var ErrStoreClosed = errors.New("store is closed")
+
+// LoadStatus ... progress of the shards loading
+type LoadStatus struct {
+	Total    int
+	Loaded   int
+	Done     bool
+	Started  time.Time
+	Duration time.Duration // time spent on the load, the current one if it isn't done
+	Err      error
+}
+
+// loader ... background load of the shard files.
+// Every shard has its own ready channel, so a request waits only for the shards of its key.
+// The collision shards are loaded first as every key may need them
+type loader struct {
+	ready  []chan struct{} // closed once the shard is loaded or failed
+	opened []bool
+	errs   []error
+	stop   chan struct{}
+	closer sync.Once
+
+	mu     sync.Mutex
+	status LoadStatus
+	done   chan struct{} // closed once all the shards are ready
+}
+
+func newLoader(total int) *loader {
+	l := &loader{
+		ready:  make([]chan struct{}, total),
+		opened: make([]bool, total),
+		errs:   make([]error, total),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		status: LoadStatus{Total: total, Started: time.Now()},
+	}
+	for i := range l.ready {
+		l.ready[i] = make(chan struct{})
+	}
+	return l
+}
+
+// LoadWorkers ... number of the shards loaded in parallel, default 4
+func LoadWorkers(workers int) OptStore {
+	return func(s *Store) error {
+		if workers < 1 {
+			return errors.New("load workers must be at least 1")
+		}
+		s.loadWorkers = workers
+		return nil
+	}
+}
+
+// LoadInBackground ... Open returns right away and the shards are loaded in the background,
+// the requests wait for the shards of their keys. The load errors are returned by WaitLoad
+// and by the requests to the failed shards
+func LoadInBackground(background bool) OptStore {
+	return func(s *Store) error {
+		s.loadBackground = background
+		return nil
+	}
+}
+
+// LoadFailFast ... the requests for the shards which aren't loaded yet fail with ErrTempFailure
+// instead of waiting for the load
+func LoadFailFast(failFast bool) OptStore {
+	return func(s *Store) error {
+		s.loadFailFast = failFast
+		return nil
+	}
+}
+
+// loadShards ... open all the shard files, replay the interrupted batch and start the maintenance.
+// When the batch log is present no shard is served until the batch is replayed
+func (s *Store) loadShards() {
+	l := s.load
+	_, err := os.Stat(s.filePath(batchLogName))
+	replay := err == nil
+
+	queue := make(chan int, s.shardsCount)
+	for i := 0; i < s.shardsCount; i++ {
+		queue <- i
+	}
+	close(queue)
+
+	var wg sync.WaitGroup
+	for w := 0; w < s.loadWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				select {
+				case <-l.stop:
+					return
+				default:
+				}
+				opts := []shard.OptShard{shard.ChunkSize(s.chunkSize), shard.MaxValueSize(s.maxValueSize),
+					shard.FileCache(s.fds), shard.Dedup(s.dedupMin),
+					shard.InlineValues(s.inlineMax), shard.SlotGrowth(s.slotGrowth),
+					shard.KeyPrefix(bucketKeyPrefix, bucketMetaPrefix, versionKeyPrefix, versionPendingPrefix),
+					shard.Watch(snapshotWatch{s: s, shard: i})}
+				if s.coldDir != "" {
+					opts = append(opts, shard.ColdFile(s.pathIn(s.coldDir, strconv.Itoa(i))))
+				}
+				err := s.shards[i].Open(s.shardPath(i), opts...)
+				if err == nil {
+					s.indexBuckets(i)
+				}
+				l.loaded(i, err)
+				if err == nil && !replay {
+					close(l.ready[i])
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	err = l.failed()
+	if err == nil && replay {
+		err = s.recoverBatch()
+	}
+	if err == nil {
+		select {
+		case <-l.stop:
+			err = ErrStoreClosed
+		default:
+		}
+	}
+	for i := range l.ready {
+		select {
+		case <-l.ready[i]:
+		default:
+			if err != nil && l.errs[i] == nil {
+				l.errs[i] = err
+			}
+			close(l.ready[i])
+		}
+	}
+	if err == nil {
+		s.maint.start()
+	}
+	l.finish(err)
+}
+
+// loaded ... record the result of the shard open
+func (l *loader) loaded(i int, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.errs[i] = err
+	if err != nil {
+		if l.status.Err == nil {
+			l.status.Err = err
+		}
+		return
+	}
+	l.opened[i] = true
+	l.status.Loaded++
+}
+
+func (l *loader) failed() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.status.Err
+}
+
+func (l *loader) finish(err error) {
+	l.mu.Lock()
+	l.status.Done = true
+	l.status.Duration = time.Since(l.status.Started)
+	if l.status.Err == nil {
+		l.status.Err = err
+	}
+	st := l.status
+	l.mu.Unlock()
+	close(l.done)
+
+	logger := logging.NoContext()
+	if st.Err != nil {
+		logger.Error("Failed to load shards", zap.Int("loaded", st.Loaded),
+			zap.Int("total", st.Total), zap.Error(st.Err))
+		return
+	}
+	logger.Info("Shards loaded", zap.Int("total", st.Total), zap.Duration("duration", st.Duration))
+}
+
+// cancel ... stop loading the shards which aren't started yet
+func (l *loader) cancel() {
+	l.closer.Do(func() {
+		close(l.stop)
+	})
+}
+
+// LoadStatus ... progress of the shards loading
+func (s *Store) LoadStatus() LoadStatus {
+	s.load.mu.Lock()
+	defer s.load.mu.Unlock()
+	st := s.load.status
+	if !st.Done {
+		st.Duration = time.Since(st.Started)
+	}
+	return st
+}
+
+// WaitLoad ... wait until all the shards are loaded, returns the first load error
+func (s *Store) WaitLoad() error {
+	<-s.load.done
+	return s.LoadStatus().Err
+}
+
+// waitShard ... wait until the shard is loaded and can serve requests
+func (s *Store) waitShard(i int) error {
+	select {
+	case <-s.load.ready[i]:
+	default:
+		if s.loadFailFast {
+			return common.ErrTempFailure
+		}
+		<-s.load.ready[i]
+	}
+	return s.load.errs[i]
+}
+
+// waitKey ... wait for the main shards of the hashes and the collision shards
+func (s *Store) waitKey(hashes ...uint32) error {
+	for i := 0; i < s.shardColCnt; i++ {
+		err := s.waitShard(i)
+		if err != nil {
+			return err
+		}
+	}
+	for _, h := range hashes {
+		err := s.waitShard(int(s.idx(h)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitAll ... wait for all the shards
+func (s *Store) waitAll() error {
+	for i := range s.shards {
+		err := s.waitShard(i)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shardReady ... the shard is loaded, doesn't wait
+func (s *Store) shardReady(i int) bool {
+	select {
+	case <-s.load.ready[i]:
+		return s.load.errs[i] == nil
+	default:
+		return false
+	}
+}
@@ -0,0 +1,157 @@
+package store
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/DenzelPenzel/nyx/internal/common"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_BackgroundLoad(t *testing.T) {
+	os.RemoveAll(dirName)
+	defer os.RemoveAll(dirName)
+
+	opts := []OptStore{Dir(dirName), ShardsTotal(16), ShardsCollision(1)}
+	s, err := Open(opts...)
+	require.NoError(t, err)
+	n := 1000
+	for i := 0; i < n; i++ {
+		require.NoError(t, s.Set([]byte("key"+strconv.Itoa(i)), []byte("value"), 0))
+	}
+	require.NoError(t, s.Close())
+
+	t.Run("requests wait for the shards", func(t *testing.T) {
+		s, err := Open(append(opts, LoadInBackground(true), LoadWorkers(1))...)
+		require.NoError(t, err)
+		defer s.Close()
+
+		for i := 0; i < n; i++ {
+			v, err := s.Get([]byte("key" + strconv.Itoa(i)))
+			require.NoError(t, err)
+			require.Equal(t, []byte("value"), v)
+		}
+		require.NoError(t, s.WaitLoad())
+		status := s.LoadStatus()
+		require.True(t, status.Done)
+		require.Equal(t, 16, status.Total)
+		require.Equal(t, 16, status.Loaded)
+		require.Equal(t, n, s.Count())
+	})
+
+	t.Run("failed shard", func(t *testing.T) {
+		name := s.shardPath(5)
+		require.NoError(t, os.WriteFile(name, []byte{255, 200}, 0644))
+
+		s, err := Open(append(opts, LoadInBackground(true))...)
+		require.NoError(t, err)
+		defer s.Close()
+
+		require.Error(t, s.WaitLoad())
+		require.Equal(t, 15, s.LoadStatus().Loaded)
+		require.Error(t, s.waitShard(5))
+		require.NoError(t, s.waitShard(6))
+
+		_, err = Open(opts...)
+		require.Error(t, err)
+	})
+
+	t.Run("fail fast", func(t *testing.T) {
+		s := &Store{shardsCount: 2, loadFailFast: true, load: newLoader(2)}
+		require.ErrorIs(t, s.waitShard(1), common.ErrTempFailure)
+		close(s.load.ready[1])
+		require.NoError(t, s.waitShard(1))
+	})
+
+	t.Run("multi get fails fast", func(t *testing.T) {
+		s := &Store{shardsCount: 2, loadFailFast: true, load: newLoader(2)}
+		_, err := s.GetReaders([]byte("a"), []byte("b"), []byte("c"))
+		require.ErrorIs(t, err, common.ErrTempFailure)
+	})
+}
+
+func Test_MaxOpenFiles(t *testing.T) {
+	os.RemoveAll(dirName)
+	defer os.RemoveAll(dirName)
+
+	opts := []OptStore{Dir(dirName), ShardsTotal(1024), MaxOpenFiles(16), ChunkSize(4 << 10)}
+	s, err := Open(opts...)
+	require.NoError(t, err)
+
+	n := 5000
+	big := randomValue(20 << 10)
+	for i := 0; i < n; i++ {
+		require.NoError(t, s.Set([]byte("key"+strconv.Itoa(i)), []byte("value"+strconv.Itoa(i)), 0))
+	}
+	require.NoError(t, s.Set([]byte("big"), big, 0))
+	for i := 0; i < n; i += 2 {
+		_, err = s.Delete([]byte("key" + strconv.Itoa(i)))
+		require.NoError(t, err)
+	}
+
+	check := func() {
+		require.Equal(t, n/2+1, s.Count())
+		for i := 1; i < n; i += 2 {
+			v, err := s.Get([]byte("key" + strconv.Itoa(i)))
+			require.NoError(t, err)
+			require.Equal(t, []byte("value"+strconv.Itoa(i)), v)
+		}
+		v, err := s.Get([]byte("big"))
+		require.NoError(t, err)
+		require.Equal(t, big, v)
+
+		stats := s.FdStats()
+		require.LessOrEqual(t, stats.Open, 16)
+		require.Equal(t, 16, stats.Limit)
+		require.Positive(t, stats.Evictions)
+	}
+	check()
+
+	require.NoError(t, s.RunJob(JobCompact))
+	require.NoError(t, s.RunJob(JobFsync))
+	require.NoError(t, s.Close())
+
+	s, err = Open(opts...)
+	require.NoError(t, err)
+	defer s.Close()
+	check()
+}
+
+func Test_MaxOpenFilesConcurrent(t *testing.T) {
+	os.RemoveAll(dirName)
+	defer os.RemoveAll(dirName)
+
+	s, err := Open(Dir(dirName), ShardsTotal(64), MaxOpenFiles(4))
+	require.NoError(t, err)
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				key := []byte("key" + strconv.Itoa(g) + "-" + strconv.Itoa(i))
+				val := []byte("value" + strconv.Itoa(i))
+				if err := s.Set(key, val, 0); err != nil {
+					panic(err)
+				}
+				v, err := s.Get(key)
+				if err != nil {
+					panic(err)
+				}
+				if !bytes.Equal(v, val) {
+					panic("unexpected value of " + string(key))
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	stats := s.FdStats()
+	require.LessOrEqual(t, stats.Open, 4)
+	require.Positive(t, stats.Evictions)
+}
@@ -0,0 +1,121 @@
+package store
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/DenzelPenzel/nyx/internal/common"
+	"github.com/DenzelPenzel/nyx/internal/db/store/shard"
+)
+
+// shardLocks ... set of shard locks held by a multi-key operation.
+// To avoid deadlocks the locks are always taken in the same order:
+// the main shards in ascending order, then all the collision shards at once
+type shardLocks struct {
+	s         *Store
+	held      []int
+	collision bool
+}
+
+// lockShards ... lock the main shards for the given hashes
+func (s *Store) lockShards(hashes ...uint32) *shardLocks {
+	idxs := make([]int, 0, len(hashes))
+	for _, h := range hashes {
+		idxs = append(idxs, int(s.idx(h)))
+	}
+	slices.Sort(idxs)
+	idxs = slices.Compact(idxs)
+
+	ls := &shardLocks{s: s, held: make([]int, 0, len(idxs)+s.shardColCnt)}
+	for _, i := range idxs {
+		s.shards[i].Lock()
+		ls.held = append(ls.held, i)
+	}
+	return ls
+}
+
+// lockAll ... lock all the shards, the writes holding any of them are finished first
+func (s *Store) lockAll() *shardLocks {
+	ls := &shardLocks{s: s, held: make([]int, 0, len(s.shards))}
+	for i := s.shardColCnt; i < len(s.shards); i++ {
+		s.shards[i].Lock()
+		ls.held = append(ls.held, i)
+	}
+	ls.lockCollision()
+	return ls
+}
+
+// lockCollision ... lock all the collision shards, must be called after all the main shards are locked
+func (ls *shardLocks) lockCollision() {
+	if ls.collision {
+		return
+	}
+	ls.collision = true
+	for i := 0; i < ls.s.shardColCnt; i++ {
+		ls.s.shards[i].Lock()
+		ls.held = append(ls.held, i)
+	}
+}
+
+func (ls *shardLocks) unlock() {
+	for i := len(ls.held) - 1; i >= 0; i-- {
+		ls.s.shards[ls.held[i]].Unlock()
+	}
+	ls.held = ls.held[:0]
+	ls.collision = false
+}
+
+// shardsHeld ... indexes of the locked shards
+func (ls *shardLocks) shardsHeld() []int {
+	return ls.held
+}
+
+func (s *Store) setLocked(ls *shardLocks, key, val []byte, h, expire, flags uint32) error {
+	err := s.shards[s.idx(h)].SetLocked(key, val, h, expire, flags)
+	// handle collision issue
+	if errors.Is(err, common.ErrCollision) {
+		ls.lockCollision()
+		for i := 0; i < s.shardColCnt; i++ {
+			err = s.shards[i].SetLocked(key, val, h, expire, flags)
+			if errors.Is(err, common.ErrCollision) {
+				continue
+			}
+			break
+		}
+	}
+	return err
+}
+
+func (s *Store) getLocked(ls *shardLocks, key []byte, h uint32) ([]byte, *shard.Header, error) {
+	v, header, err := s.shards[s.idx(h)].GetLocked(key, h)
+	// handle collision issue
+	if errors.Is(err, common.ErrCollision) {
+		ls.lockCollision()
+		for i := 0; i < s.shardColCnt; i++ {
+			v, header, err = s.shards[i].GetLocked(key, h)
+			if errors.Is(err, common.ErrCollision) || errors.Is(err, common.ErrKeyNotFound) {
+				continue
+			}
+			break
+		}
+	}
+	return v, header, err
+}
+
+func (s *Store) deleteLocked(ls *shardLocks, key []byte, h uint32) (bool, error) {
+	isDeleted, err := s.shards[s.idx(h)].DeleteLocked(key, h)
+	if errors.Is(err, common.ErrCollision) {
+		ls.lockCollision()
+		for i := 0; i < s.shardColCnt; i++ {
+			isDeleted, err = s.shards[i].DeleteLocked(key, h)
+			if errors.Is(err, common.ErrCollision) || errors.Is(err, common.ErrKeyNotFound) {
+				continue
+			}
+			if isDeleted {
+				err = nil
+			}
+			break
+		}
+	}
+	return isDeleted, err
+}
@@ -0,0 +1,323 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// compactStep ... bytes of the records copied by a single compaction step under the shard lock
+const compactStep = 1 << 20
+
+// Names of the maintenance jobs
+const (
+	JobExpire  = "expire"
+	JobFsync   = "fsync"
+	JobCompact = "compact"
+	JobScrub   = "scrub"
+	JobTier    = "tier"
+)
+
+// Budget ... limits of a single run of the maintenance job, zero - no limit
+type Budget struct {
+	Time time.Duration // duration of the run
+	IO   int64         // bytes read or written by the run
+	CPU  float64       // share of a core kept busy by the run, it pauses after every step
+}
+
+// JobStatus ... state of the maintenance job
+type JobStatus struct {
+	Name      string
+	Interval  time.Duration
+	Running   bool
+	Runs      uint64
+	Errors    uint64
+	LastRun   time.Time
+	Duration  time.Duration
+	LastError string
+}
+
+// jobFunc ... single run of the job, it must return as soon as ctx is done
+type jobFunc func(ctx context.Context) error
+
+type job struct {
+	run jobFunc
+
+	mu     sync.Mutex
+	status JobStatus
+	cancel context.CancelFunc
+}
+
+// maintenance ... scheduler of the store background jobs.
+// Every scheduled job runs in its own goroutine on its interval and never overlaps with itself.
+// The jobs work shard by shard and check their context between the steps,
+// so a cancelled job stops after the current shard step
+type maintenance struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	jobs   []*job
+}
+
+func newMaintenance() *maintenance {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &maintenance{ctx: ctx, cancel: cancel}
+}
+
+// add ... register the job, the job with zero interval is run only on demand
+func (m *maintenance) add(name string, interval time.Duration, run jobFunc) {
+	m.jobs = append(m.jobs, &job{run: run, status: JobStatus{Name: name, Interval: interval}})
+}
+
+// start ... schedule the registered jobs
+func (m *maintenance) start() {
+	for _, j := range m.jobs {
+		if j.status.Interval <= 0 {
+			continue
+		}
+		m.wg.Add(1)
+		go func(j *job) {
+			defer m.wg.Done()
+			ticker := time.NewTicker(j.status.Interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-m.ctx.Done():
+					return
+				case <-ticker.C:
+					_ = j.runOnce(m.ctx)
+				}
+			}
+		}(j)
+	}
+}
+
+func (m *maintenance) job(name string) (*job, error) {
+	for _, j := range m.jobs {
+		if j.status.Name == name {
+			return j, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown maintenance job %q", name)
+}
+
+// stop ... cancel all the jobs and wait for the running ones
+func (m *maintenance) stop() {
+	m.cancel()
+	m.wg.Wait()
+}
+
+func (j *job) runOnce(parent context.Context) error {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	j.mu.Lock()
+	if j.status.Running {
+		j.mu.Unlock()
+		return fmt.Errorf("maintenance job %q is already running", j.status.Name)
+	}
+	j.status.Running = true
+	j.cancel = cancel
+	j.mu.Unlock()
+
+	start := time.Now()
+	err := j.run(ctx)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status.Running = false
+	j.cancel = nil
+	j.status.Runs++
+	j.status.LastRun = start
+	j.status.Duration = time.Since(start)
+	j.status.LastError = ""
+	if err != nil {
+		j.status.Errors++
+		j.status.LastError = err.Error()
+	}
+	return err
+}
+
+func (j *job) state() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+// initMaintenance ... register the store jobs, they are scheduled once the shards are loaded
+func (s *Store) initMaintenance() {
+	s.maint = newMaintenance()
+	s.maint.add(JobExpire, s.expireInterval, func(ctx context.Context) error {
+		budget := s.expireBudget
+		if budget <= 0 {
+			budget = s.expireInterval / 4
+		}
+		s.expireCycle(ctx, budget)
+		return ctx.Err()
+	})
+	s.maint.add(JobFsync, s.syncInterval, s.fsyncShards)
+	s.maint.add(JobCompact, s.compactInterval, func(ctx context.Context) error {
+		return s.compactCycle(ctx, s.compactBudget)
+	})
+	s.maint.add(JobScrub, s.scrubInterval, func(ctx context.Context) error {
+		return s.scrubCycle(ctx, s.scrubBudget)
+	})
+	s.maint.add(JobTier, s.tierInterval, s.tierCycle)
+}
+
+// RunJob ... run the maintenance job right now and wait for it, the job waits for the shards load
+func (s *Store) RunJob(name string) error {
+	j, err := s.maint.job(name)
+	if err != nil {
+		return err
+	}
+	err = s.WaitLoad()
+	if err != nil {
+		return err
+	}
+	return j.runOnce(s.maint.ctx)
+}
+
+// CancelJob ... stop the current run of the job, the next scheduled run isn't affected
+func (s *Store) CancelJob(name string) error {
+	j, err := s.maint.job(name)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.cancel != nil {
+		j.cancel()
+	}
+	return nil
+}
+
+// Maintenance ... status of all the maintenance jobs
+func (s *Store) Maintenance() []JobStatus {
+	res := make([]JobStatus, 0, len(s.maint.jobs))
+	for _, j := range s.maint.jobs {
+		res = append(res, j.state())
+	}
+	return res
+}
+
+// expireCycle ... single run of the active expiry, returns the number of removed keys.
+// The shards are visited round-robin starting from the one where the previous run stopped,
+// a visit removes at most expireBatch due keys, so no shard lock is held for long.
+// The run ends when all the shards are drained or the time budget is spent, 0 - no budget
+func (s *Store) expireCycle(ctx context.Context, budget time.Duration) int {
+	s.expireMu.Lock()
+	defer s.expireMu.Unlock()
+
+	deadline := time.Now().Add(budget)
+	total := 0
+	for idle := 0; idle < s.shardsCount && ctx.Err() == nil; {
+		now := time.Now()
+		if budget > 0 && now.After(deadline) {
+			break
+		}
+		n := s.shards[s.expireShardSeq].ExpireDue(now.Unix(), expireBatch)
+		total += n
+		if n < expireBatch {
+			idle++
+		} else {
+			idle = 0
+		}
+		s.expireShardSeq = (s.expireShardSeq + 1) % s.shardsCount
+	}
+	return total
+}
+
+func (s *Store) fsyncShards(ctx context.Context) error {
+	var errs error
+	for i := range s.shards {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := s.shards[i].Fsync()
+		if err != nil {
+			errs = errors.Join(errs, fmt.Errorf("shard %d: %w", i, err))
+		}
+	}
+	return errs
+}
+
+// spent ... the budget of the run started at start is over
+func (b Budget) spent(start time.Time, io int64) bool {
+	return (b.Time > 0 && time.Since(start) >= b.Time) || (b.IO > 0 && io >= b.IO)
+}
+
+// pause ... rest after the step which took busy, so the run keeps busy only its CPU share of a core
+func (b Budget) pause(ctx context.Context, busy time.Duration) error {
+	if b.CPU <= 0 || b.CPU >= 1 {
+		return ctx.Err()
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Duration(float64(busy) * (1/b.CPU - 1))):
+		return nil
+	}
+}
+
+// compactCycle ... compact the shards where at least a half of the file is free or the classes are outdated.
+// A shard is compacted by short steps, each one copies about compactStep bytes of the live records
+// to the new file under the shard lock, so the writers wait only for a step.
+// The compaction of the shard left by the spent budget is continued by the next run
+func (s *Store) compactCycle(ctx context.Context, budget Budget) error {
+	start := time.Now()
+	var done int64
+	var errs error
+	for visited := 0; visited < s.shardsCount && !budget.spent(start, done); visited++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		i := s.compactSeq
+		s.compactSeq = (s.compactSeq + 1) % s.shardsCount
+
+		due, err := s.shards[i].CompactDue(s.compactMinFree)
+		if err == nil && due {
+			err = s.compactShard(ctx, i, budget, start, &done)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			errs = errors.Join(errs, fmt.Errorf("shard %d: %w", i, err))
+		}
+	}
+	return errs
+}
+
+// compactShard ... run the compaction steps of the shard till it's finished, the budget is spent
+// or the step has to wait for the readers of the chunks
+func (s *Store) compactShard(ctx context.Context, i int, budget Budget, start time.Time, done *int64) error {
+	for !budget.spent(start, *done) {
+		stepStart := time.Now()
+		n, finished, err := s.shards[i].CompactStep(compactStep)
+		*done += n
+		if err != nil {
+			return err
+		}
+		if finished {
+			// the records are moved, the scrubber starts the shard over
+			s.scrubMu.Lock()
+			if s.scrub.Shard == i {
+				s.scrub.Offset = 0
+			}
+			s.scrubMu.Unlock()
+			return nil
+		}
+		if n == 0 {
+			// the file replacement waits for the readers of the chunks, the next run continues
+			return nil
+		}
+		err = budget.pause(ctx, time.Since(stepStart))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package store
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/DenzelPenzel/nyx/internal/common"
+	"github.com/spaolacci/murmur3"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Compaction(t *testing.T) {
+	os.RemoveAll(dirName)
+	defer os.RemoveAll(dirName)
+
+	opts := []OptStore{Dir(dirName), ShardsTotal(8), ShardsCollision(1), ChunkSize(4 << 10), CompactMinFree(1)}
+	s, err := Open(opts...)
+	require.NoError(t, err)
+
+	n := 2000
+	for i := 0; i < n; i++ {
+		require.NoError(t, s.Set([]byte("key"+strconv.Itoa(i)), bytes.Repeat([]byte("v"), 100), 0))
+	}
+	big := randomValue(20 << 10)
+	require.NoError(t, s.SetWithFlags([]byte("big"), big, 0, 9))
+	for i := 0; i < n; i += 4 {
+		require.NoError(t, s.Set([]byte("key"+strconv.Itoa(i)), bytes.Repeat([]byte("v"), 200), 0))
+	}
+	for i := 1; i < n; i += 2 {
+		_, err = s.Delete([]byte("key" + strconv.Itoa(i)))
+		require.NoError(t, err)
+	}
+
+	before, err := s.FileSize()
+	require.NoError(t, err)
+	require.NoError(t, s.RunJob(JobCompact))
+	after, err := s.FileSize()
+	require.NoError(t, err)
+	require.Less(t, after, before)
+
+	check := func() {
+		require.Equal(t, n/2+1, s.Count())
+		for i := 0; i < n; i += 2 {
+			v, err := s.Get([]byte("key" + strconv.Itoa(i)))
+			require.NoError(t, err)
+			size := 100
+			if i%4 == 0 {
+				size = 200
+			}
+			require.Len(t, v, size)
+		}
+		v, header, err := s.GetWithHeader([]byte("big"))
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(big, v))
+		require.Equal(t, uint32(9), header.Flags())
+	}
+	check()
+
+	require.NoError(t, s.Close())
+	s, err = Open(opts...)
+	require.NoError(t, err)
+	defer s.Close()
+	check()
+
+	status := s.Maintenance()
+	require.Len(t, status, 5)
+}
+
+func Test_CompactionSteps(t *testing.T) {
+	os.RemoveAll(dirName)
+	defer os.RemoveAll(dirName)
+
+	opts := []OptStore{Dir(dirName), ShardsTotal(1), ShardsCollision(0), ChunkSize(4 << 10)}
+	s, err := Open(opts...)
+	require.NoError(t, err)
+
+	n := 500
+	vals := make(map[string][]byte)
+	set := func(key string, val []byte) {
+		require.NoError(t, s.Set([]byte(key), val, 0))
+		vals[key] = val
+	}
+	for i := 0; i < n; i++ {
+		set("key"+strconv.Itoa(i), bytes.Repeat([]byte("v"), 100))
+	}
+	set("big", randomValue(20<<10))
+	for i := 0; i < n; i += 2 {
+		_, err = s.Delete([]byte("key" + strconv.Itoa(i)))
+		require.NoError(t, err)
+		delete(vals, "key"+strconv.Itoa(i))
+	}
+
+	before, err := s.FileSize()
+	require.NoError(t, err)
+
+	// the writes between the steps change both the copied records and the ones not copied yet
+	sh := &s.shards[0]
+	step := func() bool {
+		_, finished, err := sh.CompactStep(4 << 10)
+		require.NoError(t, err)
+		return finished
+	}
+	require.False(t, step())
+	for i := 1; i < n; i += 4 {
+		key := "key" + strconv.Itoa(i)
+		require.NoError(t, s.Append([]byte(key), []byte("+")))
+		vals[key] = append(bytes.Clone(vals[key]), '+')
+	}
+	require.False(t, step())
+	require.NoError(t, s.Append([]byte("big"), []byte("tail")))
+	vals["big"] = append(bytes.Clone(vals["big"]), "tail"...)
+	set("key3", randomValue(200))
+	_, err = s.Delete([]byte("key5"))
+	require.NoError(t, err)
+	delete(vals, "key5")
+	set("new", randomValue(12<<10))
+
+	// the readers of the chunks hold the file replacement
+	r, err := s.GetReader([]byte("big"))
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		require.False(t, step())
+	}
+	require.NoError(t, r.Close())
+	require.True(t, step())
+	after, err := s.FileSize()
+	require.NoError(t, err)
+	require.Less(t, after, before)
+
+	check := func() {
+		require.Equal(t, len(vals), s.Count())
+		for key, val := range vals {
+			v, err := s.Get([]byte(key))
+			require.NoError(t, err)
+			require.True(t, bytes.Equal(val, v), key)
+		}
+		res, err := sh.Scrub(0, 1<<30, false)
+		require.NoError(t, err)
+		require.Empty(t, res.Findings)
+	}
+	check()
+
+	require.NoError(t, s.Close())
+	s, err = Open(opts...)
+	require.NoError(t, err)
+	defer s.Close()
+	sh = &s.shards[0]
+	check()
+}
+
+func Test_MaintenanceJobs(t *testing.T) {
+	os.RemoveAll(dirName)
+	defer os.RemoveAll(dirName)
+
+	s, err := Open(Dir(dirName), ExpireInterval(10*time.Millisecond))
+	require.NoError(t, err)
+	defer s.Close()
+
+	past := uint32(time.Now().Unix() - 1)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, s.Set([]byte("key"+strconv.Itoa(i)), []byte("v"), past))
+	}
+
+	t.Run("scheduled expiry", func(t *testing.T) {
+		require.Eventually(t, func() bool {
+			return s.Count() == 0
+		}, 5*time.Second, 10*time.Millisecond)
+
+		for _, job := range s.Maintenance() {
+			if job.Name == JobExpire {
+				require.Positive(t, job.Runs)
+				require.Zero(t, job.Errors)
+			}
+		}
+	})
+
+	t.Run("unknown job", func(t *testing.T) {
+		require.Error(t, s.RunJob("unknown"))
+		require.Error(t, s.CancelJob("unknown"))
+	})
+
+	t.Run("scrub finds broken record", func(t *testing.T) {
+		key := []byte("scrub")
+		require.NoError(t, s.Set(key, []byte("value"), 0))
+		require.NoError(t, s.RunJob(JobScrub))
+
+		// overwrite the key of the first record in the shard
+		h := murmur3.Sum32WithSeed(key, 0)
+		f, err := os.OpenFile(s.shardPath(int(s.idx(h))), os.O_RDWR, 0)
+		require.NoError(t, err)
+		_, err = f.WriteAt([]byte("xx"), 2+16+5)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		require.ErrorContains(t, s.RunJob(JobScrub), "found 1 records inconsistent")
+		status := s.ScrubStatus()
+		require.Equal(t, uint64(2), status.Passes)
+		require.Equal(t, uint64(1), status.Findings)
+		require.Len(t, status.Recent, 1)
+		require.Contains(t, status.Recent[0], "record is not indexed")
+		for _, job := range s.Maintenance() {
+			if job.Name == JobScrub {
+				require.Equal(t, uint64(2), job.Runs)
+				require.Equal(t, uint64(1), job.Errors)
+				require.NotEmpty(t, job.LastError)
+			}
+		}
+	})
+}
+
+func Test_ScrubQuarantine(t *testing.T) {
+	os.RemoveAll(dirName)
+	defer os.RemoveAll(dirName)
+
+	s, err := Open(Dir(dirName), ScrubQuarantine(true), ScrubRate(0))
+	require.NoError(t, err)
+	defer s.Close()
+
+	key := []byte("key")
+	require.NoError(t, s.Set(key, []byte("value"), 0))
+
+	// break the expire time of the record behind the index
+	h := murmur3.Sum32WithSeed(key, 0)
+	name := s.shardPath(int(s.idx(h)))
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0, 0, 4, 0}, 3+8)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	require.Error(t, s.RunJob(JobScrub))
+	status := s.ScrubStatus()
+	require.Equal(t, uint64(1), status.Findings)
+	require.Equal(t, uint64(1), status.Quarantined)
+	require.Contains(t, status.Recent[0], "expire time mismatch")
+
+	_, err = s.Get(key)
+	require.ErrorIs(t, err, common.ErrKeyNotFound)
+	quarantined, err := os.ReadFile(name + ".quarantine")
+	require.NoError(t, err)
+	// the 24 bytes record fills its slot exactly
+	require.Len(t, quarantined, 12+24)
+
+	// the next pass is clean
+	require.NoError(t, s.RunJob(JobScrub))
+	require.Equal(t, uint64(1), s.ScrubStatus().Findings)
+}
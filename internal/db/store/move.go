@@ -0,0 +1,213 @@
+package store
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/DenzelPenzel/nyx/internal/common"
+	"github.com/spaolacci/murmur3"
+)
+
+// MoveOpts ... NoOverwrite fails the operation with common.ErrKeyExists if the destination key exists
+type MoveOpts struct {
+	NoOverwrite bool
+}
+
+// transferOp ... write of the value of the src key to the dst key with its expire time
+type transferOp struct {
+	src, dst    []byte
+	keep        bool                  // the src key stays
+	noOverwrite bool                  // common.ErrKeyExists if the dst key exists
+	flags       func(uint32) uint32   // flags of the dst key from the src ones, nil keeps them
+	fits        func(size int64) bool // the value fits the destination, nil - no limit
+}
+
+// Rename ... rename the key keeping its value, expire time and flags, the keys may live in different shards
+func (s *Store) Rename(from, to []byte, opts MoveOpts) error {
+	return s.versioned(func() error {
+		_, err := s.transfer(transferOp{src: from, dst: to, noOverwrite: opts.NoOverwrite})
+		return err
+	}, from, to)
+}
+
+// Copy ... copy the value of the key with its expire time and flags to another key
+func (s *Store) Copy(from, to []byte, opts MoveOpts) error {
+	return s.versioned(func() error {
+		_, err := s.transfer(transferOp{src: from, dst: to, keep: true, noOverwrite: opts.NoOverwrite})
+		return err
+	}, to)
+}
+
+// MoveKey ... move the key with its expire time to another bucket under the same name,
+// nil bucket is the keyspace out of the buckets. The flags of a bucket key hold its write time:
+// the key moved into a bucket is written now, the key moved out of the buckets gets no flags.
+// The limits of the destination bucket apply as to Put
+func (s *Store) MoveKey(key []byte, from, to *BucketStore, opts MoveOpts) error {
+	op := transferOp{src: key, dst: key, noOverwrite: opts.NoOverwrite}
+	if from != nil {
+		op.src = from.Key(key)
+	}
+	if to != nil {
+		op.dst = to.Key(key)
+	}
+
+	// the bucket locks are taken in the order of the names, as the shard locks
+	first, second := from, to
+	if first == nil || (second != nil && second.Name < first.Name) {
+		first, second = second, first
+	}
+	unlock, err := lockBuckets(first, second)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	now := uint32(time.Now().Unix())
+	switch {
+	case to == nil:
+		op.flags = func(uint32) uint32 { return 0 }
+	case from == nil:
+		op.flags = func(uint32) uint32 { return now }
+	}
+	if to != nil && to != from && to.meta.limited() {
+		to.limitMu.Lock()
+		defer to.limitMu.Unlock()
+		// the failing move must not evict, the limit lock keeps the puts to the bucket out meanwhile
+		val, err := s.Get(op.src)
+		if isMissing(err) {
+			return common.ErrKeyNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if op.noOverwrite {
+			_, err = s.Get(op.dst)
+			if err == nil {
+				return common.ErrKeyExists
+			}
+			if !isMissing(err) {
+				return err
+			}
+		}
+		err = s.makeRoom(to, key, int64(len(val)))
+		if err != nil {
+			return err
+		}
+		op.fits = func(size int64) bool {
+			return to.fits(key, size)
+		}
+	}
+
+	var e bucketEntry
+	err = s.versioned(func() error {
+		e, err = s.transfer(op)
+		return err
+	}, op.src, op.dst)
+	if err != nil {
+		return err
+	}
+	if from == to {
+		return nil
+	}
+	if from != nil {
+		from.remove(key)
+	}
+	if to != nil {
+		to.put(key, e)
+	}
+	return nil
+}
+
+// lockBuckets ... hold the read write locks of the buckets in the given order, nil bucket is skipped.
+// common.ErrKeyNotFound if any of them is dropped
+func lockBuckets(buckets ...*BucketStore) (func(), error) {
+	var held []*BucketStore
+	unlock := func() {
+		for i := len(held) - 1; i >= 0; i-- {
+			held[i].writeMu.RUnlock()
+		}
+	}
+	for i, b := range buckets {
+		if b == nil || (i > 0 && b == buckets[i-1]) {
+			continue
+		}
+		b.writeMu.RLock()
+		held = append(held, b)
+		if b.dropped {
+			unlock()
+			return nil, common.ErrKeyNotFound
+		}
+	}
+	return unlock, nil
+}
+
+// transfer ... both keys are locked for the whole operation and the writes go through the batch log,
+// so the concurrent readers and a crash observe the keys either before or after the operation.
+// Returns the index entry of the written dst key
+func (s *Store) transfer(op transferOp) (bucketEntry, error) {
+	hs, hd := murmur3.Sum32WithSeed(op.src, 0), murmur3.Sum32WithSeed(op.dst, 0)
+	err := s.waitKey(hs, hd)
+	if err != nil {
+		return bucketEntry{}, err
+	}
+
+	s.batchMu.Lock()
+	defer s.batchMu.Unlock()
+	err = s.replayKept()
+	if err != nil {
+		return bucketEntry{}, err
+	}
+	ls := s.lockShards(hs, hd)
+	val, header, err := s.getLocked(ls, op.src, hs)
+	if err != nil {
+		ls.unlock()
+		if isMissing(err) {
+			return bucketEntry{}, common.ErrKeyNotFound
+		}
+		return bucketEntry{}, err
+	}
+	e := bucketEntry{size: int64(len(val)), written: header.Flags(), expire: header.Expire()}
+	if op.flags != nil {
+		e.written = op.flags(e.written)
+	}
+
+	if bytes.Equal(op.src, op.dst) {
+		ls.unlock()
+		if op.noOverwrite {
+			return bucketEntry{}, common.ErrKeyExists
+		}
+		return e, nil
+	}
+	if op.noOverwrite {
+		_, _, err = s.getLocked(ls, op.dst, hd)
+		if err == nil {
+			ls.unlock()
+			return bucketEntry{}, common.ErrKeyExists
+		}
+		if !isMissing(err) {
+			ls.unlock()
+			return bucketEntry{}, err
+		}
+	}
+	if op.fits != nil && !op.fits(e.size) {
+		ls.unlock()
+		return bucketEntry{}, common.ErrNoMem
+	}
+
+	ops := []batchOp{{kind: batchOpSet, key: op.dst, val: val, expire: e.expire, flags: e.written}}
+	hashes := []uint32{hd}
+	if !op.keep {
+		ops = append(ops, batchOp{kind: batchOpDelete, key: op.src})
+		hashes = append(hashes, hs)
+	}
+	err = s.writeBatchLog(encodeBatch(ops))
+	if err != nil {
+		ls.unlock()
+		return bucketEntry{}, err
+	}
+	err = s.applyLogged(ls, ops, hashes)
+	if err != nil {
+		return bucketEntry{}, err
+	}
+	return e, nil
+}
@@ -0,0 +1,160 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DenzelPenzel/nyx/internal/common"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_RenameCopy(t *testing.T) {
+	os.RemoveAll(dirName)
+	defer os.RemoveAll(dirName)
+
+	s, err := Open(Dir(dirName), ShardsTotal(8), ShardsCollision(1), ChunkSize(4<<10))
+	require.NoError(t, err)
+	defer s.Close()
+
+	expire := uint32(time.Now().Unix() + 100)
+	big := randomValue(20 << 10)
+	require.NoError(t, s.SetWithFlags([]byte("a"), big, expire, 7))
+	require.NoError(t, s.Set([]byte("other"), []byte("v"), 0))
+
+	check := func(key string) {
+		val, header, err := s.GetWithHeader([]byte(key))
+		require.NoError(t, err)
+		require.Equal(t, big, val)
+		require.Equal(t, expire, header.Expire())
+		require.Equal(t, uint32(7), header.Flags())
+	}
+
+	// the keys land in different shards
+	for i := 0; i < 8; i++ {
+		to := "b" + strconv.Itoa(i)
+		require.NoError(t, s.Rename([]byte("a"), []byte(to), MoveOpts{}))
+		check(to)
+		_, err = s.Get([]byte("a"))
+		require.True(t, isMissing(err))
+		require.NoError(t, s.Rename([]byte(to), []byte("a"), MoveOpts{}))
+	}
+
+	require.ErrorIs(t, s.Rename([]byte("missing"), []byte("c"), MoveOpts{}), common.ErrKeyNotFound)
+	require.ErrorIs(t, s.Rename([]byte("a"), []byte("other"), MoveOpts{NoOverwrite: true}), common.ErrKeyExists)
+	require.ErrorIs(t, s.Rename([]byte("a"), []byte("a"), MoveOpts{NoOverwrite: true}), common.ErrKeyExists)
+	require.NoError(t, s.Rename([]byte("a"), []byte("a"), MoveOpts{}))
+	check("a")
+
+	require.NoError(t, s.Copy([]byte("a"), []byte("other"), MoveOpts{}))
+	check("a")
+	check("other")
+	require.ErrorIs(t, s.Copy([]byte("a"), []byte("other"), MoveOpts{NoOverwrite: true}), common.ErrKeyExists)
+
+	t.Run("concurrent", func(t *testing.T) {
+		// the key bounces between two names, it must never be lost or duplicated
+		require.NoError(t, s.Set([]byte("x"), []byte("v"), 0))
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				from, to := []byte("x"), []byte("y")
+				if w%2 == 1 {
+					from, to = to, from
+				}
+				for i := 0; i < 100; i++ {
+					err := s.Rename(from, to, MoveOpts{NoOverwrite: true})
+					if err != nil && !errors.Is(err, common.ErrKeyNotFound) {
+						panic(err)
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+		_, errX := s.Get([]byte("x"))
+		_, errY := s.Get([]byte("y"))
+		require.True(t, (errX == nil) != (errY == nil), "%v %v", errX, errY)
+	})
+}
+
+func Test_MoveKey(t *testing.T) {
+	os.RemoveAll(dirName)
+	defer os.RemoveAll(dirName)
+
+	s, err := Open(Dir(dirName), ShardsTotal(8), ShardsCollision(1))
+	require.NoError(t, err)
+	defer s.Close()
+
+	users, err := s.Bucket("users")
+	require.NoError(t, err)
+	archive, err := s.Bucket("archive")
+	require.NoError(t, err)
+
+	expire := uint32(time.Now().Unix() + 100)
+	require.NoError(t, s.SetWithFlags([]byte("k"), []byte("value"), expire, 7))
+
+	require.NoError(t, s.MoveKey([]byte("k"), nil, users, MoveOpts{}))
+	_, err = s.Get([]byte("k"))
+	require.True(t, isMissing(err))
+	items, _, err := s.BucketRange(users, nil, nil, RangeOpts{})
+	require.NoError(t, err)
+	require.Equal(t, []BucketItem{{Key: []byte("k"), Value: []byte("value")}}, items)
+	require.Equal(t, BucketInfo{Name: "users", Keys: 1, Bytes: 5}, users.Info())
+
+	require.NoError(t, s.Put(archive, []byte("k"), []byte("old")))
+	err = s.MoveKey([]byte("k"), users, archive, MoveOpts{NoOverwrite: true})
+	require.ErrorIs(t, err, common.ErrKeyExists)
+	require.NoError(t, s.MoveKey([]byte("k"), users, archive, MoveOpts{}))
+	require.Equal(t, 0, users.Info().Keys)
+	val, header, err := s.GetWithHeader(archive.Key([]byte("k")))
+	require.NoError(t, err)
+	require.Equal(t, "value", string(val))
+	require.Equal(t, expire, header.Expire())
+
+	require.NoError(t, s.MoveKey([]byte("k"), archive, nil, MoveOpts{}))
+	require.Equal(t, 0, archive.Info().Keys)
+	val, header, err = s.GetWithHeader([]byte("k"))
+	require.NoError(t, err)
+	require.Equal(t, "value", string(val))
+	require.Equal(t, expire, header.Expire())
+	require.Zero(t, header.Flags())
+
+	t.Run("limits", func(t *testing.T) {
+		require.NoError(t, s.SetBucketOptions(users, BucketOptions{MaxKeys: 1}))
+		require.NoError(t, s.Put(users, []byte("a"), []byte("v")))
+		err := s.MoveKey([]byte("k"), nil, users, MoveOpts{})
+		require.ErrorIs(t, err, common.ErrNoMem)
+		_, err = s.Get([]byte("k"))
+		require.NoError(t, err)
+
+		require.NoError(t, s.SetBucketOptions(users, BucketOptions{MaxKeys: 1, Overflow: OverflowEvict}))
+		require.NoError(t, s.MoveKey([]byte("k"), nil, users, MoveOpts{}))
+		items, _, err := s.BucketRange(users, nil, nil, RangeOpts{})
+		require.NoError(t, err)
+		require.Equal(t, []BucketItem{{Key: []byte("k"), Value: []byte("value")}}, items)
+
+		// the failing moves evict nothing
+		require.NoError(t, s.SetBucketOptions(users, BucketOptions{MaxKeys: 2, MaxBytes: 8, Overflow: OverflowEvict}))
+		require.NoError(t, s.Put(users, []byte("a"), []byte("v")))
+		require.NoError(t, s.Set([]byte("k"), []byte("valueXYZ"), 0))
+		err = s.MoveKey([]byte("k"), nil, users, MoveOpts{NoOverwrite: true})
+		require.ErrorIs(t, err, common.ErrKeyExists)
+		err = s.MoveKey([]byte("missing"), nil, users, MoveOpts{})
+		require.ErrorIs(t, err, common.ErrKeyNotFound)
+		require.Equal(t, BucketInfo{Name: "users", Keys: 2, Bytes: 6}, users.Info())
+		_, err = s.Delete([]byte("k"))
+		require.NoError(t, err)
+	})
+
+	t.Run("dropped bucket", func(t *testing.T) {
+		require.NoError(t, s.DropBucket("archive"))
+		require.NoError(t, s.Set([]byte("j"), []byte("v"), 0))
+		err := s.MoveKey([]byte("j"), nil, archive, MoveOpts{})
+		require.ErrorIs(t, err, common.ErrKeyNotFound)
+		require.ErrorIs(t, s.MoveKey([]byte("missing"), nil, users, MoveOpts{}), common.ErrKeyNotFound)
+	})
+}
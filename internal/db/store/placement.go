@@ -0,0 +1,291 @@
+package store
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	"github.com/DenzelPenzel/nyx/internal/db/store/shard"
+)
+
+const (
+	metaName = "store.meta"
+	metaVer  = 1
+)
+
+// generations of the metadata: the copies are written to the dirs one by one,
+// so the open accepts the copies one generation behind the newest one and rewrites them
+const (
+	metaPending   = 1 // the copies are being created, the store was never opened
+	metaCommitted = 2 // every dir has its copy
+)
+
+// storeMeta ... placement of the shards over the data dirs, a copy is kept in every dir.
+// A dir is identified by the id in its own copy, so the order of the dirs in the config doesn't matter
+type storeMeta struct {
+	Version   int    `json:"version"`
+	Gen       int    `json:"gen"`       // generation of the copy, 0 - written before the generations
+	Store     string `json:"store"`     // random id of the store, all the dirs must share it
+	Dir       int    `json:"dir"`       // id of the dir holding this copy
+	Dirs      int    `json:"dirs"`      // number of the dirs
+	Shards    int    `json:"shards"`    // number of the shards
+	Placement []int  `json:"placement"` // dir id of every shard
+}
+
+// Dirs ... data directories of the store, the shards are spread over them round-robin.
+// The placement is recorded in every dir on the first open, later the dirs may be listed in any order,
+// but a dir can't be added to or removed from the existing store
+func Dirs(dirs ...string) OptStore {
+	return func(s *Store) error {
+		s.dirs = nil
+		s.dirWeights = nil
+		for _, dir := range dirs {
+			if dir == "" {
+				dir = "."
+			}
+			err := os.MkdirAll(dir, os.FileMode(0755))
+			if err != nil {
+				return err
+			}
+			s.dirs = append(s.dirs, dir)
+		}
+		return nil
+	}
+}
+
+// DirWeights ... relative capacity of the Dirs in the same order,
+// a new store places the share of the shards proportional to the weight in every dir
+func DirWeights(weights ...int) OptStore {
+	return func(s *Store) error {
+		for _, w := range weights {
+			if w < 1 {
+				return errors.New("dir weight must be at least 1")
+			}
+		}
+		s.dirWeights = weights
+		return nil
+	}
+}
+
+// place ... read or create the shards placement, the dirs are reordered by their ids.
+// The copies of the metadata left one generation behind by an interrupted write are rewritten,
+// while the creation of the store is pending the dirs without a copy take the free ids in the config order
+func (s *Store) place() error {
+	if len(s.dirs) == 0 {
+		s.dirs = []string{"."}
+	}
+	if s.dirWeights != nil && len(s.dirWeights) != len(s.dirs) {
+		return fmt.Errorf("got %d dir weights for %d dirs", len(s.dirWeights), len(s.dirs))
+	}
+	seen := make(map[string]bool, len(s.dirs))
+	for _, dir := range s.dirs {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		if seen[abs] {
+			return fmt.Errorf("data dir %s is listed twice", dir)
+		}
+		seen[abs] = true
+	}
+
+	metas := make([]*storeMeta, len(s.dirs))
+	var ref *storeMeta
+	for i, dir := range s.dirs {
+		m, err := s.readMeta(dir)
+		if err != nil {
+			return err
+		}
+		metas[i] = m
+		if m != nil && (ref == nil || m.Gen > ref.Gen) {
+			ref = m
+		}
+	}
+	if ref == nil {
+		return s.newPlacement()
+	}
+
+	if ref.Shards != s.shardsCount || len(ref.Placement) != ref.Shards {
+		return fmt.Errorf("the store has %d shards, %d configured", ref.Shards, s.shardsCount)
+	}
+	byID := make([]string, ref.Dirs)
+	var unnamed []string
+	stale := ref.Gen == metaPending
+	for i, m := range metas {
+		switch {
+		case m == nil && ref.Gen == metaPending:
+			unnamed = append(unnamed, s.dirs[i])
+			continue
+		case m == nil:
+			return fmt.Errorf("data dir %s doesn't belong to the store, dirs can't be added to the existing store", s.dirs[i])
+		case m.Store != ref.Store || m.Dirs != ref.Dirs:
+			return fmt.Errorf("data dir %s belongs to another store", s.dirs[i])
+		case m.Gen != ref.Gen && m.Gen != ref.Gen-1:
+			return fmt.Errorf("data dir %s metadata generation %d, the store is at %d", s.dirs[i], m.Gen, ref.Gen)
+		case m.Gen == ref.Gen && !slices.Equal(m.Placement, ref.Placement):
+			return fmt.Errorf("data dir %s belongs to another store", s.dirs[i])
+		case m.Dir < 0 || m.Dir >= ref.Dirs || byID[m.Dir] != "":
+			return fmt.Errorf("data dir %s has a wrong id %d", s.dirs[i], m.Dir)
+		}
+		byID[m.Dir] = s.dirs[i]
+		stale = stale || m.Gen != ref.Gen
+	}
+	for id, dir := range byID {
+		if dir == "" && len(unnamed) > 0 {
+			byID[id], unnamed = unnamed[0], unnamed[1:]
+			continue
+		}
+		if dir == "" {
+			return fmt.Errorf("data dir %d of %d is missing", id, ref.Dirs)
+		}
+	}
+	if len(unnamed) > 0 {
+		return fmt.Errorf("data dir %s doesn't belong to the store, dirs can't be added to the existing store", unnamed[0])
+	}
+	for _, id := range ref.Placement {
+		if id < 0 || id >= ref.Dirs {
+			return fmt.Errorf("wrong dir id %d in the shards placement", id)
+		}
+	}
+
+	s.dirs = byID
+	s.placement = ref.Placement
+	s.dir = s.dirs[0]
+	if stale {
+		return s.writeMetas(ref, max(ref.Gen, metaCommitted))
+	}
+	return nil
+}
+
+// newPlacement ... spread the shards over the dirs by the smooth weighted round-robin.
+// The shard files left by the store opened before without the placement stay where they are
+func (s *Store) newPlacement() error {
+	weights := s.dirWeights
+	if weights == nil {
+		weights = make([]int, len(s.dirs))
+		for i := range weights {
+			weights[i] = 1
+		}
+	}
+	total := 0
+	for _, w := range weights {
+		total += w
+	}
+
+	s.placement = make([]int, s.shardsCount)
+	current := make([]int, len(s.dirs))
+	for i := range s.placement {
+		if id, ok := s.existingShard(i); ok {
+			s.placement[i] = id
+			continue
+		}
+		best := 0
+		for j, w := range weights {
+			current[j] += w
+			if current[j] > current[best] {
+				best = j
+			}
+		}
+		current[best] -= total
+		s.placement[i] = best
+	}
+	s.dir = s.dirs[0]
+
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return err
+	}
+	m := &storeMeta{
+		Version:   metaVer,
+		Store:     hex.EncodeToString(id),
+		Dirs:      len(s.dirs),
+		Shards:    s.shardsCount,
+		Placement: s.placement,
+	}
+	err = s.writeMetas(m, metaPending)
+	if err != nil {
+		return err
+	}
+	return s.writeMetas(m, metaCommitted)
+}
+
+// writeMetas ... write the copy of the metadata of the given generation to every dir, s.dirs are ordered by the ids
+func (s *Store) writeMetas(m *storeMeta, gen int) error {
+	for i, dir := range s.dirs {
+		c := *m
+		c.Gen, c.Dir = gen, i
+		err := s.writeMeta(dir, &c)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// existingShard ... dir which already holds the shard file
+func (s *Store) existingShard(i int) (int, bool) {
+	for id, dir := range s.dirs {
+		_, err := os.Stat(s.pathIn(dir, strconv.Itoa(i)))
+		if err == nil {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+func (s *Store) readMeta(dir string) (*storeMeta, error) {
+	data, err := os.ReadFile(s.pathIn(dir, metaName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	m := &storeMeta{}
+	err = json.Unmarshal(data, m)
+	if err != nil {
+		return nil, fmt.Errorf("data dir %s metadata: %w", dir, err)
+	}
+	if m.Version != metaVer {
+		return nil, fmt.Errorf("data dir %s metadata: unknown version %d", dir, m.Version)
+	}
+	return m, nil
+}
+
+// writeMeta ... replace the metadata of the dir atomically, the rename is synced with the dir
+func (s *Store) writeMeta(dir string, m *storeMeta) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	name := s.pathIn(dir, metaName)
+	f, err := os.OpenFile(name+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(0644))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	err = errors.Join(err, f.Close())
+	if err != nil {
+		return err
+	}
+	err = os.Rename(name+".tmp", name)
+	if err != nil {
+		return err
+	}
+	return shard.SyncDir(name)
+}
+
+// shardPath ... path of the shard file in the dir the shard is placed to
+func (s *Store) shardPath(i int) string {
+	return s.pathIn(s.dirs[s.placement[i]], strconv.Itoa(i))
+}
@@ -0,0 +1,132 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Placement(t *testing.T) {
+	root := "-db-placement-test-"
+	os.RemoveAll(root)
+	defer os.RemoveAll(root)
+	dirs := []string{filepath.Join(root, "a"), filepath.Join(root, "b"), filepath.Join(root, "c")}
+
+	s, err := Open(Dirs(dirs...), DirWeights(1, 2, 1), ShardsTotal(64))
+	require.NoError(t, err)
+	n := 1000
+	for i := 0; i < n; i++ {
+		require.NoError(t, s.Set([]byte("key"+strconv.Itoa(i)), []byte("value"+strconv.Itoa(i)), 0))
+	}
+	require.NoError(t, s.Close())
+
+	for i, want := range []int{16, 32, 16} {
+		files, err := filepath.Glob(filepath.Join(dirs[i], "[0-9]*"))
+		require.NoError(t, err)
+		require.Len(t, files, want)
+	}
+
+	t.Run("reordered dirs", func(t *testing.T) {
+		s, err := Open(Dirs(dirs[2], dirs[0], dirs[1]), ShardsTotal(64))
+		require.NoError(t, err)
+		defer s.Close()
+		require.Equal(t, n, s.Count())
+		for i := 0; i < n; i++ {
+			v, err := s.Get([]byte("key" + strconv.Itoa(i)))
+			require.NoError(t, err)
+			require.Equal(t, []byte("value"+strconv.Itoa(i)), v)
+		}
+	})
+
+	t.Run("wrong config", func(t *testing.T) {
+		_, err := Open(Dirs(dirs[0], dirs[1]), ShardsTotal(64))
+		require.ErrorContains(t, err, "is missing")
+		_, err = Open(Dirs(append(dirs, filepath.Join(root, "d"))...), ShardsTotal(64))
+		require.ErrorContains(t, err, "doesn't belong to the store")
+		_, err = Open(Dirs(dirs...), ShardsTotal(128))
+		require.ErrorContains(t, err, "64 shards")
+		_, err = Open(Dirs(dirs[0], dirs[0]), ShardsTotal(64))
+		require.ErrorContains(t, err, "listed twice")
+	})
+
+	t.Run("interrupted metadata write", func(t *testing.T) {
+		gen := func(dir string) int {
+			m, err := (&Store{}).readMeta(dir)
+			require.NoError(t, err)
+			return m.Gen
+		}
+		setGen := func(dir string, g int) {
+			m, err := (&Store{}).readMeta(dir)
+			require.NoError(t, err)
+			m.Gen = g
+			require.NoError(t, (&Store{}).writeMeta(dir, m))
+		}
+
+		// a copy one generation behind is rewritten
+		setGen(dirs[1], metaPending)
+		s, err := Open(Dirs(dirs...), ShardsTotal(64))
+		require.NoError(t, err)
+		require.Equal(t, n, s.Count())
+		require.NoError(t, s.Close())
+		for _, dir := range dirs {
+			require.Equal(t, metaCommitted, gen(dir))
+		}
+
+		setGen(dirs[1], 0)
+		_, err = Open(Dirs(dirs...), ShardsTotal(64))
+		require.ErrorContains(t, err, "generation 0")
+		setGen(dirs[1], metaCommitted)
+	})
+
+	t.Run("interrupted store creation", func(t *testing.T) {
+		root := "-db-placement-new-test-"
+		os.RemoveAll(root)
+		defer os.RemoveAll(root)
+		dirs := []string{filepath.Join(root, "a"), filepath.Join(root, "b"), filepath.Join(root, "c")}
+		s, err := Open(Dirs(dirs...), ShardsTotal(8))
+		require.NoError(t, err)
+		require.NoError(t, s.Close())
+
+		// the crash after the first copy of the new store
+		m, err := (&Store{}).readMeta(dirs[0])
+		require.NoError(t, err)
+		m.Gen = metaPending
+		require.NoError(t, (&Store{}).writeMeta(dirs[0], m))
+		for _, dir := range dirs[1:] {
+			require.NoError(t, os.Remove(filepath.Join(dir, metaName)))
+		}
+
+		s, err = Open(Dirs(dirs...), ShardsTotal(8))
+		require.NoError(t, err)
+		require.NoError(t, s.Set([]byte("key"), []byte("value"), 0))
+		require.NoError(t, s.Close())
+		for i, dir := range dirs {
+			m, err := (&Store{}).readMeta(dir)
+			require.NoError(t, err)
+			require.Equal(t, metaCommitted, m.Gen)
+			require.Equal(t, i, m.Dir)
+		}
+	})
+
+	t.Run("store without placement", func(t *testing.T) {
+		os.RemoveAll(root)
+		s, err := Open(Dir(dirs[0]), ShardsTotal(8))
+		require.NoError(t, err)
+		require.NoError(t, s.Set([]byte("key"), []byte("value"), 0))
+		require.NoError(t, s.Close())
+		require.NoError(t, os.Remove(filepath.Join(dirs[0], metaName)))
+
+		s, err = Open(Dirs(dirs[1], dirs[0]), ShardsTotal(8))
+		require.NoError(t, err)
+		defer s.Close()
+		v, err := s.Get([]byte("key"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("value"), v)
+		files, err := filepath.Glob(filepath.Join(dirs[1], "[0-9]*"))
+		require.NoError(t, err)
+		require.Empty(t, files)
+	})
+}
@@ -0,0 +1,216 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DenzelPenzel/nyx/internal/common"
+)
+
+// purgeBatch ... number of the keys examined by a single step of the bulk delete
+const purgeBatch = 256
+
+// purgeKeep ... number of the finished bulk deletes kept for their status
+const purgeKeep = 16
+
+// States of the bulk delete
+const (
+	PurgeRunning   = "running"
+	PurgeDone      = "done"
+	PurgeCancelled = "cancelled"
+	PurgeFailed    = "failed"
+)
+
+// PurgeStatus ... progress of the bulk delete, Match is the glob pattern of the deleted keys.
+// Scanned counts all the keys examined by the scan, Deleted the matching ones deleted
+type PurgeStatus struct {
+	ID       uint64
+	Match    string
+	State    string
+	Scanned  uint64
+	Deleted  uint64
+	Started  time.Time
+	Duration time.Duration
+	Error    string
+}
+
+type purge struct {
+	mu     sync.Mutex
+	status PurgeStatus
+	cancel context.CancelFunc
+}
+
+// purges ... bulk deletes started on the store, the running ones and the last finished ones
+type purges struct {
+	mu   sync.Mutex
+	seq  uint64
+	list []*purge
+}
+
+// DeletePrefix ... delete all the keys starting with the prefix in the background, see DeleteMatch
+func (s *Store) DeletePrefix(prefix []byte) (uint64, error) {
+	return s.DeleteMatch(escapeGlob(string(prefix)) + "*")
+}
+
+// DeleteMatch ... delete all the keys matching the glob pattern in the background, returns the id
+// of the bulk delete to follow it with PurgeStatus and to stop it with CancelPurge.
+// The shards are visited with Scan by purgeBatch keys, so no shard lock is held for long,
+// the keys written meanwhile may survive. The keys of the buckets are left to DropBucket,
+// the versions of the deleted keys stay
+func (s *Store) DeleteMatch(pattern string) (uint64, error) {
+	if pattern == "" {
+		return 0, fmt.Errorf("empty delete pattern")
+	}
+	if err := s.maint.ctx.Err(); err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithCancel(s.maint.ctx)
+	p := &purge{cancel: cancel}
+
+	s.purges.mu.Lock()
+	s.purges.seq++
+	id := s.purges.seq
+	p.status = PurgeStatus{ID: id, Match: pattern, State: PurgeRunning, Started: time.Now()}
+	s.purges.list = append(s.purges.list, p)
+	s.purges.prune()
+	s.purges.mu.Unlock()
+
+	s.maint.wg.Add(1)
+	go func() {
+		defer s.maint.wg.Done()
+		defer cancel()
+		err := s.purge(ctx, p)
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.status.Duration = time.Since(p.status.Started)
+		switch {
+		case err == nil:
+			p.status.State = PurgeDone
+		case ctx.Err() != nil:
+			p.status.State = PurgeCancelled
+		default:
+			p.status.State = PurgeFailed
+			p.status.Error = err.Error()
+		}
+	}()
+	return id, nil
+}
+
+// purge ... delete the matching keys batch by batch until the scan is over or ctx is done
+func (s *Store) purge(ctx context.Context, p *purge) error {
+	var cursor uint64
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		keys, next, examined, err := s.scan(cursor, p.status.Match, purgeBatch)
+		if err != nil {
+			return err
+		}
+		var deleted uint64
+		for _, key := range keys {
+			if IsInternalKey(key) {
+				continue
+			}
+			ok, err := s.Delete(key)
+			if err != nil {
+				return err
+			}
+			if ok {
+				deleted++
+			}
+		}
+
+		p.mu.Lock()
+		p.status.Scanned += uint64(examined)
+		p.status.Deleted += deleted
+		p.mu.Unlock()
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// prune ... forget the oldest finished bulk deletes over purgeKeep
+func (ps *purges) prune() {
+	finished := 0
+	for _, p := range ps.list {
+		if p.state().State != PurgeRunning {
+			finished++
+		}
+	}
+	list := ps.list[:0]
+	for _, p := range ps.list {
+		if finished > purgeKeep && p.state().State != PurgeRunning {
+			finished--
+			continue
+		}
+		list = append(list, p)
+	}
+	ps.list = list
+}
+
+func (p *purge) state() PurgeStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status
+}
+
+// Purges ... status of the running and the last finished bulk deletes in the order of the start
+func (s *Store) Purges() []PurgeStatus {
+	s.purges.mu.Lock()
+	defer s.purges.mu.Unlock()
+	res := make([]PurgeStatus, 0, len(s.purges.list))
+	for _, p := range s.purges.list {
+		res = append(res, p.state())
+	}
+	return res
+}
+
+// PurgeStatus ... status of the bulk delete, common.ErrKeyNotFound for the unknown id
+func (s *Store) PurgeStatus(id uint64) (PurgeStatus, error) {
+	p, err := s.findPurge(id)
+	if err != nil {
+		return PurgeStatus{}, err
+	}
+	return p.state(), nil
+}
+
+// CancelPurge ... stop the bulk delete after the current batch, the deleted keys stay deleted
+func (s *Store) CancelPurge(id uint64) error {
+	p, err := s.findPurge(id)
+	if err != nil {
+		return err
+	}
+	p.cancel()
+	return nil
+}
+
+func (s *Store) findPurge(id uint64) (*purge, error) {
+	s.purges.mu.Lock()
+	defer s.purges.mu.Unlock()
+	for _, p := range s.purges.list {
+		if p.status.ID == id {
+			return p, nil
+		}
+	}
+	return nil, common.ErrKeyNotFound
+}
+
+// escapeGlob ... the pattern matching the string literally
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
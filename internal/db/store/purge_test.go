@@ -0,0 +1,89 @@
+package store
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/DenzelPenzel/nyx/internal/common"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_DeleteMatch(t *testing.T) {
+	os.RemoveAll(dirName)
+	defer os.RemoveAll(dirName)
+
+	s, err := Open(Dir(dirName), ShardsTotal(8), ShardsCollision(1))
+	require.NoError(t, err)
+	defer s.Close()
+
+	n := 2000
+	for i := 0; i < n; i++ {
+		require.NoError(t, s.Set([]byte("tenant:a:"+strconv.Itoa(i)), []byte("v"), 0))
+		require.NoError(t, s.Set([]byte("tenant:b:"+strconv.Itoa(i)), []byte("v"), 0))
+	}
+	require.NoError(t, s.Set([]byte("tenant*a"), []byte("v"), 0))
+	bkt, err := s.Bucket("tenant")
+	require.NoError(t, err)
+	require.NoError(t, s.Put(bkt, []byte("tenant:a:1"), []byte("v")))
+
+	wait := func(id uint64) PurgeStatus {
+		for {
+			status, err := s.PurgeStatus(id)
+			require.NoError(t, err)
+			if status.State != PurgeRunning {
+				return status
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	t.Run("prefix", func(t *testing.T) {
+		id, err := s.DeletePrefix([]byte("tenant:a:"))
+		require.NoError(t, err)
+		status := wait(id)
+		require.Equal(t, PurgeDone, status.State)
+		require.Equal(t, uint64(n), status.Deleted)
+		require.Equal(t, "tenant:a:*", status.Match)
+		// all the keys are examined, not only the matching ones
+		require.GreaterOrEqual(t, status.Scanned, uint64(2*n+1))
+
+		_, err = s.Get([]byte("tenant:a:7"))
+		require.ErrorIs(t, err, common.ErrKeyNotFound)
+		_, err = s.Get([]byte("tenant:b:7"))
+		require.NoError(t, err)
+		_, err = s.Get([]byte("tenant*a"))
+		require.NoError(t, err)
+		val, err := s.BucketGet(bkt, []byte("tenant:a:1"))
+		require.NoError(t, err)
+		require.Equal(t, "v", string(val))
+	})
+
+	t.Run("match", func(t *testing.T) {
+		id, err := s.DeleteMatch("tenant:b:1*")
+		require.NoError(t, err)
+		status := wait(id)
+		require.Equal(t, PurgeDone, status.State)
+		require.Equal(t, uint64(1111), status.Deleted)
+		_, err = s.Get([]byte("tenant:b:2"))
+		require.NoError(t, err)
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		for i := 0; i < n; i++ {
+			require.NoError(t, s.Set([]byte("tenant:c:"+strconv.Itoa(i)), []byte("v"), 0))
+		}
+		id, err := s.DeleteMatch("*")
+		require.NoError(t, err)
+		require.NoError(t, s.CancelPurge(id))
+		status := wait(id)
+		require.Equal(t, PurgeCancelled, status.State)
+		require.Less(t, status.Deleted, uint64(n))
+		require.Len(t, s.Purges(), 3)
+
+		require.ErrorIs(t, s.CancelPurge(100), common.ErrKeyNotFound)
+		_, err = s.DeleteMatch("")
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,145 @@
+package store
+
+import (
+	"errors"
+
+	"github.com/DenzelPenzel/nyx/internal/db/store/shard"
+)
+
+// DefaultScanCount ... number of the keys examined by a Scan call without the count
+const DefaultScanCount = 10
+
+// Scan ... iterate the keys of the store, cursor 0 starts the iteration and the returned cursor
+// continues it, the returned 0 means the iteration is over. About count keys are examined per call,
+// the ones matching the glob pattern are returned, an empty pattern matches every key.
+// A key present for the whole iteration is returned exactly once, the keys written
+// or deleted meanwhile may be returned or not. The expired keys are skipped
+func (s *Store) Scan(cursor uint64, match string, count int) ([][]byte, uint64, error) {
+	keys, next, _, err := s.scan(cursor, match, count)
+	return keys, next, err
+}
+
+// scan ... same as Scan, also returns the number of the keys examined
+func (s *Store) scan(cursor uint64, match string, count int) ([][]byte, uint64, int, error) {
+	if count <= 0 {
+		count = DefaultScanCount
+	}
+	// shard index | hash to resume from
+	i, from := int(cursor>>32), cursor&(shard.ScanDone-1)
+	if i >= len(s.shards) {
+		return nil, 0, 0, errors.New("wrong scan cursor")
+	}
+
+	var res [][]byte
+	examined := 0
+	for i < len(s.shards) && examined < count {
+		err := s.waitShard(i)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		keys, next, err := s.shards[i].ScanKeys(from, count-examined)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		examined += len(keys)
+		for _, key := range keys {
+			if match == "" || matchGlob(match, string(key)) {
+				res = append(res, key)
+			}
+		}
+		from = next
+		if next == shard.ScanDone {
+			i, from = i+1, 0
+		}
+	}
+
+	if i >= len(s.shards) {
+		return res, 0, examined, nil
+	}
+	return res, uint64(i)<<32 | from, examined, nil
+}
+
+// matchGlob ... the glob pattern matches the whole string: * matches any run of bytes,
+// ? any single byte, [abc], [a-z] and [^a-z] a byte of the set, \ escapes the next byte
+func matchGlob(pattern, s string) bool {
+	// position to retry the last star from
+	star, retry := -1, 0
+	p, i := 0, 0
+	for i < len(s) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				star, retry = p, i
+				p++
+				continue
+			case '?':
+				p++
+				i++
+				continue
+			case '[':
+				if end, ok := matchClass(pattern, p, s[i]); end > 0 {
+					if ok {
+						p, i = end, i+1
+						continue
+					}
+				} else if s[i] == '[' {
+					// unterminated set is a literal
+					p++
+					i++
+					continue
+				}
+			case '\\':
+				if p+1 < len(pattern) && pattern[p+1] == s[i] {
+					p, i = p+2, i+1
+					continue
+				}
+			default:
+				if pattern[p] == s[i] {
+					p++
+					i++
+					continue
+				}
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		retry++
+		p, i = star+1, retry
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchClass ... the byte is in the set starting at pattern[p] == '[', returns the position after the set,
+// 0 if the set isn't terminated
+func matchClass(pattern string, p int, c byte) (int, bool) {
+	p++
+	negate := p < len(pattern) && (pattern[p] == '^' || pattern[p] == '!')
+	if negate {
+		p++
+	}
+	matched := false
+	for first := true; p < len(pattern); first = false {
+		if pattern[p] == ']' && !first {
+			return p + 1, matched != negate
+		}
+		lo := pattern[p]
+		if lo == '\\' && p+1 < len(pattern) {
+			p++
+			lo = pattern[p]
+		}
+		hi := lo
+		if p+2 < len(pattern) && pattern[p+1] == '-' && pattern[p+2] != ']' {
+			hi = pattern[p+2]
+			p += 2
+		}
+		if lo <= c && c <= hi {
+			matched = true
+		}
+		p++
+	}
+	return 0, false
+}
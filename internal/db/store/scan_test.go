@@ -0,0 +1,119 @@
+package store
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_MatchGlob(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		key     string
+		match   bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "users:1", false},
+		{"*:1", "user:1", true},
+		{"*:1", "user:12", false},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"key[0-9]", "key7", true},
+		{"key[0-9]", "keyx", false},
+		{"a\\*b", "a*b", true},
+		{"a\\*b", "axb", false},
+		{"a[b", "a[b", true},
+	}
+	for _, tc := range testCases {
+		require.Equal(t, tc.match, matchGlob(tc.pattern, tc.key), "%s %s", tc.pattern, tc.key)
+	}
+}
+
+func Test_Scan(t *testing.T) {
+	coldDir := "-db-cold-test-"
+	os.RemoveAll(dirName)
+	os.RemoveAll(coldDir)
+	defer os.RemoveAll(dirName)
+	defer os.RemoveAll(coldDir)
+
+	s, err := Open(Dir(dirName), ColdDir(coldDir), ShardsTotal(8), ShardsCollision(1), InlineMax(8))
+	require.NoError(t, err)
+	defer s.Close()
+
+	n := 500
+	for i := 0; i < n; i++ {
+		require.NoError(t, s.Set([]byte("key"+strconv.Itoa(i)), []byte("value"+strconv.Itoa(i)), 0))
+	}
+	require.NoError(t, s.Set([]byte("expired"), []byte("v"), uint32(time.Now().Unix()-1)))
+	// half of the keys are cold
+	s.tierAfter = -time.Second
+	require.NoError(t, s.tierCycle(context.Background()))
+	for i := 0; i < n; i += 2 {
+		_, err := s.Get([]byte("key" + strconv.Itoa(i)))
+		require.NoError(t, err)
+	}
+
+	scan := func(match string, count int, during func(int)) map[string]int {
+		seen := make(map[string]int)
+		cursor, calls := uint64(0), 0
+		for {
+			keys, next, err := s.Scan(cursor, match, count)
+			require.NoError(t, err)
+			for _, k := range keys {
+				seen[string(k)]++
+			}
+			calls++
+			if during != nil {
+				during(calls)
+			}
+			if next == 0 {
+				return seen
+			}
+			cursor = next
+		}
+	}
+
+	t.Run("all keys once", func(t *testing.T) {
+		seen := scan("", 7, nil)
+		require.Len(t, seen, n)
+		for i := 0; i < n; i++ {
+			require.Equal(t, 1, seen["key"+strconv.Itoa(i)])
+		}
+	})
+
+	t.Run("match", func(t *testing.T) {
+		seen := scan("key4?", 100, nil)
+		require.Len(t, seen, 10)
+		require.Equal(t, 1, seen["key42"])
+	})
+
+	t.Run("concurrent writes", func(t *testing.T) {
+		// the kept keys grow and move to other slots, new keys come and the removed ones go
+		seen := scan("key*", 10, func(call int) {
+			for i := call; i < n; i += 50 {
+				require.NoError(t, s.Set([]byte("key"+strconv.Itoa(i)), []byte("a much longer value "+strconv.Itoa(i)), 0))
+			}
+			require.NoError(t, s.Set([]byte("key"+strconv.Itoa(n+call)), []byte("new"), 0))
+			_, err := s.Delete([]byte("key" + strconv.Itoa(n-call)))
+			require.NoError(t, err)
+		})
+		for i := 0; i < n/2; i++ {
+			require.Equal(t, 1, seen["key"+strconv.Itoa(i)], i)
+		}
+	})
+
+	_, _, err = s.Scan(uint64(100)<<32, "", 10)
+	require.Error(t, err)
+}
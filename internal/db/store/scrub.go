@@ -0,0 +1,107 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	// scrubStep ... bytes of the shard file checked under a single shard lock
+	scrubStep = 1 << 20
+	// scrubRecent ... number of the last findings kept in the scrub status
+	scrubRecent = 16
+)
+
+// ScrubStatus ... progress and findings of the background scrubber
+type ScrubStatus struct {
+	Shard       int   // shard being checked
+	Offset      int64 // position in the shard file
+	Passes      uint64
+	LastPass    time.Time
+	Bytes       uint64
+	Records     uint64
+	Findings    uint64
+	Quarantined uint64
+	Recent      []string
+}
+
+// ScrubStatus ... current scrub progress and the last findings
+func (s *Store) ScrubStatus() ScrubStatus {
+	s.scrubMu.Lock()
+	defer s.scrubMu.Unlock()
+	st := s.scrub
+	st.Recent = append([]string(nil), s.scrub.Recent...)
+	return st
+}
+
+// scrubCycle ... continue the walk over the shard files from the position where the previous run stopped.
+// The run ends at the end of the pass over all the shards or once the budget is spent,
+// the read rate is limited by the scrub rate
+func (s *Store) scrubCycle(ctx context.Context, budget Budget) error {
+	start := time.Now()
+	var read int64
+	found := 0
+	for !budget.spent(start, read) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		s.scrubMu.Lock()
+		i, from := s.scrub.Shard, s.scrub.Offset
+		s.scrubMu.Unlock()
+
+		stepStart := time.Now()
+		res, err := s.shards[i].Scrub(from, scrubStep, s.scrubQuarantine)
+		read += res.Bytes
+		found += len(res.Findings)
+
+		s.scrubMu.Lock()
+		s.scrub.Bytes += uint64(res.Bytes)
+		s.scrub.Records += uint64(res.Records)
+		s.scrub.Findings += uint64(len(res.Findings))
+		s.scrub.Quarantined += uint64(res.Quarantined)
+		for _, f := range res.Findings {
+			s.scrub.Recent = append(s.scrub.Recent, fmt.Sprintf("shard %d: %s", i, f))
+		}
+		if len(s.scrub.Recent) > scrubRecent {
+			s.scrub.Recent = s.scrub.Recent[len(s.scrub.Recent)-scrubRecent:]
+		}
+		// the broken shard is skipped till the next pass
+		s.scrub.Offset = res.Next
+		passed := false
+		if res.Next == 0 || err != nil {
+			s.scrub.Offset = 0
+			s.scrub.Shard = (i + 1) % s.shardsCount
+			if s.scrub.Shard == 0 {
+				s.scrub.Passes++
+				s.scrub.LastPass = time.Now()
+				passed = true
+			}
+		}
+		s.scrubMu.Unlock()
+
+		if err != nil {
+			return fmt.Errorf("shard %d: %w", i, err)
+		}
+		if passed {
+			break
+		}
+		err = budget.pause(ctx, time.Since(stepStart))
+		if err != nil {
+			return err
+		}
+		if s.scrubRate > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(res.Bytes * int64(time.Second) / s.scrubRate)):
+			}
+		}
+	}
+
+	if found > 0 {
+		return fmt.Errorf("found %d records inconsistent with the index", found)
+	}
+	return nil
+}
@@ -0,0 +1,470 @@
+package shard
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/DenzelPenzel/nyx/internal/common"
+)
+
+const (
+	manifestHead = 8 + 4 // value size + chunks count
+	chunkRefSize = 4 + 1 // addr + size
+
+	// minChunkPayload ... lower bound of the chunk payload for the very long keys
+	minChunkPayload = 1 << 10
+)
+
+// ErrChunkReleased ... the chunk isn't pinned by the reader, the reader of the value is closed
+var ErrChunkReleased = errors.New("chunk of the value was released")
+
+// ChunkRef ... location of the chunk in the shard file
+type ChunkRef struct {
+	Addr uint32
+	Size byte
+}
+
+// Manifest ... list of the chunks of the large value.
+// The chunks are stored in the same shard as the manifest record and aren't indexed by themselves
+type Manifest struct {
+	Size   uint64
+	Chunks []ChunkRef
+}
+
+// ParseManifest ... decode the value of the chunked record
+func ParseManifest(b []byte) (*Manifest, error) {
+	if len(b) < manifestHead {
+		return nil, errors.New("short chunks manifest")
+	}
+	m := &Manifest{Size: binary.BigEndian.Uint64(b[0:8])}
+	cnt := int(binary.BigEndian.Uint32(b[8:12]))
+	if len(b) != manifestHead+cnt*chunkRefSize {
+		return nil, errors.New("wrong chunks manifest length")
+	}
+	m.Chunks = make([]ChunkRef, cnt)
+	for i := range m.Chunks {
+		off := manifestHead + i*chunkRefSize
+		m.Chunks[i] = ChunkRef{Addr: binary.BigEndian.Uint32(b[off : off+4]), Size: b[off+4]}
+	}
+	return m, nil
+}
+
+func (m *Manifest) marshal() []byte {
+	b := make([]byte, manifestHead+len(m.Chunks)*chunkRefSize)
+	binary.BigEndian.PutUint64(b[0:8], m.Size)
+	binary.BigEndian.PutUint32(b[8:12], uint32(len(m.Chunks)))
+	for i, ref := range m.Chunks {
+		off := manifestHead + i*chunkRefSize
+		binary.BigEndian.PutUint32(b[off:off+4], ref.Addr)
+		b[off+4] = ref.Size
+	}
+	return b
+}
+
+// ChunkPayload ... max data size of the single chunk of the key, 0 - chunking is disabled.
+// The chunk record fills the biggest slot within the chunk size
+func (s *Shard) ChunkPayload(k []byte) int {
+	if s.chunkSize <= 0 {
+		return 0
+	}
+	n := int(s.classes.floor(int64(s.chunkSize))) - int(sizeHead) - len(k)
+	if n < minChunkPayload {
+		n = minChunkPayload
+	}
+	return n
+}
+
+// Owns ... the key can be stored in the shard: the hash is free or belongs to the same key
+func (s *Shard) Owns(k []byte, h uint32) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	_, _, err := s.lookup(k, h)
+	if errors.Is(err, common.ErrCollision) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// WriteChunk ... write the piece of the large value to the free slot.
+// The chunk stays invisible until the manifest referencing it is written by SetChunked
+func (s *Shard) WriteChunk(k, data []byte) (ChunkRef, error) {
+	s.Lock()
+	defer s.Unlock()
+	ref, err := s.writeChunk(k, data)
+	if err == nil {
+		s.pending[ref.Addr] = ref.Size
+	}
+	return ref, err
+}
+
+// ReleaseChunks ... free the chunks which are not referenced by any manifest, e.g. after a failed upload
+func (s *Shard) ReleaseChunks(refs []ChunkRef) {
+	s.Lock()
+	defer s.Unlock()
+	for _, ref := range refs {
+		delete(s.pending, ref.Addr)
+	}
+	s.releaseRefs(refs)
+}
+
+// SetChunked ... write the manifest of the large value, the previous value of the key is released
+func (s *Shard) SetChunked(k []byte, h uint32, m *Manifest, expire, flags uint32) error {
+	s.Lock()
+	defer s.Unlock()
+	err := s.notify(k, h)
+	if err != nil {
+		return err
+	}
+	oldAddr, oldSize, err := s.lookup(k, h)
+	if err == nil {
+		err = s.setManifest(k, h, m, expire, flags, oldAddr, oldSize)
+	}
+	if err == nil {
+		for _, ref := range m.Chunks {
+			delete(s.pending, ref.Addr)
+		}
+	}
+	return err
+}
+
+// GetChunked ... same as Get, but for the chunked value only the manifest is returned,
+// so the caller can read the chunks one by one with ReadChunk. The chunks are pinned:
+// they aren't reused by the newer values until the caller releases them with UnpinChunks
+func (s *Shard) GetChunked(k []byte, h uint32) ([]byte, *Manifest, *Header, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.GetChunkedLocked(k, h)
+}
+
+// GetChunkedLocked ... same as GetChunked, the caller holds the lock
+func (s *Shard) GetChunkedLocked(k []byte, h uint32) ([]byte, *Manifest, *Header, error) {
+	header, val, err := s.getRecord(k, h)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if header.status == statusManifest {
+		m, err := ParseManifest(val)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		for _, ref := range m.Chunks {
+			s.pinned[ref.Addr]++
+		}
+		return nil, m, header, nil
+	}
+	val, err = s.resolve(header, val)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return val, nil, header, nil
+}
+
+// ReadChunk ... read the chunk of the key's large value pinned by GetChunked.
+// The value may be replaced or removed meanwhile, the pinned chunk keeps its data until it's unpinned
+func (s *Shard) ReadChunk(k []byte, ref ChunkRef) ([]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if s.pinned[ref.Addr] == 0 {
+		return nil, ErrChunkReleased
+	}
+	return s.readChunk(k, ref)
+}
+
+// UnpinChunks ... release the chunks pinned by GetChunked, the chunks released by the value
+// meanwhile are freed with their last pin
+func (s *Shard) UnpinChunks(refs []ChunkRef) {
+	s.Lock()
+	defer s.Unlock()
+	for _, ref := range refs {
+		s.pinned[ref.Addr]--
+		if s.pinned[ref.Addr] > 0 {
+			continue
+		}
+		delete(s.pinned, ref.Addr)
+		if size, ok := s.retired[ref.Addr]; ok {
+			delete(s.retired, ref.Addr)
+			s.remapping[ref.Addr] = size
+		}
+	}
+}
+
+func (s *Shard) readChunk(k []byte, ref ChunkRef) ([]byte, error) {
+	bb := make([]byte, s.classes.size(ref.Size))
+	_, err := s.f.ReadAt(bb, int64(ref.Addr))
+	if err != nil {
+		return nil, err
+	}
+	header, key, val := unmarshal(bb)
+	if header.status != statusChunk || !bytes.Equal(key, k) {
+		return nil, errors.New("corrupted chunk of the value")
+	}
+	return val, nil
+}
+
+// readChunked ... assemble the whole large value
+func (s *Shard) readChunked(k []byte, m *Manifest) ([]byte, error) {
+	v := make([]byte, 0, m.Size)
+	for _, ref := range m.Chunks {
+		chunk, err := s.readChunk(k, ref)
+		if err != nil {
+			return nil, err
+		}
+		v = append(v, chunk...)
+	}
+	if uint64(len(v)) < m.Size {
+		return nil, errors.New("short chunked value")
+	}
+	return v[:m.Size], nil
+}
+
+// alloc ... take the free slot of the given size or the end of the file
+func (s *Shard) alloc(size byte) (int64, error) {
+	for addr, sizeh := range s.remapping {
+		if sizeh == size {
+			delete(s.remapping, addr)
+			return int64(addr), nil
+		}
+	}
+	return s.f.Seek(0, 2)
+}
+
+// free ... release the slot of the removed record together with the chunks of the large value
+// or the reference to the shared value
+func (s *Shard) free(addr uint32, size byte) {
+	s.remapping[addr] = size
+	s.releaseChunked(addr)
+	s.releaseRef(addr)
+}
+
+func (s *Shard) releaseChunked(addr uint32) {
+	if refs, ok := s.chunked[addr]; ok {
+		delete(s.chunked, addr)
+		s.releaseRefs(refs)
+	}
+}
+
+// releaseRefs ... free the chunks, the chunks pinned by the readers are freed by the last UnpinChunks
+func (s *Shard) releaseRefs(refs []ChunkRef) {
+	for _, ref := range refs {
+		if s.pinned[ref.Addr] > 0 {
+			s.retired[ref.Addr] = ref.Size
+			continue
+		}
+		s.remapping[ref.Addr] = ref.Size
+	}
+}
+
+func (s *Shard) writeChunk(k, data []byte) (ChunkRef, error) {
+	header, b := s.marshal(k, data, 0, 0)
+	header.status = statusChunk
+	b[1] = statusChunk
+
+	pos, err := s.alloc(header.sizeByte)
+	if err != nil {
+		return ChunkRef{}, err
+	}
+	err = s.writeAt(b, uint32(pos), pos)
+	if err != nil {
+		s.remapping[uint32(pos)] = header.sizeByte
+		return ChunkRef{}, err
+	}
+	s.useFsync = true
+	return ChunkRef{Addr: uint32(pos), Size: header.sizeByte}, nil
+}
+
+// writeChunks ... split the data into chunks and write them
+func (s *Shard) writeChunks(k, data []byte) ([]ChunkRef, error) {
+	payload := s.ChunkPayload(k)
+	refs := make([]ChunkRef, 0, len(data)/payload+1)
+	for len(data) > 0 {
+		n := min(payload, len(data))
+		ref, err := s.writeChunk(k, data[:n])
+		if err != nil {
+			s.releaseRefs(refs)
+			return nil, err
+		}
+		refs = append(refs, ref)
+		data = data[n:]
+	}
+	return refs, nil
+}
+
+// setManifest ... write the manifest record in place of the old record of the key.
+// The chunks of the old value which aren't used by the new one are released
+func (s *Shard) setManifest(k []byte, h uint32, m *Manifest, expire, flags uint32, oldAddr int64, oldSize byte) error {
+	var old []ChunkRef
+	if oldAddr >= 0 {
+		old = s.chunked[uint32(oldAddr)]
+		delete(s.chunked, uint32(oldAddr))
+	}
+
+	header, b := s.marshal(k, m.marshal(), expire, flags)
+	header.status = statusManifest
+	b[1] = statusManifest
+	err := s.put(h, header, b, oldAddr, oldSize)
+	if err != nil {
+		return err
+	}
+
+	addr, _, _ := Decode(s.mapping[h])
+	s.chunked[addr] = m.Chunks
+
+	old = slices.DeleteFunc(old, func(ref ChunkRef) bool {
+		return slices.Contains(m.Chunks, ref)
+	})
+	s.releaseRefs(old)
+	return nil
+}
+
+// concatChunked ... append or prepend the data to the chunked value.
+// Prepend adds new chunks in front, append fills the last chunk first
+func (s *Shard) concatChunked(k []byte, h uint32, addr uint32, size byte, header *Header, val, data []byte, prepend bool) error {
+	m, err := ParseManifest(val)
+	if err != nil {
+		return err
+	}
+	if s.maxValue > 0 && int64(m.Size)+int64(len(data)) > s.maxValue {
+		return common.ErrValueTooBig
+	}
+
+	refs := slices.Clone(m.Chunks)
+	if prepend {
+		newRefs, err := s.writeChunks(k, data)
+		if err != nil {
+			return err
+		}
+		refs = append(newRefs, refs...)
+	} else if len(refs) > 0 {
+		rest, err := s.fillChunk(k, refs, data)
+		if err != nil {
+			return err
+		}
+		newRefs, err := s.writeChunks(k, rest)
+		if err != nil {
+			return err
+		}
+		refs = append(refs, newRefs...)
+	}
+
+	m = &Manifest{Size: m.Size + uint64(len(data)), Chunks: refs}
+	return s.setManifest(k, h, m, header.expire, header.flags, int64(addr), size)
+}
+
+// fillChunk ... append the head of the data to the last chunk up to the chunk payload.
+// The last ref is replaced if the chunk had to be moved, the rest of the data is returned
+func (s *Shard) fillChunk(k []byte, refs []ChunkRef, data []byte) ([]byte, error) {
+	last := refs[len(refs)-1]
+	bb := make([]byte, s.classes.size(last.Size))
+	_, err := s.f.ReadAt(bb, int64(last.Addr))
+	if err != nil {
+		return nil, err
+	}
+	header, key, val := unmarshal(bb)
+
+	fill := min(s.ChunkPayload(k)-len(val), len(data))
+	if fill <= 0 {
+		return data, nil
+	}
+
+	if uint64(sizeHead)+uint64(header.keyLength)+uint64(len(val)+fill) > uint64(s.classes.size(last.Size)) {
+		v := make([]byte, 0, len(val)+fill)
+		v = append(append(v, val...), data[:fill]...)
+		ref, err := s.writeChunk(k, v)
+		if err != nil {
+			return nil, err
+		}
+		refs[len(refs)-1] = ref
+		return data[fill:], nil
+	}
+
+	oldValLength := header.valLength
+	header.valLength += uint32(fill)
+	b := make([]byte, 0, fill+len(key))
+	b = append(append(b, data[:fill]...), key...)
+	err = s.writeAt(b, last.Addr, int64(last.Addr+sizeHead+oldValLength))
+	if err != nil {
+		return nil, err
+	}
+	hb := make([]byte, sizeHead)
+	writeHeader(hb, header)
+	err = s.writeAt(hb, last.Addr, int64(last.Addr))
+	if err != nil {
+		return nil, err
+	}
+	return data[fill:], nil
+}
+
+// getRecord ... read the raw record of the key, expired record is removed from the index
+func (s *Shard) getRecord(k []byte, h uint32) (*Header, []byte, error) {
+	err := s.warm(h)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, ok := s.mapping[h]
+	if !ok {
+		return nil, nil, common.ErrKeyNotFound
+	}
+	addr, size, expire := Decode(data)
+
+	if expire != 0 && int64(expire) < time.Now().Unix() {
+		s.removeEntry(h)
+		s.free(addr, size)
+		return nil, nil, ErrKeyExpired
+	}
+
+	if header, val, ok := s.getInline(k, h); ok {
+		if header.expire != 0 && int64(header.expire) < time.Now().Unix() {
+			s.removeEntry(h)
+			s.free(addr, size)
+			return nil, nil, ErrKeyExpired
+		}
+		return header, val, nil
+	}
+
+	bb := make([]byte, s.classes.size(size))
+	_, err = s.f.ReadAt(bb, int64(addr))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header, key, val := unmarshal(bb)
+	if !bytes.Equal(key, k) {
+		return nil, nil, common.ErrCollision
+	}
+
+	if header.expire != 0 && int64(header.expire) < time.Now().Unix() {
+		s.removeEntry(h)
+		s.free(addr, size)
+		return nil, nil, ErrKeyExpired
+	}
+	return header, val, nil
+}
+
+// lookup ... address and size of the key record, -1 if the key isn't in the shard
+func (s *Shard) lookup(k []byte, h uint32) (int64, byte, error) {
+	err := s.warm(h)
+	if err != nil {
+		return -1, 0, err
+	}
+	data, ok := s.mapping[h]
+	if !ok {
+		return -1, 0, nil
+	}
+	addr, size, _ := Decode(data)
+	if rec, ok := s.inline[h]; ok && bytes.Equal(rec.key, k) {
+		return int64(addr), size, nil
+	}
+	bb := make([]byte, s.classes.size(size))
+	_, err = s.f.ReadAt(bb, int64(addr))
+	if err != nil {
+		return -1, 0, err
+	}
+	_, key, _ := unmarshal(bb)
+	if !bytes.Equal(key, k) {
+		return -1, 0, common.ErrCollision
+	}
+	return int64(addr), size, nil
+}
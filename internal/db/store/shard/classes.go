@@ -0,0 +1,137 @@
+package shard
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+const (
+	// DefaultSlotGrowth ... growth of the slot sizes in percent, every next size class is 1.25x bigger
+	DefaultSlotGrowth = 125
+	MinSlotGrowth     = 110
+	// MaxSlotGrowth ... the slot sizes are powers of two, the only classes of the v2 files
+	MaxSlotGrowth = 200
+
+	// maxSlot ... the biggest record
+	maxSlot = 1 << 31
+)
+
+// sizeClasses ... slot sizes of the records of a file, the record header keeps the index of its class.
+// Every class is the growth percent of the previous one, starting at 1 byte
+type sizeClasses struct {
+	growth byte
+	slots  []int64
+}
+
+var (
+	classTablesMu sync.Mutex
+	classTables   = make(map[int]*sizeClasses)
+)
+
+// powerOfTwo ... size classes of the files before v3
+var powerOfTwo = sizeClassesFor(MaxSlotGrowth)
+
+// sizeClassesFor ... the table of the growth, the tables are shared, so they can be compared by pointer
+func sizeClassesFor(growth int) *sizeClasses {
+	classTablesMu.Lock()
+	defer classTablesMu.Unlock()
+	if c, ok := classTables[growth]; ok {
+		return c
+	}
+	c := &sizeClasses{growth: byte(growth), slots: []int64{1}}
+	for last := int64(1); last < maxSlot; {
+		last = max(last+1, (last*int64(growth)+99)/100)
+		c.slots = append(c.slots, min(last, maxSlot))
+	}
+	classTables[growth] = c
+	return c
+}
+
+// SlotGrowth ... growth of the slot sizes in percent for the new files and the compacted ones,
+// 110 to 200, default DefaultSlotGrowth. The lower growth wastes less space on the padding,
+// but the free slots are less likely to be reused by a record of another size
+func SlotGrowth(growth int) OptShard {
+	return func(s *Shard) {
+		s.growth = growth
+	}
+}
+
+// ValidSlotGrowth ... the growth is in the supported range
+func ValidSlotGrowth(growth int) bool {
+	return growth >= MinSlotGrowth && growth <= MaxSlotGrowth
+}
+
+// slotClasses ... configured classes of the new files
+func (s *Shard) slotClasses() *sizeClasses {
+	if !ValidSlotGrowth(s.growth) {
+		return sizeClassesFor(DefaultSlotGrowth)
+	}
+	return sizeClassesFor(s.growth)
+}
+
+// size ... slot size of the class
+func (c *sizeClasses) size(class byte) int64 {
+	if int(class) >= len(c.slots) {
+		return maxSlot
+	}
+	return c.slots[class]
+}
+
+// classOf ... the smallest class which fits the record of n bytes
+func (c *sizeClasses) classOf(n uint64) byte {
+	for i, slot := range c.slots {
+		if uint64(slot) >= n {
+			return byte(i)
+		}
+	}
+	return byte(len(c.slots) - 1)
+}
+
+// floor ... the biggest slot not exceeding n bytes
+func (c *sizeClasses) floor(n int64) int64 {
+	res := c.slots[0]
+	for _, slot := range c.slots {
+		if slot > n {
+			break
+		}
+		res = slot
+	}
+	return res
+}
+
+// fileHead ... version prefix of the file with the classes
+func (c *sizeClasses) fileHead() []byte {
+	return []byte{versionMarker, currentShardVer, c.growth}
+}
+
+// readClasses ... size classes of the file of the version and the offset of its first record,
+// the v3 prefix is followed by the growth byte
+func readClasses(r io.Reader, ver int) (*sizeClasses, int64, error) {
+	if ver < 3 {
+		return powerOfTwo, 2, nil
+	}
+	b := make([]byte, 1)
+	_, err := io.ReadFull(r, b)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !ValidSlotGrowth(int(b[0])) {
+		return nil, 0, errors.New("wrong slot growth of the shard file")
+	}
+	return sizeClassesFor(int(b[0])), 3, nil
+}
+
+// reslot ... copy of the record in the slot of the target classes, returns the new class
+func reslot(b []byte, from, to *sizeClasses) ([]byte, byte) {
+	if from == to {
+		return b, b[0]
+	}
+	header := parseHeader(b, currentShardVer)
+	n := uint64(sizeHead) + uint64(header.keyLength) + uint64(header.valLength)
+	class := to.classOf(n)
+	nb := make([]byte, to.size(class))
+	copy(nb, b[:n])
+	nb[0] = class
+	return nb, class
+}
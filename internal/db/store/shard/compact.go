@@ -0,0 +1,333 @@
+package shard
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+)
+
+const compactSuffix = ".compact"
+
+// slot ... address and class of a record in the shard file
+type slot struct {
+	addr uint32
+	size byte
+}
+
+// compaction ... unfinished compaction of the shard. The live slots are copied to the new file
+// step by step, a slot written since its copy is copied again, the file is replaced by the last step
+type compaction struct {
+	f       *os.File
+	name    string
+	classes *sizeClasses
+	pos     int64
+	order   []slot            // live slots at the start in the file order
+	next    int               // the first slot of order not visited yet
+	copies  map[uint32]slot   // copies of the old slots in the new file
+	deps    map[uint32]uint32 // chunk slot / the manifest slot whose copy refers to the copy of the chunk
+	garbage []slot            // stale copies, marked deleted before the file is replaced
+}
+
+// invalidate ... drop the copy of the changed slot, the copy of the manifest referring to the slot as well
+func (c *compaction) invalidate(addr uint32) {
+	cp, ok := c.copies[addr]
+	if !ok {
+		return
+	}
+	delete(c.copies, addr)
+	c.garbage = append(c.garbage, cp)
+	if m, ok := c.deps[addr]; ok {
+		delete(c.deps, addr)
+		c.invalidate(m)
+	}
+}
+
+// FreeSize ... total size of the free slots and the file size
+func (s *Shard) FreeSize() (int64, int64, error) {
+	s.RLock()
+	defer s.RUnlock()
+	var free int64
+	for _, size := range s.remapping {
+		free += s.classes.size(size)
+	}
+	fi, err := s.f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	return free, fi.Size(), nil
+}
+
+// CompactDue ... the compaction of the shard is started and not finished yet, the file has other classes
+// than the configured ones or at least a half of the file and minFree bytes are free
+func (s *Shard) CompactDue(minFree int64) (bool, error) {
+	s.RLock()
+	compacting, classes := s.compaction != nil, s.classes
+	s.RUnlock()
+	if compacting || classes != s.slotClasses() {
+		return true, nil
+	}
+	free, size, err := s.FreeSize()
+	if err != nil {
+		return false, err
+	}
+	return free >= minFree && 2*free >= size, nil
+}
+
+// CompactStep ... copy about limit bytes of the live records to the new shard file without the free slots,
+// returns the number of read and written bytes and true once the compaction is finished.
+// The shard is locked only for the step, the slots written between the steps are copied again.
+// The file is replaced by the step which copies the rest of the changed slots,
+// while there is an unfinished streamed write or the chunks are pinned by the open value readers
+// the replacement waits, their chunks would lose the addresses.
+// The new file gets the configured size classes, so the files of older versions are converted
+func (s *Shard) CompactStep(limit int64) (int64, bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.compaction == nil {
+		err := s.startCompaction()
+		if err != nil {
+			return 0, true, err
+		}
+	}
+	c := s.compaction
+
+	var done int64
+	for c.next < len(c.order) && done < limit {
+		sl := c.order[c.next]
+		c.next++
+		_, copied := c.copies[sl.addr]
+		_, free := s.remapping[sl.addr]
+		_, retired := s.retired[sl.addr]
+		if copied || free || retired {
+			continue
+		}
+		n, err := s.copySlot(sl)
+		done += n
+		if err != nil {
+			return done, true, s.abortCompaction(err)
+		}
+	}
+	if c.next < len(c.order) {
+		return done, false, nil
+	}
+
+	// the slots written since the start are copied by the steps till the rest fits into a single step
+	live, rest := s.liveSlots()
+	var restSize int64
+	for _, sl := range rest {
+		restSize += s.classes.size(sl.size)
+	}
+	for _, sl := range rest {
+		if restSize > limit && done >= limit {
+			return done, false, nil
+		}
+		if _, ok := c.copies[sl.addr]; ok {
+			// copied along with its manifest
+			continue
+		}
+		n, err := s.copySlot(sl)
+		done += n
+		if err != nil {
+			return done, true, s.abortCompaction(err)
+		}
+	}
+	if restSize > limit || len(s.pending) > 0 || len(s.pinned) > 0 {
+		return done, false, nil
+	}
+
+	err := s.finishCompaction(live)
+	if err != nil {
+		return done, true, s.abortCompaction(err)
+	}
+	return done, true, nil
+}
+
+func (s *Shard) startCompaction() error {
+	name := s.name + compactSuffix
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.FileMode(0644))
+	if err != nil {
+		return err
+	}
+	classes := s.slotClasses()
+	head := classes.fileHead()
+	_, err = f.Write(head)
+	if err != nil {
+		return errors.Join(err, f.Close(), os.Remove(name))
+	}
+
+	_, order := s.liveSlots()
+	// keep the records in the file order, so the new file is written sequentially
+	slices.SortFunc(order, func(a, b slot) int {
+		return cmp.Compare(a.addr, b.addr)
+	})
+	s.compaction = &compaction{
+		f:       f,
+		name:    name,
+		classes: classes,
+		pos:     int64(len(head)),
+		order:   order,
+		copies:  make(map[uint32]slot),
+		deps:    make(map[uint32]uint32),
+	}
+	return nil
+}
+
+// abortCompaction ... drop the new file, the shard file is untouched
+func (s *Shard) abortCompaction(err error) error {
+	c := s.compaction
+	if c == nil {
+		return err
+	}
+	s.compaction = nil
+	return errors.Join(err, c.f.Close(), os.Remove(c.name))
+}
+
+// liveSlots ... the slots of the key records, the chunks and the shared values, and those of them not copied yet
+func (s *Shard) liveSlots() (map[uint32]bool, []slot) {
+	live := make(map[uint32]bool, len(s.mapping))
+	var rest []slot
+	add := func(sl slot) {
+		live[sl.addr] = true
+		if s.compaction != nil {
+			if _, ok := s.compaction.copies[sl.addr]; ok {
+				return
+			}
+		}
+		rest = append(rest, sl)
+	}
+	for _, entry := range s.mapping {
+		addr, size, _ := Decode(entry)
+		add(slot{addr: addr, size: size})
+		for _, ref := range s.chunked[addr] {
+			add(slot{addr: ref.Addr, size: ref.Size})
+		}
+	}
+	for _, b := range s.blobs {
+		add(slot{addr: b.addr, size: b.size})
+	}
+	return live, rest
+}
+
+// copySlot ... write the copy of the slot to the new file, returns the number of read and written bytes.
+// The copy of the manifest refers to the copies of its chunks, they are copied first
+func (s *Shard) copySlot(sl slot) (int64, error) {
+	c := s.compaction
+	b := make([]byte, s.classes.size(sl.size))
+	_, err := s.f.ReadAt(b, int64(sl.addr))
+	if err != nil {
+		return 0, err
+	}
+	done := int64(len(b))
+
+	if refs, ok := s.chunked[sl.addr]; ok {
+		newRefs := make([]ChunkRef, len(refs))
+		for i, ref := range refs {
+			cp, ok := c.copies[ref.Addr]
+			if !ok {
+				n, err := s.copySlot(slot{addr: ref.Addr, size: ref.Size})
+				done += n
+				if err != nil {
+					return done, err
+				}
+				cp = c.copies[ref.Addr]
+			}
+			newRefs[i] = ChunkRef{Addr: cp.addr, Size: cp.size}
+			c.deps[ref.Addr] = sl.addr
+		}
+		// the manifest keeps its length, only the chunk addresses are changed
+		header, _, val := unmarshal(b)
+		m, err := ParseManifest(val)
+		if err != nil {
+			return done, fmt.Errorf("manifest at %d: %w", sl.addr, err)
+		}
+		m.Chunks = newRefs
+		copy(b[sizeHead:sizeHead+header.valLength], m.marshal())
+	}
+
+	b, size := reslot(b, s.classes, c.classes)
+	_, err = c.f.WriteAt(b, c.pos)
+	if err != nil {
+		return done, err
+	}
+	c.copies[sl.addr] = slot{addr: uint32(c.pos), size: size}
+	c.pos += int64(len(b))
+	return done + int64(len(b)), nil
+}
+
+// finishCompaction ... replace the shard file by the new one, all the live slots are copied
+func (s *Shard) finishCompaction(live map[uint32]bool) error {
+	c := s.compaction
+	remapping := make(map[uint32]byte)
+	for addr, cp := range c.copies {
+		if !live[addr] {
+			c.garbage = append(c.garbage, cp)
+		}
+	}
+	for _, cp := range c.garbage {
+		_, err := c.f.WriteAt([]byte{deleted}, int64(cp.addr)+1)
+		if err != nil {
+			return err
+		}
+		remapping[cp.addr] = cp.size
+	}
+
+	err := c.f.Sync()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(c.name, s.name)
+	if err != nil {
+		return err
+	}
+	// the old file is unlinked already, close errors don't matter anymore
+	_ = s.f.Close()
+	s.f = wrapFile(s.fds, s.name, c.f)
+	s.compaction = nil
+
+	for h, entry := range s.mapping {
+		addr, _, _ := Decode(entry)
+		cp := c.copies[addr]
+		s.mapping[h] = uint64(cp.addr)<<32 | uint64(cp.size)<<24 | entry&0xffffff
+		if rec, ok := s.inline[h]; ok {
+			rec.header.sizeByte = cp.size
+		}
+	}
+	chunked := make(map[uint32][]ChunkRef, len(s.chunked))
+	for addr, refs := range s.chunked {
+		newRefs := make([]ChunkRef, len(refs))
+		for i, ref := range refs {
+			cp := c.copies[ref.Addr]
+			newRefs[i] = ChunkRef{Addr: cp.addr, Size: cp.size}
+		}
+		chunked[c.copies[addr].addr] = newRefs
+	}
+	deduped := make(map[uint32]blobKey, len(s.deduped))
+	for addr, key := range s.deduped {
+		deduped[c.copies[addr].addr] = key
+	}
+	for _, b := range s.blobs {
+		cp := c.copies[b.addr]
+		b.addr, b.size = cp.addr, cp.size
+	}
+	s.chunked = chunked
+	s.deduped = deduped
+	s.remapping = remapping
+	s.classes = c.classes
+	s.start = int64(len(c.classes.fileHead()))
+	s.useFsync = false
+	// the rename is durable only once the directory is synced
+	return SyncDir(s.name)
+}
+
+// writeAt ... write b at off into the slot starting at addr, the copy of the slot made by
+// the unfinished compaction is dropped, so the slot is copied again
+func (s *Shard) writeAt(b []byte, addr uint32, off int64) error {
+	if s.compaction != nil {
+		s.compaction.invalidate(addr)
+	}
+	_, err := s.f.WriteAt(b, off)
+	return err
+}
@@ -0,0 +1,176 @@
+package shard
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+)
+
+// blobKeySize ... the blob record is keyed by the sha256 of its value
+const blobKeySize = sha256.Size
+
+type blobKey [blobKeySize]byte
+
+// blob ... value shared by the keys with the same content.
+// The references aren't stored, they are counted on load from the key records
+type blob struct {
+	addr   uint32
+	size   byte
+	length uint32 // value length
+	refs   int
+}
+
+// DedupStats ... state of the values deduplication
+type DedupStats struct {
+	Blobs        int
+	Refs         int
+	StoredBytes  int64 // size of the shared values
+	LogicalBytes int64 // size of the values as seen by the keys
+}
+
+// Dedup ... values of at least this size are stored once per shard by the content hash,
+// the keys with the same value share the single blob record. Zero - deduplication is off.
+// Values split into chunks are never deduplicated
+func Dedup(threshold int) OptShard {
+	return func(s *Shard) {
+		s.dedupMin = threshold
+	}
+}
+
+// DedupStats ... number of the shared values and their references
+func (s *Shard) DedupStats() DedupStats {
+	s.RLock()
+	defer s.RUnlock()
+	var res DedupStats
+	for _, b := range s.blobs {
+		res.Blobs++
+		res.Refs += b.refs
+		res.StoredBytes += int64(b.length)
+		res.LogicalBytes += int64(b.length) * int64(b.refs)
+	}
+	return res
+}
+
+// dedupable ... the value is stored as the reference to the shared blob
+func (s *Shard) dedupable(k, v []byte) bool {
+	if s.dedupMin <= 0 || len(v) < s.dedupMin {
+		return false
+	}
+	payload := s.ChunkPayload(k)
+	return payload == 0 || len(v) <= payload
+}
+
+// writeRef ... write the key record referencing the shared blob with the value,
+// the blob is written first if the shard has no such value yet
+func (s *Shard) writeRef(k, v []byte, h, expire, flags uint32, oldAddr int64, oldSize byte) error {
+	key := blobKey(sha256.Sum256(v))
+	b, ok := s.blobs[key]
+	if !ok {
+		header, rec := s.marshal(key[:], v, 0, 0)
+		header.status = statusBlob
+		rec[1] = statusBlob
+		pos, err := s.alloc(header.sizeByte)
+		if err != nil {
+			return err
+		}
+		err = s.writeAt(rec, uint32(pos), pos)
+		if err != nil {
+			s.remapping[uint32(pos)] = header.sizeByte
+			return err
+		}
+		b = &blob{addr: uint32(pos), size: header.sizeByte, length: uint32(len(v))}
+		s.blobs[key] = b
+	}
+	// taken before the old record is released, it may reference the same blob
+	b.refs++
+
+	header, rec := s.marshal(k, key[:], expire, flags)
+	header.status = statusRef
+	rec[1] = statusRef
+	err := s.put(h, header, rec, oldAddr, oldSize)
+	if err != nil {
+		s.releaseBlob(key)
+		return err
+	}
+	addr, _, _ := Decode(s.mapping[h])
+	s.deduped[addr] = key
+	return nil
+}
+
+// resolve ... value of the record, the shared value is read for the reference record.
+// The header then describes the value as seen by the key
+func (s *Shard) resolve(header *Header, val []byte) ([]byte, error) {
+	if header.status != statusRef {
+		return val, nil
+	}
+	v, err := s.readBlob(val)
+	if err != nil {
+		return nil, err
+	}
+	header.status = 0
+	header.valLength = uint32(len(v))
+	return v, nil
+}
+
+// readBlob ... value of the shared blob referenced by the key record
+func (s *Shard) readBlob(ref []byte) ([]byte, error) {
+	if len(ref) != blobKeySize {
+		return nil, errors.New("corrupted reference to the shared value")
+	}
+	b, ok := s.blobs[blobKey(ref)]
+	if !ok {
+		return nil, errors.New("missing shared value")
+	}
+	bb := make([]byte, s.classes.size(b.size))
+	_, err := s.f.ReadAt(bb, int64(b.addr))
+	if err != nil {
+		return nil, err
+	}
+	header, key, val := unmarshal(bb)
+	if header.status != statusBlob || !bytes.Equal(key, ref) {
+		return nil, errors.New("corrupted shared value")
+	}
+	return val, nil
+}
+
+// releaseRef ... drop the reference of the key record at addr
+func (s *Shard) releaseRef(addr uint32) {
+	if key, ok := s.deduped[addr]; ok {
+		delete(s.deduped, addr)
+		s.releaseBlob(key)
+	}
+}
+
+// releaseBlob ... the blob without references is freed
+func (s *Shard) releaseBlob(key blobKey) {
+	b, ok := s.blobs[key]
+	if !ok {
+		return
+	}
+	b.refs--
+	if b.refs <= 0 {
+		delete(s.blobs, key)
+		s.remapping[b.addr] = b.size
+	}
+}
+
+// loadBlobs ... count the references after the index is loaded,
+// the blobs left without references by an interrupted write are freed
+func (s *Shard) loadBlobs(blobs map[blobKey]*blob) {
+	for addr, key := range s.deduped {
+		b, ok := blobs[key]
+		if !ok {
+			// the scrubber reports the key, the value can't be read
+			delete(s.deduped, addr)
+			continue
+		}
+		b.refs++
+	}
+	for key, b := range blobs {
+		if b.refs == 0 {
+			s.remapping[b.addr] = b.size
+			continue
+		}
+		s.blobs[key] = b
+	}
+}
@@ -0,0 +1,109 @@
+package shard
+
+import (
+	"container/heap"
+)
+
+// expiryCompactMin ... the stale heap items aren't compacted below this heap size
+const expiryCompactMin = 1024
+
+type expiryItem struct {
+	at uint32 // expire time
+	h  uint32 // key hash
+}
+
+type expiryHeap []expiryItem
+
+func (e expiryHeap) Len() int           { return len(e) }
+func (e expiryHeap) Less(i, j int) bool { return e[i].at < e[j].at }
+func (e expiryHeap) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+
+func (e *expiryHeap) Push(x any) {
+	*e = append(*e, x.(expiryItem))
+}
+
+func (e *expiryHeap) Pop() any {
+	old := *e
+	item := old[len(old)-1]
+	*e = old[:len(old)-1]
+	return item
+}
+
+// expiryIndex ... min-heap of the expire times of the keys with ttl.
+// The due keys are found in time proportional to their number instead of a full index scan.
+// Overwritten and removed keys leave stale heap items, they are skipped by comparing
+// with the current expire time of the key and are compacted once they dominate the heap
+type expiryIndex struct {
+	items expiryHeap
+	due   map[uint32]uint32 // key hash / current expire time
+}
+
+func newExpiryIndex() *expiryIndex {
+	return &expiryIndex{due: make(map[uint32]uint32)}
+}
+
+// set ... track the expire time of the key, 0 - the key never expires
+func (e *expiryIndex) set(h, at uint32) {
+	if at == 0 {
+		delete(e.due, h)
+		return
+	}
+	if old, ok := e.due[h]; ok && old == at {
+		return
+	}
+	e.due[h] = at
+	heap.Push(&e.items, expiryItem{at: at, h: h})
+	e.compact()
+}
+
+func (e *expiryIndex) remove(h uint32) {
+	delete(e.due, h)
+}
+
+// popDue ... remove and return up to limit keys which expire before now
+func (e *expiryIndex) popDue(now uint32, limit int) []uint32 {
+	var due []uint32
+	for len(e.items) > 0 && len(due) < limit {
+		item := e.items[0]
+		if item.at >= now {
+			break
+		}
+		heap.Pop(&e.items)
+		if at, ok := e.due[item.h]; ok && at == item.at {
+			delete(e.due, item.h)
+			due = append(due, item.h)
+		}
+	}
+	return due
+}
+
+// next ... the earliest expire time, 0 - no keys with ttl
+func (e *expiryIndex) next() uint32 {
+	for len(e.items) > 0 {
+		item := e.items[0]
+		if at, ok := e.due[item.h]; ok && at == item.at {
+			return item.at
+		}
+		heap.Pop(&e.items)
+	}
+	return 0
+}
+
+func (e *expiryIndex) len() int {
+	return len(e.due)
+}
+
+// compact ... drop the stale items when they take more than a half of the heap
+func (e *expiryIndex) compact() {
+	if len(e.items) < expiryCompactMin || len(e.items) < 2*len(e.due) {
+		return
+	}
+	items := e.items[:0]
+	for _, item := range e.items {
+		if at, ok := e.due[item.h]; ok && at == item.at {
+			items = append(items, item)
+		}
+	}
+	e.items = items
+	heap.Init(&e.items)
+}
@@ -0,0 +1,265 @@
+package shard
+
+import (
+	"container/list"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// FdCache ... budget of the open shard files shared by the shards of a store.
+// The files are opened on demand and the idle ones not used recently are closed
+// once the budget is exceeded. A file in use is never closed,
+// so the budget may be exceeded while more files are in use at once.
+// The calls to an open file don't take the lock of the cache, it's taken only to open and close the files
+type FdCache struct {
+	mu        sync.Mutex // guards the ring of the open files and the counters
+	limit     int
+	ring      *list.List    // open files, in the order they were opened
+	hand      *list.Element // next file checked by the eviction
+	over      atomic.Bool   // the budget was exceeded by the files in use
+	opens     uint64
+	evictions uint64
+}
+
+// FdStats ... state of the file descriptors cache
+type FdStats struct {
+	Open      int
+	Limit     int
+	Opens     uint64
+	Evictions uint64
+}
+
+// NewFdCache ... create the cache keeping at most limit files open, 0 - no limit
+func NewFdCache(limit int) *FdCache {
+	return &FdCache{limit: limit, ring: list.New()}
+}
+
+// FileCache ... open the shard file through the shared cache,
+// by default the shard keeps its file open all the time
+func FileCache(c *FdCache) OptShard {
+	return func(s *Shard) {
+		s.fds = c
+	}
+}
+
+// Stats ... current state of the cache
+func (c *FdCache) Stats() FdStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return FdStats{Open: c.ring.Len(), Limit: c.limit, Opens: c.opens, Evictions: c.evictions}
+}
+
+// evict ... close the idle files until the budget is met, the caller holds the lock.
+// It's the clock sweep: a file used since the last pass of the hand is kept for one more pass
+func (c *FdCache) evict() {
+	for n := 2 * c.ring.Len(); c.limit > 0 && c.ring.Len() > c.limit && n > 0; n-- {
+		if c.hand == nil {
+			c.hand = c.ring.Front()
+		}
+		f := c.hand.Value.(*file)
+		c.hand = c.hand.Next()
+		if f.used.Swap(false) {
+			continue
+		}
+		if f.tryClose() {
+			c.evictions++
+		}
+	}
+	c.over.Store(c.limit > 0 && c.ring.Len() > c.limit)
+}
+
+// remove ... drop the closed file from the ring, the caller holds the lock
+func (c *FdCache) remove(f *file) {
+	if c.hand == f.elem {
+		c.hand = c.hand.Next()
+	}
+	c.ring.Remove(f.elem)
+	f.elem = nil
+}
+
+// file ... shard file, with the cache the descriptor may be closed between the calls.
+// The positional calls pin the descriptor for their duration only,
+// the sequential reads must pin it for the whole scan, as the position is lost on reopen
+type file struct {
+	cache *FdCache
+	name  string
+	mu    sync.Mutex // guards the open and the close of the descriptor
+	fd    atomic.Pointer[os.File]
+	pins  atomic.Int32
+	used  atomic.Bool   // pinned since the last pass of the eviction
+	elem  *list.Element // guarded by the lock of the cache
+}
+
+// wrapFile ... wrap the opened file, it's registered in the cache
+func wrapFile(c *FdCache, name string, fd *os.File) *file {
+	f := &file{cache: c, name: name}
+	f.fd.Store(fd)
+	if c != nil {
+		f.used.Store(true)
+		c.mu.Lock()
+		f.elem = c.ring.PushBack(f)
+		c.opens++
+		c.evict()
+		c.mu.Unlock()
+	}
+	return f
+}
+
+// pin ... descriptor of the file, reopened if it was evicted. Must be followed by unpin.
+// The pin is published before the descriptor is read, and the eviction clears the descriptor
+// before it checks the pins, so at least one of them sees the other
+func (f *file) pin() (*os.File, error) {
+	c := f.cache
+	if c == nil {
+		return f.fd.Load(), nil
+	}
+	f.pins.Add(1)
+	if !f.used.Load() {
+		f.used.Store(true)
+	}
+	if fd := f.fd.Load(); fd != nil {
+		return fd, nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if fd := f.fd.Load(); fd != nil {
+		return fd, nil
+	}
+	fd, err := os.OpenFile(f.name, os.O_RDWR, 0)
+	if err != nil {
+		f.pins.Add(-1)
+		return nil, err
+	}
+	f.fd.Store(fd)
+	c.mu.Lock()
+	f.elem = c.ring.PushBack(f)
+	c.opens++
+	c.evict()
+	c.mu.Unlock()
+	return fd, nil
+}
+
+// unpin ... release the descriptor, the last user of the file over the budget closes the idle files
+func (f *file) unpin() {
+	c := f.cache
+	if c == nil {
+		return
+	}
+	if f.pins.Add(-1) == 0 && c.over.Load() {
+		c.mu.Lock()
+		c.evict()
+		c.mu.Unlock()
+	}
+}
+
+// tryClose ... close the descriptor unless the file is in use, the caller holds the lock of the cache.
+// The file being opened or closed holds its own lock, so it's skipped as well
+func (f *file) tryClose() bool {
+	if f.pins.Load() > 0 || !f.mu.TryLock() {
+		return false
+	}
+	defer f.mu.Unlock()
+	fd := f.fd.Swap(nil)
+	if f.pins.Load() > 0 {
+		// pinned meanwhile, the descriptor may be in use already
+		f.fd.Store(fd)
+		return false
+	}
+	// the data stays in the page cache, a later fsync of the reopened file still flushes it
+	_ = fd.Close()
+	f.cache.remove(f)
+	return true
+}
+
+func (f *file) ReadAt(b []byte, off int64) (int, error) {
+	fd, err := f.pin()
+	if err != nil {
+		return 0, err
+	}
+	defer f.unpin()
+	return fd.ReadAt(b, off)
+}
+
+func (f *file) WriteAt(b []byte, off int64) (int, error) {
+	fd, err := f.pin()
+	if err != nil {
+		return 0, err
+	}
+	defer f.unpin()
+	return fd.WriteAt(b, off)
+}
+
+func (f *file) Read(b []byte) (int, error) {
+	fd, err := f.pin()
+	if err != nil {
+		return 0, err
+	}
+	defer f.unpin()
+	return fd.Read(b)
+}
+
+func (f *file) Write(b []byte) (int, error) {
+	fd, err := f.pin()
+	if err != nil {
+		return 0, err
+	}
+	defer f.unpin()
+	return fd.Write(b)
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	fd, err := f.pin()
+	if err != nil {
+		return 0, err
+	}
+	defer f.unpin()
+	return fd.Seek(offset, whence)
+}
+
+func (f *file) Stat() (os.FileInfo, error) {
+	fd, err := f.pin()
+	if err != nil {
+		return nil, err
+	}
+	defer f.unpin()
+	return fd.Stat()
+}
+
+func (f *file) Sync() error {
+	fd, err := f.pin()
+	if err != nil {
+		return err
+	}
+	defer f.unpin()
+	return fd.Sync()
+}
+
+func (f *file) Truncate(size int64) error {
+	fd, err := f.pin()
+	if err != nil {
+		return err
+	}
+	defer f.unpin()
+	return fd.Truncate(size)
+}
+
+// Close ... close the descriptor and drop the file from the cache
+func (f *file) Close() error {
+	c := f.cache
+	if c == nil {
+		return f.fd.Load().Close()
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fd := f.fd.Swap(nil)
+	if fd == nil {
+		return nil
+	}
+	err := fd.Close()
+	c.mu.Lock()
+	c.remove(f)
+	c.mu.Unlock()
+	return err
+}
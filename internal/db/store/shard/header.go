@@ -5,18 +5,28 @@ import (
 	"errors"
 	"fmt"
 	"io"
-
-	"github.com/DenzelPenzel/nyx/internal/utils"
 )
 
 const (
 	versionMarker   = 255
-	currentShardVer = 1
+	currentShardVer = 3
 	deleted         = 42
+
+	// record statuses, the regular value has status 0
+	statusManifest = 1 // list of the chunks of the large value
+	statusChunk    = 2 // piece of the large value, is not indexed by itself
+	statusBlob     = 3 // value shared by the keys, keyed by the content hash, is not indexed by itself
+	statusRef      = 4 // key record holding the content hash of the shared value
 )
 
+// FormatVersion ... version of the record format written by the shards
+const FormatVersion = currentShardVer
+
+// errTornRecord ... the record at the file tail is incomplete or inconsistent
+var errTornRecord = errors.New("torn record")
+
 var (
-	sizeHeaders = map[int]uint32{0: 8, 1: 12}
+	sizeHeaders = map[int]uint32{0: 8, 1: 12, 2: 16, 3: 16}
 	sizeHead    = sizeHeaders[currentShardVer]
 )
 
@@ -26,43 +36,78 @@ type Header struct {
 	keyLength uint16
 	valLength uint32
 	expire    uint32
+	flags     uint32
+}
+
+// Expire ... absolute expiration time of the record, 0 - never expires
+func (h *Header) Expire() uint32 {
+	return h.expire
+}
+
+// Flags ... opaque client flags stored with the record
+func (h *Header) Flags() uint32 {
+	return h.flags
 }
 
-func makeHeader(k, v []byte, expire uint32) *Header {
+// Chunked ... the value is split into chunks, the record holds the chunks manifest
+func (h *Header) Chunked() bool {
+	return h.status == statusManifest
+}
+
+func makeHeader(c *sizeClasses, k, v []byte, expire, flags uint32) *Header {
 	header := &Header{
 		status:    0,
 		keyLength: uint16(len(k)),
 		valLength: uint32(len(v)),
 		expire:    expire,
+		flags:     flags,
 	}
-	sizeByte, _ := utils.NextPowerOf2(uint32(header.keyLength) + header.valLength + sizeHead)
-	header.sizeByte = sizeByte
+	header.sizeByte = c.classOf(uint64(header.keyLength) + uint64(header.valLength) + uint64(sizeHead))
 	return header
 }
 
-func parseHeader(b []byte) *Header {
+func parseHeader(b []byte, ver int) *Header {
 	header := &Header{}
 	header.sizeByte = b[0]
 	header.status = b[1]
 	header.keyLength = binary.BigEndian.Uint16(b[2:4])
 	header.valLength = binary.BigEndian.Uint32(b[4:8])
-	header.expire = binary.BigEndian.Uint32(b[8:12])
+	if ver >= 1 {
+		header.expire = binary.BigEndian.Uint32(b[8:12])
+	}
+	if ver >= 2 {
+		header.flags = binary.BigEndian.Uint32(b[12:16])
+	}
 	return header
 }
 
+// valid ... the header describes a record which fits into its slot
+func (h *Header) valid(ver int, c *sizeClasses) bool {
+	switch h.status {
+	case 0, deleted, statusManifest, statusChunk, statusBlob, statusRef:
+	default:
+		return false
+	}
+	return int(h.sizeByte) < len(c.slots) &&
+		uint64(sizeHeaders[ver])+uint64(h.keyLength)+uint64(h.valLength) <= uint64(c.size(h.sizeByte))
+}
+
 func readHeader(r io.Reader, ver int) (*Header, error) {
 	var header *Header
 	var err error
 	b := make([]byte, sizeHeaders[ver])
 	n, err := io.ReadFull(r, b)
 	if n != int(sizeHeaders[ver]) {
-		if errors.Is(err, io.EOF) {
+		switch {
+		case errors.Is(err, io.EOF):
 			err = nil
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			err = errTornRecord
 		}
 		return header, err
 	}
-	if ver == currentShardVer {
-		header = parseHeader(b)
+	if ver <= currentShardVer {
+		header = parseHeader(b, ver)
 	} else {
 		err = fmt.Errorf("wrong header version %d", ver)
 	}
@@ -75,12 +120,13 @@ func writeHeader(b []byte, header *Header) {
 	binary.BigEndian.PutUint16(b[2:4], header.keyLength)
 	binary.BigEndian.PutUint32(b[4:8], header.valLength)
 	binary.BigEndian.PutUint32(b[8:12], header.expire)
+	binary.BigEndian.PutUint32(b[12:16], header.flags)
 }
 
-func marshal(k, v []byte, expire uint32) (*Header, []byte) {
-	header := makeHeader(k, v, expire)
-	size := 1 << header.sizeByte
-	b := make([]byte, size)
+// marshal ... the record in the slot of the shard size classes
+func (s *Shard) marshal(k, v []byte, expire, flags uint32) (*Header, []byte) {
+	header := makeHeader(s.classes, k, v, expire, flags)
+	b := make([]byte, s.classes.size(header.sizeByte))
 	writeHeader(b, header)
 	copy(b[sizeHead:], v)
 	copy(b[sizeHead+header.valLength:], k)
@@ -88,7 +134,7 @@ func marshal(k, v []byte, expire uint32) (*Header, []byte) {
 }
 
 func unmarshal(b []byte) (*Header, []byte, []byte) {
-	header := parseHeader(b)
+	header := parseHeader(b, currentShardVer)
 	k := b[sizeHead+header.valLength : sizeHead+header.valLength+uint32(header.keyLength)]
 	v := b[sizeHead : sizeHead+header.valLength]
 	return header, k, v
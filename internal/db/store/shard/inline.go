@@ -0,0 +1,51 @@
+package shard
+
+import (
+	"bytes"
+	"slices"
+)
+
+// inlineRec ... copy of the tiny value record kept in memory, the record is still written to the file
+type inlineRec struct {
+	header Header
+	key    []byte
+	val    []byte
+}
+
+// InlineValues ... values up to this size are kept in the index as well,
+// so they are read without touching the file. Zero - the values are always read from the file
+func InlineValues(max int) OptShard {
+	return func(s *Shard) {
+		s.inlineMax = max
+	}
+}
+
+// Inlined ... number of the values kept in memory
+func (s *Shard) Inlined() int {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.inline)
+}
+
+// cacheInline ... keep the copy of the regular record with the tiny value,
+// any other record of the hash drops the copy
+func (s *Shard) cacheInline(h uint32, header *Header, key, val []byte) {
+	if s.inlineMax <= 0 {
+		return
+	}
+	if header.status != 0 || int(header.valLength) > s.inlineMax {
+		delete(s.inline, h)
+		return
+	}
+	s.inline[h] = &inlineRec{header: *header, key: slices.Clone(key), val: slices.Clone(val)}
+}
+
+// getInline ... record of the key from memory, the caller gets its own copy
+func (s *Shard) getInline(k []byte, h uint32) (*Header, []byte, bool) {
+	rec, ok := s.inline[h]
+	if !ok || !bytes.Equal(rec.key, k) {
+		return nil, nil, false
+	}
+	header := rec.header
+	return &header, slices.Clone(rec.val), true
+}
@@ -0,0 +1,88 @@
+package shard
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/DenzelPenzel/nyx/internal/logging"
+	"go.uber.org/zap"
+)
+
+// ErrCorruptedRecord ... the broken record is followed by more data, so it isn't a torn tail.
+// The file is left as is, the truncation would drop all the valid records after the broken one
+var ErrCorruptedRecord = errors.New("corrupted record in the middle of the shard file")
+
+// checkRecord ... the record at offset must be consistent and fully written.
+// The broken record running to the end of file or followed only by zeros is the leftover
+// of an interrupted write, errTornRecord, otherwise it's ErrCorruptedRecord
+func checkRecord(r io.ReaderAt, header *Header, ver int, c *sizeClasses, offset, fileSize int64) error {
+	classKnown := int(header.sizeByte) < len(c.slots)
+	end := offset + c.size(header.sizeByte)
+	if header.valid(ver, c) && end <= fileSize {
+		return nil
+	}
+	if classKnown && end >= fileSize {
+		return errTornRecord
+	}
+	zeros, err := zeroTail(r, offset+int64(sizeHeaders[ver]), fileSize)
+	if err != nil {
+		return err
+	}
+	if zeros {
+		return errTornRecord
+	}
+	return fmt.Errorf("%w: offset %d", ErrCorruptedRecord, offset)
+}
+
+// zeroTail ... the file holds only zeros from offset to the end
+func zeroTail(r io.ReaderAt, offset, fileSize int64) (bool, error) {
+	b := make([]byte, 64<<10)
+	for offset < fileSize {
+		n := min(int64(len(b)), fileSize-offset)
+		_, err := r.ReadAt(b[:n], offset)
+		if err != nil {
+			return false, err
+		}
+		if !bytes.Equal(b[:n], make([]byte, n)) {
+			return false, nil
+		}
+		offset += n
+	}
+	return true, nil
+}
+
+// repairTail ... truncate the shard file to the last valid record which ends at offset.
+// The discarded bytes are kept next to the shard file for forensics
+func repairTail(file *file, name string, offset, fileSize int64) error {
+	copyName := fmt.Sprintf("%s.torn-%d-%d", name, offset, time.Now().Unix())
+	f, err := os.OpenFile(copyName, os.O_CREATE|os.O_WRONLY|os.O_EXCL, os.FileMode(0644))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, io.NewSectionReader(file, offset, fileSize-offset))
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = file.Truncate(offset)
+	if err != nil {
+		return err
+	}
+	logging.NoContext().Warn("Truncate torn tail of the shard",
+		zap.String("shard", name),
+		zap.Int64("offset", offset),
+		zap.Int64("bytes", fileSize-offset),
+		zap.String("copy", copyName),
+	)
+	return file.Sync()
+}
@@ -0,0 +1,150 @@
+package shard
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/DenzelPenzel/nyx/internal/common"
+)
+
+// ScanDone ... the position returned by ScanKeys once the shard has no more keys
+const ScanDone = uint64(1) << 32
+
+// ScanKeys ... keys of up to n records with the hashes from `from` on, in the order of the hashes.
+// The first page of a scan takes the sorted snapshot of the hashes, the later pages continue
+// in the snapshot, so a page costs the binary search and the reads of its keys. The hash of a key
+// doesn't change when its record moves, so the keys present for the whole scan are returned
+// exactly once whatever is written meanwhile: the snapshot taken by another scan later has them too.
+// Returns the position to resume from, ScanDone at the end of the shard. The expired keys are skipped
+func (s *Shard) ScanKeys(from uint64, n int) ([][]byte, uint64, error) {
+	if from >= ScanDone {
+		return nil, ScanDone, nil
+	}
+	if n <= 0 {
+		n = 1
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if from == 0 || s.scanSnap == nil {
+		s.scanSnap = s.sortedHashes()
+	}
+	snap := s.scanSnap
+	i, _ := slices.BinarySearch(snap, uint32(from))
+	hashes := snap[i:min(i+n, len(snap))]
+	next := ScanDone
+	if i+n < len(snap) {
+		next = uint64(hashes[len(hashes)-1]) + 1
+	} else {
+		// the last page, the snapshot is taken again by the next scan
+		s.scanSnap = nil
+	}
+
+	keys := make([][]byte, 0, len(hashes))
+	now := time.Now().Unix()
+	for _, h := range hashes {
+		key, expire, err := s.keyOf(h)
+		if err != nil {
+			return nil, 0, err
+		}
+		if key == nil || (expire != 0 && int64(expire) < now) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, next, nil
+}
+
+// sortedHashes ... hashes of the hot and the cold keys in ascending order
+func (s *Shard) sortedHashes() []uint32 {
+	res := make([]uint32, 0, len(s.mapping)+len(s.coldMapping))
+	for h := range s.mapping {
+		res = append(res, h)
+	}
+	for h := range s.coldMapping {
+		if _, hot := s.mapping[h]; !hot {
+			res = append(res, h)
+		}
+	}
+	slices.Sort(res)
+	return res
+}
+
+// headerOf ... header of the key record, only the header and the key are read from the file.
+// The cold record is read in place without the promotion and the expired one is left to the expiration
+func (s *Shard) headerOf(k []byte, h uint32) (*Header, error) {
+	if header, _, ok := s.getInline(k, h); ok {
+		if header.expire != 0 && int64(header.expire) < time.Now().Unix() {
+			return nil, ErrKeyExpired
+		}
+		return header, nil
+	}
+	f, c := s.f, s.classes
+	entry, ok := s.mapping[h]
+	if !ok {
+		f, c = s.cold, s.coldClasses
+		entry, ok = s.coldMapping[h]
+	}
+	if !ok {
+		return nil, common.ErrKeyNotFound
+	}
+
+	addr, _, _ := Decode(entry)
+	b := make([]byte, sizeHead)
+	_, err := f.ReadAt(b, int64(addr))
+	if err != nil {
+		return nil, err
+	}
+	header := parseHeader(b, currentShardVer)
+	if !header.valid(currentShardVer, c) {
+		return nil, fmt.Errorf("%w: offset %d", ErrCorruptedRecord, addr)
+	}
+	key := make([]byte, header.keyLength)
+	_, err = f.ReadAt(key, int64(addr)+int64(sizeHead)+int64(header.valLength))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(key, k) {
+		return nil, common.ErrCollision
+	}
+	if header.expire != 0 && int64(header.expire) < time.Now().Unix() {
+		return nil, ErrKeyExpired
+	}
+	return header, nil
+}
+
+// keyOf ... key and expire time of the record indexed by the hash, nil if the key is gone,
+// the cold records are read in place without the promotion
+func (s *Shard) keyOf(h uint32) ([]byte, uint32, error) {
+	if rec, ok := s.inline[h]; ok {
+		return bytes.Clone(rec.key), rec.header.expire, nil
+	}
+	f, c := s.f, s.classes
+	entry, ok := s.mapping[h]
+	if !ok {
+		f, c = s.cold, s.coldClasses
+		entry, ok = s.coldMapping[h]
+	}
+	if !ok {
+		return nil, 0, nil
+	}
+
+	addr, _, _ := Decode(entry)
+	b := make([]byte, sizeHead)
+	_, err := f.ReadAt(b, int64(addr))
+	if err != nil {
+		return nil, 0, err
+	}
+	header := parseHeader(b, currentShardVer)
+	if !header.valid(currentShardVer, c) {
+		return nil, 0, nil
+	}
+	key := make([]byte, header.keyLength)
+	_, err = f.ReadAt(key, int64(addr)+int64(sizeHead)+int64(header.valLength))
+	if err != nil {
+		return nil, 0, err
+	}
+	return key, header.expire, nil
+}
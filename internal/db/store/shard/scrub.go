@@ -0,0 +1,217 @@
+package shard
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/spaolacci/murmur3"
+)
+
+const quarantineSuffix = ".quarantine"
+
+// ScrubFinding ... inconsistency between the record on disk and the shard index
+type ScrubFinding struct {
+	Offset int64
+	Key    []byte
+	Reason string
+}
+
+func (f ScrubFinding) String() string {
+	if f.Key == nil {
+		return fmt.Sprintf("%s at %d", f.Reason, f.Offset)
+	}
+	return fmt.Sprintf("%s at %d, key %q", f.Reason, f.Offset, f.Key)
+}
+
+// ScrubResult ... outcome of a single Scrub call
+type ScrubResult struct {
+	Next        int64 // offset of the next record, 0 - the end of the file is reached
+	Bytes       int64
+	Records     int
+	Quarantined int
+	Findings    []ScrubFinding
+}
+
+// Scrub ... walk the records of the file starting at offset from until limit bytes are read
+// and check every record against the index: size class, expire time, key and chunks ownership.
+// The record format has no checksums, so the value bytes themselves aren't verified.
+// With quarantine the mismatched records are copied to the quarantine file next to the shard,
+// dropped from the index and marked deleted, so they are never served or loaded again
+func (s *Shard) Scrub(from, limit int64, quarantine bool) (ScrubResult, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	var res ScrubResult
+	fi, err := s.f.Stat()
+	if err != nil {
+		return res, err
+	}
+	size := fi.Size()
+	pos := max(from, s.start)
+
+	// chunks referenced by the manifests, collected on the first chunk record
+	var refs map[uint32]bool
+	for pos < size && res.Bytes < limit {
+		hb := make([]byte, sizeHead)
+		_, err = s.f.ReadAt(hb, pos)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return res, err
+		}
+		header := parseHeader(hb, currentShardVer)
+		if err != nil || checkRecord(s.f, header, currentShardVer, s.classes, pos, size) != nil {
+			// the record length is unknown, so the rest of the file can't be walked
+			res.Findings = append(res.Findings, ScrubFinding{Offset: pos, Reason: "corrupted record header"})
+			pos = size
+			break
+		}
+
+		b := make([]byte, s.classes.size(header.sizeByte))
+		_, err = s.f.ReadAt(b, pos)
+		if err != nil {
+			return res, err
+		}
+		res.Bytes += int64(len(b))
+		res.Records++
+
+		if header.status == statusChunk && refs == nil {
+			refs = make(map[uint32]bool, len(s.pending))
+			for addr := range s.pending {
+				refs[addr] = true
+			}
+			for _, chunks := range s.chunked {
+				for _, ref := range chunks {
+					refs[ref.Addr] = true
+				}
+			}
+			// released by their value, still read by the open readers
+			for addr := range s.retired {
+				refs[addr] = true
+			}
+		}
+		finding, h, indexed := s.checkIndex(uint32(pos), header, b, refs)
+		if finding != nil {
+			res.Findings = append(res.Findings, *finding)
+			if quarantine {
+				err = s.quarantine(finding, header, b, h, indexed)
+				if err != nil {
+					return res, err
+				}
+				res.Quarantined++
+			}
+		}
+		pos += int64(len(b))
+	}
+
+	if pos < size {
+		res.Next = pos
+	}
+	return res, nil
+}
+
+// checkIndex ... compare the record at addr with the index.
+// Returns the finding, the key hash and whether the key index points to the record
+func (s *Shard) checkIndex(addr uint32, header *Header, b []byte, refs map[uint32]bool) (*ScrubFinding, uint32, bool) {
+	if _, free := s.remapping[addr]; free || header.status == deleted {
+		return nil, 0, false
+	}
+	if header.status == statusChunk {
+		if !refs[addr] {
+			return &ScrubFinding{Offset: int64(addr), Reason: "unreferenced chunk"}, 0, false
+		}
+		return nil, 0, false
+	}
+	if header.status == statusBlob {
+		_, key, _ := unmarshal(b)
+		if bl, ok := s.blobs[blobKey(key)]; len(key) != blobKeySize || !ok || bl.addr != addr {
+			return &ScrubFinding{Offset: int64(addr), Reason: "unreferenced shared value"}, 0, false
+		}
+		return nil, 0, false
+	}
+
+	_, key, val := unmarshal(b)
+	h := murmur3.Sum32WithSeed(key, 0)
+	finding := &ScrubFinding{Offset: int64(addr), Key: slices.Clone(key)}
+
+	entry, ok := s.mapping[h]
+	entryAddr, entrySize, _ := Decode(entry)
+	if !ok || entryAddr != addr {
+		if header.expire != 0 && int64(header.expire) < time.Now().Unix() {
+			// the expired record which wasn't accessed since the load
+			return nil, h, false
+		}
+		finding.Reason = "record is not indexed"
+		return finding, h, false
+	}
+
+	switch {
+	case entrySize != header.sizeByte:
+		finding.Reason = "size class mismatch"
+	case uint32(entry&0xffffff) != header.expire>>9:
+		finding.Reason = "expire time mismatch"
+	case header.status == statusManifest:
+		m, err := ParseManifest(val)
+		if err != nil || !slices.Equal(m.Chunks, s.chunked[addr]) {
+			finding.Reason = "chunks manifest mismatch"
+		}
+	case s.inline[h] != nil && !bytes.Equal(s.inline[h].val, val):
+		finding.Reason = "inline value mismatch"
+	case header.status == statusRef:
+		if len(val) != blobKeySize || s.deduped[addr] != blobKey(val) || s.blobs[blobKey(val)] == nil {
+			finding.Reason = "missing shared value"
+		}
+	}
+	if finding.Reason == "" {
+		return nil, h, true
+	}
+	return finding, h, true
+}
+
+// quarantine ... keep a copy of the mismatched record and take it out of service.
+// The slot isn't reused until the next load, it may sit on a bad disk area
+func (s *Shard) quarantine(finding *ScrubFinding, header *Header, b []byte, h uint32, indexed bool) error {
+	if header.status == statusChunk || header.status == statusBlob {
+		// the leaked chunk or shared value has no owner, its space is just reclaimed
+		s.remapping[uint32(finding.Offset)] = header.sizeByte
+		return nil
+	}
+
+	f, err := os.OpenFile(s.name+quarantineSuffix, os.O_CREATE|os.O_WRONLY|os.O_APPEND, os.FileMode(0644))
+	if err != nil {
+		return err
+	}
+	// offset | record length | record
+	head := make([]byte, 12)
+	binary.BigEndian.PutUint64(head[0:8], uint64(finding.Offset))
+	binary.BigEndian.PutUint32(head[8:12], uint32(len(b)))
+	_, err = f.Write(append(head, b...))
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if indexed {
+		s.removeEntry(h)
+		if refs, ok := s.chunked[uint32(finding.Offset)]; ok {
+			delete(s.chunked, uint32(finding.Offset))
+			s.releaseRefs(refs)
+		}
+		s.releaseRef(uint32(finding.Offset))
+	}
+	err = s.writeAt([]byte{deleted}, uint32(finding.Offset), finding.Offset+1)
+	if err != nil {
+		return err
+	}
+	s.useFsync = true
+	return nil
+}
@@ -11,22 +11,115 @@ import (
 	"time"
 
 	"github.com/DenzelPenzel/nyx/internal/common"
-	"github.com/DenzelPenzel/nyx/internal/utils"
 	"github.com/spaolacci/murmur3"
 )
 
 type Shard struct {
 	sync.RWMutex
-	f         *os.File          // file storage
-	mapping   map[uint32]uint64 // keys mapping
-	remapping map[uint32]byte   // space remapping: addr /size
+	f         *file                 // file storage
+	fds       *FdCache              // shared budget of the open files, nil - the file is always open
+	name      string                // file path
+	mapping   map[uint32]uint64     // keys mapping
+	remapping map[uint32]byte       // space remapping: addr /size
+	chunked   map[uint32][]ChunkRef // chunks of the large values: manifest addr / chunks
+	pinned    map[uint32]int        // chunks read by the open value readers: addr / pins, see GetChunked
+	retired   map[uint32]byte       // pinned chunks released by their value, freed with the last pin
+	pending   map[uint32]byte       // chunks written by WriteChunk and not referenced by a manifest yet
+	expiry    *expiryIndex          // expire times of the keys with ttl
+	scanSnap  []uint32              // sorted hashes taken by the first page of a scan, see ScanKeys
+	chunkSize int
+	maxValue  int64
 	useFsync  bool
+	classes   *sizeClasses // slot sizes of the file
+	start     int64        // offset of the first record
+	growth    int          // slot growth of the new files, see SlotGrowth
+
+	compaction *compaction // unfinished compaction, see CompactStep
+
+	// values shared by the keys, see Dedup
+	dedupMin int
+	blobs    map[blobKey]*blob
+	deduped  map[uint32]blobKey // key records referencing the blobs: addr / content hash
+
+	inlineMax int
+	inline    map[uint32]*inlineRec // tiny values kept in memory, see InlineValues
+
+	keyPrefix [][]byte      // the loaded keys with the prefixes are collected, see KeyPrefix
+	watcher   Watcher       // gets the keys before they are changed, see Watch
+	prefixed  []PrefixedKey // collected keys, handed over by PrefixedKeys
+
+	// capacity tier, nil - tiering is off
+	cold        *file
+	coldName    string
+	coldClasses *sizeClasses
+	coldStart   int64
+	coldMapping map[uint32]uint64 // keys mapping of the cold file
+	coldFree    map[uint32]byte   // free slots of the cold file: addr / size
+	accessed    map[uint32]uint32 // last access time of the hot keys
+	demoted     uint64
+	promoted    uint64
 }
 
-var forceExit bool
+// OptShard is a shard options
+type OptShard func(*Shard)
+
+// ChunkSize ... slot size of a single chunk, the values which don't fit into one chunk are split.
+// Zero disables chunking
+func ChunkSize(size int) OptShard {
+	return func(s *Shard) {
+		s.chunkSize = size
+	}
+}
+
+// MaxValueSize ... the bigger values are rejected with ErrValueTooBig, zero - no limit
+func MaxValueSize(size int64) OptShard {
+	return func(s *Shard) {
+		s.maxValue = size
+	}
+}
+
+// KeyPrefix ... collect the keys with any of the prefixes while the file is loaded,
+// so the caller can build its own index of them without another pass over the file
+func KeyPrefix(prefixes ...[]byte) OptShard {
+	return func(s *Shard) {
+		s.keyPrefix = prefixes
+	}
+}
+
+// PrefixedKey ... loaded key with the KeyPrefix, the size of its value, the expire time and the flags
+type PrefixedKey struct {
+	Key    []byte
+	Size   int64
+	Expire uint32
+	Flags  uint32
+}
+
+// PrefixedKeys ... the keys with the KeyPrefix found by the load, the list is handed over once.
+// The keys may repeat and some of them may be removed since the load
+func (s *Shard) PrefixedKeys() []PrefixedKey {
+	s.Lock()
+	defer s.Unlock()
+	keys := s.prefixed
+	s.prefixed = nil
+	return keys
+}
+
+// collectKey ... remember the loaded key with the KeyPrefix, returns false if the key has no such prefix
+func (s *Shard) collectKey(key []byte, header *Header, size int64) bool {
+	for _, prefix := range s.keyPrefix {
+		if bytes.HasPrefix(key, prefix) {
+			s.prefixed = append(s.prefixed, PrefixedKey{Key: bytes.Clone(key), Size: size, Expire: header.expire, Flags: header.flags})
+			return true
+		}
+	}
+	return false
+}
+
+// ErrKeyExpired ... the key is still in the index, but its ttl is over
+var ErrKeyExpired = errors.New("key expired")
 
 // upgrade ... upgrade the file format
-func (s *Shard) upgrade(ver int, name string) error {
+func (s *Shard) upgrade(ver int, name string, offset, fileSize int64) error {
 	var newFile *os.File
 	newName := name + ".new"
 	newFile, err := os.OpenFile(newName, os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.FileMode(0644))
@@ -35,17 +128,29 @@ func (s *Shard) upgrade(ver int, name string) error {
 	}
 
 	// write the new version header
-	_, err = newFile.Write([]byte{versionMarker, currentShardVer})
+	s.classes = s.slotClasses()
+	head := s.classes.fileHead()
+	s.start = int64(len(head))
+	_, err = newFile.Write(head)
 	if err != nil {
 		return err
 	}
 
-	seek := uint32(2)
+	seek := uint32(len(head))
 	oldSizeHead := sizeHeaders[ver]
 	sizeDiff := sizeHead - oldSizeHead
 
 	for {
 		header, err := readHeader(s.f, ver)
+		if err == nil && header != nil {
+			err = checkRecord(s.f, header, ver, powerOfTwo, offset, fileSize)
+		}
+		if errors.Is(err, errTornRecord) {
+			err = repairTail(s.f, s.name, offset, fileSize)
+			if err == nil {
+				break
+			}
+		}
 		if err != nil {
 			newFile.Close()
 			return err
@@ -53,11 +158,13 @@ func (s *Shard) upgrade(ver int, name string) error {
 		if header == nil {
 			break
 		}
-		oldSizeData := (1 << header.sizeByte) - oldSizeHead
-		sizeb, size := utils.NextPowerOf2(sizeHead + uint32(header.keyLength) + header.valLength)
-		header.sizeByte = sizeb
+		offset += powerOfTwo.size(header.sizeByte)
+		oldSizeData := uint32(powerOfTwo.size(header.sizeByte)) - oldSizeHead
+		header.sizeByte = s.classes.classOf(uint64(sizeHead) + uint64(header.keyLength) + uint64(header.valLength))
+		size := uint32(s.classes.size(header.sizeByte))
 
-		b := make([]byte, size+sizeDiff)
+		// the old slot may be bigger than the new one
+		b := make([]byte, max(size+sizeDiff, sizeHead+oldSizeData))
 		writeHeader(b, header)
 		n, err := s.f.Read(b[sizeHead : sizeHead+oldSizeData])
 		if err != nil {
@@ -75,7 +182,8 @@ func (s *Shard) upgrade(ver int, name string) error {
 		endPos := int(sizeHead) + int(header.keyLength) + int(header.valLength)
 		h := murmur3.Sum32WithSeed(b[startPos:endPos], 0)
 
-		s.mapping[h] = Encode(seek, header.sizeByte, header.expire)
+		s.setEntry(h, seek, header.sizeByte, header.expire)
+		s.collectKey(b[startPos:endPos], header, int64(header.valLength))
 		n, err = newFile.Write(b[0:size])
 		if err != nil {
 			return err
@@ -88,7 +196,7 @@ func (s *Shard) upgrade(ver int, name string) error {
 		return err
 	}
 	// rewrite the ref to the new file
-	s.f = newFile
+	s.f = wrapFile(s.fds, name, newFile)
 	// remove the old file from the disk
 	err = os.Remove(name)
 	if err != nil {
@@ -102,16 +210,42 @@ func (s *Shard) upgrade(ver int, name string) error {
 	return nil
 }
 
-func (s *Shard) writeHeader(ver int, offset uint32) error {
+// writeHeader ... load the index from the file, the torn tail left by a crash is truncated.
+// A broken record in the middle of the file fails the load with ErrCorruptedRecord
+func (s *Shard) writeHeader(ver int, offset uint32, fileSize int64) error {
+	// chunks not referenced by any manifest are left by the interrupted writes
+	chunks := make(map[uint32]byte)
+	blobs := make(map[blobKey]*blob)
+	// collected keys of the shared values, their size is known once the blobs are loaded
+	refKeys := make(map[int]blobKey)
+
 	for {
 		header, err := readHeader(s.f, ver)
+		if err == nil && header != nil {
+			err = checkRecord(s.f, header, ver, s.classes, int64(offset), fileSize)
+		}
+		if errors.Is(err, errTornRecord) {
+			err = repairTail(s.f, s.name, int64(offset), fileSize)
+			if err != nil {
+				return err
+			}
+			break
+		}
 		if err != nil {
 			return err
 		}
 		if header == nil {
 			break
 		}
-		_, err = s.f.Seek(int64(header.valLength), 1)
+
+		var val []byte
+		if header.status == statusManifest || header.status == statusRef ||
+			(header.status == 0 && int(header.valLength) <= s.inlineMax) {
+			val = make([]byte, header.valLength)
+			_, err = io.ReadFull(s.f, val)
+		} else {
+			_, err = s.f.Seek(int64(header.valLength), 1)
+		}
 		if err != nil {
 			return err
 		}
@@ -122,31 +256,92 @@ func (s *Shard) writeHeader(ver int, offset uint32) error {
 			return err
 		}
 
-		shift := 1 << header.sizeByte
+		shift := int(s.classes.size(header.sizeByte))
 		// skip empty tail
 		res, err := s.f.Seek(int64(shift-int(header.keyLength)-int(header.valLength)-int(sizeHead)), 1)
 		if err != nil {
 			return err
 		}
 
-		if header.status != deleted && (header.expire == 0 || int64(header.expire) >= time.Now().Unix()) {
+		switch {
+		case header.status == statusChunk:
+			chunks[offset] = header.sizeByte
+		case header.status == statusBlob:
+			// a second copy of the same value is left by an interrupted write, the first one is kept
+			if len(key) != blobKeySize || blobs[blobKey(key)] != nil {
+				s.remapping[offset] = header.sizeByte
+				break
+			}
+			blobs[blobKey(key)] = &blob{addr: offset, size: header.sizeByte, length: header.valLength}
+		case header.status != deleted && (header.expire == 0 || int64(header.expire) >= time.Now().Unix()):
 			h := murmur3.Sum32WithSeed(key, 0)
-			s.mapping[h] = Encode(offset, header.sizeByte, header.expire)
-		} else {
+			size := int64(header.valLength)
+			if header.status == statusManifest {
+				m, err := ParseManifest(val)
+				if err != nil {
+					return err
+				}
+				s.chunked[offset] = m.Chunks
+				size = int64(m.Size)
+			}
+			if header.status == statusRef && len(val) == blobKeySize {
+				s.deduped[offset] = blobKey(val)
+			}
+			s.setEntry(h, offset, header.sizeByte, header.expire)
+			s.cacheInline(h, header, key, val)
+			if s.collectKey(key, header, size) && header.status == statusRef && len(val) == blobKeySize {
+				refKeys[len(s.prefixed)-1] = blobKey(val)
+			}
+		default:
 			s.remapping[offset] = header.sizeByte
 		}
 
 		offset = uint32(res)
 	}
 
+	for _, refs := range s.chunked {
+		for _, ref := range refs {
+			delete(chunks, ref.Addr)
+		}
+	}
+	for addr, size := range chunks {
+		s.remapping[addr] = size
+	}
+	s.loadBlobs(blobs)
+	for i, key := range refKeys {
+		if b, ok := s.blobs[key]; ok {
+			s.prefixed[i].Size = int64(b.length)
+		}
+	}
+
 	return nil
 }
 
-func (s *Shard) Open(name string) error {
+func (s *Shard) Open(name string, opts ...OptShard) error {
 	s.Lock()
 	defer s.Unlock()
 
-	forceExit = false
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.coldName != "" {
+		s.accessed = make(map[uint32]uint32)
+	}
+
+	err := s.load(name)
+	if err != nil || s.coldName == "" {
+		return err
+	}
+	return s.openCold()
+}
+
+// load ... open the shard file and load the index
+func (s *Shard) load(name string) error {
+	// the leftover of the interrupted compaction, the original file is still intact
+	err := os.Remove(name + compactSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
 
 	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, os.FileMode(0644))
 	if err != nil {
@@ -158,9 +353,24 @@ func (s *Shard) Open(name string) error {
 		return err
 	}
 
-	s.f = f
+	s.f = wrapFile(s.fds, name, f)
+	// the file is read sequentially, keep the descriptor until the index is loaded
+	_, err = s.f.pin()
+	if err != nil {
+		return err
+	}
+	defer s.f.unpin()
+	s.name = name
 	s.mapping = make(map[uint32]uint64)
 	s.remapping = make(map[uint32]byte)
+	s.chunked = make(map[uint32][]ChunkRef)
+	s.pinned = make(map[uint32]int)
+	s.retired = make(map[uint32]byte)
+	s.pending = make(map[uint32]byte)
+	s.blobs = make(map[blobKey]*blob)
+	s.deduped = make(map[uint32]blobKey)
+	s.inline = make(map[uint32]*inlineRec)
+	s.expiry = newExpiryIndex()
 	fi, err := s.f.Stat()
 
 	if err != nil {
@@ -170,7 +380,10 @@ func (s *Shard) Open(name string) error {
 	// create a new file
 	if fi.Size() == 0 {
 		// write shard info to the file
-		_, err = s.f.Write([]byte{versionMarker, currentShardVer})
+		s.classes = s.slotClasses()
+		head := s.classes.fileHead()
+		s.start = int64(len(head))
+		_, err = s.f.Write(head)
 		if err != nil {
 			return err
 		}
@@ -190,15 +403,21 @@ func (s *Shard) Open(name string) error {
 
 	if ver == 0 {
 		s.f.Seek(0, 0)
+		s.classes = powerOfTwo
 	} else {
-		offset = 2
+		s.classes, s.start, err = readClasses(s.f, ver)
+		if err != nil {
+			return err
+		}
+		offset = uint32(s.start)
 	}
 
-	if ver < currentShardVer {
-		return s.upgrade(ver, name)
+	// v2 has the current record layout, its power of two slots are converted by the compaction
+	if ver < 2 {
+		return s.upgrade(ver, name, int64(offset), fi.Size())
 	}
 
-	return s.writeHeader(ver, offset)
+	return s.writeHeader(ver, offset, fi.Size())
 }
 
 func (s *Shard) readKey(keyLen uint16) ([]byte, error) {
@@ -218,150 +437,302 @@ func (s *Shard) Fsync() error {
 	if s.useFsync {
 		s.Lock()
 		defer s.Unlock()
-		s.useFsync = false
-		return s.f.Sync()
+		return s.FsyncLocked()
 	}
 	return nil
 }
 
-func (s *Shard) ExpireKeys(maxRuntime time.Duration) error {
-	startTime := time.Now().UnixMilli()
-	current := startTime / 1000
-	expired := make([]uint32, 0, 1024)
-
-	if maxRuntime.Seconds() > 1000 {
-		maxRuntime = time.Duration(1000) * time.Second
+// FsyncLocked ... same as Fsync, the shard is locked by the caller
+func (s *Shard) FsyncLocked() error {
+	if !s.useFsync {
+		return nil
 	}
+	s.useFsync = false
+	return s.f.Sync()
+}
 
-	endTime := startTime + maxRuntime.Milliseconds()
-
-	s.RLock()
+// ExpireDue ... remove up to limit keys which expired before now, returns the number of removed keys.
+// A result equal to the limit means more keys may be due
+func (s *Shard) ExpireDue(now int64, limit int) int {
+	s.Lock()
+	defer s.Unlock()
 
-	for key, val := range s.mapping {
-		_, _, expire := Decode(val)
-		if expire != 0 && current > int64(expire) {
-			expired = append(expired, key)
+	due := s.expiry.popDue(uint32(now), limit)
+	for _, h := range due {
+		if data, ok := s.mapping[h]; ok {
+			addr, size, _ := Decode(data)
+			delete(s.mapping, h)
+			delete(s.accessed, h)
+			delete(s.inline, h)
+			s.free(addr, size)
+		} else if data, ok := s.coldMapping[h]; ok {
+			addr, size, _ := Decode(data)
+			delete(s.coldMapping, h)
+			s.coldFree[addr] = size
 		}
 	}
+	return len(due)
+}
 
-	s.RUnlock()
-	if len(expired) == 0 {
-		return nil
-	}
-
-	sleepTime := maxRuntime.Milliseconds() / int64(len(expired)) / 2
-	totalBulk := 1
+// NextExpire ... the earliest expire time of the shard keys, 0 - no keys with ttl
+func (s *Shard) NextExpire() uint32 {
+	s.Lock()
+	defer s.Unlock()
+	return s.expiry.next()
+}
 
-	if sleepTime < 1 {
-		totalBulk = len(expired)/int(maxRuntime.Milliseconds()+1) + 1
-		sleepTime = 1
-	} else if sleepTime > 10 {
-		sleepTime = 10
+// setEntry ... add the key record to the index
+func (s *Shard) setEntry(h, addr uint32, size byte, expire uint32) {
+	s.mapping[h] = Encode(addr, size, expire)
+	s.expiry.set(h, expire)
+	if s.accessed != nil {
+		s.accessed[h] = uint32(time.Now().Unix())
 	}
+}
 
-	if maxRuntime == time.Duration(0) {
-		totalBulk = 1000
-		sleepTime = 0
-		endTime = startTime + 300000
-	}
+// removeEntry ... remove the key record from the index
+func (s *Shard) removeEntry(h uint32) {
+	delete(s.mapping, h)
+	delete(s.accessed, h)
+	delete(s.inline, h)
+	s.expiry.remove(h)
+}
 
+func (s *Shard) Set(k, v []byte, h, expire, flags uint32) error {
 	s.Lock()
+	defer s.Unlock()
+	return s.write(k, v, h, expire, flags)
+}
 
-	cnt := 0
-	bulkCount := 0
-	for _, h := range expired {
-		if forceExit || time.Now().UnixMilli() >= endTime {
-			break
-		}
-		cnt++
-		data, ok := s.mapping[h]
-		if ok {
-			addr, sizeb, expire := Decode(data)
-			if expire != 0 && current > int64(expire) {
-				delete(s.mapping, h)
-				s.remapping[addr] = sizeb
-			}
+// SetLocked ... same as Set, but the caller must already hold the shard lock
+func (s *Shard) SetLocked(k, v []byte, h, expire, flags uint32) error {
+	return s.write(k, v, h, expire, flags)
+}
+
+func (s *Shard) write(k, v []byte, h, expire, flags uint32) error {
+	if s.maxValue > 0 && int64(len(v)) > s.maxValue {
+		return common.ErrValueTooBig
+	}
+	err := s.notify(k, h)
+	if err != nil {
+		return err
+	}
+	s.useFsync = true
+	oldAddr, oldSize, err := s.lookup(k, h)
+	if err != nil {
+		return err
+	}
+
+	if payload := s.ChunkPayload(k); payload > 0 && len(v) > payload {
+		refs, err := s.writeChunks(k, v)
+		if err != nil {
+			return err
 		}
-		bulkCount++
-		if bulkCount >= totalBulk {
-			s.Unlock()
-			time.Sleep(time.Duration(sleepTime) * time.Millisecond)
-			s.Lock()
-			bulkCount = 0
+		err = s.setManifest(k, h, &Manifest{Size: uint64(len(v)), Chunks: refs}, expire, flags, oldAddr, oldSize)
+		if err != nil {
+			s.releaseRefs(refs)
 		}
+		return err
+	}
+	if s.dedupable(k, v) {
+		return s.writeRef(k, v, h, expire, flags, oldAddr, oldSize)
 	}
 
-	s.Unlock()
+	header, b := s.marshal(k, v, expire, flags)
+	return s.put(h, header, b, oldAddr, oldSize)
+}
 
+// put ... write the marshaled record to the old slot if the size is the same,
+// otherwise the record is relocated to the free slot or to the end of file
+func (s *Shard) put(h uint32, header *Header, b []byte, oldAddr int64, oldSize byte) error {
+	if oldAddr < 0 || oldSize != header.sizeByte {
+		return s.relocate(h, header, b, oldAddr, oldSize)
+	}
+	s.releaseChunked(uint32(oldAddr))
+	s.releaseRef(uint32(oldAddr))
+	err := s.writeAt(b, uint32(oldAddr), oldAddr)
+	if err != nil {
+		return err
+	}
+	s.index(h, header, b, uint32(oldAddr))
 	return nil
 }
 
-func (s *Shard) Set(k, v []byte, h, expire uint32) error {
+// relocate ... write the record to the free slot or to the end of file, then release the old slot.
+// The old record is marked deleted only after the new one is written, so a crash keeps one of them
+func (s *Shard) relocate(h uint32, header *Header, b []byte, oldAddr int64, oldSize byte) error {
+	pos, err := s.alloc(header.sizeByte)
+	if err != nil {
+		return err
+	}
+	err = s.writeAt(b, uint32(pos), pos)
+	if err != nil {
+		return err
+	}
+	s.index(h, header, b, uint32(pos))
+	if oldAddr < 0 {
+		return nil
+	}
+	err = s.writeAt([]byte{deleted}, uint32(oldAddr), oldAddr+1)
+	if err != nil {
+		return err
+	}
+	s.free(uint32(oldAddr), oldSize)
+	return nil
+}
+
+// index ... point the key to the written record
+func (s *Shard) index(h uint32, header *Header, b []byte, pos uint32) {
+	s.setEntry(h, pos, header.sizeByte, header.expire)
+	_, key, val := unmarshal(b)
+	s.cacheInline(h, header, key, val)
+}
+
+// Concat ... append or prepend the data to the value of the existing key.
+// When the result still fits into the slot the record is updated in place:
+// append writes only the new data and the key, prepend rewrites the value in the same slot,
+// the header goes last. Otherwise, the record is moved to a bigger slot before the old one is released
+// or split into chunks once it outgrows a single chunk. Expire time and flags are always kept
+func (s *Shard) Concat(k, data []byte, h uint32, prepend bool) error {
 	s.Lock()
 	defer s.Unlock()
-	return s.write(k, v, h, expire)
-}
 
-func (s *Shard) write(k, v []byte, h, expire uint32) error {
-	var err error
+	err := s.notify(k, h)
+	if err != nil {
+		return err
+	}
+	header, val, err := s.getRecord(k, h)
+	if err != nil {
+		return err
+	}
+	addr, size, _ := Decode(s.mapping[h])
 	s.useFsync = true
-	header, b := marshal(k, v, expire)
-	// write at file
-	pos := int64(-1)
 
-	if data, ok := s.mapping[h]; ok {
-		addr, size, _ := Decode(data)
-		bb := make([]byte, 1<<size)
-		_, err := s.f.ReadAt(bb, int64(addr))
+	if s.maxValue > 0 && int64(header.valLength)+int64(len(data)) > s.maxValue {
+		return common.ErrValueTooBig
+	}
+
+	if header.status == statusManifest {
+		return s.concatChunked(k, h, addr, size, header, val, data, prepend)
+	}
+	if header.status == statusRef {
+		// the shared value is never changed in place, the key gets the new value
+		val, err = s.resolve(header, val)
 		if err != nil {
 			return err
 		}
-		oldHeader, key, _ := unmarshal(bb)
-		if !bytes.Equal(key, k) {
-			return common.ErrCollision
+		v := make([]byte, 0, len(val)+len(data))
+		if prepend {
+			v = append(append(v, data...), val...)
+		} else {
+			v = append(append(v, val...), data...)
 		}
+		return s.write(k, v, h, header.expire, header.flags)
+	}
 
-		if oldHeader.sizeByte == header.sizeByte {
-			pos = int64(addr)
-		} else {
-			delByte := []byte{deleted}
-			_, err := s.f.WriteAt(delByte, int64(addr+1))
-			if err != nil {
-				return err
-			}
-			s.remapping[addr] = oldHeader.sizeByte
+	recordLen := uint64(sizeHead) + uint64(header.keyLength) + uint64(header.valLength) + uint64(len(data))
+	if recordLen <= uint64(s.classes.size(size)) {
+		return s.concatInPlace(k, h, addr, header, val, data, prepend)
+	}
 
-			for addrKey, sizeh := range s.remapping {
-				if sizeh == header.sizeByte {
-					pos = int64(addrKey)
-					delete(s.remapping, addrKey)
-					break
-				}
-			}
+	v := make([]byte, 0, len(val)+len(data))
+	if prepend {
+		v = append(append(v, data...), val...)
+	} else {
+		v = append(append(v, val...), data...)
+	}
+	// the value outgrows a single chunk
+	if payload := s.ChunkPayload(k); payload > 0 && len(v) > payload {
+		refs, err := s.writeChunks(k, v)
+		if err != nil {
+			return err
 		}
+		m := &Manifest{Size: uint64(len(v)), Chunks: refs}
+		return s.setManifest(k, h, m, header.expire, header.flags, int64(addr), size)
 	}
+	newHeader, b := s.marshal(k, v, header.expire, header.flags)
+	return s.relocate(h, newHeader, b, int64(addr), size)
+}
 
-	if pos < 0 {
-		// append to the end of file
-		pos, _ = s.f.Seek(0, 2)
+// concatInPlace ... write the data and the key into the slot of the record, then the header with the new
+// value length, so the record points to the new value only after it's written
+func (s *Shard) concatInPlace(k []byte, h, addr uint32, header *Header, val, data []byte, prepend bool) error {
+	oldValLength := header.valLength
+	header.valLength += uint32(len(data))
+	var b []byte
+	var pos int64
+	if prepend {
+		b = make([]byte, 0, int(header.valLength)+len(k))
+		b = append(append(append(b, data...), val...), k...)
+		pos = int64(addr + sizeHead)
+	} else {
+		b = make([]byte, 0, len(data)+len(k))
+		b = append(append(b, data...), k...)
+		pos = int64(addr + sizeHead + oldValLength)
 	}
-
-	_, err = s.f.WriteAt(b, pos)
+	err := s.writeAt(b, addr, pos)
 	if err != nil {
 		return err
 	}
 
-	s.mapping[h] = Encode(uint32(pos), header.sizeByte, header.expire)
+	hb := make([]byte, sizeHead)
+	writeHeader(hb, header)
+	err = s.writeAt(hb, addr, int64(addr))
+	if err != nil {
+		return err
+	}
+	if prepend {
+		s.cacheInline(h, header, k, b[:header.valLength])
+	} else {
+		s.cacheInline(h, header, k, append(val, data...))
+	}
 	return nil
 }
 
 func (s *Shard) Touch(k []byte, h, expire uint32) error {
 	s.Lock()
 	defer s.Unlock()
+	return s.touch(k, h, expire)
+}
+
+// Expiry ... expire time of the key, 0 if the key has no ttl
+func (s *Shard) Expiry(k []byte, h uint32) (uint32, error) {
+	s.RLock()
+	defer s.RUnlock()
+	header, err := s.headerOf(k, h)
+	if err != nil {
+		return 0, err
+	}
+	return header.expire, nil
+}
+
+// Persist ... remove the ttl of the key, false if the key has no ttl
+func (s *Shard) Persist(k []byte, h uint32) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	header, _, err := s.getRecord(k, h)
+	if err != nil {
+		return false, err
+	}
+	if header.expire == 0 {
+		return false, nil
+	}
+	return true, s.touch(k, h, 0)
+}
+
+func (s *Shard) touch(k []byte, h, expire uint32) error {
+	err := s.notify(k, h)
+	if err != nil {
+		return err
+	}
+	err = s.warm(h)
+	if err != nil {
+		return err
+	}
 
 	if data, ok := s.mapping[h]; ok {
 		addr, size, _ := Decode(data)
-		bb := make([]byte, 1<<size)
+		bb := make([]byte, s.classes.size(size))
 		_, err := s.f.ReadAt(bb, int64(addr))
 		if err != nil {
 			return err
@@ -372,16 +743,20 @@ func (s *Shard) Touch(k []byte, h, expire uint32) error {
 		}
 
 		if header.expire != 0 && int64(header.expire) < time.Now().Unix() {
-			return errors.New("invalid key")
+			return ErrKeyExpired
 		}
 
 		header.expire = expire
 		b := make([]byte, sizeHead)
 		writeHeader(b, header)
-		_, err = s.f.WriteAt(b, int64(addr))
+		err = s.writeAt(b, addr, int64(addr))
 		if err != nil {
 			return err
 		}
+		s.setEntry(h, addr, size, expire)
+		if rec, ok := s.inline[h]; ok {
+			rec.header.expire = expire
+		}
 		s.useFsync = true
 	} else {
 		return common.ErrKeyNotFound
@@ -396,44 +771,45 @@ func (s *Shard) Get(k []byte, h uint32) ([]byte, *Header, error) {
 	return s.get(k, h)
 }
 
-func (s *Shard) get(k []byte, h uint32) ([]byte, *Header, error) {
-	if data, ok := s.mapping[h]; ok {
-		addr, size, expire := Decode(data)
+// GetLocked ... same as Get, but the caller must already hold the shard lock
+func (s *Shard) GetLocked(k []byte, h uint32) ([]byte, *Header, error) {
+	return s.get(k, h)
+}
 
-		if expire != 0 && int64(expire) < time.Now().Unix() {
-			delete(s.mapping, h)
-			s.remapping[addr] = size
-			return nil, nil, errors.New("key expired")
-		}
+func (s *Shard) get(k []byte, h uint32) ([]byte, *Header, error) {
+	header, val, err := s.getRecord(k, h)
+	if err != nil {
+		return nil, nil, err
+	}
 
-		bb := make([]byte, 1<<size)
-		_, err := s.f.ReadAt(bb, int64(addr))
+	if header.status == statusManifest {
+		m, err := ParseManifest(val)
 		if err != nil {
 			return nil, nil, err
 		}
-
-		header, key, val := unmarshal(bb)
-		if !bytes.Equal(key, k) {
-			return nil, nil, common.ErrCollision
-		}
-
-		if header.expire != 0 && int64(header.expire) < time.Now().Unix() {
-			delete(s.mapping, h)
-			s.remapping[addr] = size
-			return nil, nil, errors.New("key expired")
+		val, err = s.readChunked(k, m)
+		if err != nil {
+			return nil, nil, err
 		}
-
-		return val, header, nil
+	}
+	val, err = s.resolve(header, val)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return nil, nil, common.ErrKeyNotFound
+	return val, header, nil
 }
 
 func (s *Shard) Close() error {
-	forceExit = true
 	s.Lock()
 	defer s.Unlock()
-	return s.f.Close()
+	// the unfinished compaction is dropped, the shard file is untouched
+	err := s.abortCompaction(nil)
+	err = errors.Join(err, s.f.Close())
+	if s.cold != nil {
+		err = errors.Join(err, s.cold.Close())
+	}
+	return err
 }
 
 func (s *Shard) FileSize() (int64, error) {
@@ -443,15 +819,39 @@ func (s *Shard) FileSize() (int64, error) {
 	if err != nil {
 		return -1, err
 	}
-	return f.Size(), nil
+	if s.cold == nil {
+		return f.Size(), nil
+	}
+	cf, err := s.cold.Stat()
+	if err != nil {
+		return -1, err
+	}
+	return f.Size() + cf.Size(), nil
 }
 
 func (s *Shard) Delete(k []byte, h uint32) (bool, error) {
 	s.Lock()
 	defer s.Unlock()
+	return s.delete(k, h)
+}
+
+// DeleteLocked ... same as Delete, but the caller must already hold the shard lock
+func (s *Shard) DeleteLocked(k []byte, h uint32) (bool, error) {
+	return s.delete(k, h)
+}
+
+func (s *Shard) delete(k []byte, h uint32) (bool, error) {
+	err := s.notify(k, h)
+	if err != nil {
+		return false, err
+	}
+	err = s.warm(h)
+	if err != nil {
+		return false, err
+	}
 	if data, ok := s.mapping[h]; ok {
 		addr, size, _ := Decode(data)
-		bb := make([]byte, 1<<size)
+		bb := make([]byte, s.classes.size(size))
 		_, err := s.f.ReadAt(bb, int64(addr))
 		if err != nil {
 			return false, err
@@ -461,12 +861,12 @@ func (s *Shard) Delete(k []byte, h uint32) (bool, error) {
 			return false, common.ErrCollision
 		}
 		// found the key now can delete it
-		_, err = s.f.WriteAt([]byte{deleted}, int64(addr+1))
+		err = s.writeAt([]byte{deleted}, addr, int64(addr+1))
 		if err != nil {
 			return false, err
 		}
-		delete(s.mapping, h)
-		s.remapping[addr] = header.sizeByte
+		s.removeEntry(h)
+		s.free(addr, header.sizeByte)
 		return true, nil
 	}
 	return false, nil
@@ -476,9 +876,9 @@ func (s *Shard) Counter(k []byte, h uint32, v uint64, inc bool) (uint64, error)
 	s.Lock()
 	defer s.Unlock()
 	old, header, err := s.get(k, h)
-	expire := uint32(0)
+	expire, flags := uint32(0), uint32(0)
 	if header != nil {
-		expire = header.expire
+		expire, flags = header.expire, header.flags
 	}
 
 	if errors.Is(err, common.ErrKeyNotFound) {
@@ -503,21 +903,46 @@ func (s *Shard) Counter(k []byte, h uint32, v uint64, inc bool) (uint64, error)
 
 	b := make([]byte, 8)
 	binary.BigEndian.PutUint64(b, cnt)
-	err = s.write(k, b, h, expire)
+	err = s.write(k, b, h, expire, flags)
 	return cnt, err
 }
 
 func (s *Shard) Count() int {
 	s.RLock()
 	defer s.RUnlock()
-	return len(s.mapping)
+	return len(s.mapping) + len(s.coldMapping)
 }
 
 func (s *Shard) Backup(w io.Writer) error {
 	s.Lock()
 	defer s.Unlock()
+	return s.backup(w, nil)
+}
+
+// BackupLocked ... same as Backup, the records of the keys for which skip returns true are left out.
+// The caller must already hold the shard lock
+func (s *Shard) BackupLocked(w io.Writer, skip func(k []byte) bool) error {
+	return s.backup(w, skip)
+}
+
+// BackupRecord ... write the record of the key in the format of Backup
+func (s *Shard) BackupRecord(w io.Writer, k, v []byte, expire, flags uint32) error {
+	header := makeHeader(s.classes, k, v, expire, flags)
+	b := make([]byte, sizeHead, int(sizeHead)+len(v)+len(k))
+	writeHeader(b, header)
+	_, err := w.Write(append(append(b, v...), k...))
+	return err
+}
 
-	_, err := s.f.Seek(2, 0)
+func (s *Shard) backup(w io.Writer, skip func(k []byte) bool) error {
+	// the file is read sequentially, keep the descriptor until the end
+	_, err := s.f.pin()
+	if err != nil {
+		return err
+	}
+	defer s.f.unpin()
+
+	_, err = s.f.Seek(s.start, 0)
 	if err != nil {
 		return err
 	}
@@ -543,7 +968,7 @@ func (s *Shard) Backup(w io.Writer) error {
 			return fmt.Errorf("wrong file size format, got: %d, expect: %d", n, size-int(sizeHead))
 		}
 
-		shift := 1 << header.sizeByte
+		shift := int(s.classes.size(header.sizeByte))
 		// move cursor pointer
 		_, err = s.f.Seek(int64(shift-int(header.keyLength)-int(header.valLength)-int(sizeHead)), 1)
 		if err != nil {
@@ -553,6 +978,9 @@ func (s *Shard) Backup(w io.Writer) error {
 		if header.status == deleted || (header.expire != 0 && int64(header.expire) < time.Now().Unix()) {
 			continue
 		}
+		if skip != nil && skip(b[sizeHead+header.valLength:]) {
+			continue
+		}
 
 		_, err = w.Write(b)
 		if err != nil {
@@ -560,5 +988,5 @@ func (s *Shard) Backup(w io.Writer) error {
 		}
 	}
 
-	return nil
+	return s.backupCold(w, skip)
 }
@@ -0,0 +1,302 @@
+package shard
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/spaolacci/murmur3"
+)
+
+// ColdFile ... path of the capacity tier file of the shard, empty - tiering is off.
+// The records not accessed for a while are moved there by Demote and moved back on the next access
+func ColdFile(name string) OptShard {
+	return func(s *Shard) {
+		s.coldName = name
+	}
+}
+
+// TierStats ... number of the keys in every tier and the moves between them
+type TierStats struct {
+	Hot      int
+	Cold     int
+	Demoted  uint64
+	Promoted uint64
+}
+
+// Tiers ... state of the shard tiers
+func (s *Shard) Tiers() TierStats {
+	s.RLock()
+	defer s.RUnlock()
+	return TierStats{Hot: len(s.mapping), Cold: len(s.coldMapping), Demoted: s.demoted, Promoted: s.promoted}
+}
+
+// openCold ... open the capacity tier file and load its index.
+// The record present in both files is the leftover of an interrupted move, the hot copy wins
+func (s *Shard) openCold() error {
+	f, err := os.OpenFile(s.coldName, os.O_CREATE|os.O_RDWR, os.FileMode(0644))
+	if err != nil {
+		return err
+	}
+	s.cold = wrapFile(s.fds, s.coldName, f)
+	s.coldMapping = make(map[uint32]uint64)
+	s.coldFree = make(map[uint32]byte)
+
+	fi, err := s.cold.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	if size == 0 {
+		// the classes of the hot file, so the records are moved as is
+		s.coldClasses = s.classes
+		head := s.coldClasses.fileHead()
+		s.coldStart = int64(len(head))
+		_, err = s.cold.WriteAt(head, 0)
+		return err
+	}
+
+	ver := make([]byte, 2)
+	_, err = s.cold.ReadAt(ver, 0)
+	if err != nil {
+		return err
+	}
+	if ver[0] != versionMarker || ver[1] < 2 || ver[1] > currentShardVer {
+		return errors.New("unknown shard version in file " + s.coldName)
+	}
+	s.coldClasses, s.coldStart, err = readClasses(io.NewSectionReader(s.cold, 2, 1), int(ver[1]))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	for pos := s.coldStart; pos < size; {
+		hb := make([]byte, sizeHead)
+		_, err = s.cold.ReadAt(hb, pos)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		header := parseHeader(hb, currentShardVer)
+		if err == nil {
+			err = checkRecord(s.cold, header, currentShardVer, s.coldClasses, pos, size)
+		}
+		// the header cut by the end of the file is torn as well
+		if errors.Is(err, errTornRecord) || errors.Is(err, io.EOF) {
+			return repairTail(s.cold, s.coldName, pos, size)
+		}
+		if err != nil {
+			return err
+		}
+
+		b := make([]byte, s.coldClasses.size(header.sizeByte))
+		_, err = s.cold.ReadAt(b, pos)
+		if err != nil {
+			return err
+		}
+		_, key, _ := unmarshal(b)
+		h := murmur3.Sum32WithSeed(key, 0)
+		_, hot := s.mapping[h]
+
+		switch {
+		case header.status != 0 || (header.expire != 0 && int64(header.expire) < now):
+			s.coldFree[uint32(pos)] = header.sizeByte
+		case hot:
+			_, err = s.cold.WriteAt([]byte{deleted}, pos+1)
+			if err != nil {
+				return err
+			}
+			s.coldFree[uint32(pos)] = header.sizeByte
+		default:
+			s.coldMapping[h] = Encode(uint32(pos), header.sizeByte, header.expire)
+			s.expiry.set(h, header.expire)
+			s.collectKey(key, header, int64(header.valLength))
+		}
+		pos += int64(len(b))
+	}
+	return nil
+}
+
+// warm ... record the access of the key, the cold record is moved back to the hot tier.
+// Every keyed operation warms the hash first, so the hash is never indexed in both tiers
+func (s *Shard) warm(h uint32) error {
+	if s.cold == nil {
+		return nil
+	}
+	if _, ok := s.mapping[h]; ok {
+		s.accessed[h] = uint32(time.Now().Unix())
+		return nil
+	}
+	entry, ok := s.coldMapping[h]
+	if !ok {
+		return nil
+	}
+
+	addr, coldSize, _ := Decode(entry)
+	b := make([]byte, s.coldClasses.size(coldSize))
+	_, err := s.cold.ReadAt(b, int64(addr))
+	if err != nil {
+		return err
+	}
+	b, size := reslot(b, s.coldClasses, s.classes)
+	pos, err := s.alloc(size)
+	if err != nil {
+		return err
+	}
+	err = s.writeAt(b, uint32(pos), pos)
+	if err == nil {
+		// the hot copy must be durable before the cold one is dropped
+		err = s.f.Sync()
+	}
+	if err != nil {
+		s.remapping[uint32(pos)] = size
+		return err
+	}
+
+	delete(s.coldMapping, h)
+	s.mapping[h] = uint64(pos)<<32 | uint64(size)<<24 | entry&0xffffff
+	s.accessed[h] = uint32(time.Now().Unix())
+	header, key, val := unmarshal(b)
+	s.cacheInline(h, header, key, val)
+	s.promoted++
+
+	_, err = s.cold.WriteAt([]byte{deleted}, int64(addr)+1)
+	if err == nil {
+		err = s.cold.Sync()
+	}
+	if err != nil {
+		// the stale cold copy loses to the hot one on the next load
+		return err
+	}
+	s.coldFree[addr] = coldSize
+	return nil
+}
+
+// Demote ... move up to limit records not accessed since before to the cold tier,
+// returns the number of the moved records. The chunked and shared values always stay in the hot tier
+func (s *Shard) Demote(before int64, limit int) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.cold == nil {
+		return 0, nil
+	}
+
+	type move struct {
+		h     uint32
+		entry uint64
+		pos   int64
+		size  byte // class of the cold slot
+	}
+	var moves []move
+	release := func(moves []move) {
+		for _, m := range moves {
+			s.coldFree[uint32(m.pos)] = m.size
+		}
+	}
+
+	now := time.Now().Unix()
+	for h, at := range s.accessed {
+		if len(moves) >= limit {
+			break
+		}
+		if int64(at) >= before {
+			continue
+		}
+		entry, ok := s.mapping[h]
+		if !ok {
+			delete(s.accessed, h)
+			continue
+		}
+		addr, size, _ := Decode(entry)
+		_, chunked := s.chunked[addr]
+		if _, shared := s.deduped[addr]; chunked || shared {
+			// forget the access, so the value isn't checked on every run
+			delete(s.accessed, h)
+			continue
+		}
+
+		b := make([]byte, s.classes.size(size))
+		_, err := s.f.ReadAt(b, int64(addr))
+		if err != nil {
+			release(moves)
+			return 0, err
+		}
+		header := parseHeader(b, currentShardVer)
+		if header.status != 0 || (header.expire != 0 && int64(header.expire) < now) {
+			continue
+		}
+
+		b, coldSize := reslot(b, s.classes, s.coldClasses)
+		pos, err := s.coldAlloc(coldSize)
+		if err == nil {
+			_, err = s.cold.WriteAt(b, pos)
+		}
+		if err != nil {
+			release(moves)
+			return 0, err
+		}
+		moves = append(moves, move{h: h, entry: entry, pos: pos, size: coldSize})
+	}
+	if len(moves) == 0 {
+		return 0, nil
+	}
+
+	// the cold copies must be durable before the hot ones are dropped
+	err := s.cold.Sync()
+	if err != nil {
+		release(moves)
+		return 0, err
+	}
+	for i, m := range moves {
+		addr, size, _ := Decode(m.entry)
+		err = s.writeAt([]byte{deleted}, addr, int64(addr)+1)
+		if err != nil {
+			release(moves[i:])
+			return i, err
+		}
+		delete(s.mapping, m.h)
+		delete(s.accessed, m.h)
+		delete(s.inline, m.h)
+		s.remapping[addr] = size
+		s.coldMapping[m.h] = uint64(m.pos)<<32 | uint64(m.size)<<24 | m.entry&0xffffff
+		s.demoted++
+	}
+	s.useFsync = true
+	return len(moves), nil
+}
+
+// backupCold ... write the live records of the cold tier in the backup format
+func (s *Shard) backupCold(w io.Writer, skip func(k []byte) bool) error {
+	now := time.Now().Unix()
+	for _, entry := range s.coldMapping {
+		addr, size, _ := Decode(entry)
+		b := make([]byte, s.coldClasses.size(size))
+		_, err := s.cold.ReadAt(b, int64(addr))
+		if err != nil {
+			return err
+		}
+		header, key, _ := unmarshal(b)
+		if header.expire != 0 && int64(header.expire) < now {
+			continue
+		}
+		if skip != nil && skip(key) {
+			continue
+		}
+		_, err = w.Write(b[:int(sizeHead)+int(header.valLength)+int(header.keyLength)])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// coldAlloc ... take the free slot of the cold file or the end of the file
+func (s *Shard) coldAlloc(size byte) (int64, error) {
+	for addr, sizeh := range s.coldFree {
+		if sizeh == size {
+			delete(s.coldFree, addr)
+			return int64(addr), nil
+		}
+	}
+	return s.cold.Seek(0, 2)
+}
@@ -2,9 +2,20 @@ package shard
 
 import (
 	"errors"
+	"io"
 	"os"
+	"path/filepath"
 )
 
+// SyncDir ... fsync the directory of the file, so the file created or renamed there survives a crash
+func SyncDir(name string) error {
+	d, err := os.Open(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	return errors.Join(d.Sync(), d.Close())
+}
+
 func Encode(addr uint32, size byte, expire uint32) uint64 {
 	return uint64(addr)<<32 | uint64(size)<<24 | uint64(expire)>>9
 }
@@ -19,7 +30,7 @@ func Decode(key uint64) (uint32, byte, uint32) {
 	return add, size, expire
 }
 
-func getFileVer(file *os.File) (int, error) {
+func getFileVer(file io.Reader) (int, error) {
 	b := make([]byte, 2)
 	n, err := file.Read(b)
 	if err != nil {
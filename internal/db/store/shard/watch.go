@@ -0,0 +1,44 @@
+package shard
+
+import (
+	"errors"
+
+	"github.com/DenzelPenzel/nyx/internal/common"
+)
+
+// Watcher ... gets the state of the keys before they are changed by a write, a delete or a touch.
+// Both methods are called under the shard lock, so they must not call the shard back
+type Watcher interface {
+	// Watching ... the state of the key is wanted
+	Watching(k []byte) bool
+	// Before ... the value and the header of the key before the change, nil header - the key is missing
+	Before(k, v []byte, header *Header)
+}
+
+// Watch ... hand the keys to the watcher before they are changed, nil - no watcher.
+// The expired keys removed by ExpireDue and the records moved by the compaction or the tiering
+// aren't reported, their values don't change
+func Watch(w Watcher) OptShard {
+	return func(s *Shard) {
+		s.watcher = w
+	}
+}
+
+// notify ... report the current state of the key to the watcher, the caller holds the lock.
+// The key living in another shard is left to that shard
+func (s *Shard) notify(k []byte, h uint32) error {
+	if s.watcher == nil || !s.watcher.Watching(k) {
+		return nil
+	}
+	v, header, err := s.get(k, h)
+	switch {
+	case err == nil:
+		s.watcher.Before(k, v, header)
+	case errors.Is(err, common.ErrKeyNotFound) || errors.Is(err, ErrKeyExpired):
+		s.watcher.Before(k, nil, nil)
+	case errors.Is(err, common.ErrCollision):
+	default:
+		return err
+	}
+	return nil
+}
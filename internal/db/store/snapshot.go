@@ -0,0 +1,309 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DenzelPenzel/nyx/internal/common"
+	"github.com/DenzelPenzel/nyx/internal/db/store/shard"
+	"github.com/spaolacci/murmur3"
+)
+
+// ErrSnapshotReleased ... the snapshot is used after Release
+var ErrSnapshotReleased = errors.New("snapshot is released")
+
+// snapshots ... the snapshots not released yet, the changes of the keys save their state for them.
+// The list is replaced on every change, so the writes read it without the lock,
+// the saved keys of a shard are guarded by the lock of the shard only
+type snapshots struct {
+	active atomic.Int32
+	mu     sync.Mutex // serializes the changes of the list
+	list   atomic.Pointer[[]*Snapshot]
+	shards []sync.Mutex // guard the saved keys and the backup state of every shard in all the snapshots
+}
+
+// current ... the snapshots not released yet
+func (ss *snapshots) current() []*Snapshot {
+	if l := ss.list.Load(); l != nil {
+		return *l
+	}
+	return nil
+}
+
+// savedKey ... state of the key at the moment of the snapshot, saved by the first change of the key since then
+type savedKey struct {
+	val      []byte
+	header   shard.Header
+	missing  bool
+	backedUp bool // the record of the key was already written by the running Backup
+}
+
+// Snapshot ... read only view of the store frozen at the moment it was taken, while the writes go on.
+// The snapshot is copy on write: the first change of a key after the snapshot saves the previous state
+// of the key in it, so the snapshot holds the memory of the values changed while it's alive
+// and must be released with Release. The ttl is counted at the read,
+// the keys expiring meanwhile disappear from the snapshot as well
+type Snapshot struct {
+	s        *Store
+	taken    time.Time
+	saved    []map[Str]*savedKey // saved keys of every shard, nil once released
+	backup   []bool              // the shards written by the running Backup
+	running  atomic.Bool         // Backup is running
+	released atomic.Bool
+}
+
+// Snapshot ... take the snapshot of the store, the writes in progress are finished first.
+// The multi-key writes as WriteBatch and Rename are seen either fully or not at all
+func (s *Store) Snapshot() (*Snapshot, error) {
+	err := s.waitAll()
+	if err != nil {
+		return nil, err
+	}
+	ls := s.lockAll()
+	defer ls.unlock()
+
+	sn := &Snapshot{
+		s:      s,
+		taken:  time.Now(),
+		saved:  make([]map[Str]*savedKey, len(s.shards)),
+		backup: make([]bool, len(s.shards)),
+	}
+	for i := range sn.saved {
+		sn.saved[i] = make(map[Str]*savedKey)
+	}
+	s.snaps.mu.Lock()
+	list := append(slices.Clone(s.snaps.current()), sn)
+	s.snaps.list.Store(&list)
+	s.snaps.active.Add(1)
+	s.snaps.mu.Unlock()
+	return sn, nil
+}
+
+// Taken ... time the snapshot was taken
+func (sn *Snapshot) Taken() time.Time {
+	return sn.taken
+}
+
+// Release ... drop the saved values, the snapshot can't be read anymore
+func (sn *Snapshot) Release() {
+	s := sn.s
+	s.snaps.mu.Lock()
+	if sn.released.Swap(true) {
+		s.snaps.mu.Unlock()
+		return
+	}
+	list := slices.DeleteFunc(slices.Clone(s.snaps.current()), func(v *Snapshot) bool {
+		return v == sn
+	})
+	s.snaps.list.Store(&list)
+	s.snaps.active.Add(-1)
+	s.snaps.mu.Unlock()
+
+	for i := range sn.saved {
+		s.snaps.shards[i].Lock()
+		sn.saved[i] = nil
+		s.snaps.shards[i].Unlock()
+	}
+}
+
+// Get ... value of the key at the moment of the snapshot
+func (sn *Snapshot) Get(key []byte) ([]byte, error) {
+	v, _, err := sn.GetWithHeader(key)
+	return v, err
+}
+
+// GetWithHeader ... same as Get, also returns the record header with the expire time and flags.
+// common.ErrKeyNotFound if the key was missing or it's expired
+func (sn *Snapshot) GetWithHeader(key []byte) ([]byte, *shard.Header, error) {
+	v, header, err := sn.s.GetWithHeader(key)
+	if err != nil && !isMissing(err) {
+		return nil, nil, err
+	}
+
+	// the state of the key is saved before the key is changed,
+	// so once the read observes the change the saved state is already there
+	saved, ok, released := sn.lookup(key)
+	switch {
+	case released:
+		return nil, nil, ErrSnapshotReleased
+	case ok && (saved.missing || saved.expired(time.Now())):
+		return nil, nil, common.ErrKeyNotFound
+	case ok:
+		header := saved.header
+		return saved.val, &header, nil
+	case err != nil:
+		return nil, nil, common.ErrKeyNotFound
+	}
+	return v, header, nil
+}
+
+// lookup ... saved state of the key, it's saved by the shard holding the key: its own or a collision one
+func (sn *Snapshot) lookup(key []byte) (*savedKey, bool, bool) {
+	s := sn.s
+	h := murmur3.Sum32WithSeed(key, 0)
+	shards := []int{int(s.idx(h))}
+	for i := 0; i < s.shardColCnt; i++ {
+		shards = append(shards, i)
+	}
+	for _, i := range shards {
+		s.snaps.shards[i].Lock()
+		saved, ok := sn.saved[i][Str(key)]
+		released := sn.saved[i] == nil
+		s.snaps.shards[i].Unlock()
+		if released || ok {
+			return saved, ok, released
+		}
+	}
+	return nil, false, false
+}
+
+func (k *savedKey) expired(now time.Time) bool {
+	return k.header.Expire() != 0 && int64(k.header.Expire()) < now.Unix()
+}
+
+// Backup ... write all the records of the snapshot in the format of Store.Backup.
+// The shards are written one by one under their locks, the keys changed since the snapshot
+// are written from their saved state after all the shards
+func (sn *Snapshot) Backup(w io.Writer) error {
+	s := sn.s
+	if sn.released.Load() {
+		return ErrSnapshotReleased
+	}
+	if !sn.running.CompareAndSwap(false, true) {
+		return errors.New("backup of the snapshot is already running")
+	}
+	defer sn.running.Store(false)
+	// the state of the previous backup
+	for i := range sn.saved {
+		s.snaps.shards[i].Lock()
+		sn.backup[i] = false
+		for _, saved := range sn.saved[i] {
+			saved.backedUp = false
+		}
+		s.snaps.shards[i].Unlock()
+	}
+
+	_, err := w.Write([]byte{shard.FormatVersion})
+	if err != nil {
+		return err
+	}
+	for i := range s.shards {
+		err = sn.backupShard(w, i)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the keys changed before their shard was written were skipped there
+	type record struct {
+		key []byte
+		*savedKey
+	}
+	var records []record
+	now := time.Now()
+	for i := range sn.saved {
+		s.snaps.shards[i].Lock()
+		if sn.saved[i] == nil {
+			s.snaps.shards[i].Unlock()
+			return ErrSnapshotReleased
+		}
+		for k, saved := range sn.saved[i] {
+			if !saved.missing && !saved.backedUp && !saved.expired(now) {
+				records = append(records, record{key: []byte(k), savedKey: saved})
+			}
+		}
+		s.snaps.shards[i].Unlock()
+	}
+	slices.SortFunc(records, func(a, b record) int {
+		return bytes.Compare(a.key, b.key)
+	})
+	for _, r := range records {
+		sh := &s.shards[s.idx(murmur3.Sum32WithSeed(r.key, 0))]
+		err = sh.BackupRecord(w, r.key, r.val, r.header.Expire(), r.header.Flags())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backupShard ... write the records of the shard, the keys changed since the snapshot are skipped.
+// The shard is marked as written under its lock, so the keys changed later are known to be written
+func (sn *Snapshot) backupShard(w io.Writer, i int) error {
+	s := sn.s
+	sh := &s.shards[i]
+	sh.Lock()
+	defer sh.Unlock()
+	mu := &s.snaps.shards[i]
+	err := sh.BackupLocked(w, func(k []byte) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		_, ok := sn.saved[i][Str(k)]
+		return ok
+	})
+	mu.Lock()
+	sn.backup[i] = true
+	mu.Unlock()
+	return err
+}
+
+// snapshotWatch ... saves the state of the keys of the shard for the snapshots before the keys are changed
+type snapshotWatch struct {
+	s     *Store
+	shard int
+}
+
+func (w snapshotWatch) Watching(k []byte) bool {
+	if w.s.snaps.active.Load() == 0 {
+		return false
+	}
+	list := w.s.snaps.current()
+	mu := &w.s.snaps.shards[w.shard]
+	mu.Lock()
+	defer mu.Unlock()
+	for _, sn := range list {
+		saved := sn.saved[w.shard]
+		if saved == nil {
+			continue
+		}
+		if _, ok := saved[Str(k)]; !ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (w snapshotWatch) Before(k, v []byte, header *shard.Header) {
+	list := w.s.snaps.current()
+	mu := &w.s.snaps.shards[w.shard]
+	mu.Lock()
+	defer mu.Unlock()
+	var val []byte
+	for _, sn := range list {
+		saved := sn.saved[w.shard]
+		if saved == nil {
+			continue
+		}
+		if _, ok := saved[Str(k)]; ok {
+			continue
+		}
+		key := &savedKey{missing: header == nil}
+		if header != nil {
+			// the value may share the memory of the record cache, it's copied once for all the snapshots
+			if val == nil {
+				val = bytes.Clone(v)
+				if val == nil {
+					val = []byte{}
+				}
+			}
+			key.val, key.header = val, *header
+			key.backedUp = sn.backup[w.shard]
+		}
+		saved[Str(k)] = key
+	}
+}
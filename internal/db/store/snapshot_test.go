@@ -0,0 +1,226 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DenzelPenzel/nyx/internal/common"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Snapshot(t *testing.T) {
+	os.RemoveAll(dirName)
+	defer os.RemoveAll(dirName)
+
+	s, err := Open(Dir(dirName), ShardsTotal(8), ShardsCollision(1), ChunkSize(4<<10), InlineMax(16))
+	require.NoError(t, err)
+	defer s.Close()
+
+	big := randomValue(20 << 10)
+	expire := uint32(time.Now().Unix() + 100)
+	require.NoError(t, s.SetWithFlags([]byte("big"), big, 0, 3))
+	require.NoError(t, s.Set([]byte("small"), []byte("v1"), expire))
+	require.NoError(t, s.Set([]byte("gone"), []byte("v"), 0))
+	require.NoError(t, s.Set([]byte("same"), []byte("v"), 0))
+	_, err = s.Incr([]byte("cnt"), 1)
+	require.NoError(t, err)
+
+	sn, err := s.Snapshot()
+	require.NoError(t, err)
+
+	require.NoError(t, s.Set([]byte("big"), []byte("small now"), 0))
+	require.NoError(t, s.Append([]byte("small"), []byte("+")))
+	require.NoError(t, s.Touch([]byte("small"), 0))
+	_, err = s.Delete([]byte("gone"))
+	require.NoError(t, err)
+	_, err = s.Incr([]byte("cnt"), 5)
+	require.NoError(t, err)
+	require.NoError(t, s.Set([]byte("new"), []byte("v"), 0))
+	b := s.NewWriteBatch()
+	b.Set([]byte("small"), []byte("v3"), 0)
+	b.Set([]byte("new2"), []byte("v"), 0)
+	require.NoError(t, b.Commit())
+
+	val, header, err := sn.GetWithHeader([]byte("big"))
+	require.NoError(t, err)
+	require.Equal(t, big, val)
+	require.Equal(t, uint32(3), header.Flags())
+	val, header, err = sn.GetWithHeader([]byte("small"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v1"), val)
+	require.Equal(t, expire, header.Expire())
+	val, err = sn.Get([]byte("gone"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v"), val)
+	val, err = sn.Get([]byte("same"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v"), val)
+	val, err = sn.Get([]byte("cnt"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), binary.BigEndian.Uint64(val))
+	for _, key := range []string{"new", "new2", "never"} {
+		_, err = sn.Get([]byte(key))
+		require.ErrorIs(t, err, common.ErrKeyNotFound)
+	}
+
+	// the live keys aren't affected by the snapshot
+	val, err = s.Get([]byte("small"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v3"), val)
+	val, err = s.Get([]byte("big"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("small now"), val)
+
+	// the snapshots taken later see the later state
+	sn2, err := s.Snapshot()
+	require.NoError(t, err)
+	_, err = s.Delete([]byte("small"))
+	require.NoError(t, err)
+	val, err = sn2.Get([]byte("small"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v3"), val)
+	val, err = sn.Get([]byte("small"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v1"), val)
+
+	sn.Release()
+	sn.Release()
+	_, err = sn.Get([]byte("small"))
+	require.ErrorIs(t, err, ErrSnapshotReleased)
+	sn2.Release()
+	require.Empty(t, s.snaps.current())
+
+	// no state is saved without the snapshots
+	require.NoError(t, s.Set([]byte("small"), []byte("v4"), 0))
+	require.Zero(t, s.snaps.active.Load())
+}
+
+func Test_SnapshotConsistent(t *testing.T) {
+	os.RemoveAll(dirName)
+	defer os.RemoveAll(dirName)
+
+	s, err := Open(Dir(dirName), ShardsTotal(8), ShardsCollision(1))
+	require.NoError(t, err)
+	defer s.Close()
+
+	keys := [][]byte{[]byte("x"), []byte("y"), []byte("z")}
+	write := func(i int) error {
+		b := s.NewWriteBatch()
+		for _, k := range keys {
+			b.Set(k, []byte(strconv.Itoa(i)), 0)
+		}
+		return b.Commit()
+	}
+	require.NoError(t, write(0))
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := write(i); err != nil {
+				panic(err)
+			}
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		sn, err := s.Snapshot()
+		require.NoError(t, err)
+		first, err := sn.Get(keys[0])
+		require.NoError(t, err)
+		for _, k := range keys[1:] {
+			val, err := sn.Get(k)
+			require.NoError(t, err)
+			require.Equal(t, first, val)
+		}
+		sn.Release()
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func Test_SnapshotBackup(t *testing.T) {
+	os.RemoveAll(dirName)
+	defer os.RemoveAll(dirName)
+
+	s, err := Open(Dir(dirName), ShardsTotal(8), ShardsCollision(1))
+	require.NoError(t, err)
+	defer s.Close()
+
+	want := make(map[string]string)
+	for i := 0; i < 200; i++ {
+		key, val := "key"+strconv.Itoa(i), "val"+strconv.Itoa(i)
+		require.NoError(t, s.Set([]byte(key), []byte(val), 0))
+		want[key] = val
+	}
+
+	sn, err := s.Snapshot()
+	require.NoError(t, err)
+	defer sn.Release()
+
+	// the writes before and while the backup runs
+	for i := 0; i < 50; i++ {
+		_, err = s.Delete([]byte("key" + strconv.Itoa(i)))
+		require.NoError(t, err)
+		require.NoError(t, s.Set([]byte("new"+strconv.Itoa(i)), []byte("v"), 0))
+	}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			key := []byte("key" + strconv.Itoa(i%200))
+			if err := s.Set(key, []byte("changed"), 0); err != nil {
+				panic(err)
+			}
+		}
+	}()
+
+	var buf bytes.Buffer
+	err = sn.Backup(&buf)
+	close(stop)
+	wg.Wait()
+	require.NoError(t, err)
+	require.Equal(t, want, readBackup(t, buf.Bytes()))
+}
+
+// readBackup ... keys and values of the regular records of the backup
+func readBackup(t *testing.T, b []byte) map[string]string {
+	const head = 16
+	require.NotEmpty(t, b)
+	b = b[1:]
+	res := make(map[string]string)
+	for len(b) > 0 {
+		require.GreaterOrEqual(t, len(b), head)
+		status := b[1]
+		keyLen := int(binary.BigEndian.Uint16(b[2:4]))
+		valLen := int(binary.BigEndian.Uint32(b[4:8]))
+		require.GreaterOrEqual(t, len(b), head+keyLen+valLen)
+		if status == 0 {
+			key := string(b[head+valLen : head+valLen+keyLen])
+			_, dup := res[key]
+			require.False(t, dup, key)
+			res[key] = string(b[head : head+valLen])
+		}
+		b = b[head+keyLen+valLen:]
+	}
+	return res
+}
@@ -2,20 +2,18 @@ package store
 
 import (
 	"compress/gzip"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"sync"
 	"time"
 
 	"github.com/DenzelPenzel/nyx/internal/common"
 	"github.com/DenzelPenzel/nyx/internal/db/store/shard"
-	"github.com/DenzelPenzel/nyx/internal/interval"
-	"github.com/DenzelPenzel/nyx/internal/logging"
-	"github.com/google/btree"
 	"github.com/spaolacci/murmur3"
-	"go.uber.org/zap"
 )
 
 type Store struct {
@@ -26,38 +24,62 @@ type Store struct {
 	shardColCnt    int
 	expireShardSeq int
 
-	dir            string
+	dir            string // dir of the store files other than the shards
+	dirs           []string
+	dirWeights     []int
+	placement      []int // dir of every shard
 	syncInterval   time.Duration
-	interv         interval.Interval
 	expireInterval time.Duration
-	expInterv      interval.Interval
-	btree          *btree.BTree
+	expireBudget   time.Duration
+	expireMu       sync.Mutex
+	bucketMu       sync.Mutex
+	buckets        map[string]*BucketStore
+	bucketNames    map[string]bool // buckets with the metadata found by the load, see openBuckets
+	bucketsOpen    bool
+	migrateLegacy  bool // see MigrateLegacyBuckets
+	batchMu        sync.Mutex
+	keptBatch      []batchOp // the batch failed to roll back, its log is kept. Guarded by batchMu
+	chunkSize      int
+	maxValueSize   int64
+	maxOpenFiles   int
+	fds            *shard.FdCache
+	dedupMin       int
+	inlineMax      int
+	slotGrowth     int
+	coldDir        string
+	tierAfter      time.Duration
+	tierInterval   time.Duration
+
+	maint           *maintenance
+	purges          purges
+	mvcc            mvcc
+	snaps           snapshots
+	compactInterval time.Duration
+	compactBudget   Budget
+	compactMinFree  int64
+	compactSeq      int
+	scrubInterval   time.Duration
+	scrubBudget     Budget
+	scrubRate       int64
+	scrubQuarantine bool
+	scrubMu         sync.Mutex
+	scrub           ScrubStatus
+
+	load           *loader
+	loadWorkers    int
+	loadBackground bool
+	loadFailFast   bool
 }
 
+// expireBatch ... max number of the keys removed from a shard by a single active expiry step
+const expireBatch = 256
+
 // OptStore is a store options
 type OptStore func(*Store) error
 
+// Dir ... single data directory of the store
 func Dir(dir string) OptStore {
-	return func(s *Store) error {
-		if dir == "" {
-			dir = "."
-		}
-		_, err := os.Stat(dir)
-		if err != nil {
-			if os.IsNotExist(err) {
-				if dir != "." {
-					err = os.MkdirAll(dir, os.FileMode(0755))
-					if err != nil {
-						return err
-					}
-				}
-			} else {
-				return err
-			}
-		}
-		s.dir = dir
-		return nil
-	}
+	return Dirs(dir)
 }
 
 // ShardsCollision ... Represents the number of shards used for resolving collisions
@@ -84,50 +106,214 @@ func ShardsTotal(shards int) OptStore {
 func SyncInterval(interv time.Duration) OptStore {
 	return func(s *Store) error {
 		s.syncInterval = interv
-		if interv > 0 {
-			s.interv = interval.SetInterval(func(_ time.Time) {
-				for i := range s.shards {
-					err := s.shards[i].Fsync()
-					if err != nil {
-						panic(err)
-					}
-				}
-			}, interv)
+		return nil
+	}
+}
+
+// CompactInterval ... how often the shards with mostly free space are rewritten, default 0 - never
+func CompactInterval(interv time.Duration) OptStore {
+	return func(s *Store) error {
+		s.compactInterval = interv
+		return nil
+	}
+}
+
+// CompactBudget ... limits of a single compaction run, the shard left by the spent budget is continued by the next run.
+// Default a quarter of a core
+func CompactBudget(budget Budget) OptStore {
+	return func(s *Store) error {
+		s.compactBudget = budget
+		return nil
+	}
+}
+
+// CompactMinFree ... the shard is compacted once it has at least this much free space
+// and the free space takes at least a half of the file, default 1MB
+func CompactMinFree(size int64) OptStore {
+	return func(s *Store) error {
+		s.compactMinFree = size
+		return nil
+	}
+}
+
+// ScrubInterval ... how often the shard records are verified, default 0 - never
+func ScrubInterval(interv time.Duration) OptStore {
+	return func(s *Store) error {
+		s.scrubInterval = interv
+		return nil
+	}
+}
+
+// ScrubBudget ... limits of a single scrub run
+func ScrubBudget(budget Budget) OptStore {
+	return func(s *Store) error {
+		s.scrubBudget = budget
+		return nil
+	}
+}
+
+// ScrubRate ... max read rate of the scrubber in bytes per second, default 16MB/s, 0 - no limit
+func ScrubRate(rate int64) OptStore {
+	return func(s *Store) error {
+		if rate < 0 {
+			return errors.New("scrub rate must not be negative")
+		}
+		s.scrubRate = rate
+		return nil
+	}
+}
+
+// ScrubQuarantine ... take the records which don't match the index out of service,
+// by default the mismatches are only reported
+func ScrubQuarantine(quarantine bool) OptStore {
+	return func(s *Store) error {
+		s.scrubQuarantine = quarantine
+		return nil
+	}
+}
+
+// ChunkSize ... values which don't fit the single record of this size are split into chunks,
+// default 1MB, 0 - chunking is disabled
+func ChunkSize(size int) OptStore {
+	return func(s *Store) error {
+		if size < 0 {
+			return errors.New("chunk size must not be negative")
+		}
+		s.chunkSize = size
+		return nil
+	}
+}
+
+// MaxValueSize ... the bigger values are rejected with ErrValueTooBig, default 0 - no limit
+func MaxValueSize(size int64) OptStore {
+	return func(s *Store) error {
+		if size < 0 {
+			return errors.New("max value size must not be negative")
 		}
+		s.maxValueSize = size
 		return nil
 	}
 }
 
+// DedupThreshold ... values of at least this size are stored once per shard by the content hash
+// and shared by the keys with the same value. Default 0 - deduplication is off
+func DedupThreshold(size int) OptStore {
+	return func(s *Store) error {
+		if size < 0 {
+			return errors.New("dedup threshold must not be negative")
+		}
+		s.dedupMin = size
+		return nil
+	}
+}
+
+// InlineMax ... values up to this size are kept in memory as well and are read without touching the file,
+// e.g. counters and flags. Default 0 - the values are always read from the file
+func InlineMax(size int) OptStore {
+	return func(s *Store) error {
+		if size < 0 {
+			return errors.New("inline max size must not be negative")
+		}
+		s.inlineMax = size
+		return nil
+	}
+}
+
+// SlotGrowth ... ratio of the neighbour slot sizes of the records, 1.1 to 2, default 1.25.
+// It's recorded in every new shard file, the existing files keep their classes until compacted
+func SlotGrowth(growth float64) OptStore {
+	return func(s *Store) error {
+		percent := int(math.Round(growth * 100))
+		if !shard.ValidSlotGrowth(percent) {
+			return fmt.Errorf("slot growth must be from %.2f to %.2f",
+				float64(shard.MinSlotGrowth)/100, float64(shard.MaxSlotGrowth)/100)
+		}
+		s.slotGrowth = percent
+		return nil
+	}
+}
+
+// MaxOpenFiles ... max number of the shard files kept open, the files are opened on demand
+// and the least recently used ones are closed, so the shards count may exceed the fd limit.
+// Default 0 - all the shard files are open all the time
+func MaxOpenFiles(files int) OptStore {
+	return func(s *Store) error {
+		if files < 0 {
+			return errors.New("max open files must not be negative")
+		}
+		s.maxOpenFiles = files
+		return nil
+	}
+}
+
+// ColdDir ... capacity tier dir, the records not accessed for the tier period are moved there
+// in the background and moved back on access. Default empty - tiering is off
+func ColdDir(dir string) OptStore {
+	return func(s *Store) error {
+		if dir != "" {
+			err := os.MkdirAll(dir, os.FileMode(0755))
+			if err != nil {
+				return err
+			}
+		}
+		s.coldDir = dir
+		return nil
+	}
+}
+
+// TierAfter ... the record not accessed for this period is moved to the cold tier, default 24h
+func TierAfter(period time.Duration) OptStore {
+	return func(s *Store) error {
+		if period <= 0 {
+			return errors.New("tier period must be positive")
+		}
+		s.tierAfter = period
+		return nil
+	}
+}
+
+// TierInterval ... how often the idle records are moved to the cold tier, default 0 - never
+func TierInterval(interv time.Duration) OptStore {
+	return func(s *Store) error {
+		s.tierInterval = interv
+		return nil
+	}
+}
+
+// ExpireInterval ... how often the active expiry runs, each run removes the due keys of all the shards
+// within the expire budget, default 0 - the expired keys are removed only on access
 func ExpireInterval(interv time.Duration) OptStore {
 	return func(s *Store) error {
-		logger := logging.NoContext()
 		s.expireInterval = interv
-		if interv > 0 {
-			s.expInterv = interval.SetInterval(func(_ time.Time) {
-				err := s.shards[s.expireShardSeq].ExpireKeys(interv)
-				if err != nil {
-					logger.Warn("Error expire shard",
-						zap.Int("shard seq", s.expireShardSeq),
-						zap.Error(err),
-					)
-				}
-				s.expireShardSeq++
-				if s.expireShardSeq >= s.shardsCount {
-					s.expireShardSeq = 0
-				}
-			}, interv)
-		}
 		return nil
 	}
 }
 
+// ExpireBudget ... max duration of a single active expiry run, default a quarter of the expire interval
+func ExpireBudget(budget time.Duration) OptStore {
+	return func(s *Store) error {
+		s.expireBudget = budget
+		return nil
+	}
+}
+
+// Open ... open the store in the directory, by default it returns once all the shards are loaded
 func Open(opts ...OptStore) (*Store, error) {
 	s := &Store{
 		syncInterval:   0,
 		expireInterval: 0,
 		shardColCnt:    4,
 		shardsCount:    256,
-		btree:          btree.New(32),
+		chunkSize:      1 << 20,
+		compactMinFree: 1 << 20,
+		compactBudget:  Budget{CPU: 0.25},
+		scrubRate:      16 << 20,
+		loadWorkers:    4,
+		tierAfter:      24 * time.Hour,
+		slotGrowth:     shard.DefaultSlotGrowth,
+		buckets:        make(map[string]*BucketStore),
+		bucketNames:    make(map[string]bool),
+		mvcc:           mvcc{keys: make(map[Str][]Version)},
 	}
 
 	for _, opt := range opts {
@@ -141,65 +327,64 @@ func Open(opts ...OptStore) (*Store, error) {
 		return nil, errors.New("shardsCount must be more then shardColCount at min 1")
 	}
 
-	stopWorkers := false
-	s.shards = make([]shard.Shard, s.shardsCount)
-	shardsChan := make(chan int, s.shardsCount)
-	errChan := make(chan error, 4)
-
-	var wg sync.WaitGroup
-
-	for i := 0; i < 4; i++ {
-		wg.Add(1)
-		go func() {
-			for i := range shardsChan {
-				if stopWorkers {
-					break
-				}
-				var filename string
-				if s.prefix != "" {
-					filename = fmt.Sprintf("%s/%s-%d", s.dir, s.prefix, i)
-				} else {
-					filename = fmt.Sprintf("%s/%d", s.dir, i)
-				}
-				err := s.shards[i].Open(filename)
-				if err != nil {
-					errChan <- err
-					stopWorkers = true
-					break
-				}
-			}
-			wg.Done()
-		}()
+	err := s.place()
+	if err != nil {
+		return nil, err
 	}
 
-	for i := range s.shards {
-		shardsChan <- i
+	s.shards = make([]shard.Shard, s.shardsCount)
+	if s.maxOpenFiles > 0 {
+		s.fds = shard.NewFdCache(s.maxOpenFiles)
+	}
+	s.load = newLoader(s.shardsCount)
+	s.snaps.shards = make([]sync.Mutex, s.shardsCount)
+	s.initMaintenance()
+	go s.loadShards()
+	if s.loadBackground {
+		return s, nil
 	}
+	return s, s.WaitLoad()
+}
 
-	close(shardsChan)
-	wg.Wait()
+// filePath ... path of the store file with the given name
+func (s *Store) filePath(name string) string {
+	return s.pathIn(s.dir, name)
+}
 
-	if len(errChan) > 0 {
-		err := <-errChan
-		return s, err
+func (s *Store) pathIn(dir, name string) string {
+	if s.prefix != "" {
+		return fmt.Sprintf("%s/%s-%s", dir, s.prefix, name)
 	}
-
-	return s, nil
+	return fmt.Sprintf("%s/%s", dir, name)
 }
 
 func (s *Store) idx(h uint32) uint32 {
 	return uint32((int(h) % (s.shardsCount - s.shardColCnt)) + s.shardColCnt)
 }
 
-// Set ...store key and val in shard, max packet size 2^19, 512kb (524288)
-// packet size = len(key) + len(val) + 8
+// Set ...store key and val in shard, the values bigger than the chunk size are split into chunks
 func (s *Store) Set(key, val []byte, expire uint32) error {
+	return s.SetWithFlags(key, val, expire, 0)
+}
+
+// SetWithFlags ... same as Set, the opaque client flags are stored with the value
+func (s *Store) SetWithFlags(key, val []byte, expire, flags uint32) error {
+	return s.versioned(func() error {
+		return s.setWithFlags(key, val, expire, flags)
+	}, key)
+}
+
+func (s *Store) setWithFlags(key, val []byte, expire, flags uint32) error {
 	h := murmur3.Sum32WithSeed(key, 0)
-	err := s.shards[s.idx(h)].Set(key, val, h, expire)
+	err := s.waitKey(h)
+	if err != nil {
+		return err
+	}
+	err = s.shards[s.idx(h)].Set(key, val, h, expire, flags)
 	// handle collision issue
 	if errors.Is(err, common.ErrCollision) {
 		for i := 0; i < s.shardColCnt; i++ {
-			err = s.shards[i].Set(key, val, h, expire)
+			err = s.shards[i].Set(key, val, h, expire, flags)
 			if errors.Is(err, common.ErrCollision) {
 				continue
 			}
@@ -212,7 +397,11 @@ func (s *Store) Set(key, val []byte, expire uint32) error {
 // Touch ... update key expire time
 func (s *Store) Touch(key []byte, expire uint32) error {
 	h := murmur3.Sum32WithSeed(key, 0)
-	err := s.shards[s.idx(h)].Touch(key, h, expire)
+	err := s.waitKey(h)
+	if err != nil {
+		return err
+	}
+	err = s.shards[s.idx(h)].Touch(key, h, expire)
 	// handle hash collision issue
 	if errors.Is(err, common.ErrCollision) {
 		for i := 0; i < s.shardColCnt; i++ {
@@ -227,25 +416,147 @@ func (s *Store) Touch(key []byte, expire uint32) error {
 }
 
 func (s *Store) Get(key []byte) ([]byte, error) {
+	v, _, err := s.GetWithHeader(key)
+	return v, err
+}
+
+// GetWithHeader ... same as Get, also returns the record header with the expire time and flags
+func (s *Store) GetWithHeader(key []byte) ([]byte, *shard.Header, error) {
 	h := murmur3.Sum32WithSeed(key, 0)
-	v, _, err := s.shards[s.idx(h)].Get(key, h)
+	err := s.waitKey(h)
+	if err != nil {
+		return nil, nil, err
+	}
+	v, header, err := s.shards[s.idx(h)].Get(key, h)
 	// handle collision issue
 	if errors.Is(err, common.ErrCollision) {
 		for i := 0; i < s.shardColCnt; i++ {
-			v, _, err = s.shards[i].Get(key, h)
+			v, header, err = s.shards[i].Get(key, h)
 			if errors.Is(err, common.ErrCollision) || errors.Is(err, common.ErrKeyNotFound) {
 				continue
 			}
 			break
 		}
 	}
-	return v, err
+	return v, header, err
+}
+
+// isMissing ... the error means the key isn't present in the store
+func isMissing(err error) bool {
+	return errors.Is(err, common.ErrKeyNotFound) ||
+		errors.Is(err, common.ErrCollision) ||
+		errors.Is(err, shard.ErrKeyExpired)
+}
+
+// Add ... store the key only if it doesn't exist yet.
+// The check and the write are done under the same shard lock
+func (s *Store) Add(key, val []byte, expire, flags uint32) error {
+	return s.versioned(func() error {
+		return s.add(key, val, expire, flags)
+	}, key)
+}
+
+func (s *Store) add(key, val []byte, expire, flags uint32) error {
+	h := murmur3.Sum32WithSeed(key, 0)
+	err := s.waitKey(h)
+	if err != nil {
+		return err
+	}
+	ls := s.lockShards(h)
+	defer ls.unlock()
+
+	_, _, err = s.getLocked(ls, key, h)
+	if err == nil {
+		return common.ErrKeyExists
+	}
+	if !isMissing(err) {
+		return err
+	}
+	return s.setLocked(ls, key, val, h, expire, flags)
+}
+
+// Replace ... store the key only if it already exists
+func (s *Store) Replace(key, val []byte, expire, flags uint32) error {
+	return s.versioned(func() error {
+		return s.replace(key, val, expire, flags)
+	}, key)
+}
+
+func (s *Store) replace(key, val []byte, expire, flags uint32) error {
+	h := murmur3.Sum32WithSeed(key, 0)
+	err := s.waitKey(h)
+	if err != nil {
+		return err
+	}
+	ls := s.lockShards(h)
+	defer ls.unlock()
+
+	_, _, err = s.getLocked(ls, key, h)
+	if isMissing(err) {
+		return common.ErrKeyNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return s.setLocked(ls, key, val, h, expire, flags)
+}
+
+// Append ... add the data to the end of the existing value.
+// The record is updated in place while the value fits into its slot, expire time and flags are kept
+func (s *Store) Append(key, data []byte) error {
+	return s.versioned(func() error {
+		return s.concat(key, data, false)
+	}, key)
+}
+
+// Prepend ... add the data to the beginning of the existing value.
+// The record is updated in place while the value fits into its slot, expire time and flags are kept
+func (s *Store) Prepend(key, data []byte) error {
+	return s.versioned(func() error {
+		return s.concat(key, data, true)
+	}, key)
+}
+
+func (s *Store) concat(key, data []byte, prepend bool) error {
+	h := murmur3.Sum32WithSeed(key, 0)
+	err := s.waitKey(h)
+	if err != nil {
+		return err
+	}
+	err = s.shards[s.idx(h)].Concat(key, data, h, prepend)
+	// handle collision issue
+	if errors.Is(err, common.ErrCollision) {
+		for i := 0; i < s.shardColCnt; i++ {
+			err = s.shards[i].Concat(key, data, h, prepend)
+			if errors.Is(err, common.ErrCollision) || errors.Is(err, common.ErrKeyNotFound) {
+				continue
+			}
+			break
+		}
+	}
+	if isMissing(err) {
+		return common.ErrKeyNotFound
+	}
+	return err
 }
 
 func (s *Store) Delete(key []byte) (bool, error) {
+	var isDeleted bool
+	err := s.versioned(func() error {
+		var err error
+		isDeleted, err = s.deleteKey(key)
+		return err
+	}, key)
+	return isDeleted, err
+}
+
+func (s *Store) deleteKey(key []byte) (bool, error) {
 	h := murmur3.Sum32WithSeed(key, 0)
-	idx := s.idx(h)
-	isDeleted, err := s.shards[idx].Delete(key, h)
+	err := s.waitKey(h)
+	if err != nil {
+		return false, err
+	}
+	isDeleted, err := s.shards[s.idx(h)].Delete(key, h)
 	if errors.Is(err, common.ErrCollision) {
 		for i := 0; i < s.shardColCnt; i++ {
 			isDeleted, err = s.shards[i].Delete(key, h)
@@ -261,23 +572,27 @@ func (s *Store) Delete(key []byte) (bool, error) {
 	return isDeleted, err
 }
 
+// Count ... number of the keys in the loaded shards
 func (s *Store) Count() int {
 	res := 0
 	for i := range s.shards {
+		if !s.shardReady(i) {
+			continue
+		}
 		res += s.shards[i].Count()
 	}
 	return res
 }
 
-// Close ... close related shards
+// Close ... stop the shards load and close the loaded shards
 func (s *Store) Close() error {
-	if s.syncInterval > 0 {
-		s.interv.Clear()
-	}
-	if s.expireInterval > 0 {
-		s.expInterv.Clear()
-	}
+	s.load.cancel()
+	<-s.load.done
+	s.maint.stop()
 	for i := range s.shards {
+		if !s.load.opened[i] {
+			continue
+		}
 		err := s.shards[i].Close()
 		if err != nil {
 			return err
@@ -286,8 +601,47 @@ func (s *Store) Close() error {
 	return nil
 }
 
+// FdStats ... state of the open files budget, zero if all the files are always open
+func (s *Store) FdStats() shard.FdStats {
+	if s.fds == nil {
+		return shard.FdStats{}
+	}
+	return s.fds.Stats()
+}
+
+// Dedup ... state of the values deduplication of the loaded shards
+func (s *Store) Dedup() shard.DedupStats {
+	var res shard.DedupStats
+	for i := range s.shards {
+		if !s.shardReady(i) {
+			continue
+		}
+		st := s.shards[i].DedupStats()
+		res.Blobs += st.Blobs
+		res.Refs += st.Refs
+		res.StoredBytes += st.StoredBytes
+		res.LogicalBytes += st.LogicalBytes
+	}
+	return res
+}
+
+// Inlined ... number of the values kept in memory by the loaded shards
+func (s *Store) Inlined() int {
+	var res int
+	for i := range s.shards {
+		if s.shardReady(i) {
+			res += s.shards[i].Inlined()
+		}
+	}
+	return res
+}
+
 // FileSize ... total size of the disk storage used by the DB
 func (s *Store) FileSize() (int64, error) {
+	err := s.waitAll()
+	if err != nil {
+		return -1, err
+	}
 	var res int64
 	for i := range s.shards {
 		sz, err := s.shards[i].FileSize()
@@ -300,29 +654,36 @@ func (s *Store) FileSize() (int64, error) {
 }
 
 func (s *Store) Incr(k []byte, v uint64) (uint64, error) {
-	h := murmur3.Sum32WithSeed(k, 0)
-	idx := s.idx(h)
-	return s.shards[idx].Counter(k, h, v, true)
+	return s.counter(k, v, true)
 }
 
 func (s *Store) Decr(k []byte, v uint64) (uint64, error) {
+	return s.counter(k, v, false)
+}
+
+func (s *Store) counter(k []byte, v uint64, inc bool) (uint64, error) {
 	h := murmur3.Sum32WithSeed(k, 0)
-	idx := s.idx(h)
-	return s.shards[idx].Counter(k, h, v, false)
+	err := s.waitKey(h)
+	if err != nil {
+		return 0, err
+	}
+	var res uint64
+	err = s.versioned(func() error {
+		res, err = s.shards[s.idx(h)].Counter(k, h, v, inc)
+		return err
+	}, k)
+	return res, err
 }
 
+// Backup ... write all the records of the store, the backup is taken from a snapshot,
+// so it holds the keys as they were at its start while the writes go on
 func (s *Store) Backup(w io.Writer) error {
-	_, err := w.Write([]byte{1})
+	sn, err := s.Snapshot()
 	if err != nil {
 		return err
 	}
-	for i := range s.shards {
-		err = s.shards[i].Backup(w)
-		if err != nil {
-			return err
-		}
-	}
-	return err
+	defer sn.Release()
+	return sn.Backup(w)
 }
 
 func (s *Store) BackupGZ(w io.Writer) error {
@@ -335,12 +696,12 @@ func (s *Store) Restore(_ io.Reader) error {
 	return nil
 }
 
+// Expire ... remove all the due keys of the store
 func (s *Store) Expire() error {
-	for i := range s.shards {
-		err := s.shards[i].ExpireKeys(time.Duration(0))
-		if err != nil {
-			return err
-		}
+	err := s.WaitLoad()
+	if err != nil {
+		return err
 	}
+	s.expireCycle(context.Background(), 0)
 	return nil
 }
@@ -2,13 +2,21 @@ package store
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/DenzelPenzel/nyx/internal/common"
+	"github.com/DenzelPenzel/nyx/internal/db/store/shard"
 	"github.com/DenzelPenzel/nyx/internal/utils"
 	"github.com/spaolacci/murmur3"
 	"github.com/stretchr/testify/require"
@@ -225,3 +233,334 @@ func Test_BucketEmptyKey(t *testing.T) {
 	require.True(t, bytes.Equal([]byte("def"), res))
 	require.Equal(t, 1, s.Count())
 }
+
+func Test_ConditionalOps(t *testing.T) {
+	s, shutdown, err := mockDB()
+	require.NoError(t, err)
+	defer shutdown()
+
+	key := []byte("key")
+
+	err = s.Replace(key, []byte("1"), 0, 0)
+	require.ErrorIs(t, err, common.ErrKeyNotFound)
+
+	err = s.Append(key, []byte("1"))
+	require.ErrorIs(t, err, common.ErrKeyNotFound)
+
+	err = s.Add(key, []byte("b"), 0, 0)
+	require.NoError(t, err)
+
+	err = s.Add(key, []byte("x"), 0, 0)
+	require.ErrorIs(t, err, common.ErrKeyExists)
+
+	err = s.Append(key, []byte("c"))
+	require.NoError(t, err)
+
+	err = s.Prepend(key, []byte("a"))
+	require.NoError(t, err)
+
+	v, err := s.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, "abc", string(v))
+
+	err = s.Replace(key, []byte("new"), 0, 0)
+	require.NoError(t, err)
+
+	v, err = s.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, "new", string(v))
+}
+
+func Test_ConcurrentAdd(t *testing.T) {
+	s, shutdown, err := mockDB()
+	require.NoError(t, err)
+	defer shutdown()
+
+	workers := runtime.NumCPU() * 4
+	rounds := 200
+
+	for r := 0; r < rounds; r++ {
+		key := []byte(fmt.Sprintf("key-%d", r))
+		var wins atomic.Int32
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				err := s.Add(key, []byte(strconv.Itoa(w)), 0, 0)
+				if err == nil {
+					wins.Add(1)
+					return
+				}
+				if !errors.Is(err, common.ErrKeyExists) {
+					panic(err)
+				}
+			}(w)
+		}
+		wg.Wait()
+		require.Equal(t, int32(1), wins.Load())
+	}
+}
+
+func Test_ConcurrentAppend(t *testing.T) {
+	s, shutdown, err := mockDB()
+	require.NoError(t, err)
+	defer shutdown()
+
+	key := []byte("log")
+	require.NoError(t, s.Set(key, []byte{}, 0))
+
+	workers := runtime.NumCPU() * 4
+	perWorker := 100
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				var err error
+				if w%2 == 0 {
+					err = s.Append(key, []byte("a"))
+				} else {
+					err = s.Prepend(key, []byte("p"))
+				}
+				if err != nil {
+					panic(err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	v, err := s.Get(key)
+	require.NoError(t, err)
+	require.Len(t, v, workers*perWorker)
+	require.Equal(t, workers/2*perWorker, bytes.Count(v, []byte("a")))
+	require.Equal(t, workers/2*perWorker, bytes.Count(v, []byte("p")))
+}
+
+func Test_ConcatKeepsExpireAndFlags(t *testing.T) {
+	os.RemoveAll(dirName)
+	defer os.RemoveAll(dirName)
+	s, err := Open(Dir(dirName), ShardsCollision(0), ShardsTotal(1))
+	require.NoError(t, err)
+	defer s.Close()
+
+	key := []byte("log")
+	expire := uint32(time.Now().Add(time.Hour).Unix())
+	err = s.SetWithFlags(key, []byte("bc"), expire, 7)
+	require.NoError(t, err)
+
+	size, err := s.FileSize()
+	require.NoError(t, err)
+
+	t.Run("test in place append and prepend", func(t *testing.T) {
+		require.NoError(t, s.Append(key, []byte("d")))
+		require.NoError(t, s.Prepend(key, []byte("a")))
+
+		v, header, err := s.GetWithHeader(key)
+		require.NoError(t, err)
+		require.Equal(t, "abcd", string(v))
+		require.Equal(t, expire, header.Expire())
+		require.Equal(t, uint32(7), header.Flags())
+
+		// the record still fits into its slot
+		newSize, err := s.FileSize()
+		require.NoError(t, err)
+		require.Equal(t, size, newSize)
+	})
+
+	t.Run("test append with relocation", func(t *testing.T) {
+		tail := bytes.Repeat([]byte("e"), 100)
+		require.NoError(t, s.Append(key, tail))
+
+		v, header, err := s.GetWithHeader(key)
+		require.NoError(t, err)
+		require.Equal(t, "abcd"+string(tail), string(v))
+		require.Equal(t, expire, header.Expire())
+		require.Equal(t, uint32(7), header.Flags())
+
+		newSize, err := s.FileSize()
+		require.NoError(t, err)
+		require.Greater(t, newSize, size)
+	})
+
+	t.Run("test concat survives reopen", func(t *testing.T) {
+		require.NoError(t, s.Close())
+		s, err = Open(Dir(dirName), ShardsCollision(0), ShardsTotal(1))
+		require.NoError(t, err)
+
+		v, header, err := s.GetWithHeader(key)
+		require.NoError(t, err)
+		require.Equal(t, 104, len(v))
+		require.Equal(t, uint32(7), header.Flags())
+	})
+}
+
+func Test_UpgradeShardV1(t *testing.T) {
+	os.RemoveAll(dirName)
+	defer os.RemoveAll(dirName)
+	require.NoError(t, os.MkdirAll(dirName, os.FileMode(0755)))
+
+	// v1 record: size, status, key len, val len, expire | val | key | padding
+	k, v := []byte("key"), []byte("value")
+	rec := make([]byte, 32)
+	rec[0] = 5
+	binary.BigEndian.PutUint16(rec[2:4], uint16(len(k)))
+	binary.BigEndian.PutUint32(rec[4:8], uint32(len(v)))
+	copy(rec[12:], v)
+	copy(rec[12+len(v):], k)
+	data := append([]byte{255, 1}, rec...)
+	require.NoError(t, os.WriteFile(dirName+"/0", data, os.FileMode(0644)))
+
+	s, err := Open(Dir(dirName), ShardsCollision(0), ShardsTotal(1))
+	require.NoError(t, err)
+	defer s.Close()
+
+	res, header, err := s.GetWithHeader(k)
+	require.NoError(t, err)
+	require.Equal(t, v, res)
+	require.Equal(t, uint32(0), header.Flags())
+
+	require.NoError(t, s.Set([]byte("other"), []byte("1"), 0))
+	res, err = s.Get([]byte("other"))
+	require.NoError(t, err)
+	require.Equal(t, "1", string(res))
+}
+
+func Test_ActiveExpire(t *testing.T) {
+	s, shutdown, err := mockDB()
+	require.NoError(t, err)
+	defer shutdown()
+
+	past := uint32(time.Now().Unix() - 10)
+	future := uint32(time.Now().Unix() + 3600)
+	n := 10_000
+	for i := 0; i < n; i++ {
+		require.NoError(t, s.Set([]byte("expired"+strconv.Itoa(i)), []byte("v"), past))
+		require.NoError(t, s.Set([]byte("alive"+strconv.Itoa(i)), []byte("v"), future))
+	}
+	// the overwritten keys leave stale expire entries which must be skipped
+	require.NoError(t, s.Set([]byte("expired0"), []byte("v"), 0))
+	require.NoError(t, s.Touch([]byte("alive0"), past))
+	require.Equal(t, 2*n, s.Count())
+
+	t.Run("budget limits the run", func(t *testing.T) {
+		removed := s.expireCycle(context.Background(), time.Nanosecond)
+		require.Less(t, removed, n-2)
+	})
+
+	t.Run("all due keys are removed", func(t *testing.T) {
+		require.NoError(t, s.Expire())
+		require.Equal(t, n, s.Count())
+
+		_, err := s.Get([]byte("expired0"))
+		require.NoError(t, err)
+		_, header, err := s.GetWithHeader([]byte("alive1"))
+		require.NoError(t, err)
+		require.Equal(t, future, header.Expire())
+		_, err = s.Get([]byte("expired1"))
+		require.ErrorIs(t, err, common.ErrKeyNotFound)
+		_, err = s.Get([]byte("alive0"))
+		require.ErrorIs(t, err, common.ErrKeyNotFound)
+	})
+
+	t.Run("expire index is rebuilt on open", func(t *testing.T) {
+		require.NoError(t, s.Close())
+		s, err = Open(Dir(dirName))
+		require.NoError(t, err)
+
+		require.NoError(t, s.Set([]byte("late"), []byte("v"), past))
+		require.Equal(t, 1, s.expireCycle(context.Background(), 0))
+		require.Equal(t, n, s.Count())
+	})
+}
+
+func Test_TornTail(t *testing.T) {
+	key := []byte("key")
+	h := murmur3.Sum32WithSeed(key, 0)
+
+	for name, tail := range map[string][]byte{
+		"partial header": {10, 0, 0, 3},
+		// the slot of the class 30 is about 2KB
+		"short record":  append([]byte{30, 0, 0, 3, 0, 0, 0, 5}, make([]byte, 30)...),
+		"bogus lengths": append([]byte{5, 0, 0, 3, 0, 1, 0, 0}, make([]byte, 24)...),
+	} {
+		t.Run(name, func(t *testing.T) {
+			s, shutdown, err := mockDB()
+			require.NoError(t, err)
+			defer shutdown()
+
+			require.NoError(t, s.SetWithFlags(key, []byte("value"), 0, 4))
+			require.NoError(t, s.Close())
+
+			// simulate the crash in the middle of the next record write
+			name := s.shardPath(int(s.idx(h)))
+			fi, err := os.Stat(name)
+			require.NoError(t, err)
+			f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0)
+			require.NoError(t, err)
+			_, err = f.Write(tail)
+			require.NoError(t, err)
+			require.NoError(t, f.Close())
+
+			s, err = Open(Dir(dirName))
+			require.NoError(t, err)
+
+			repaired, err := os.Stat(name)
+			require.NoError(t, err)
+			require.Equal(t, fi.Size(), repaired.Size())
+
+			copies, err := filepath.Glob(name + ".torn-*")
+			require.NoError(t, err)
+			require.Len(t, copies, 1)
+			discarded, err := os.ReadFile(copies[0])
+			require.NoError(t, err)
+			require.Equal(t, tail, discarded)
+
+			v, header, err := s.GetWithHeader(key)
+			require.NoError(t, err)
+			require.Equal(t, []byte("value"), v)
+			require.Equal(t, uint32(4), header.Flags())
+			require.NoError(t, s.Set([]byte("next"), []byte("value"), 0))
+		})
+	}
+}
+
+func Test_CorruptedRecord(t *testing.T) {
+	s, shutdown, err := mockDB()
+	require.NoError(t, err)
+	defer shutdown()
+
+	key := []byte("key")
+	idx := s.idx(murmur3.Sum32WithSeed(key, 0))
+	next := []byte("key0")
+	for i := 1; s.idx(murmur3.Sum32WithSeed(next, 0)) != idx; i++ {
+		next = []byte("key" + strconv.Itoa(i))
+	}
+	require.NoError(t, s.Set(key, []byte("first value"), 0))
+	require.NoError(t, s.Set(next, []byte("second value"), 0))
+	require.NoError(t, s.Close())
+
+	// bogus value length of the first record, the valid record follows it
+	name := s.shardPath(int(idx))
+	b, err := os.ReadFile(name)
+	require.NoError(t, err)
+	pos := bytes.Index(b, []byte("first value")) - 16
+	require.Positive(t, pos)
+	binary.BigEndian.PutUint32(b[pos+4:pos+8], 1<<20)
+	require.NoError(t, os.WriteFile(name, b, 0o644))
+
+	s, err = Open(Dir(dirName))
+	require.ErrorIs(t, err, shard.ErrCorruptedRecord)
+	s.Close()
+
+	// nothing is truncated
+	after, err := os.ReadFile(name)
+	require.NoError(t, err)
+	require.Equal(t, b, after)
+	copies, err := filepath.Glob(name + ".torn-*")
+	require.NoError(t, err)
+	require.Empty(t, copies)
+}
@@ -0,0 +1,54 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/DenzelPenzel/nyx/internal/db/store/shard"
+)
+
+// tierBatch ... max number of the records moved to the cold tier under a single shard lock
+const tierBatch = 256
+
+// tierCycle ... move the records not accessed for the tier period to the cold tier
+func (s *Store) tierCycle(ctx context.Context) error {
+	if s.coldDir == "" {
+		return nil
+	}
+	before := time.Now().Add(-s.tierAfter).Unix()
+	var errs error
+	for i := range s.shards {
+		for {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			n, err := s.shards[i].Demote(before, tierBatch)
+			if err != nil {
+				errs = errors.Join(errs, fmt.Errorf("shard %d: %w", i, err))
+				break
+			}
+			if n < tierBatch {
+				break
+			}
+		}
+	}
+	return errs
+}
+
+// Tiers ... number of the keys in the hot and the cold tiers of the loaded shards
+func (s *Store) Tiers() shard.TierStats {
+	var res shard.TierStats
+	for i := range s.shards {
+		if !s.shardReady(i) {
+			continue
+		}
+		st := s.shards[i].Tiers()
+		res.Hot += st.Hot
+		res.Cold += st.Cold
+		res.Demoted += st.Demoted
+		res.Promoted += st.Promoted
+	}
+	return res
+}
@@ -0,0 +1,112 @@
+package store
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/DenzelPenzel/nyx/internal/common"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Tiering(t *testing.T) {
+	coldDir := "-db-cold-test-"
+	os.RemoveAll(dirName)
+	os.RemoveAll(coldDir)
+	defer os.RemoveAll(dirName)
+	defer os.RemoveAll(coldDir)
+
+	opts := []OptStore{Dir(dirName), ColdDir(coldDir), ShardsTotal(16), ChunkSize(4 << 10)}
+	s, err := Open(opts...)
+	require.NoError(t, err)
+
+	n := 1000
+	for i := 0; i < n; i++ {
+		require.NoError(t, s.SetWithFlags([]byte("key"+strconv.Itoa(i)), []byte("value"+strconv.Itoa(i)), 0, 7))
+	}
+	big := randomValue(20 << 10)
+	require.NoError(t, s.Set([]byte("big"), big, 0))
+
+	// every record is idle
+	s.tierAfter = -time.Second
+	require.NoError(t, s.tierCycle(context.Background()))
+	tiers := s.Tiers()
+	require.Equal(t, 1, tiers.Hot)
+	require.Equal(t, n, tiers.Cold)
+	require.Equal(t, n+1, s.Count())
+
+	t.Run("ttl read in place", func(t *testing.T) {
+		_, err := s.TTL([]byte("key5"))
+		require.ErrorIs(t, err, common.ErrNoTTL)
+		_, err = s.TTL([]byte("missing"))
+		require.ErrorIs(t, err, common.ErrKeyNotFound)
+		require.Equal(t, 1, s.Tiers().Hot)
+	})
+
+	t.Run("promote on access", func(t *testing.T) {
+		v, header, err := s.GetWithHeader([]byte("key1"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("value1"), v)
+		require.Equal(t, uint32(7), header.Flags())
+		require.Equal(t, 2, s.Tiers().Hot)
+
+		ok, err := s.Delete([]byte("key2"))
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.NoError(t, s.Set([]byte("key3"), []byte("new"), 0))
+		require.NoError(t, s.Append([]byte("key4"), []byte("+")))
+
+		_, err = s.Get([]byte("key2"))
+		require.ErrorIs(t, err, common.ErrKeyNotFound)
+		require.Equal(t, n, s.Count())
+		tiers := s.Tiers()
+		require.Equal(t, 4, tiers.Hot)
+		require.Equal(t, n-4, tiers.Cold)
+		require.Equal(t, uint64(4), tiers.Promoted)
+	})
+
+	check := func() {
+		require.Equal(t, n, s.Count())
+		for i := 0; i < n; i++ {
+			v, err := s.Get([]byte("key" + strconv.Itoa(i)))
+			switch i {
+			case 2:
+				require.ErrorIs(t, err, common.ErrKeyNotFound)
+			case 3:
+				require.Equal(t, []byte("new"), v)
+			case 4:
+				require.Equal(t, []byte("value4+"), v)
+			default:
+				require.NoError(t, err)
+				require.Equal(t, []byte("value"+strconv.Itoa(i)), v)
+			}
+		}
+		v, err := s.Get([]byte("big"))
+		require.NoError(t, err)
+		require.Equal(t, big, v)
+	}
+
+	t.Run("reopen", func(t *testing.T) {
+		require.NoError(t, s.Close())
+		s, err = Open(opts...)
+		require.NoError(t, err)
+		tiers := s.Tiers()
+		require.Equal(t, 4, tiers.Hot)
+		require.Equal(t, n-4, tiers.Cold)
+		check()
+		require.Equal(t, n, s.Tiers().Hot)
+	})
+
+	t.Run("demote again", func(t *testing.T) {
+		s.tierAfter = -time.Second
+		require.NoError(t, s.RunJob(JobTier))
+		require.Equal(t, n-1, s.Tiers().Cold)
+		require.NoError(t, s.Close())
+		s, err = Open(opts...)
+		require.NoError(t, err)
+		defer s.Close()
+		check()
+	})
+}
@@ -0,0 +1,91 @@
+package store
+
+import (
+	"errors"
+	"time"
+
+	"github.com/DenzelPenzel/nyx/internal/common"
+	"github.com/spaolacci/murmur3"
+)
+
+// Expiry ... expire time of the key in unix seconds, 0 if the key has no ttl.
+// Only the header and the key of the record are read, the value and the chunks of a large value
+// aren't touched and the cold record isn't promoted
+func (s *Store) Expiry(key []byte) (uint32, error) {
+	h := murmur3.Sum32WithSeed(key, 0)
+	err := s.waitKey(h)
+	if err != nil {
+		return 0, err
+	}
+	expire, err := s.shards[s.idx(h)].Expiry(key, h)
+	// handle collision issue
+	if errors.Is(err, common.ErrCollision) {
+		for i := 0; i < s.shardColCnt; i++ {
+			expire, err = s.shards[i].Expiry(key, h)
+			if errors.Is(err, common.ErrCollision) || errors.Is(err, common.ErrKeyNotFound) {
+				continue
+			}
+			break
+		}
+	}
+	if isMissing(err) {
+		return 0, common.ErrKeyNotFound
+	}
+	return expire, err
+}
+
+// TTL ... remaining time to live of the key rounded down to seconds,
+// common.ErrKeyNotFound for the missing key and common.ErrNoTTL for the key without the ttl
+func (s *Store) TTL(key []byte) (time.Duration, error) {
+	expire, err := s.Expiry(key)
+	if err != nil {
+		return 0, err
+	}
+	if expire == 0 {
+		return 0, common.ErrNoTTL
+	}
+	ttl := time.Duration(int64(expire)-time.Now().Unix()) * time.Second
+	if ttl < 0 {
+		ttl = 0
+	}
+	return ttl, nil
+}
+
+// Persist ... remove the ttl of the key, common.ErrNoTTL if the key has none
+func (s *Store) Persist(key []byte) error {
+	h := murmur3.Sum32WithSeed(key, 0)
+	err := s.waitKey(h)
+	if err != nil {
+		return err
+	}
+	persisted, err := s.shards[s.idx(h)].Persist(key, h)
+	// handle collision issue
+	if errors.Is(err, common.ErrCollision) {
+		for i := 0; i < s.shardColCnt; i++ {
+			persisted, err = s.shards[i].Persist(key, h)
+			if errors.Is(err, common.ErrCollision) || errors.Is(err, common.ErrKeyNotFound) {
+				continue
+			}
+			break
+		}
+	}
+	if isMissing(err) {
+		return common.ErrKeyNotFound
+	}
+	if err == nil && !persisted {
+		return common.ErrNoTTL
+	}
+	return err
+}
+
+// ExpireAt ... set the absolute expire time of the key, the key with the time in the past expires right away
+func (s *Store) ExpireAt(key []byte, at time.Time) error {
+	if at.Unix() <= 0 || at.Unix() > int64(^uint32(0)) {
+		return errors.New("expire time out of range")
+	}
+	err := s.Touch(key, uint32(at.Unix()))
+	if isMissing(err) {
+		return common.ErrKeyNotFound
+	}
+	return err
+}
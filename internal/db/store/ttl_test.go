@@ -0,0 +1,67 @@
+package store
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/DenzelPenzel/nyx/internal/common"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_TTL(t *testing.T) {
+	os.RemoveAll(dirName)
+	defer os.RemoveAll(dirName)
+
+	s, err := Open(Dir(dirName), ShardsTotal(8), ShardsCollision(1), ChunkSize(4<<10))
+	require.NoError(t, err)
+	defer s.Close()
+
+	now := time.Now().Unix()
+	require.NoError(t, s.Set([]byte("ttl"), []byte("v"), uint32(now+100)))
+	require.NoError(t, s.Set([]byte("no-ttl"), []byte("v"), 0))
+	big := randomValue(20 << 10)
+	require.NoError(t, s.SetWithFlags([]byte("big"), big, uint32(now+50), 3))
+
+	ttl, err := s.TTL([]byte("ttl"))
+	require.NoError(t, err)
+	require.InDelta(t, 100, ttl.Seconds(), 2)
+	ttl, err = s.TTL([]byte("big"))
+	require.NoError(t, err)
+	require.InDelta(t, 50, ttl.Seconds(), 2)
+
+	_, err = s.TTL([]byte("no-ttl"))
+	require.ErrorIs(t, err, common.ErrNoTTL)
+	_, err = s.TTL([]byte("missing"))
+	require.ErrorIs(t, err, common.ErrKeyNotFound)
+
+	t.Run("persist", func(t *testing.T) {
+		require.NoError(t, s.Persist([]byte("big")))
+		expire, err := s.Expiry([]byte("big"))
+		require.NoError(t, err)
+		require.Zero(t, expire)
+		val, header, err := s.GetWithHeader([]byte("big"))
+		require.NoError(t, err)
+		require.Equal(t, big, val)
+		require.Equal(t, uint32(3), header.Flags())
+
+		require.ErrorIs(t, s.Persist([]byte("big")), common.ErrNoTTL)
+		require.ErrorIs(t, s.Persist([]byte("missing")), common.ErrKeyNotFound)
+	})
+
+	t.Run("expire at", func(t *testing.T) {
+		at := time.Unix(now+1000, 0)
+		require.NoError(t, s.ExpireAt([]byte("no-ttl"), at))
+		expire, err := s.Expiry([]byte("no-ttl"))
+		require.NoError(t, err)
+		require.Equal(t, uint32(at.Unix()), expire)
+
+		require.NoError(t, s.ExpireAt([]byte("ttl"), time.Unix(now-1, 0)))
+		_, err = s.Get([]byte("ttl"))
+		require.True(t, isMissing(err))
+		_, err = s.TTL([]byte("ttl"))
+		require.ErrorIs(t, err, common.ErrKeyNotFound)
+		require.ErrorIs(t, s.ExpireAt([]byte("ttl"), at), common.ErrKeyNotFound)
+		require.ErrorIs(t, s.ExpireAt([]byte("missing"), at), common.ErrKeyNotFound)
+	})
+}
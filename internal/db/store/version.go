@@ -0,0 +1,533 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DenzelPenzel/nyx/internal/common"
+	"github.com/DenzelPenzel/nyx/internal/db/store/shard"
+	"github.com/spaolacci/murmur3"
+)
+
+var (
+	// versionKeyPrefix ... the store key of a version is the prefix, the key length, the key,
+	// the version number, the write time and the kind, see versionKey
+	versionKeyPrefix = []byte("[version]")
+	// versionSeqKey ... the version numbers up to the stored one may be given out already
+	versionSeqKey = []byte("[version_seq]")
+	// versionPendingPrefix ... the store key of the prefix and the key is written before a versioned write
+	// of the key and deleted once its version is recorded, so the version lost by a crash is recorded on open
+	versionPendingPrefix = []byte("[version_pending]")
+)
+
+const (
+	// versionSeqBlock ... number of the version numbers reserved by a single write of versionSeqKey
+	versionSeqBlock = 1024
+	// versionStripes ... number of the locks serializing the versioned writes of the keys
+	versionStripes = 64
+
+	versionValue   = 0
+	versionDeleted = 1
+)
+
+// Version ... single version of the key, the versions of all the keys are numbered by the same sequence
+type Version struct {
+	Version uint64
+	Written time.Time
+	Deleted bool // the version is the delete of the key
+	Size    int64
+	Flags   uint32
+
+	expire uint32
+}
+
+// mvcc ... versions of the keys in the MVCC mode, see KeepVersions
+type mvcc struct {
+	keep   int
+	period time.Duration
+
+	mu      sync.Mutex
+	open    bool
+	seq     uint64            // last given out version number
+	stored  uint64            // the version numbers reserved in versionSeqKey
+	keys    map[Str][]Version // the versions of every key, the oldest first
+	pending [][]byte          // keys with the pending marker found by the load, see versionPendingPrefix
+	locks   [versionStripes]sync.Mutex
+
+	recoverMu sync.Mutex  // serializes the recovery of the pending versions
+	recovered atomic.Bool // the pending versions are recorded
+}
+
+func (m *mvcc) enabled() bool {
+	return m.keep > 0 || m.period > 0
+}
+
+// KeepVersions ... MVCC mode, every write and delete of a key is kept as its version, the last n versions
+// of the key stay, the older ones are deleted and their space is reclaimed by the compaction.
+// Default 0 - no limit of the number, the mode is on if the KeepVersionsFor period is set.
+// The version is a copy of the value, so every write costs twice the bytes on disk plus two small
+// writes of the pending marker, the large values are copied chunk by chunk.
+// The keys of the buckets aren't versioned
+func KeepVersions(n int) OptStore {
+	return func(s *Store) error {
+		if n < 0 {
+			return errors.New("number of the versions must not be negative")
+		}
+		s.mvcc.keep = n
+		return nil
+	}
+}
+
+// KeepVersionsFor ... MVCC mode, the versions stay for the period, then they expire, see KeepVersions.
+// With both limits the version goes once any of them is over
+func KeepVersionsFor(period time.Duration) OptStore {
+	return func(s *Store) error {
+		if period < 0 {
+			return errors.New("versions period must not be negative")
+		}
+		s.mvcc.period = period
+		return nil
+	}
+}
+
+// IsInternalKey ... the store key holds a key of a bucket, the bucket metadata or a version of a key,
+// the plain key commands reject it with common.ErrBadRequest
+func IsInternalKey(key []byte) bool {
+	return IsBucketKey(key) || bytes.HasPrefix(key, versionKeyPrefix) || bytes.Equal(key, versionSeqKey) ||
+		bytes.HasPrefix(key, versionPendingPrefix)
+}
+
+func versionPendingKey(key []byte) []byte {
+	return append(bytes.Clone(versionPendingPrefix), key...)
+}
+
+func versionKey(key []byte, v Version) []byte {
+	b := make([]byte, 0, len(versionKeyPrefix)+binary.MaxVarintLen64+len(key)+17)
+	b = append(b, versionKeyPrefix...)
+	b = binary.AppendUvarint(b, uint64(len(key)))
+	b = append(b, key...)
+	b = binary.BigEndian.AppendUint64(b, v.Version)
+	b = binary.BigEndian.AppendUint64(b, uint64(v.Written.UnixNano()))
+	if v.Deleted {
+		return append(b, versionDeleted)
+	}
+	return append(b, versionValue)
+}
+
+func parseVersionKey(b []byte) ([]byte, Version, bool) {
+	if !bytes.HasPrefix(b, versionKeyPrefix) {
+		return nil, Version{}, false
+	}
+	b = b[len(versionKeyPrefix):]
+	n, l := binary.Uvarint(b)
+	if l <= 0 || uint64(len(b)-l) != n+17 {
+		return nil, Version{}, false
+	}
+	b = b[l:]
+	key, b := b[:n], b[n:]
+	return key, Version{
+		Version: binary.BigEndian.Uint64(b),
+		Written: time.Unix(0, int64(binary.BigEndian.Uint64(b[8:]))),
+		Deleted: b[16] == versionDeleted,
+	}, true
+}
+
+// indexVersions ... add the versions found by the shard load to the index, returns the other keys
+func (s *Store) indexVersions(keys []shard.PrefixedKey) []shard.PrefixedKey {
+	rest := keys[:0]
+	s.mvcc.mu.Lock()
+	defer s.mvcc.mu.Unlock()
+	for _, pk := range keys {
+		if bytes.HasPrefix(pk.Key, versionPendingPrefix) {
+			s.mvcc.pending = append(s.mvcc.pending, pk.Key[len(versionPendingPrefix):])
+			continue
+		}
+		key, v, ok := parseVersionKey(pk.Key)
+		if !ok {
+			rest = append(rest, pk)
+			continue
+		}
+		v.Size, v.Flags, v.expire = pk.Size, pk.Flags, pk.Expire
+		s.mvcc.keys[Str(key)] = append(s.mvcc.keys[Str(key)], v)
+		s.mvcc.seq = max(s.mvcc.seq, v.Version)
+	}
+	return rest
+}
+
+// openVersions ... order the loaded versions and restore the sequence, the caller holds mvcc.mu
+func (s *Store) openVersions() error {
+	if s.mvcc.open {
+		return nil
+	}
+	b, err := s.Get(versionSeqKey)
+	if err != nil && !isMissing(err) {
+		return err
+	}
+	if err == nil && len(b) == 8 {
+		s.mvcc.stored = binary.BigEndian.Uint64(b)
+	}
+	s.mvcc.seq = max(s.mvcc.seq, s.mvcc.stored)
+	for _, versions := range s.mvcc.keys {
+		slices.SortFunc(versions, func(a, b Version) int {
+			return compareUint64(a.Version, b.Version)
+		})
+	}
+	s.mvcc.open = true
+	return nil
+}
+
+// openMVCC ... open the versions and record the versions of the writes interrupted by a crash
+func (s *Store) openMVCC() error {
+	if s.mvcc.recovered.Load() {
+		return nil
+	}
+	s.mvcc.recoverMu.Lock()
+	defer s.mvcc.recoverMu.Unlock()
+	if s.mvcc.recovered.Load() {
+		return nil
+	}
+	s.mvcc.mu.Lock()
+	err := s.openVersions()
+	s.mvcc.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for len(s.mvcc.pending) > 0 {
+		key := s.mvcc.pending[0]
+		unlock := s.lockVersions([][]byte{key})
+		err = s.recoverVersion(key)
+		unlock()
+		if err != nil {
+			return err
+		}
+		s.mvcc.pending = s.mvcc.pending[1:]
+	}
+	s.mvcc.recovered.Store(true)
+	return nil
+}
+
+// recoverVersion ... record the state of the key if it differs from its last version,
+// then delete the pending marker. The caller holds the lock of the key
+func (s *Store) recoverVersion(key []byte) error {
+	s.mvcc.mu.Lock()
+	versions := s.mvcc.keys[Str(key)]
+	s.mvcc.mu.Unlock()
+	var last *Version
+	if len(versions) > 0 {
+		last = &versions[len(versions)-1]
+	}
+
+	same, err := s.sameAsVersion(key, last)
+	if err != nil {
+		return err
+	}
+	if !same {
+		err = s.recordVersion(key)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = s.deleteKey(versionPendingKey(key))
+	if err != nil && !isMissing(err) {
+		return err
+	}
+	return nil
+}
+
+// sameAsVersion ... the current state of the key is the version, nil version is no version at all.
+// The values are compared chunk by chunk
+func (s *Store) sameAsVersion(key []byte, v *Version) (bool, error) {
+	cur, err := s.GetReader(key)
+	switch {
+	case isMissing(err):
+		return v == nil || v.Deleted, nil
+	case err != nil:
+		return false, err
+	}
+	defer cur.Close()
+	if v == nil || v.Deleted || v.Size != cur.Size() || v.Flags != cur.Header().Flags() {
+		return false, nil
+	}
+	old, err := s.GetReader(versionKey(key, *v))
+	if isMissing(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer old.Close()
+	a, b := make([]byte, 64<<10), make([]byte, 64<<10)
+	for {
+		n, err := io.ReadFull(cur, a)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, err
+		}
+		m, err := io.ReadFull(old, b)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, err
+		}
+		if n != m || !bytes.Equal(a[:n], b[:m]) {
+			return false, nil
+		}
+		if n < len(a) {
+			return true, nil
+		}
+	}
+}
+
+func compareUint64(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// nextVersion ... next version number, a new block of the numbers is reserved once the stored one is used up,
+// so the numbers keep growing across the restarts. The caller holds mvcc.mu
+func (s *Store) nextVersion() (uint64, error) {
+	if s.mvcc.seq+1 > s.mvcc.stored {
+		stored := s.mvcc.seq + versionSeqBlock
+		err := s.setWithFlags(versionSeqKey, binary.BigEndian.AppendUint64(nil, stored), 0, 0)
+		if err != nil {
+			return 0, err
+		}
+		s.mvcc.stored = stored
+	}
+	s.mvcc.seq++
+	return s.mvcc.seq, nil
+}
+
+// versioned ... run the write of the keys, in the MVCC mode record the new state of every written key
+// as its version. The versioned writes of the same key are serialized, so the versions follow the writes
+func (s *Store) versioned(write func() error, keys ...[]byte) error {
+	if !s.mvcc.enabled() {
+		return write()
+	}
+	seen := make(map[Str]bool, len(keys))
+	user := make([][]byte, 0, len(keys))
+	for _, k := range keys {
+		if !IsInternalKey(k) && !seen[Str(k)] {
+			seen[Str(k)] = true
+			user = append(user, k)
+		}
+	}
+	if len(user) == 0 {
+		return write()
+	}
+
+	err := s.waitAll()
+	if err != nil {
+		return err
+	}
+	err = s.openMVCC()
+	if err != nil {
+		return err
+	}
+
+	unlock := s.lockVersions(user)
+	defer unlock()
+	for _, k := range user {
+		err = s.setWithFlags(versionPendingKey(k), nil, 0, 0)
+		if err != nil {
+			return err
+		}
+	}
+	err = write()
+	if err != nil {
+		// the failed write may be applied in part, the changed keys get their versions
+		for _, k := range user {
+			err = errors.Join(err, s.recoverVersion(k))
+		}
+		return err
+	}
+	for _, k := range user {
+		err = s.recordVersion(k)
+		if err != nil {
+			return err
+		}
+		_, err = s.deleteKey(versionPendingKey(k))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lockVersions ... lock the stripes of the keys in ascending order
+func (s *Store) lockVersions(keys [][]byte) func() {
+	stripes := make([]int, 0, len(keys))
+	for _, k := range keys {
+		stripes = append(stripes, int(murmur3.Sum32WithSeed(k, 0)%versionStripes))
+	}
+	slices.Sort(stripes)
+	stripes = slices.Compact(stripes)
+	for _, i := range stripes {
+		s.mvcc.locks[i].Lock()
+	}
+	return func() {
+		for j := len(stripes) - 1; j >= 0; j-- {
+			s.mvcc.locks[stripes[j]].Unlock()
+		}
+	}
+}
+
+// recordVersion ... store the current value of the key as its new version, the missing key is recorded
+// as deleted once. The large value is copied chunk by chunk. The versions over the limits are deleted
+func (s *Store) recordVersion(key []byte) error {
+	now := time.Now()
+	v := Version{Written: now}
+	if s.mvcc.period > 0 {
+		v.expire = uint32(now.Add(s.mvcc.period).Unix())
+	}
+	err := s.writeVersion(key, &v)
+	if errors.Is(err, errNoVersion) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	s.mvcc.mu.Lock()
+	versions := append(s.mvcc.keys[Str(key)], v)
+	var reclaimed []Version
+	for len(versions) > 0 && versions[0].expired(now) {
+		versions = versions[1:]
+	}
+	if s.mvcc.keep > 0 && len(versions) > s.mvcc.keep {
+		reclaimed = slices.Clone(versions[:len(versions)-s.mvcc.keep])
+		versions = versions[len(versions)-s.mvcc.keep:]
+	}
+	s.mvcc.keys[Str(key)] = versions
+	s.mvcc.mu.Unlock()
+
+	for _, old := range reclaimed {
+		_, err = s.deleteKey(versionKey(key, old))
+		if err != nil && !isMissing(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// errNoVersion ... the key is missing and its last version is the delete already
+var errNoVersion = errors.New("no new version")
+
+// writeVersion ... write the current value of the key as the version, the number is given out
+// once the value is read
+func (s *Store) writeVersion(key []byte, v *Version) error {
+	r, err := s.GetReader(key)
+	switch {
+	case isMissing(err):
+		s.mvcc.mu.Lock()
+		versions := s.mvcc.keys[Str(key)]
+		s.mvcc.mu.Unlock()
+		if len(versions) == 0 || versions[len(versions)-1].Deleted {
+			return errNoVersion
+		}
+		v.Deleted, v.Size, v.Flags = true, 0, 0
+	case err != nil:
+		return err
+	default:
+		defer r.Close()
+		v.Deleted, v.Size, v.Flags = false, r.Size(), r.Header().Flags()
+	}
+
+	if v.Version == 0 {
+		s.mvcc.mu.Lock()
+		v.Version, err = s.nextVersion()
+		s.mvcc.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	if v.Deleted {
+		return s.setWithFlags(versionKey(key, *v), nil, v.expire, v.Flags)
+	}
+	if r.Chunked() {
+		return s.setStream(versionKey(key, *v), r, r.Size(), v.expire, v.Flags)
+	}
+	val, err := r.Bytes()
+	if err != nil {
+		return err
+	}
+	return s.setWithFlags(versionKey(key, *v), val, v.expire, v.Flags)
+}
+
+func (v Version) expired(now time.Time) bool {
+	return v.expire != 0 && int64(v.expire) < now.Unix()
+}
+
+// versionsOf ... the live versions of the key, the oldest first
+func (s *Store) versionsOf(key []byte) ([]Version, error) {
+	if !s.mvcc.enabled() {
+		return nil, common.ErrNotSupported
+	}
+	err := s.waitAll()
+	if err != nil {
+		return nil, err
+	}
+	err = s.openMVCC()
+	if err != nil {
+		return nil, err
+	}
+	s.mvcc.mu.Lock()
+	defer s.mvcc.mu.Unlock()
+	now := time.Now()
+	var res []Version
+	for _, v := range s.mvcc.keys[Str(key)] {
+		if !v.expired(now) {
+			res = append(res, v)
+		}
+	}
+	return res, nil
+}
+
+// History ... versions of the key kept by the MVCC mode, the oldest first.
+// common.ErrKeyNotFound if the key has no versions, common.ErrNotSupported if the mode is off
+func (s *Store) History(key []byte) ([]Version, error) {
+	versions, err := s.versionsOf(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, common.ErrKeyNotFound
+	}
+	return versions, nil
+}
+
+// GetVersion ... value of the version of the key, nil for the version deleting the key.
+// common.ErrKeyNotFound if there is no such version or it's already reclaimed
+func (s *Store) GetVersion(key []byte, version uint64) ([]byte, Version, error) {
+	versions, err := s.versionsOf(key)
+	if err != nil {
+		return nil, Version{}, err
+	}
+	i, ok := slices.BinarySearchFunc(versions, version, func(v Version, version uint64) int {
+		return compareUint64(v.Version, version)
+	})
+	if !ok {
+		return nil, Version{}, common.ErrKeyNotFound
+	}
+	v := versions[i]
+	if v.Deleted {
+		return nil, v, nil
+	}
+	val, err := s.Get(versionKey(key, v))
+	if isMissing(err) {
+		return nil, Version{}, common.ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, Version{}, err
+	}
+	return val, v, nil
+}
@@ -0,0 +1,199 @@
+package store
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/DenzelPenzel/nyx/internal/common"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Versions(t *testing.T) {
+	os.RemoveAll(dirName)
+	defer os.RemoveAll(dirName)
+
+	opts := []OptStore{Dir(dirName), ShardsTotal(8), ShardsCollision(1), KeepVersions(3), CompactMinFree(1)}
+	s, err := Open(opts...)
+	require.NoError(t, err)
+
+	key := []byte("config")
+	for i := 1; i <= 5; i++ {
+		require.NoError(t, s.SetWithFlags(key, []byte("v"+strconv.Itoa(i)), 0, uint32(i)))
+	}
+	require.NoError(t, s.Append(key, []byte("+")))
+	_, err = s.Delete(key)
+	require.NoError(t, err)
+	// deleting the missing key isn't a new version
+	_, err = s.Delete(key)
+	require.NoError(t, err)
+
+	history, err := s.History(key)
+	require.NoError(t, err)
+	require.Len(t, history, 3)
+	require.Equal(t, int64(2), history[0].Size)
+	require.Equal(t, int64(3), history[1].Size)
+	require.True(t, history[2].Deleted)
+	for i := 1; i < len(history); i++ {
+		require.Greater(t, history[i].Version, history[i-1].Version)
+	}
+
+	val, v, err := s.GetVersion(key, history[1].Version)
+	require.NoError(t, err)
+	require.Equal(t, "v5+", string(val))
+	require.Equal(t, uint32(5), v.Flags)
+	val, v, err = s.GetVersion(key, history[2].Version)
+	require.NoError(t, err)
+	require.Nil(t, val)
+	require.True(t, v.Deleted)
+	_, _, err = s.GetVersion(key, history[0].Version-1)
+	require.ErrorIs(t, err, common.ErrKeyNotFound)
+
+	_, err = s.History([]byte("missing"))
+	require.ErrorIs(t, err, common.ErrKeyNotFound)
+
+	t.Run("batch and rename", func(t *testing.T) {
+		b := s.NewWriteBatch()
+		b.Set([]byte("a"), []byte("1"), 0)
+		b.Set([]byte("b"), []byte("2"), 0)
+		require.NoError(t, b.Commit())
+		require.NoError(t, s.Rename([]byte("a"), []byte("c"), MoveOpts{}))
+
+		history, err := s.History([]byte("a"))
+		require.NoError(t, err)
+		require.Len(t, history, 2)
+		require.True(t, history[1].Deleted)
+		history, err = s.History([]byte("c"))
+		require.NoError(t, err)
+		require.Len(t, history, 1)
+		val, _, err := s.GetVersion([]byte("c"), history[0].Version)
+		require.NoError(t, err)
+		require.Equal(t, "1", string(val))
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		before, err := s.History(key)
+		require.NoError(t, err)
+		require.NoError(t, s.Close())
+
+		s, err = Open(opts...)
+		require.NoError(t, err)
+		after, err := s.History(key)
+		require.NoError(t, err)
+		require.Len(t, after, len(before))
+		for i := range before {
+			require.Equal(t, before[i].Version, after[i].Version)
+			require.Equal(t, before[i].Written.UnixNano(), after[i].Written.UnixNano())
+			require.Equal(t, before[i].Deleted, after[i].Deleted)
+		}
+
+		// the numbers keep growing after the restart
+		require.NoError(t, s.Set(key, []byte("v6"), 0))
+		history, err := s.History(key)
+		require.NoError(t, err)
+		require.Greater(t, history[len(history)-1].Version, before[len(before)-1].Version)
+	})
+
+	t.Run("compaction", func(t *testing.T) {
+		big := randomValue(1000)
+		for i := 0; i < 200; i++ {
+			require.NoError(t, s.Set(key, big, 0))
+		}
+		before, err := s.FileSize()
+		require.NoError(t, err)
+		require.NoError(t, s.RunJob(JobCompact))
+		after, err := s.FileSize()
+		require.NoError(t, err)
+		require.Less(t, after, before)
+
+		history, err := s.History(key)
+		require.NoError(t, err)
+		require.Len(t, history, 3)
+		val, _, err := s.GetVersion(key, history[0].Version)
+		require.NoError(t, err)
+		require.Equal(t, big, val)
+	})
+	require.NoError(t, s.Close())
+}
+
+func Test_VersionsFor(t *testing.T) {
+	os.RemoveAll(dirName)
+	defer os.RemoveAll(dirName)
+
+	s, err := Open(Dir(dirName), KeepVersionsFor(time.Second))
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.NoError(t, s.Set([]byte("k"), []byte("1"), 0))
+	time.Sleep(2100 * time.Millisecond)
+	require.NoError(t, s.Set([]byte("k"), []byte("2"), 0))
+
+	history, err := s.History([]byte("k"))
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	val, _, err := s.GetVersion([]byte("k"), history[0].Version)
+	require.NoError(t, err)
+	require.Equal(t, "2", string(val))
+}
+
+func Test_VersionsOff(t *testing.T) {
+	os.RemoveAll(dirName)
+	defer os.RemoveAll(dirName)
+
+	s, err := Open(Dir(dirName))
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.NoError(t, s.Set([]byte("k"), []byte("1"), 0))
+	_, err = s.History([]byte("k"))
+	require.ErrorIs(t, err, common.ErrNotSupported)
+	_, _, err = s.GetVersion([]byte("k"), 1)
+	require.ErrorIs(t, err, common.ErrNotSupported)
+}
+
+func Test_VersionsRecovery(t *testing.T) {
+	os.RemoveAll(dirName)
+	defer os.RemoveAll(dirName)
+
+	opts := []OptStore{Dir(dirName), ShardsTotal(8), ShardsCollision(1), KeepVersions(5), ChunkSize(4 << 10)}
+	s, err := Open(opts...)
+	require.NoError(t, err)
+
+	// the large values are versioned chunk by chunk
+	big := randomValue(20 << 10)
+	require.NoError(t, s.SetStream([]byte("big"), bytes.NewReader(big), int64(len(big)), 0, 0))
+	history, err := s.History([]byte("big"))
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	val, _, err := s.GetVersion([]byte("big"), history[0].Version)
+	require.NoError(t, err)
+	require.Equal(t, big, val)
+
+	// the crash after the write of the key and before its version
+	require.NoError(t, s.Set([]byte("changed"), []byte("v1"), 0))
+	require.NoError(t, s.setWithFlags(versionPendingKey([]byte("changed")), nil, 0, 0))
+	require.NoError(t, s.setWithFlags([]byte("changed"), []byte("v2"), 0, 0))
+	// and before the write
+	require.NoError(t, s.Set([]byte("same"), []byte("v1"), 0))
+	require.NoError(t, s.setWithFlags(versionPendingKey([]byte("same")), nil, 0, 0))
+	require.NoError(t, s.Close())
+
+	s, err = Open(opts...)
+	require.NoError(t, err)
+	defer s.Close()
+	history, err = s.History([]byte("changed"))
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	val, _, err = s.GetVersion([]byte("changed"), history[1].Version)
+	require.NoError(t, err)
+	require.Equal(t, []byte("v2"), val)
+	history, err = s.History([]byte("same"))
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	for _, key := range []string{"changed", "same"} {
+		_, err = s.Get(versionPendingKey([]byte(key)))
+		require.ErrorIs(t, err, common.ErrKeyNotFound)
+	}
+}
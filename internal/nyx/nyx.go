@@ -89,7 +89,13 @@ func (n *Nyx) Get(req common.GetRequest) error {
 				resChan = nil
 				continue
 			}
-			n.res.Get(res)
+			// a value streamed out partially leaves the connection in a broken state
+			if resErr := n.res.Get(res); resErr != nil && err == nil {
+				err = resErr
+			}
+			if res.Stream != nil {
+				res.Stream.Close()
+			}
 
 		case resErr, ok := <-errChan:
 			if !ok {
@@ -157,6 +163,170 @@ func (n *Nyx) Version(req common.VersionRequest) error {
 	return n.res.Version(req.Opaque)
 }
 
+func (n *Nyx) Batch(req common.BatchRequest) error {
+	err := n.db.Batch(req)
+	if err == nil {
+		err = n.res.Batch(req.Opaque, req.Quiet)
+	}
+	return err
+}
+
+func (n *Nyx) Stats(req common.StatsRequest) error {
+	stats, err := n.db.Stats(req)
+	if err == nil {
+		err = n.res.Stats(req.Opaque, stats)
+	}
+	return err
+}
+
+func (n *Nyx) BucketSet(req common.BucketSetRequest) error {
+	err := n.db.BucketSet(req)
+	if err == nil {
+		err = n.res.Set(req.Opaque, req.Quiet)
+	}
+	return err
+}
+
+func (n *Nyx) BucketGet(req common.BucketGetRequest) error {
+	res, err := n.db.BucketGet(req)
+	if err != nil {
+		return err
+	}
+	for _, r := range res {
+		err = n.res.Get(r)
+		if err != nil {
+			return err
+		}
+	}
+	return n.res.GetEnd(req.Opaque, false)
+}
+
+func (n *Nyx) BucketDelete(req common.BucketDeleteRequest) error {
+	err := n.db.BucketDelete(req)
+	if err == nil {
+		err = n.res.Delete(req.Opaque)
+	}
+	return err
+}
+
+func (n *Nyx) BucketRange(req common.BucketRangeRequest) error {
+	res, err := n.db.BucketRange(req)
+	if err == nil {
+		err = n.res.Range(res)
+	}
+	return err
+}
+
+func (n *Nyx) BucketList(req common.BucketListRequest) error {
+	buckets, err := n.db.BucketList(req)
+	if err == nil {
+		err = n.res.Buckets(req.Opaque, buckets)
+	}
+	return err
+}
+
+func (n *Nyx) BucketDrop(req common.BucketDropRequest) error {
+	err := n.db.BucketDrop(req)
+	if err == nil {
+		err = n.res.BucketDrop(req.Opaque, req.Quiet)
+	}
+	return err
+}
+
+func (n *Nyx) BucketRename(req common.BucketRenameRequest) error {
+	err := n.db.BucketRename(req)
+	if err == nil {
+		err = n.res.BucketRename(req.Opaque, req.Quiet)
+	}
+	return err
+}
+
+func (n *Nyx) BucketConfig(req common.BucketConfigRequest) error {
+	err := n.db.BucketConfig(req)
+	if err == nil {
+		err = n.res.BucketConfig(req.Opaque, req.Quiet)
+	}
+	return err
+}
+
+func (n *Nyx) Scan(req common.ScanRequest) error {
+	res, err := n.db.Scan(req)
+	if err == nil {
+		err = n.res.Scan(res)
+	}
+	return err
+}
+
+func (n *Nyx) Purge(req common.PurgeRequest) error {
+	id, err := n.db.Purge(req)
+	if err == nil {
+		err = n.res.Purge(req.Opaque, id)
+	}
+	return err
+}
+
+func (n *Nyx) PurgeStatus(req common.PurgeStatusRequest) error {
+	purges, err := n.db.PurgeStatus(req)
+	if err == nil {
+		err = n.res.PurgeStatus(req.Opaque, purges)
+	}
+	return err
+}
+
+func (n *Nyx) PurgeCancel(req common.PurgeCancelRequest) error {
+	err := n.db.PurgeCancel(req)
+	if err == nil {
+		err = n.res.PurgeCancel(req.Opaque, req.Quiet)
+	}
+	return err
+}
+
+func (n *Nyx) TTL(req common.TTLRequest) error {
+	ttl, err := n.db.TTL(req)
+	if err == nil {
+		err = n.res.TTL(req.Opaque, ttl)
+	}
+	return err
+}
+
+func (n *Nyx) Persist(req common.PersistRequest) error {
+	err := n.db.Persist(req)
+	if err == nil {
+		err = n.res.Persist(req.Opaque, req.Quiet)
+	}
+	return err
+}
+
+// ExpireAt ... replies as touch
+func (n *Nyx) ExpireAt(req common.ExpireAtRequest) error {
+	err := n.db.ExpireAt(req)
+	if err == nil {
+		err = n.res.Touch(req.Opaque)
+	}
+	return err
+}
+
+func (n *Nyx) History(req common.HistoryRequest) error {
+	versions, err := n.db.History(req)
+	if err == nil {
+		err = n.res.History(req.Opaque, versions)
+	}
+	return err
+}
+
+// GetVersion ... the deleting version is a miss
+func (n *Nyx) GetVersion(req common.GetVersionRequest) error {
+	res, err := n.db.GetVersion(req)
+	if err != nil {
+		return err
+	}
+	err = n.res.Get(res)
+	if err != nil {
+		return err
+	}
+	return n.res.GetEnd(req.Opaque, false)
+}
+
 func (n *Nyx) Unknown(_ common.Request) error {
 	return common.ErrUnknownCmd
 }
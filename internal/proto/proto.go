@@ -25,6 +25,20 @@ type Responder interface {
 	Noop(opaque uint32) error
 	Quit(opaque uint32, quiet bool) error
 	Version(opaque uint32) error
+	Batch(opaque uint32, quiet bool) error
+	Stats(opaque uint32, stats []common.Stat) error
+	Range(response common.RangeResponse) error
+	Buckets(opaque uint32, buckets []common.BucketInfo) error
+	BucketDrop(opaque uint32, quiet bool) error
+	BucketRename(opaque uint32, quiet bool) error
+	BucketConfig(opaque uint32, quiet bool) error
+	Scan(response common.ScanResponse) error
+	Purge(opaque uint32, id uint64) error
+	PurgeStatus(opaque uint32, purges []common.PurgeInfo) error
+	PurgeCancel(opaque uint32, quiet bool) error
+	TTL(opaque uint32, ttl int64) error
+	Persist(opaque uint32, quiet bool) error
+	History(opaque uint32, versions []common.VersionInfo) error
 	Error(opaque uint32, reqType common.RequestType, err error, quiet bool) error
 }
 
@@ -12,6 +12,13 @@ import (
 	"github.com/DenzelPenzel/nyx/internal/common"
 )
 
+// streamThreshold ... data blocks of the set command bigger than this are passed
+// to the handler as a stream instead of being buffered in memory
+const streamThreshold = 1 << 20
+
+// maxBatchOps ... limit of the sub-commands of the batch command
+const maxBatchOps = 10000
+
 type ParserText struct {
 	reader *bufio.Reader
 }
@@ -37,19 +44,19 @@ func (t ParserText) Parse() (common.Request, common.RequestType, int64, error) {
 
 	switch clParts[0] {
 	case "set":
-		return setRequest(t.reader, clParts, common.RequestSet, start)
+		return setRequest(t.reader, clParts, common.RequestSet, start, true)
 
 	case "add":
-		return setRequest(t.reader, clParts, common.RequestAdd, start)
+		return setRequest(t.reader, clParts, common.RequestAdd, start, false)
 
 	case "replace":
-		return setRequest(t.reader, clParts, common.RequestReplace, start)
+		return setRequest(t.reader, clParts, common.RequestReplace, start, false)
 
 	case "append":
-		return setRequest(t.reader, clParts, common.RequestAppend, start)
+		return setRequest(t.reader, clParts, common.RequestAppend, start, false)
 
 	case "prepend":
-		return setRequest(t.reader, clParts, common.RequestPrepend, start)
+		return setRequest(t.reader, clParts, common.RequestPrepend, start, false)
 
 	case "get":
 		if len(clParts) < 2 {
@@ -100,6 +107,61 @@ func (t ParserText) Parse() (common.Request, common.RequestType, int64, error) {
 			Exptime: uint32(exptime),
 			Opaque:  uint32(0),
 		}, common.RequestTouch, start, nil
+	case "ttl":
+		if len(clParts) != 2 {
+			return nil, common.RequestTTL, start, common.ErrBadRequest
+		}
+		return common.TTLRequest{
+			Key:    []byte(clParts[1]),
+			Opaque: 0,
+		}, common.RequestTTL, start, nil
+
+	case "persist":
+		if len(clParts) != 2 {
+			return nil, common.RequestPersist, start, common.ErrBadRequest
+		}
+		return common.PersistRequest{
+			Key:    []byte(clParts[1]),
+			Opaque: 0,
+		}, common.RequestPersist, start, nil
+
+	case "expireat":
+		if len(clParts) != 3 {
+			return nil, common.RequestExpireAt, start, common.ErrBadRequest
+		}
+		exptime, err := strconv.ParseUint(clParts[2], 10, 32)
+		if err != nil {
+			return nil, common.RequestExpireAt, start, common.ErrBadExptime
+		}
+		return common.ExpireAtRequest{
+			Key:     []byte(clParts[1]),
+			Exptime: uint32(exptime),
+			Opaque:  0,
+		}, common.RequestExpireAt, start, nil
+
+	case "history":
+		if len(clParts) != 2 {
+			return nil, common.RequestHistory, start, common.ErrBadRequest
+		}
+		return common.HistoryRequest{
+			Key:    []byte(clParts[1]),
+			Opaque: 0,
+		}, common.RequestHistory, start, nil
+
+	case "vget":
+		if len(clParts) != 3 {
+			return nil, common.RequestGetVersion, start, common.ErrBadRequest
+		}
+		version, err := strconv.ParseUint(clParts[2], 10, 64)
+		if err != nil {
+			return nil, common.RequestGetVersion, start, common.ErrBadRequest
+		}
+		return common.GetVersionRequest{
+			Key:     []byte(clParts[1]),
+			Version: version,
+			Opaque:  0,
+		}, common.RequestGetVersion, start, nil
+
 	case "noop":
 		if len(clParts) != 1 {
 			return nil, common.RequestNoop, start, common.ErrBadRequest
@@ -117,6 +179,120 @@ func (t ParserText) Parse() (common.Request, common.RequestType, int64, error) {
 			Quiet:  false,
 		}, common.RequestQuit, start, nil
 
+	case "batch":
+		return batchRequest(t.reader, clParts, start)
+
+	case "stats":
+		if len(clParts) > 2 {
+			return nil, common.RequestStats, start, common.ErrBadRequest
+		}
+		req := common.StatsRequest{Opaque: 0}
+		if len(clParts) == 2 {
+			req.Group = clParts[1]
+		}
+		return req, common.RequestStats, start, nil
+
+	case "bset":
+		return bucketSetRequest(t.reader, clParts, start)
+
+	case "bget":
+		if len(clParts) < 3 {
+			return nil, common.RequestBucketGet, start, common.ErrBadRequest
+		}
+
+		var keys [][]byte
+		for _, key := range clParts[2:] {
+			keys = append(keys, []byte(key))
+		}
+		return common.BucketGetRequest{
+			Bucket: clParts[1],
+			Keys:   keys,
+			Opaque: 0,
+		}, common.RequestBucketGet, start, nil
+
+	case "bdelete":
+		if len(clParts) != 3 {
+			return nil, common.RequestBucketDelete, start, common.ErrBadRequest
+		}
+		return common.BucketDeleteRequest{
+			Bucket: clParts[1],
+			Key:    []byte(clParts[2]),
+			Opaque: 0,
+		}, common.RequestBucketDelete, start, nil
+
+	case "brange":
+		if len(clParts) < 4 {
+			return nil, common.RequestBucketRange, start, common.ErrBadRequest
+		}
+		req := common.BucketRangeRequest{
+			Bucket: clParts[1],
+			Start:  rangeBound(clParts[2]),
+			End:    rangeBound(clParts[3]),
+		}
+		err := rangeOptions(&req, clParts[4:])
+		if err != nil {
+			return nil, common.RequestBucketRange, start, err
+		}
+		return req, common.RequestBucketRange, start, nil
+
+	case "bprefix":
+		if len(clParts) < 3 {
+			return nil, common.RequestBucketRange, start, common.ErrBadRequest
+		}
+		req := common.BucketRangeRequest{
+			Bucket: clParts[1],
+			Prefix: []byte(clParts[2]),
+		}
+		err := rangeOptions(&req, clParts[3:])
+		if err != nil {
+			return nil, common.RequestBucketRange, start, err
+		}
+		return req, common.RequestBucketRange, start, nil
+
+	case "blist":
+		if len(clParts) != 1 {
+			return nil, common.RequestBucketList, start, common.ErrBadRequest
+		}
+		return common.BucketListRequest{
+			Opaque: 0,
+		}, common.RequestBucketList, start, nil
+
+	case "bdrop":
+		if len(clParts) != 2 {
+			return nil, common.RequestBucketDrop, start, common.ErrBadRequest
+		}
+		return common.BucketDropRequest{
+			Bucket: clParts[1],
+			Opaque: 0,
+		}, common.RequestBucketDrop, start, nil
+
+	case "brename":
+		if len(clParts) != 3 {
+			return nil, common.RequestBucketRename, start, common.ErrBadRequest
+		}
+		return common.BucketRenameRequest{
+			Bucket:  clParts[1],
+			NewName: clParts[2],
+			Opaque:  0,
+		}, common.RequestBucketRename, start, nil
+
+	case "bconfig":
+		if len(clParts) < 2 {
+			return nil, common.RequestBucketConfig, start, common.ErrBadRequest
+		}
+		req := common.BucketConfigRequest{Bucket: clParts[1]}
+		err := bucketOptions(&req, clParts[2:])
+		if err != nil {
+			return nil, common.RequestBucketConfig, start, err
+		}
+		return req, common.RequestBucketConfig, start, nil
+
+	case "scan":
+		return scanRequest(clParts, start)
+
+	case "purge":
+		return purgeRequest(clParts, start)
+
 	case "version":
 		if len(clParts) != 1 {
 			return nil, common.RequestQuit, start, common.ErrBadRequest
@@ -130,7 +306,9 @@ func (t ParserText) Parse() (common.Request, common.RequestType, int64, error) {
 	}
 }
 
-func setRequest(r *bufio.Reader, clParts []string, reqType common.RequestType, start int64) (common.SetRequest, common.RequestType, int64, error) {
+// setRequest ... parse the storage command, if stream is set the big data block
+// isn't read here but handed over as SetRequest.Stream, the handler must consume it
+func setRequest(r *bufio.Reader, clParts []string, reqType common.RequestType, start int64, stream bool) (common.SetRequest, common.RequestType, int64, error) {
 	if len(clParts) != 5 {
 		return common.SetRequest{}, reqType, start, common.ErrBadRequest
 	}
@@ -155,6 +333,17 @@ func setRequest(r *bufio.Reader, clParts []string, reqType common.RequestType, s
 		return common.SetRequest{}, reqType, start, common.ErrBadLength
 	}
 
+	if stream && length > streamThreshold {
+		return common.SetRequest{
+			Key:     key,
+			Flags:   uint32(flags),
+			Exptime: uint32(exptime),
+			Opaque:  uint32(0),
+			Stream:  &dataReader{r: r, left: int64(length)},
+			Length:  int64(length),
+		}, reqType, start, nil
+	}
+
 	// Read in data
 	dataBuf := make([]byte, length)
 	_, err = io.ReadAtLeast(r, dataBuf, int(length))
@@ -177,3 +366,271 @@ func setRequest(r *bufio.Reader, clParts []string, reqType common.RequestType, s
 		Data:    dataBuf,
 	}, reqType, start, nil
 }
+
+// dataReader ... reads the data block of the command, the trailing "\r\n" is consumed at the end
+type dataReader struct {
+	r    *bufio.Reader
+	left int64
+}
+
+func (d *dataReader) Read(p []byte) (int, error) {
+	if d.left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > d.left {
+		p = p[:d.left]
+	}
+	n, err := d.r.Read(p)
+	d.left -= int64(n)
+	if d.left == 0 {
+		// Consume the last two bytes "\r\n"
+		d.r.ReadString(byte('\n'))
+	}
+	if errors.Is(err, io.EOF) && d.left > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// batchRequest ... parse the batch of set and delete commands
+// batch <count>\r\n
+// followed by <count> lines, at most maxBatchOps, of the set (with the data block) or delete commands.
+// All the sub-commands are consumed even if some of them are invalid,
+// so they are never executed one by one outside the batch
+func batchRequest(r *bufio.Reader, clParts []string, start int64) (common.BatchRequest, common.RequestType, int64, error) {
+	if len(clParts) != 2 {
+		return common.BatchRequest{}, common.RequestBatch, start, common.ErrBadRequest
+	}
+
+	count, err := strconv.ParseUint(strings.TrimSpace(clParts[1]), 10, 32)
+	if err != nil {
+		log.Printf("Error parsing count for batch command: %s\n", err.Error())
+		return common.BatchRequest{}, common.RequestBatch, start, common.ErrBadRequest
+	}
+	if count > maxBatchOps {
+		log.Printf("Batch command count %d is over the limit %d\n", count, maxBatchOps)
+		return common.BatchRequest{}, common.RequestBatch, start, common.ErrBadRequest
+	}
+
+	var opErr error
+	var ops []common.BatchOp
+	for i := uint64(0); i < count; i++ {
+		data, err := r.ReadString('\n')
+		if err != nil {
+			return common.BatchRequest{}, common.RequestBatch, start, err
+		}
+
+		parts := strings.Split(strings.TrimSpace(data), " ")
+		switch parts[0] {
+		case "set":
+			req, _, _, err := setRequest(r, parts, common.RequestSet, start, false)
+			if err != nil {
+				opErr = errors.Join(opErr, err)
+				continue
+			}
+			ops = append(ops, common.BatchOp{
+				Type:    common.RequestSet,
+				Key:     req.Key,
+				Data:    req.Data,
+				Flags:   req.Flags,
+				Exptime: req.Exptime,
+			})
+
+		case "delete":
+			if len(parts) != 2 {
+				opErr = errors.Join(opErr, common.ErrBadRequest)
+				continue
+			}
+			ops = append(ops, common.BatchOp{
+				Type: common.RequestDelete,
+				Key:  []byte(parts[1]),
+			})
+
+		default:
+			opErr = errors.Join(opErr, common.ErrBadRequest)
+		}
+	}
+
+	if opErr != nil {
+		return common.BatchRequest{}, common.RequestBatch, start, opErr
+	}
+
+	return common.BatchRequest{
+		Ops:    ops,
+		Opaque: uint32(0),
+	}, common.RequestBatch, start, nil
+}
+
+// bucketSetRequest ... parse the bucket set command
+// bset <bucket> <key> [<exptime>] <bytes>\r\n
+// <data block>\r\n
+// the key without the exptime gets the default ttl of the bucket
+func bucketSetRequest(r *bufio.Reader, clParts []string, start int64) (common.BucketSetRequest, common.RequestType, int64, error) {
+	if len(clParts) != 4 && len(clParts) != 5 {
+		return common.BucketSetRequest{}, common.RequestBucketSet, start, common.ErrBadRequest
+	}
+
+	var exptime uint64
+	if len(clParts) == 5 {
+		var err error
+		exptime, err = strconv.ParseUint(strings.TrimSpace(clParts[3]), 10, 32)
+		if err != nil {
+			log.Printf("Error parsing ttl for bset command: %s\n", err.Error())
+			return common.BucketSetRequest{}, common.RequestBucketSet, start, common.ErrBadExptime
+		}
+	}
+
+	length, err := strconv.ParseUint(strings.TrimSpace(clParts[len(clParts)-1]), 10, 32)
+	if err != nil {
+		log.Printf("Error parsing length for bset command: %s\n", err.Error())
+		return common.BucketSetRequest{}, common.RequestBucketSet, start, common.ErrBadLength
+	}
+
+	dataBuf := make([]byte, length)
+	_, err = io.ReadAtLeast(r, dataBuf, int(length))
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return common.BucketSetRequest{}, common.RequestBucketSet, start, common.ErrBadLength
+		}
+		return common.BucketSetRequest{}, common.RequestBucketSet, start, common.ErrInternal
+	}
+
+	// Consume the last two bytes "\r\n"
+	r.ReadString(byte('\n'))
+
+	return common.BucketSetRequest{
+		Bucket:  clParts[1],
+		Key:     []byte(clParts[2]),
+		Data:    dataBuf,
+		Exptime: uint32(exptime),
+		Opaque:  uint32(0),
+	}, common.RequestBucketSet, start, nil
+}
+
+// rangeBound ... "-" is the open bound of the range
+func rangeBound(s string) []byte {
+	if s == "-" {
+		return nil
+	}
+	return []byte(s)
+}
+
+// rangeOptions ... parse the options of the brange and bprefix commands
+// [limit <n>] [rev] [cursor <key>]
+func rangeOptions(req *common.BucketRangeRequest, opts []string) error {
+	for i := 0; i < len(opts); i++ {
+		switch opts[i] {
+		case "rev":
+			req.Reverse = true
+		case "limit":
+			if i+1 >= len(opts) {
+				return common.ErrBadRequest
+			}
+			limit, err := strconv.ParseUint(opts[i+1], 10, 31)
+			if err != nil {
+				return common.ErrBadRequest
+			}
+			req.Limit = int(limit)
+			i++
+		case "cursor":
+			if i+1 >= len(opts) {
+				return common.ErrBadRequest
+			}
+			req.Cursor = []byte(opts[i+1])
+			i++
+		default:
+			return common.ErrBadRequest
+		}
+	}
+	return nil
+}
+
+// bucketOptions ... parse the options of the bconfig command, the missing ones mean no ttl or no limit
+// [ttl <seconds>] [maxkeys <n>] [maxbytes <n>] [overflow reject|evict]
+func bucketOptions(req *common.BucketConfigRequest, opts []string) error {
+	if len(opts)%2 != 0 {
+		return common.ErrBadRequest
+	}
+	for i := 0; i < len(opts); i += 2 {
+		name, val := opts[i], opts[i+1]
+		var err error
+		switch name {
+		case "ttl":
+			var ttl uint64
+			ttl, err = strconv.ParseUint(val, 10, 32)
+			req.TTL = uint32(ttl)
+		case "maxkeys":
+			var n uint64
+			n, err = strconv.ParseUint(val, 10, 31)
+			req.MaxKeys = int(n)
+		case "maxbytes":
+			var n uint64
+			n, err = strconv.ParseUint(val, 10, 63)
+			req.MaxBytes = int64(n)
+		case "overflow":
+			if val != "reject" && val != "evict" {
+				return common.ErrBadRequest
+			}
+			req.Overflow = val
+		default:
+			return common.ErrBadRequest
+		}
+		if err != nil {
+			return common.ErrBadRequest
+		}
+	}
+	return nil
+}
+
+// scanRequest ... parse the scan command
+// scan <cursor> [match <pattern>] [count <n>]
+func scanRequest(clParts []string, start int64) (common.Request, common.RequestType, int64, error) {
+	if len(clParts) < 2 || len(clParts)%2 != 0 {
+		return nil, common.RequestScan, start, common.ErrBadRequest
+	}
+	cursor, err := strconv.ParseUint(clParts[1], 10, 64)
+	if err != nil {
+		return nil, common.RequestScan, start, common.ErrBadRequest
+	}
+	req := common.ScanRequest{Cursor: cursor}
+	for i := 2; i < len(clParts); i += 2 {
+		switch clParts[i] {
+		case "match":
+			req.Match = clParts[i+1]
+		case "count":
+			count, err := strconv.ParseUint(clParts[i+1], 10, 31)
+			if err != nil {
+				return nil, common.RequestScan, start, common.ErrBadRequest
+			}
+			req.Count = int(count)
+		default:
+			return nil, common.RequestScan, start, common.ErrBadRequest
+		}
+	}
+	return req, common.RequestScan, start, nil
+}
+
+// purgeRequest ... parse the purge command
+// purge prefix <prefix> | purge match <pattern> | purge status | purge cancel <id>
+func purgeRequest(clParts []string, start int64) (common.Request, common.RequestType, int64, error) {
+	if len(clParts) == 2 && clParts[1] == "status" {
+		return common.PurgeStatusRequest{}, common.RequestPurgeStatus, start, nil
+	}
+	if len(clParts) != 3 {
+		return nil, common.RequestPurge, start, common.ErrBadRequest
+	}
+	switch clParts[1] {
+	case "prefix", "match":
+		return common.PurgeRequest{
+			Pattern: clParts[2],
+			Prefix:  clParts[1] == "prefix",
+		}, common.RequestPurge, start, nil
+	case "cancel":
+		id, err := strconv.ParseUint(clParts[2], 10, 64)
+		if err != nil {
+			return nil, common.RequestPurgeCancel, start, common.ErrBadRequest
+		}
+		return common.PurgeCancelRequest{ID: id}, common.RequestPurgeCancel, start, nil
+	}
+	return nil, common.RequestPurge, start, common.ErrBadRequest
+}
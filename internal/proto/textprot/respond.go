@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"io"
 
 	"github.com/DenzelPenzel/nyx/internal/common"
 )
@@ -48,12 +49,20 @@ func (t ResponderText) Get(response common.GetResponse) error {
 	// [VALUE <key> <flags> <bytes>\r\n
 	// <data block>\r\n]*
 	// END\r\n
-	_, err := fmt.Fprintf(t.writer, "VALUE %s %d %d\r\n", response.Key, response.Flags, len(response.Data))
+	size := int64(len(response.Data))
+	if response.Stream != nil {
+		size = response.Size
+	}
+	_, err := fmt.Fprintf(t.writer, "VALUE %s %d %d\r\n", response.Key, response.Flags, size)
 	if err != nil {
 		return err
 	}
 
-	_, err = t.writer.Write(response.Data)
+	if response.Stream != nil {
+		_, err = io.Copy(t.writer, response.Stream)
+	} else {
+		_, err = t.writer.Write(response.Data)
+	}
 	if err != nil {
 		return err
 	}
@@ -94,6 +103,31 @@ func (t ResponderText) Touch(_ uint32) error {
 	return t.resp("TOUCHED")
 }
 
+func (t ResponderText) TTL(_ uint32, ttl int64) error {
+	return t.resp(fmt.Sprintf("TTL %d", ttl))
+}
+
+func (t ResponderText) Persist(_ uint32, _ bool) error {
+	return t.resp("PERSISTED")
+}
+
+func (t ResponderText) History(_ uint32, versions []common.VersionInfo) error {
+	// [HISTORY <version> <written> <flags> <bytes>\r\n | HISTORY <version> <written> DELETED\r\n]*
+	// END\r\n
+	for _, v := range versions {
+		var err error
+		if v.Deleted {
+			_, err = fmt.Fprintf(t.writer, "HISTORY %d %d DELETED\r\n", v.Version, v.Written)
+		} else {
+			_, err = fmt.Fprintf(t.writer, "HISTORY %d %d %d %d\r\n", v.Version, v.Written, v.Flags, v.Size)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return t.resp("END")
+}
+
 func (t ResponderText) Noop(_ uint32) error {
 	return t.resp("Yep, it works.")
 }
@@ -109,6 +143,103 @@ func (t ResponderText) Version(_ uint32) error {
 	return t.resp("VERSION " + common.VersionString)
 }
 
+func (t ResponderText) Batch(_ uint32, _ bool) error {
+	return t.resp("COMMITTED")
+}
+
+func (t ResponderText) Stats(_ uint32, stats []common.Stat) error {
+	// [STAT <name> <value>\r\n]*
+	// END\r\n
+	for _, stat := range stats {
+		_, err := fmt.Fprintf(t.writer, "STAT %s %s\r\n", stat.Name, stat.Value)
+		if err != nil {
+			return err
+		}
+	}
+	return t.resp("END")
+}
+
+func (t ResponderText) Range(response common.RangeResponse) error {
+	// [VALUE <key> <flags> <bytes>\r\n
+	// <data block>\r\n]*
+	// [CURSOR <key>\r\n]
+	// END\r\n
+	for _, item := range response.Items {
+		err := t.Get(item)
+		if err != nil {
+			return err
+		}
+	}
+	if response.Cursor != nil {
+		_, err := fmt.Fprintf(t.writer, "CURSOR %s\r\n", response.Cursor)
+		if err != nil {
+			return err
+		}
+	}
+	return t.resp("END")
+}
+
+func (t ResponderText) Buckets(_ uint32, buckets []common.BucketInfo) error {
+	// [BUCKET <name> <keys> <bytes>\r\n]*
+	// END\r\n
+	for _, b := range buckets {
+		_, err := fmt.Fprintf(t.writer, "BUCKET %s %d %d\r\n", b.Name, b.Keys, b.Bytes)
+		if err != nil {
+			return err
+		}
+	}
+	return t.resp("END")
+}
+
+func (t ResponderText) BucketDrop(_ uint32, _ bool) error {
+	return t.resp("DROPPED")
+}
+
+func (t ResponderText) BucketRename(_ uint32, _ bool) error {
+	return t.resp("RENAMED")
+}
+
+func (t ResponderText) BucketConfig(_ uint32, _ bool) error {
+	return t.resp("CONFIGURED")
+}
+
+func (t ResponderText) Scan(response common.ScanResponse) error {
+	// [KEY <key>\r\n]*
+	// CURSOR <cursor>\r\n
+	// END\r\n
+	for _, key := range response.Keys {
+		_, err := fmt.Fprintf(t.writer, "KEY %s\r\n", key)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(t.writer, "CURSOR %d\r\n", response.Cursor)
+	if err != nil {
+		return err
+	}
+	return t.resp("END")
+}
+
+func (t ResponderText) Purge(_ uint32, id uint64) error {
+	return t.resp(fmt.Sprintf("PURGE %d", id))
+}
+
+func (t ResponderText) PurgeStatus(_ uint32, purges []common.PurgeInfo) error {
+	// [PURGE <id> <state> <scanned> <deleted> <pattern>\r\n]*
+	// END\r\n
+	for _, p := range purges {
+		_, err := fmt.Fprintf(t.writer, "PURGE %d %s %d %d %s\r\n", p.ID, p.State, p.Scanned, p.Deleted, p.Match)
+		if err != nil {
+			return err
+		}
+	}
+	return t.resp("END")
+}
+
+func (t ResponderText) PurgeCancel(_ uint32, _ bool) error {
+	return t.resp("CANCELLED")
+}
+
 func (t ResponderText) Error(_ uint32, _ common.RequestType, err error, _ bool) error {
 	switch {
 	case errors.Is(err, common.ErrKeyNotFound):
@@ -117,6 +248,8 @@ func (t ResponderText) Error(_ uint32, _ common.RequestType, err error, _ bool)
 		return t.resp("NOT_STORED")
 	case errors.Is(err, common.ErrItemNotStored):
 		return t.resp("NOT_STORED")
+	case errors.Is(err, common.ErrNoTTL):
+		return t.resp("NO_TTL")
 	case errors.Is(err, common.ErrValueTooBig):
 		fallthrough
 	case errors.Is(err, common.ErrInvalidArgs):
@@ -82,6 +82,63 @@ func (s *DefaultServer) Loop() {
 		case common.RequestAdd:
 			err = s.n.Add(request.(common.SetRequest))
 
+		case common.RequestBatch:
+			err = s.n.Batch(request.(common.BatchRequest))
+
+		case common.RequestStats:
+			err = s.n.Stats(request.(common.StatsRequest))
+
+		case common.RequestBucketSet:
+			err = s.n.BucketSet(request.(common.BucketSetRequest))
+
+		case common.RequestBucketGet:
+			err = s.n.BucketGet(request.(common.BucketGetRequest))
+
+		case common.RequestBucketDelete:
+			err = s.n.BucketDelete(request.(common.BucketDeleteRequest))
+
+		case common.RequestBucketRange:
+			err = s.n.BucketRange(request.(common.BucketRangeRequest))
+
+		case common.RequestBucketList:
+			err = s.n.BucketList(request.(common.BucketListRequest))
+
+		case common.RequestBucketDrop:
+			err = s.n.BucketDrop(request.(common.BucketDropRequest))
+
+		case common.RequestBucketRename:
+			err = s.n.BucketRename(request.(common.BucketRenameRequest))
+
+		case common.RequestBucketConfig:
+			err = s.n.BucketConfig(request.(common.BucketConfigRequest))
+
+		case common.RequestScan:
+			err = s.n.Scan(request.(common.ScanRequest))
+
+		case common.RequestPurge:
+			err = s.n.Purge(request.(common.PurgeRequest))
+
+		case common.RequestPurgeStatus:
+			err = s.n.PurgeStatus(request.(common.PurgeStatusRequest))
+
+		case common.RequestPurgeCancel:
+			err = s.n.PurgeCancel(request.(common.PurgeCancelRequest))
+
+		case common.RequestTTL:
+			err = s.n.TTL(request.(common.TTLRequest))
+
+		case common.RequestPersist:
+			err = s.n.Persist(request.(common.PersistRequest))
+
+		case common.RequestExpireAt:
+			err = s.n.ExpireAt(request.(common.ExpireAtRequest))
+
+		case common.RequestHistory:
+			err = s.n.History(request.(common.HistoryRequest))
+
+		case common.RequestGetVersion:
+			err = s.n.GetVersion(request.(common.GetVersionRequest))
+
 		default:
 			s.n.Error(nil, common.RequestUnknown, fmt.Errorf("invalid req type"))
 		}
@@ -42,6 +42,25 @@ type testNyx struct {
 	noopRes,
 	quitRes,
 	versionRes,
+	batchRes,
+	statsRes,
+	bucketSetRes,
+	bucketGetRes,
+	bucketDeleteRes,
+	bucketRangeRes,
+	bucketListRes,
+	bucketDropRes,
+	bucketRenameRes,
+	bucketConfigRes,
+	scanRes,
+	purgeRes,
+	purgeStatusRes,
+	purgeCancelRes,
+	ttlRes,
+	persistRes,
+	expireAtRes,
+	historyRes,
+	getVersionRes,
 	unknownRes error
 
 	callMap map[string]interface{}
@@ -99,6 +118,82 @@ func (t *testNyx) Version(_ common.VersionRequest) error {
 	t.callMap["Version"] = nil
 	return t.versionRes
 }
+func (t *testNyx) Batch(_ common.BatchRequest) error {
+	t.callMap["Batch"] = nil
+	return t.batchRes
+}
+func (t *testNyx) Stats(_ common.StatsRequest) error {
+	t.callMap["Stats"] = nil
+	return t.statsRes
+}
+func (t *testNyx) BucketSet(_ common.BucketSetRequest) error {
+	t.callMap["BucketSet"] = nil
+	return t.bucketSetRes
+}
+func (t *testNyx) BucketGet(_ common.BucketGetRequest) error {
+	t.callMap["BucketGet"] = nil
+	return t.bucketGetRes
+}
+func (t *testNyx) BucketDelete(_ common.BucketDeleteRequest) error {
+	t.callMap["BucketDelete"] = nil
+	return t.bucketDeleteRes
+}
+func (t *testNyx) BucketRange(_ common.BucketRangeRequest) error {
+	t.callMap["BucketRange"] = nil
+	return t.bucketRangeRes
+}
+func (t *testNyx) BucketList(_ common.BucketListRequest) error {
+	t.callMap["BucketList"] = nil
+	return t.bucketListRes
+}
+func (t *testNyx) BucketDrop(_ common.BucketDropRequest) error {
+	t.callMap["BucketDrop"] = nil
+	return t.bucketDropRes
+}
+func (t *testNyx) BucketRename(_ common.BucketRenameRequest) error {
+	t.callMap["BucketRename"] = nil
+	return t.bucketRenameRes
+}
+func (t *testNyx) BucketConfig(_ common.BucketConfigRequest) error {
+	t.callMap["BucketConfig"] = nil
+	return t.bucketConfigRes
+}
+func (t *testNyx) Scan(_ common.ScanRequest) error {
+	t.callMap["Scan"] = nil
+	return t.scanRes
+}
+func (t *testNyx) Purge(_ common.PurgeRequest) error {
+	t.callMap["Purge"] = nil
+	return t.purgeRes
+}
+func (t *testNyx) PurgeStatus(_ common.PurgeStatusRequest) error {
+	t.callMap["PurgeStatus"] = nil
+	return t.purgeStatusRes
+}
+func (t *testNyx) PurgeCancel(_ common.PurgeCancelRequest) error {
+	t.callMap["PurgeCancel"] = nil
+	return t.purgeCancelRes
+}
+func (t *testNyx) TTL(_ common.TTLRequest) error {
+	t.callMap["TTL"] = nil
+	return t.ttlRes
+}
+func (t *testNyx) Persist(_ common.PersistRequest) error {
+	t.callMap["Persist"] = nil
+	return t.persistRes
+}
+func (t *testNyx) ExpireAt(_ common.ExpireAtRequest) error {
+	t.callMap["ExpireAt"] = nil
+	return t.expireAtRes
+}
+func (t *testNyx) History(_ common.HistoryRequest) error {
+	t.callMap["History"] = nil
+	return t.historyRes
+}
+func (t *testNyx) GetVersion(_ common.GetVersionRequest) error {
+	t.callMap["GetVersion"] = nil
+	return t.getVersionRes
+}
 func (t *testNyx) Unknown(_ common.Request) error {
 	t.callMap["Unknown"] = nil
 	return t.unknownRes
@@ -189,4 +284,131 @@ func Test_Server(t *testing.T) {
 			Data: []byte("data"),
 		})
 	})
+
+	t.Run("Batch", func(t *testing.T) {
+		testSuccess(t, "Batch", common.RequestBatch, common.BatchRequest{
+			Ops: []common.BatchOp{
+				{Type: common.RequestSet, Key: []byte("key"), Data: []byte("data")},
+				{Type: common.RequestDelete, Key: []byte("key2")},
+			},
+		})
+	})
+
+	t.Run("Stats", func(t *testing.T) {
+		testSuccess(t, "Stats", common.RequestStats, common.StatsRequest{
+			Group: "maintenance",
+		})
+	})
+
+	t.Run("BucketSet", func(t *testing.T) {
+		testSuccess(t, "BucketSet", common.RequestBucketSet, common.BucketSetRequest{
+			Bucket: "users",
+			Key:    []byte("001"),
+			Data:   []byte("abc"),
+		})
+	})
+
+	t.Run("BucketGet", func(t *testing.T) {
+		testSuccess(t, "BucketGet", common.RequestBucketGet, common.BucketGetRequest{
+			Bucket: "users",
+			Keys:   [][]byte{[]byte("001")},
+		})
+	})
+
+	t.Run("BucketDelete", func(t *testing.T) {
+		testSuccess(t, "BucketDelete", common.RequestBucketDelete, common.BucketDeleteRequest{
+			Bucket: "users",
+			Key:    []byte("001"),
+		})
+	})
+
+	t.Run("BucketRange", func(t *testing.T) {
+		testSuccess(t, "BucketRange", common.RequestBucketRange, common.BucketRangeRequest{
+			Bucket: "users",
+			Prefix: []byte("0"),
+			Limit:  10,
+		})
+	})
+
+	t.Run("BucketList", func(t *testing.T) {
+		testSuccess(t, "BucketList", common.RequestBucketList, common.BucketListRequest{})
+	})
+
+	t.Run("BucketDrop", func(t *testing.T) {
+		testSuccess(t, "BucketDrop", common.RequestBucketDrop, common.BucketDropRequest{
+			Bucket: "users",
+		})
+	})
+
+	t.Run("BucketRename", func(t *testing.T) {
+		testSuccess(t, "BucketRename", common.RequestBucketRename, common.BucketRenameRequest{
+			Bucket:  "users",
+			NewName: "customers",
+		})
+	})
+
+	t.Run("BucketConfig", func(t *testing.T) {
+		testSuccess(t, "BucketConfig", common.RequestBucketConfig, common.BucketConfigRequest{
+			Bucket:   "sessions",
+			TTL:      3600,
+			MaxKeys:  1000,
+			Overflow: "evict",
+		})
+	})
+
+	t.Run("Scan", func(t *testing.T) {
+		testSuccess(t, "Scan", common.RequestScan, common.ScanRequest{
+			Match: "user:*",
+			Count: 100,
+		})
+	})
+
+	t.Run("Purge", func(t *testing.T) {
+		testSuccess(t, "Purge", common.RequestPurge, common.PurgeRequest{
+			Pattern: "tenant:a:",
+			Prefix:  true,
+		})
+	})
+
+	t.Run("PurgeStatus", func(t *testing.T) {
+		testSuccess(t, "PurgeStatus", common.RequestPurgeStatus, common.PurgeStatusRequest{})
+	})
+
+	t.Run("PurgeCancel", func(t *testing.T) {
+		testSuccess(t, "PurgeCancel", common.RequestPurgeCancel, common.PurgeCancelRequest{
+			ID: 1,
+		})
+	})
+
+	t.Run("TTL", func(t *testing.T) {
+		testSuccess(t, "TTL", common.RequestTTL, common.TTLRequest{
+			Key: []byte("foo"),
+		})
+	})
+
+	t.Run("Persist", func(t *testing.T) {
+		testSuccess(t, "Persist", common.RequestPersist, common.PersistRequest{
+			Key: []byte("foo"),
+		})
+	})
+
+	t.Run("ExpireAt", func(t *testing.T) {
+		testSuccess(t, "ExpireAt", common.RequestExpireAt, common.ExpireAtRequest{
+			Key:     []byte("foo"),
+			Exptime: 2000000000,
+		})
+	})
+
+	t.Run("History", func(t *testing.T) {
+		testSuccess(t, "History", common.RequestHistory, common.HistoryRequest{
+			Key: []byte("foo"),
+		})
+	})
+
+	t.Run("GetVersion", func(t *testing.T) {
+		testSuccess(t, "GetVersion", common.RequestGetVersion, common.GetVersionRequest{
+			Key:     []byte("foo"),
+			Version: 3,
+		})
+	})
 }